@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Keybag wrap flags (WRAP tag)
+const (
+	keybagWrapDevice   = 1 // Class key wrapped with the device UID key (not usable off-device)
+	keybagWrapPasscode = 2 // Class key wrapped with the key derived from the backup password
+)
+
+// aesKeyWrapIV is the RFC 3394 default initial value
+var aesKeyWrapIV = []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+
+// keybagClassKey is one protection class key from a keybag
+type keybagClassKey struct {
+	class   uint32
+	wrap    uint32
+	wrapped []byte // WPKY
+	key     []byte // Unwrapped key, set by Unlock
+}
+
+// Keybag is the backup keybag stored in Manifest.plist (BackupKeyBag)
+type Keybag struct {
+	salt       []byte // SALT: salt for the SHA-1 round
+	iterations int    // ITER
+	dpsl       []byte // DPSL: salt for the SHA-256 round (iOS 10.2+)
+	dpic       int    // DPIC
+	classKeys  map[uint32]*keybagClassKey
+}
+
+// parseKeybag parses the TLV keybag format: 4-byte tag, 4-byte big-endian length, value
+// Tags before the second UUID describe the keybag; each later UUID starts a class key
+func parseKeybag(data []byte) (*Keybag, error) {
+	kb := &Keybag{classKeys: make(map[uint32]*keybagClassKey)}
+	var current *keybagClassKey
+	uuids := 0
+
+	for off := 0; off < len(data); {
+		if len(data)-off < 8 {
+			return nil, fmt.Errorf("truncated keybag")
+		}
+		tag := string(data[off : off+4])
+		length := int(binary.BigEndian.Uint32(data[off+4 : off+8]))
+		off += 8
+		if length < 0 || length > len(data)-off {
+			return nil, fmt.Errorf("truncated keybag value for %s", tag)
+		}
+		value := data[off : off+length]
+		off += length
+
+		if tag == "UUID" {
+			uuids++
+			if uuids > 1 {
+				if current != nil {
+					kb.classKeys[current.class] = current
+				}
+				current = &keybagClassKey{}
+			}
+			continue
+		}
+
+		if current == nil {
+			switch tag {
+			case "SALT":
+				kb.salt = value
+			case "ITER":
+				kb.iterations = int(keybagUint(value))
+			case "DPSL":
+				kb.dpsl = value
+			case "DPIC":
+				kb.dpic = int(keybagUint(value))
+			}
+			continue
+		}
+
+		switch tag {
+		case "CLAS":
+			current.class = keybagUint(value)
+		case "WRAP":
+			current.wrap = keybagUint(value)
+		case "WPKY":
+			current.wrapped = value
+		}
+	}
+	if current != nil {
+		kb.classKeys[current.class] = current
+	}
+
+	if len(kb.salt) == 0 || kb.iterations <= 0 {
+		return nil, fmt.Errorf("keybag has no SALT/ITER")
+	}
+	if len(kb.classKeys) == 0 {
+		return nil, fmt.Errorf("keybag has no class keys")
+	}
+	return kb, nil
+}
+
+// keybagUint reads a big-endian integer keybag value
+func keybagUint(value []byte) uint32 {
+	return uint32(readBigEndian(value))
+}
+
+// passcodeKey derives the key that unwraps the class keys from the backup password
+// iOS 10.2+ runs PBKDF2-SHA256 (DPSL/DPIC) before the original PBKDF2-SHA1 (SALT/ITER)
+func (kb *Keybag) passcodeKey(password string) ([]byte, error) {
+	secret := password
+	if len(kb.dpsl) > 0 && kb.dpic > 0 {
+		round1, err := pbkdf2.Key(sha256.New, password, kb.dpsl, kb.dpic, 32)
+		if err != nil {
+			return nil, err
+		}
+		secret = string(round1)
+	}
+	return pbkdf2.Key(sha1.New, secret, kb.salt, kb.iterations, 32)
+}
+
+// Unlock unwraps the class keys with the backup password
+// Returns a wrong-password BackupError when the password doesn't match
+func (kb *Keybag) Unlock(password string) error {
+	key, err := kb.passcodeKey(password)
+	if err != nil {
+		return fmt.Errorf("failed to derive key from backup password: %v", err)
+	}
+
+	unlocked := 0
+	for _, ck := range kb.classKeys {
+		if ck.wrap&keybagWrapPasscode == 0 || ck.wrap&keybagWrapDevice != 0 {
+			continue
+		}
+		unwrapped, err := aesUnwrap(key, ck.wrapped)
+		if err != nil {
+			return &BackupError{Kind: ErrKindWrongPassword, Detail: "keybag class key did not unwrap", Err: err}
+		}
+		ck.key = unwrapped
+		unlocked++
+	}
+	if unlocked == 0 {
+		return fmt.Errorf("keybag has no password-protected class keys")
+	}
+	return nil
+}
+
+// unwrapKey unwraps a per-file or manifest key: 4-byte little-endian protection class then the wrapped key
+func (kb *Keybag) unwrapKey(wrapped []byte) ([]byte, error) {
+	if len(wrapped) < 4+24 {
+		return nil, fmt.Errorf("wrapped key too short (%d bytes)", len(wrapped))
+	}
+	class := binary.LittleEndian.Uint32(wrapped[:4])
+	ck, ok := kb.classKeys[class]
+	if !ok || ck.key == nil {
+		return nil, fmt.Errorf("no unlocked key for protection class %d", class)
+	}
+	return aesUnwrap(ck.key, wrapped[4:])
+}
+
+// aesUnwrap implements RFC 3394 AES key unwrap
+func aesUnwrap(kek []byte, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < 24 || len(wrapped)%8 != 0 {
+		return nil, fmt.Errorf("invalid wrapped key length %d", len(wrapped))
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(wrapped)/8 - 1
+	a := make([]byte, 8)
+	copy(a, wrapped[:8])
+	r := make([]byte, n*8)
+	copy(r, wrapped[8:])
+
+	buf := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(buf[:8], binary.BigEndian.Uint64(a)^t)
+			copy(buf[8:], r[(i-1)*8:i*8])
+			block.Decrypt(buf, buf)
+			copy(a, buf[:8])
+			copy(r[(i-1)*8:i*8], buf[8:])
+		}
+	}
+
+	if subtle.ConstantTimeCompare(a, aesKeyWrapIV) != 1 {
+		return nil, fmt.Errorf("key unwrap integrity check failed")
+	}
+	return r, nil
+}
+
+// cryptChunkSize is how much of a file is encrypted or decrypted at a time (a multiple of the AES block size)
+const cryptChunkSize = 64 * 1024
+
+// decryptCBC decrypts AES-CBC data with a zero IV from src to dst and removes the PKCS#7 padding
+// The data is streamed in chunks; the last plaintext block is held back until it is known to carry the padding
+func decryptCBC(key []byte, dst io.Writer, src io.Reader) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	mode := cipher.NewCBCDecrypter(block, make([]byte, aes.BlockSize))
+
+	chunk := make([]byte, cryptChunkSize)
+	var last []byte
+	for {
+		n, readErr := io.ReadFull(src, chunk)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return readErr
+		}
+		if n%aes.BlockSize != 0 {
+			return fmt.Errorf("ciphertext is not a multiple of the block size")
+		}
+		if n > 0 {
+			mode.CryptBlocks(chunk[:n], chunk[:n])
+			if _, err := dst.Write(last); err != nil {
+				return err
+			}
+			if _, err := dst.Write(chunk[:n-aes.BlockSize]); err != nil {
+				return err
+			}
+			last = append(last[:0], chunk[n-aes.BlockSize:n]...)
+		}
+		if readErr != nil {
+			break
+		}
+	}
+
+	plaintext, err := removePKCS7Padding(last)
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(plaintext)
+	return err
+}
+
+// encryptCBC pads with PKCS#7 and encrypts with AES-CBC and a zero IV from src to dst, as backups do
+func encryptCBC(key []byte, dst io.Writer, src io.Reader) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	mode := cipher.NewCBCEncrypter(block, make([]byte, aes.BlockSize))
+
+	chunk := make([]byte, cryptChunkSize+aes.BlockSize) // Room for a full padding block
+	for {
+		n, readErr := io.ReadFull(src, chunk[:cryptChunkSize])
+		if readErr == nil {
+			mode.CryptBlocks(chunk[:n], chunk[:n])
+			if _, err := dst.Write(chunk[:n]); err != nil {
+				return err
+			}
+			continue
+		}
+		if readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return readErr
+		}
+
+		pad := aes.BlockSize - n%aes.BlockSize
+		padded := chunk[:n+pad]
+		copy(padded[n:], bytes.Repeat([]byte{byte(pad)}, pad))
+		mode.CryptBlocks(padded, padded)
+		_, err := dst.Write(padded)
+		return err
+	}
+}
+
+// removePKCS7Padding strips PKCS#7 padding from the last block of a decryption
+// Invalid padding means the key or the data is wrong, so it is an error rather than returned as plaintext
+func removePKCS7Padding(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("ciphertext is empty")
+	}
+	pad := int(data[len(data)-1])
+	if pad == 0 || pad > aes.BlockSize || pad > len(data) {
+		return nil, fmt.Errorf("invalid padding (wrong key or corrupt data)")
+	}
+	for _, b := range data[len(data)-pad:] {
+		if int(b) != pad {
+			return nil, fmt.Errorf("invalid padding (wrong key or corrupt data)")
+		}
+	}
+	return data[:len(data)-pad], nil
+}
+
+// cryptFile streams src through crypt into dst, or copies it unchanged when crypt is nil
+// A partially written dst is removed on failure
+func cryptFile(src string, dst string, perm os.FileMode, crypt func(io.Writer, io.Reader) error) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", filepath.Base(src), err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", filepath.Base(dst), err)
+	}
+	if crypt == nil {
+		_, err = io.Copy(out, in)
+	} else {
+		err = crypt(out, in)
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return nil
+}
+
+// withKey binds a key to decryptCBC or encryptCBC for cryptFile (a nil key copies the file unchanged)
+func withKey(key []byte, crypt func([]byte, io.Writer, io.Reader) error) func(io.Writer, io.Reader) error {
+	if key == nil {
+		return nil
+	}
+	return func(dst io.Writer, src io.Reader) error {
+		return crypt(key, dst, src)
+	}
+}
+
+// BackupDecryptor decrypts Manifest.db and files of an encrypted backup
+type BackupDecryptor struct {
+	backupDir   string
+	keybag      *Keybag
+	manifestKey []byte // Wrapped Manifest.db key (ManifestKey in Manifest.plist)
+}
+
+// readManifestPlist decodes a backup's Manifest.plist
+func readManifestPlist(backupDir string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(filepath.Join(backupDir, "Manifest.plist"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Manifest.plist: %v", err)
+	}
+	v, err := decodePlist(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Manifest.plist: %v", err)
+	}
+	manifest, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Manifest.plist is not a dictionary")
+	}
+	return manifest, nil
+}
+
+// IsBackupEncrypted reports whether a backup's Manifest.plist says it is encrypted
+// A backup without Manifest.plist is treated as unencrypted
+func IsBackupEncrypted(backupDir string) (bool, error) {
+	if _, err := os.Stat(filepath.Join(backupDir, "Manifest.plist")); os.IsNotExist(err) {
+		return false, nil
+	}
+	manifest, err := readManifestPlist(backupDir)
+	if err != nil {
+		return false, err
+	}
+	encrypted, _ := manifest["IsEncrypted"].(bool)
+	return encrypted, nil
+}
+
+// NewBackupDecryptor unlocks an encrypted backup's keybag with the backup password
+func NewBackupDecryptor(backupDir string, password string) (*BackupDecryptor, error) {
+	if password == "" {
+		return nil, &BackupError{Kind: ErrKindPasswordRequired}
+	}
+
+	manifest, err := readManifestPlist(backupDir)
+	if err != nil {
+		return nil, err
+	}
+	keybagData, ok := manifest["BackupKeyBag"].([]byte)
+	if !ok {
+		return nil, fmt.Errorf("Manifest.plist has no BackupKeyBag")
+	}
+	keybag, err := parseKeybag(keybagData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse backup keybag: %v", err)
+	}
+	if err := keybag.Unlock(password); err != nil {
+		return nil, err
+	}
+
+	manifestKey, _ := manifest["ManifestKey"].([]byte)
+	return &BackupDecryptor{backupDir: backupDir, keybag: keybag, manifestKey: manifestKey}, nil
+}
+
+// DecryptManifest writes the decrypted Manifest.db to dstPath
+// Backups made before iOS 10.2 have no ManifestKey and an unencrypted Manifest.db
+func (bd *BackupDecryptor) DecryptManifest(dstPath string) error {
+	key, err := bd.manifestDBKey()
+	if err != nil {
+		return err
+	}
+	if err := cryptFile(filepath.Join(bd.backupDir, "Manifest.db"), dstPath, 0600, withKey(key, decryptCBC)); err != nil {
+		return fmt.Errorf("failed to decrypt Manifest.db: %v", err)
+	}
+	return nil
+}
+
+// EncryptManifest encrypts a decrypted Manifest.db (e.g. after updating it) over the backup's Manifest.db
+// The file is replaced atomically so an interruption leaves the previous manifest intact
+func (bd *BackupDecryptor) EncryptManifest(srcPath string) error {
+	key, err := bd.manifestDBKey()
+	if err != nil {
+		return err
+	}
+
+	manifestPath := filepath.Join(bd.backupDir, "Manifest.db")
+	tempPath := manifestPath + ".encrypting"
+	if err := cryptFile(srcPath, tempPath, 0644, withKey(key, encryptCBC)); err != nil {
+		return fmt.Errorf("failed to encrypt Manifest.db: %v", err)
+	}
+	if err := os.Rename(tempPath, manifestPath); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to replace Manifest.db: %v", err)
+	}
+	return nil
+}
+
+// manifestDBKey unwraps the Manifest.db key, or returns nil when Manifest.db is not encrypted
+func (bd *BackupDecryptor) manifestDBKey() ([]byte, error) {
+	if len(bd.manifestKey) == 0 {
+		return nil, nil
+	}
+	key, err := bd.keybag.unwrapKey(bd.manifestKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap Manifest.db key: %v", err)
+	}
+	return key, nil
+}
+
+// FileKey returns the AES key of a file from its Manifest.db Files.file blob
+// Returns nil for files stored unencrypted (e.g. empty files have no EncryptionKey)
+func (bd *BackupDecryptor) FileKey(fileBlob []byte) ([]byte, error) {
+	archive, err := decodeKeyedArchive(fileBlob)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode file metadata: %v", err)
+	}
+	wrapped := archive.data("EncryptionKey")
+	if wrapped == nil {
+		return nil, nil
+	}
+	key, err := bd.keybag.unwrapKey(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap file key: %v", err)
+	}
+	return key, nil
+}
+
+// DecryptFile decrypts src into dst with a file key (a nil key copies the file unchanged)
+func DecryptFile(key []byte, src string, dst string) error {
+	if err := cryptFile(src, dst, 0600, withKey(key, decryptCBC)); err != nil {
+		return fmt.Errorf("failed to decrypt file: %v", err)
+	}
+	return nil
+}
+
+// EncryptFile encrypts src into dst with a file key (a nil key copies the file unchanged)
+func EncryptFile(key []byte, src string, dst string) error {
+	if err := cryptFile(src, dst, 0644, withKey(key, encryptCBC)); err != nil {
+		return fmt.Errorf("failed to encrypt file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"image/color"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// mbFileBinaryPlist is an NSKeyedArchiver MBFile archive in binary plist form, as stored in Manifest.db
+// (ProtectionClass 3, Size 1234, EncryptionKey = class 3 + bytes 0..39)
+const mbFileBinaryPlist = "62706c6973743030d401020304050624275924617263686976657258246f626a656374735424746f70582476657273696f6e5f100f4e534b657965644172636869766572a6070815161a2155246e756c6cd6090a0b0c0d0e0f10111213145624636c6173735d456e6372797074696f6e4b65795c4c6173744d6f6469666965645f100f50726f74656374696f6e436c6173735c52656c6174697665506174685453697a6580058003126553f100100380021104d25f101d4c6962726172792f534d532f4174746163686d656e74732f612e706e67d209171819574e532e6461746180044f102c03000000000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f2021222324252627d21b1c1d1e5824636c61737365735a24636c6173736e616d65a31e1f205d4e534d757461626c6544617461564e5344617461584e534f626a656374d21b1c2223a22320564d4246696c65d1252654726f6f74800112000186a000080011001b0024002900320044004b0051005e0065007300800092009f00a400a600a800ad00af00b100b400d400d900e100e3011201170120012b012f013d0144014d01520155015c015f01640166000000000000020100000000000000280000000000000000000000000000016b"
+
+// aesWrap implements RFC 3394 AES key wrap (the inverse of aesUnwrap) for building fixtures
+func aesWrap(t *testing.T, kek []byte, key []byte) []byte {
+	t.Helper()
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		t.Fatalf("Invalid KEK: %v", err)
+	}
+	n := len(key) / 8
+	a := append([]byte(nil), aesKeyWrapIV...)
+	r := append([]byte(nil), key...)
+	buf := make([]byte, 16)
+	for j := 0; j <= 5; j++ {
+		for i := 1; i <= n; i++ {
+			copy(buf[:8], a)
+			copy(buf[8:], r[(i-1)*8:i*8])
+			block.Encrypt(buf, buf)
+			binary.BigEndian.PutUint64(a, binary.BigEndian.Uint64(buf[:8])^uint64(n*j+i))
+			copy(r[(i-1)*8:i*8], buf[8:])
+		}
+	}
+	return append(a, r...)
+}
+
+// testKey returns a deterministic 32-byte key
+func testKey(seed byte) []byte {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = seed + byte(i)
+	}
+	return key
+}
+
+// keybagTLV encodes one keybag tag
+func keybagTLV(tag string, value []byte) []byte {
+	out := []byte(tag)
+	out = binary.BigEndian.AppendUint32(out, uint32(len(value)))
+	return append(out, value...)
+}
+
+// keybagInt encodes an integer keybag value
+func keybagInt(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+// wrappedWithClass prefixes a wrapped key with its little-endian protection class
+func wrappedWithClass(class uint32, wrapped []byte) []byte {
+	return append(binary.LittleEndian.AppendUint32(nil, class), wrapped...)
+}
+
+// encryptedBackupFixture is a synthetic encrypted backup
+type encryptedBackupFixture struct {
+	dir      string
+	fileID   string
+	fileKey  []byte
+	password string
+}
+
+// createEncryptedBackup builds an encrypted backup with one PNG attachment, using cheap key derivation
+func createEncryptedBackup(t *testing.T) encryptedBackupFixture {
+	t.Helper()
+	const password = "correct horse"
+	dir := filepath.Join(t.TempDir(), "00008110-000E785101F2401E")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("Failed to create backup dir: %v", err)
+	}
+
+	salt, dpsl := []byte("salt-salt-salt-salt-"), []byte("dpsl-dpsl-dpsl-dpsl-")
+	round1, _ := pbkdf2.Key(sha256.New, password, dpsl, 7, 32)
+	passcodeKey, _ := pbkdf2.Key(sha1.New, string(round1), salt, 5, 32)
+
+	classKeys := map[uint32][]byte{3: testKey(0x30), 4: testKey(0x40)}
+	var keybag []byte
+	keybag = append(keybag, keybagTLV("VERS", keybagInt(4))...)
+	keybag = append(keybag, keybagTLV("TYPE", keybagInt(1))...)
+	keybag = append(keybag, keybagTLV("UUID", bytes.Repeat([]byte{1}, 16))...)
+	keybag = append(keybag, keybagTLV("WRAP", keybagInt(0))...)
+	keybag = append(keybag, keybagTLV("SALT", salt)...)
+	keybag = append(keybag, keybagTLV("ITER", keybagInt(5))...)
+	keybag = append(keybag, keybagTLV("DPIC", keybagInt(7))...)
+	keybag = append(keybag, keybagTLV("DPSL", dpsl)...)
+	for _, class := range []uint32{3, 4} {
+		keybag = append(keybag, keybagTLV("UUID", bytes.Repeat([]byte{byte(class)}, 16))...)
+		keybag = append(keybag, keybagTLV("CLAS", keybagInt(class))...)
+		keybag = append(keybag, keybagTLV("WRAP", keybagInt(keybagWrapPasscode))...)
+		keybag = append(keybag, keybagTLV("KTYP", keybagInt(0))...)
+		keybag = append(keybag, keybagTLV("WPKY", aesWrap(t, passcodeKey, classKeys[class]))...)
+	}
+
+	manifestDBKey := testKey(0x50)
+	manifestKey := wrappedWithClass(4, aesWrap(t, classKeys[4], manifestDBKey))
+
+	manifestPlist := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>BackupKeyBag</key>
+	<data>%s</data>
+	<key>IsEncrypted</key>
+	<true/>
+	<key>ManifestKey</key>
+	<data>%s</data>
+	<key>Version</key>
+	<string>10.0</string>
+</dict>
+</plist>
+`, base64.StdEncoding.EncodeToString(keybag), base64.StdEncoding.EncodeToString(manifestKey))
+	if err := os.WriteFile(filepath.Join(dir, "Manifest.plist"), []byte(manifestPlist), 0644); err != nil {
+		t.Fatalf("Failed to write Manifest.plist: %v", err)
+	}
+
+	// Encrypted PNG attachment
+	fixture := encryptedBackupFixture{
+		dir:      dir,
+		fileID:   "ab00000000000000000000000000000000000001",
+		fileKey:  testKey(0x60),
+		password: password,
+	}
+	plainPath := filepath.Join(t.TempDir(), "plain.png")
+	writeTestPNG(t, plainPath, 40, 30, color.RGBA{200, 10, 10, 255})
+	filePath := filepath.Join(dir, fixture.fileID[:2], fixture.fileID)
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	if err := EncryptFile(fixture.fileKey, plainPath, filePath); err != nil {
+		t.Fatalf("Failed to encrypt fixture file: %v", err)
+	}
+
+	// MBFile archive (XML form) holding the wrapped file key
+	fileBlob := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0">
+<dict>
+	<key>$archiver</key><string>NSKeyedArchiver</string>
+	<key>$top</key><dict><key>root</key><dict><key>CF$UID</key><integer>1</integer></dict></dict>
+	<key>$objects</key>
+	<array>
+		<string>$null</string>
+		<dict>
+			<key>ProtectionClass</key><integer>3</integer>
+			<key>EncryptionKey</key><dict><key>CF$UID</key><integer>2</integer></dict>
+		</dict>
+		<dict><key>NS.data</key><data>%s</data></dict>
+	</array>
+</dict>
+</plist>
+`, base64.StdEncoding.EncodeToString(wrappedWithClass(3, aesWrap(t, classKeys[3], fixture.fileKey))))
+
+	// Build the plaintext Manifest.db, then store it encrypted
+	plainDir := t.TempDir()
+	createTestManifest(t, plainDir, []testManifestFile{
+		{fixture.fileID, "MediaDomain", "Library/SMS/Attachments/01/IMG_0001.PNG", 1},
+	})
+	db, err := sql.Open("sqlite3", filepath.Join(plainDir, "Manifest.db"))
+	if err != nil {
+		t.Fatalf("Failed to open manifest: %v", err)
+	}
+	if _, err := db.Exec(`UPDATE Files SET file = ? WHERE fileID = ?`, []byte(fileBlob), fixture.fileID); err != nil {
+		t.Fatalf("Failed to store file blob: %v", err)
+	}
+	db.Close()
+	if err := EncryptFile(manifestDBKey, filepath.Join(plainDir, "Manifest.db"), filepath.Join(dir, "Manifest.db")); err != nil {
+		t.Fatalf("Failed to encrypt Manifest.db: %v", err)
+	}
+
+	return fixture
+}
+
+// TestAESUnwrapRFC3394 tests key unwrap against the RFC 3394 test vector
+func TestAESUnwrapRFC3394(t *testing.T) {
+	kek, _ := hex.DecodeString("000102030405060708090A0B0C0D0E0F")
+	wrapped, _ := hex.DecodeString("1FA68B0A8112B447AEF34BD8FB5A7B829D3E862371D2CFE5")
+	want, _ := hex.DecodeString("00112233445566778899AABBCCDDEEFF")
+
+	got, err := aesUnwrap(kek, wrapped)
+	if err != nil || !bytes.Equal(got, want) {
+		t.Errorf("aesUnwrap = %x, %v; want %x", got, err, want)
+	}
+
+	wrapped[5] ^= 0xff
+	if _, err := aesUnwrap(kek, wrapped); err == nil {
+		t.Error("Expected integrity check failure for corrupted input")
+	}
+}
+
+// TestCBCStreaming tests that streamed encryption round-trips at chunk boundaries and matches
+// encrypting the padded data in one piece
+func TestCBCStreaming(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatalf("NewCipher failed: %v", err)
+	}
+
+	for _, size := range []int{0, 1, 15, 16, 17, cryptChunkSize - 1, cryptChunkSize, cryptChunkSize + 16, 3*cryptChunkSize + 5} {
+		plaintext := make([]byte, size)
+		for i := range plaintext {
+			plaintext[i] = byte(i * 7)
+		}
+
+		var encrypted bytes.Buffer
+		if err := encryptCBC(key, &encrypted, bytes.NewReader(plaintext)); err != nil {
+			t.Fatalf("size %d: encryptCBC failed: %v", size, err)
+		}
+		pad := aes.BlockSize - size%aes.BlockSize
+		want := append(append([]byte(nil), plaintext...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+		cipher.NewCBCEncrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(want, want)
+		if !bytes.Equal(encrypted.Bytes(), want) {
+			t.Errorf("size %d: streamed ciphertext differs from one-piece encryption", size)
+		}
+
+		var decrypted bytes.Buffer
+		if err := decryptCBC(key, &decrypted, bytes.NewReader(encrypted.Bytes())); err != nil {
+			t.Fatalf("size %d: decryptCBC failed: %v", size, err)
+		}
+		if !bytes.Equal(decrypted.Bytes(), plaintext) {
+			t.Errorf("size %d: round trip changed the data", size)
+		}
+	}
+}
+
+// TestCBCRejectsBadPadding tests that a wrong key or truncated ciphertext is an error, not garbage plaintext
+func TestCBCRejectsBadPadding(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	var encrypted bytes.Buffer
+	if err := encryptCBC(key, &encrypted, strings.NewReader("a photo that is not quite two blocks")); err != nil {
+		t.Fatalf("encryptCBC failed: %v", err)
+	}
+
+	wrongKey := bytes.Repeat([]byte{0x24}, 32)
+	if err := decryptCBC(wrongKey, io.Discard, bytes.NewReader(encrypted.Bytes())); err == nil {
+		t.Error("Expected a padding error for the wrong key")
+	}
+	if err := decryptCBC(key, io.Discard, bytes.NewReader(encrypted.Bytes()[:encrypted.Len()-aes.BlockSize])); err == nil {
+		t.Error("Expected a padding error for a truncated ciphertext")
+	}
+	if err := decryptCBC(key, io.Discard, bytes.NewReader(encrypted.Bytes()[:encrypted.Len()-1])); err == nil {
+		t.Error("Expected an error for a ciphertext that is not whole blocks")
+	}
+	if err := decryptCBC(key, io.Discard, bytes.NewReader(nil)); err == nil {
+		t.Error("Expected an error for an empty ciphertext")
+	}
+
+	// A failed file decryption leaves no partial output behind
+	dir := t.TempDir()
+	src := filepath.Join(dir, "encrypted")
+	if err := os.WriteFile(src, encrypted.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	dst := filepath.Join(dir, "decrypted")
+	if err := DecryptFile(wrongKey, src, dst); err == nil {
+		t.Error("Expected DecryptFile to fail with the wrong key")
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("Expected no output after a failed decryption, got %v", err)
+	}
+}
+
+// TestDecodeBinaryMBFile tests decoding an NSKeyedArchiver MBFile from a binary plist
+func TestDecodeBinaryMBFile(t *testing.T) {
+	data, _ := hex.DecodeString(mbFileBinaryPlist)
+	archive, err := decodeKeyedArchive(data)
+	if err != nil {
+		t.Fatalf("decodeKeyedArchive failed: %v", err)
+	}
+
+	if class, ok := archive.integer("ProtectionClass"); !ok || class != 3 {
+		t.Errorf("Expected ProtectionClass 3, got %v", class)
+	}
+	if size, ok := archive.integer("Size"); !ok || size != 1234 {
+		t.Errorf("Expected Size 1234, got %v", size)
+	}
+	if path, _ := archive.resolve(archive.root["RelativePath"]).(string); path != "Library/SMS/Attachments/a.png" {
+		t.Errorf("Unexpected RelativePath %q", path)
+	}
+	key := archive.data("EncryptionKey")
+	if len(key) != 44 || key[0] != 3 || key[43] != 39 {
+		t.Errorf("Unexpected EncryptionKey %x", key)
+	}
+
+	// Truncated input must fail cleanly
+	if _, err := decodePlist(data[:len(data)-40]); err == nil {
+		t.Error("Expected error for truncated binary plist")
+	}
+}
+
+// TestOpenEncryptedManifest tests decrypting Manifest.db for analysis
+func TestOpenEncryptedManifest(t *testing.T) {
+	fixture := createEncryptedBackup(t)
+
+	if encrypted, err := IsBackupEncrypted(fixture.dir); err != nil || !encrypted {
+		t.Fatalf("Expected encrypted backup, got %v, %v", encrypted, err)
+	}
+
+	analyzer, decryptor, err := OpenBackupManifest(fixture.dir, fixture.password)
+	if err != nil {
+		t.Fatalf("OpenBackupManifest failed: %v", err)
+	}
+	if decryptor == nil {
+		t.Fatal("Expected a decryptor for an encrypted backup")
+	}
+	files, err := analyzer.ListFiles()
+	if err != nil || len(files) != 1 || files[0].FileID != fixture.fileID {
+		t.Errorf("Unexpected manifest files %+v, %v", files, err)
+	}
+
+	blob, err := analyzer.FileBlob(fixture.fileID)
+	if err != nil {
+		t.Fatalf("FileBlob failed: %v", err)
+	}
+	key, err := decryptor.FileKey(blob)
+	if err != nil || !bytes.Equal(key, fixture.fileKey) {
+		t.Errorf("Expected file key %x, got %x, %v", fixture.fileKey, key, err)
+	}
+
+	tempPath := analyzer.tempPath
+	analyzer.Close()
+	if _, err := os.Stat(tempPath); !os.IsNotExist(err) {
+		t.Error("Decrypted manifest should be removed on Close")
+	}
+}
+
+// TestEncryptedBackupPasswordErrors tests the typed errors for missing and wrong passwords
+func TestEncryptedBackupPasswordErrors(t *testing.T) {
+	fixture := createEncryptedBackup(t)
+
+	_, _, err := OpenBackupManifest(fixture.dir, "")
+	if kind := backupErrorKind(err); kind != ErrKindPasswordRequired {
+		t.Errorf("Expected %s, got %v", ErrKindPasswordRequired, err)
+	}
+
+	_, _, err = OpenBackupManifest(fixture.dir, "wrong")
+	if kind := backupErrorKind(err); kind != ErrKindWrongPassword {
+		t.Errorf("Expected %s, got %v", ErrKindWrongPassword, err)
+	}
+}
+
+// TestTransformEncryptedBackup tests that media in an encrypted backup is converted and re-encrypted
+func TestTransformEncryptedBackup(t *testing.T) {
+	fixture := createEncryptedBackup(t)
+	filePath := filepath.Join(fixture.dir, fixture.fileID[:2], fixture.fileID)
+
+	journal, err := OpenTransformJournal(journalPathForBackup(fixture.dir), fixture.dir)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	defer journal.Close()
+	transformer := NewBackupTransformer()
+	transformer.SetJournal(journal)
+
+	opts := TransformOptions{BackupDir: fixture.dir, Workers: 1, Password: fixture.password}
+	summary, err := TransformBackup(context.Background(), transformer, opts)
+	if err != nil {
+		t.Fatalf("TransformBackup failed: %v", err)
+	}
+	if summary.Outcomes[OutcomeConverted] != 1 {
+		t.Fatalf("Expected 1 converted file, got %+v", summary.Outcomes)
+	}
+
+	// The stored file is still ciphertext and decrypts to a JPEG
+	ciphertext, _ := os.ReadFile(filePath)
+	if bytes.HasPrefix(ciphertext, []byte{0xFF, 0xD8}) {
+		t.Error("Converted file should be stored encrypted")
+	}
+	decrypted := filepath.Join(t.TempDir(), "out.jpg")
+	if err := DecryptFile(fixture.fileKey, filePath, decrypted); err != nil {
+		t.Fatalf("DecryptFile failed: %v", err)
+	}
+	if !isJPEGFile(t, decrypted) {
+		t.Error("Decrypted file should be a JPEG")
+	}
+
+	// The journal recognises the staged copy on a rerun
+	summary, err = TransformBackup(context.Background(), transformer, opts)
+	if err != nil {
+		t.Fatalf("Second TransformBackup failed: %v", err)
+	}
+	if summary.Outcomes[OutcomeAlreadyDone] != 1 {
+		t.Errorf("Expected the rerun to skip the converted file, got %+v", summary.Outcomes)
+	}
+
+	entry, err := journal.Lookup(filePath)
+	if err != nil || entry == nil || strings.Contains(entry.Path, "iosbackup-decrypted") {
+		t.Errorf("Journal should key staged files by backup layout, got %+v, %v", entry, err)
+	}
+}
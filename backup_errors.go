@@ -0,0 +1,315 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// BackupErrorKind identifies a class of backup failure
+type BackupErrorKind string
+
+const (
+	// ErrKindDeviceNotFound means no device (or not the requested one) is connected
+	ErrKindDeviceNotFound BackupErrorKind = "device-not-found"
+	// ErrKindNotPaired means the device hasn't trusted this computer yet
+	ErrKindNotPaired BackupErrorKind = "not-paired"
+	// ErrKindPasscodeRequired means the device waits for its passcode before it starts the backup
+	ErrKindPasscodeRequired BackupErrorKind = "passcode-required"
+	// ErrKindDeviceLocked means the device must be unlocked before the backup can continue
+	ErrKindDeviceLocked BackupErrorKind = "device-locked"
+	// ErrKindPasswordRequired means backup encryption is on and no password was supplied
+	ErrKindPasswordRequired BackupErrorKind = "password-required"
+	// ErrKindWrongPassword means the supplied backup password was rejected
+	ErrKindWrongPassword BackupErrorKind = "wrong-password"
+	// ErrKindDiskFull means the backup disk (or the device) ran out of space
+	ErrKindDiskFull BackupErrorKind = "disk-full"
+	// ErrKindDeviceDisconnected means the device went away or the connection to it dropped
+	ErrKindDeviceDisconnected BackupErrorKind = "device-disconnected"
+	// ErrKindProtocolError means ios_backup and the device disagreed about the backup protocol
+	ErrKindProtocolError BackupErrorKind = "protocol-error"
+	// ErrKindStalled means ios_backup stopped producing output and was terminated by the watchdog
+	ErrKindStalled BackupErrorKind = "stalled"
+	// ErrKindBackupFailed means ios_backup exited with an error that wasn't recognised
+	ErrKindBackupFailed BackupErrorKind = "backup-failed"
+)
+
+// exitCodeFailure is the exit code for errors that aren't a classified backup failure
+const exitCodeFailure = 1
+
+// backupErrorKinds lists every failure kind, e.g. for validating -retry-on
+var backupErrorKinds = []BackupErrorKind{
+	ErrKindDeviceNotFound,
+	ErrKindNotPaired,
+	ErrKindPasscodeRequired,
+	ErrKindDeviceLocked,
+	ErrKindPasswordRequired,
+	ErrKindWrongPassword,
+	ErrKindDiskFull,
+	ErrKindDeviceDisconnected,
+	ErrKindProtocolError,
+	ErrKindBackupFailed,
+	ErrKindStalled,
+}
+
+// backupErrorInfo is the user-facing description of a failure kind
+type backupErrorInfo struct {
+	message     string // What went wrong
+	remediation string // What the user can do about it
+	exitCode    int    // Process exit code, distinct per kind
+}
+
+var backupErrorInfos = map[BackupErrorKind]backupErrorInfo{
+	ErrKindDeviceNotFound: {
+		message:     "no device was found",
+		remediation: "Connect the device with a USB cable (or use -network for a device on Wi-Fi) and check that it is listed by the devices command",
+		exitCode:    10,
+	},
+	ErrKindNotPaired: {
+		message:     "the device is not paired with this computer",
+		remediation: "Unlock the device, tap Trust on the \"Trust This Computer?\" prompt and enter the passcode, then start the backup again",
+		exitCode:    11,
+	},
+	ErrKindPasscodeRequired: {
+		message:     "the device is waiting for its passcode",
+		remediation: "Enter the passcode on the device to allow the backup, then start the backup again",
+		exitCode:    12,
+	},
+	ErrKindDeviceLocked: {
+		message:     "the device is locked",
+		remediation: "Unlock your phone and keep it unlocked until the backup has started",
+		exitCode:    13,
+	},
+	ErrKindPasswordRequired: {
+		message:     "the backup is encrypted and no password was given",
+		remediation: "Pass the backup password with -password-env, -password-fd or -password-stdin",
+		exitCode:    14,
+	},
+	ErrKindWrongPassword: {
+		message:     "the backup password was rejected",
+		remediation: "Check the backup password; it is the password set when backup encryption was turned on, not the device passcode",
+		exitCode:    15,
+	},
+	ErrKindDiskFull: {
+		message:     "there is not enough free space",
+		remediation: "Free up space on the disk holding the backup directory (or on the device if it reported the error) and start the backup again; it continues where it stopped",
+		exitCode:    16,
+	},
+	ErrKindDeviceDisconnected: {
+		message:     "the device was disconnected",
+		remediation: "Reconnect the device, preferably directly rather than through a hub, and start the backup again; it continues where it stopped",
+		exitCode:    17,
+	},
+	ErrKindProtocolError: {
+		message:     "communication with the device failed",
+		remediation: "Restart the device and reconnect it; if the error persists, update ios_backup and libimobiledevice",
+		exitCode:    18,
+	},
+	ErrKindStalled: {
+		message:     "ios_backup stalled",
+		remediation: "Check that the device is unlocked and connected and start the backup again; it continues where it stopped (-idle-restart sets how long ios_backup may stay silent)",
+		exitCode:    20,
+	},
+	ErrKindBackupFailed: {
+		message:     "ios_backup failed",
+		remediation: "Check the ios_backup output above (-verbose shows more detail)",
+		exitCode:    19,
+	},
+}
+
+// BackupError is a classified backup failure
+type BackupError struct {
+	Kind   BackupErrorKind
+	Detail string // ios_backup output line that identified the failure
+	Err    error  // Underlying error (e.g. the ios_backup exit status)
+}
+
+// Error returns the failure description
+func (e *BackupError) Error() string {
+	msg := string(e.Kind)
+	if info, ok := backupErrorInfos[e.Kind]; ok {
+		msg = info.message
+	}
+	if e.Detail != "" {
+		msg += fmt.Sprintf(" (%s)", e.Detail)
+	}
+	if e.Err != nil {
+		msg += fmt.Sprintf(": %v", e.Err)
+	}
+	return msg
+}
+
+// Unwrap returns the underlying error
+func (e *BackupError) Unwrap() error {
+	return e.Err
+}
+
+// Remediation returns what the user can do about the failure
+func (e *BackupError) Remediation() string {
+	return backupErrorInfos[e.Kind].remediation
+}
+
+// backupErrorKind returns the kind of a classified error, or "" for unclassified errors
+func backupErrorKind(err error) BackupErrorKind {
+	var backupErr *BackupError
+	if errors.As(err, &backupErr) {
+		return backupErr.Kind
+	}
+	return ""
+}
+
+// errorRemediation returns the remediation for a classified error, or "" for unclassified errors
+func errorRemediation(err error) string {
+	var backupErr *BackupError
+	if errors.As(err, &backupErr) {
+		return backupErr.Remediation()
+	}
+	return ""
+}
+
+// exitCodeForError returns the process exit code for an error (0 for nil)
+func exitCodeForError(err error) int {
+	if err == nil {
+		return 0
+	}
+	if info, ok := backupErrorInfos[backupErrorKind(err)]; ok {
+		return info.exitCode
+	}
+	return exitCodeFailure
+}
+
+// printExitCodes writes the exit code table for usage output
+func printExitCodes(w io.Writer) {
+	fmt.Fprintf(w, "  %-3d %s\n", 0, "success")
+	fmt.Fprintf(w, "  %-3d %s\n", exitCodeFailure, "other error (invalid options, missing tools, ...)")
+	for _, kind := range backupErrorKinds {
+		fmt.Fprintf(w, "  %-3d %s: %s\n", backupErrorInfos[kind].exitCode, kind, backupErrorInfos[kind].message)
+	}
+}
+
+// outputMarkers maps phrases in ios_backup/libimobiledevice output to failure kinds
+// Checked in order, so more specific kinds come first
+var outputMarkers = []struct {
+	kind    BackupErrorKind
+	markers []string
+}{
+	{ErrKindPasswordRequired, []string{
+		"can't get password input in non-interactive mode",
+		"no backup password given",
+	}},
+	{ErrKindWrongPassword, []string{
+		"wrong password",
+		"incorrect password",
+		"invalid password",
+		"bad password",
+	}},
+	{ErrKindNotPaired, []string{
+		"not paired",
+		"pairing dialog response pending",
+		"user denied pairing",
+		"trust this computer",
+		"invalid host id",
+		"invalidhostid",
+		"lockdownd, error code -18",
+		"lockdownd, error code -19",
+		"lockdownd, error code -21",
+	}},
+	{ErrKindPasscodeRequired, []string{
+		"enter the passcode",
+		"enter passcode",
+		"passcode required",
+		"waiting for passcode",
+	}},
+	{ErrKindDeviceLocked, []string{
+		"device is locked",
+		"device locked",
+		"please unlock",
+		"password protected",
+		"lockdownd, error code -17",
+	}},
+	{ErrKindDiskFull, []string{
+		"no space left on device",
+		"disk full",
+		"not enough free space",
+		"not enough space",
+		"insufficient free disk space",
+	}},
+	{ErrKindDeviceNotFound, []string{
+		"no device found",
+		"device not found",
+		"no device connected",
+		"no device with udid",
+	}},
+	{ErrKindDeviceDisconnected, []string{
+		"device disconnected",
+		"device removed",
+		"could not connect to device",
+		"connection lost",
+		"lost connection",
+		"connection reset",
+		"mux error",
+		"broken pipe",
+	}},
+	{ErrKindProtocolError, []string{
+		"protocol error",
+		"plist error",
+		"ssl error",
+		"unexpected message",
+		"received unexpected",
+		"could not receive",
+		"could not start service",
+	}},
+}
+
+// deviceErrorCodeRe matches device error codes reported by ios_backup, e.g. "ErrorCode 105: ..."
+var deviceErrorCodeRe = regexp.MustCompile(`(?i)errorcode (\d+)`)
+
+// deviceErrorCodes maps MobileBackup2 device error codes to failure kinds
+// ios_backup also exits with the device error code when the device aborts the backup
+var deviceErrorCodes = map[int]BackupErrorKind{
+	105: ErrKindDiskFull, // Insufficient free disk space on drive to upload files
+}
+
+// dataLinePrefixes start ios_backup lines that report files and domains
+// File names and domains come from the device, so "disk full.jpg" must not read as a failure
+var dataLinePrefixes = []string{"FILE_SAVED:", "FILE_FILTERED:", "Receiving domain:"}
+
+// classifyOutputLine maps an ios_backup output line to a failure kind ("" if it doesn't indicate one)
+// File, domain and progress lines never indicate a failure
+func classifyOutputLine(line string) BackupErrorKind {
+	trimmed := strings.TrimSpace(line)
+	for _, prefix := range dataLinePrefixes {
+		if strings.HasPrefix(trimmed, prefix) {
+			return ""
+		}
+	}
+	if progressBarRe.MatchString(trimmed) {
+		return ""
+	}
+
+	lower := strings.ToLower(line)
+	for _, entry := range outputMarkers {
+		for _, marker := range entry.markers {
+			if strings.Contains(lower, marker) {
+				return entry.kind
+			}
+		}
+	}
+	if m := deviceErrorCodeRe.FindStringSubmatch(line); m != nil {
+		code, _ := strconv.Atoi(m[1])
+		return deviceErrorCodes[code]
+	}
+	return ""
+}
+
+// classifyExitStatus maps the ios_backup exit status to a failure kind ("" if it doesn't indicate one)
+func classifyExitStatus(err error) BackupErrorKind {
+	code, ok := processExitCode(err)
+	if !ok {
+		return ""
+	}
+	return deviceErrorCodes[code]
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestClassifyOutputLine tests the mapping of ios_backup output to failure kinds
+func TestClassifyOutputLine(t *testing.T) {
+	cases := []struct {
+		line string
+		kind BackupErrorKind
+	}{
+		{"No device found.", ErrKindDeviceNotFound},
+		{"No device found with udid 00008110-000E785101F2401E.", ErrKindDeviceNotFound},
+		{"ERROR: Could not connect to lockdownd, error code -19", ErrKindNotPaired},
+		{"ERROR: Device is not paired with this host", ErrKindNotPaired},
+		{"Please enter the passcode on the device to continue", ErrKindPasscodeRequired},
+		{"ERROR: Could not connect to lockdownd, error code -17", ErrKindDeviceLocked},
+		{"ERROR: Device is locked, please unlock it", ErrKindDeviceLocked},
+		{"ERROR: Can't get password input in non-interactive mode.", ErrKindPasswordRequired},
+		{"ErrorCode 207: Wrong password", ErrKindWrongPassword},
+		{"Error writing file: No space left on device", ErrKindDiskFull},
+		{"ErrorCode 105: Insufficient free disk space on drive to upload files", ErrKindDiskFull},
+		{"ErrorCode 105: (mobilebackup2 error)", ErrKindDiskFull},
+		{"ERROR: Device disconnected", ErrKindDeviceDisconnected},
+		{"ERROR: Could not receive from mobilebackup2 (-3)", ErrKindProtocolError},
+		{"ERROR: Could not start service com.apple.mobilebackup2", ErrKindProtocolError},
+		{"Receiving files", ""},
+		{"ErrorCode 1: Unknown", ""},
+		{"FILE_SAVED: path=udid/Snapshot/ab/abcd domain=MediaDomain-Library/SMS/Attachments/disk full.jpg", ""},
+		{"FILE_FILTERED: path=udid/Snapshot/cd/cdef domain=AppDomain-com.example.brokenpipe-Documents/broken pipe.txt", ""},
+		{"[=====     ]  45% (1.2 MB/2.7 MB)", ""},
+	}
+	for _, c := range cases {
+		if kind := classifyOutputLine(c.line); kind != c.kind {
+			t.Errorf("classifyOutputLine(%q) = %q, expected %q", c.line, kind, c.kind)
+		}
+	}
+}
+
+// TestBackupErrorKindsDescribed tests that every kind has a message, a remediation and a distinct exit code
+func TestBackupErrorKindsDescribed(t *testing.T) {
+	codes := map[int]BackupErrorKind{0: "success", exitCodeFailure: "other"}
+	for _, kind := range backupErrorKinds {
+		info, ok := backupErrorInfos[kind]
+		if !ok || info.message == "" || info.remediation == "" {
+			t.Errorf("Kind %s is missing its description", kind)
+			continue
+		}
+		if other, dup := codes[info.exitCode]; dup {
+			t.Errorf("Kinds %s and %s share exit code %d", kind, other, info.exitCode)
+		}
+		codes[info.exitCode] = kind
+	}
+
+	locked := fmt.Errorf("backup failed: %w", &BackupError{Kind: ErrKindDeviceLocked})
+	if exitCodeForError(locked) != backupErrorInfos[ErrKindDeviceLocked].exitCode {
+		t.Errorf("Wrapped errors should keep their exit code, got %d", exitCodeForError(locked))
+	}
+	if errorRemediation(locked) == "" {
+		t.Error("Wrapped errors should keep their remediation")
+	}
+	if exitCodeForError(errors.New("other")) != exitCodeFailure || exitCodeForError(nil) != 0 {
+		t.Error("Unclassified errors should exit with 1 and success with 0")
+	}
+}
+
+// TestRunClassifiesExitStatus tests that ios_backup failures are typed from the exit status
+// when the output doesn't identify them
+func TestRunClassifiesExitStatus(t *testing.T) {
+	cases := []struct {
+		name   string
+		script string
+		kind   BackupErrorKind
+	}{
+		{"device-error-code", "#!/bin/bash\necho 'Backup Failed.' >&2\nexit 105\n", ErrKindDiskFull},
+		{"unrecognised", "#!/bin/bash\necho 'Something odd happened' >&2\nexit 3\n", ErrKindBackupFailed},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			mockIosBackup := filepath.Join(tempDir, "ios_backup_mock")
+			if err := os.WriteFile(mockIosBackup, []byte(c.script), 0755); err != nil {
+				t.Fatalf("Failed to create mock ios_backup: %v", err)
+			}
+
+			runner, err := NewBackupRunner(filepath.Join(tempDir, "backup"), mockIosBackup, false, NewBackupTransformer())
+			if err != nil {
+				t.Fatalf("Failed to create runner: %v", err)
+			}
+			runner.SetConsoleOutput(&bytes.Buffer{})
+			runner.SetRetryPolicy(RetryPolicy{})
+
+			err = runner.Run()
+			if kind := backupErrorKind(err); kind != c.kind {
+				t.Errorf("Expected kind %s, got %q (%v)", c.kind, kind, err)
+			}
+		})
+	}
+}
+
+// TestRunIgnoresMarkersInFileNames tests that a saved file named like a failure doesn't mask the real failure
+func TestRunIgnoresMarkersInFileNames(t *testing.T) {
+	tempDir := t.TempDir()
+	mockIosBackup := filepath.Join(tempDir, "ios_backup_mock")
+	script := "#!/bin/bash\n" +
+		"echo 'FILE_SAVED: path=udid/Snapshot/ab/abcd domain=MediaDomain-Library/SMS/Attachments/disk full.txt' >&2\n" +
+		"echo 'ERROR: Device disconnected' >&2\n" +
+		"exit 1\n"
+	if err := os.WriteFile(mockIosBackup, []byte(script), 0755); err != nil {
+		t.Fatalf("Failed to create mock ios_backup: %v", err)
+	}
+
+	runner, err := NewBackupRunner(filepath.Join(tempDir, "backup"), mockIosBackup, false, NewBackupTransformer())
+	if err != nil {
+		t.Fatalf("Failed to create runner: %v", err)
+	}
+	runner.SetConsoleOutput(&bytes.Buffer{})
+	runner.SetRetryPolicy(RetryPolicy{})
+
+	err = runner.Run()
+	if kind := backupErrorKind(err); kind != ErrKindDeviceDisconnected {
+		t.Errorf("Expected kind %s, got %q (%v)", ErrKindDeviceDisconnected, kind, err)
+	}
+}
+
+// TestSelectDeviceNotFound tests that a missing device is a typed failure
+func TestSelectDeviceNotFound(t *testing.T) {
+	if _, err := SelectDevice(nil, ""); backupErrorKind(err) != ErrKindDeviceNotFound {
+		t.Errorf("Expected %s with no devices, got %v", ErrKindDeviceNotFound, err)
+	}
+	devices := []Device{{UDID: "aaaa"}}
+	if _, err := SelectDevice(devices, "bbbb"); backupErrorKind(err) != ErrKindDeviceNotFound {
+		t.Errorf("Expected %s for an unknown UDID, got %v", ErrKindDeviceNotFound, err)
+	}
+}
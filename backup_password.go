@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// backupPasswordEnv is the variable ios_backup (idevicebackup2) reads the backup password from
+const backupPasswordEnv = "BACKUP_PASSWORD"
+
+// PasswordOptions says where the encrypted backup password comes from (at most one source)
+type PasswordOptions struct {
+	EnvVar string // Name of an environment variable holding the password
+	FD     int    // File descriptor to read the password from (-1 for none)
+	Stdin  bool   // Read the password from the first line of stdin
+}
+
+// passwordFlags registers the -password-env, -password-fd and -password-stdin flags
+func passwordFlags(fs *flag.FlagSet) *PasswordOptions {
+	opts := &PasswordOptions{}
+	fs.StringVar(&opts.EnvVar, "password-env", "", "Read the encrypted backup password from this environment variable")
+	fs.IntVar(&opts.FD, "password-fd", -1, "Read the encrypted backup password from this file descriptor")
+	fs.BoolVar(&opts.Stdin, "password-stdin", false, "Read the encrypted backup password from the first line of stdin")
+	return opts
+}
+
+// ReadBackupPassword reads the backup password from the configured source
+// Returns "" when no source is configured
+func ReadBackupPassword(opts PasswordOptions, stdin io.Reader) (string, error) {
+	sources := 0
+	if opts.EnvVar != "" {
+		sources++
+	}
+	if opts.FD >= 0 {
+		sources++
+	}
+	if opts.Stdin {
+		sources++
+	}
+	if sources == 0 {
+		return "", nil
+	}
+	if sources > 1 {
+		return "", fmt.Errorf("use only one of -password-env, -password-fd and -password-stdin")
+	}
+
+	var password string
+	switch {
+	case opts.EnvVar != "":
+		value, ok := os.LookupEnv(opts.EnvVar)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", opts.EnvVar)
+		}
+		password = value
+		// Keep the password out of the environment of other child processes (heic-converter, ffmpeg)
+		os.Unsetenv(opts.EnvVar)
+	case opts.FD >= 0:
+		file := os.NewFile(uintptr(opts.FD), "password-fd")
+		if file == nil {
+			return "", fmt.Errorf("invalid password file descriptor %d", opts.FD)
+		}
+		defer file.Close()
+		line, err := readPasswordLine(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read password from file descriptor %d: %v", opts.FD, err)
+		}
+		password = line
+	case opts.Stdin:
+		line, err := readPasswordLine(stdin)
+		if err != nil {
+			return "", fmt.Errorf("failed to read password from stdin: %v", err)
+		}
+		password = line
+	}
+
+	if password == "" {
+		return "", fmt.Errorf("backup password is empty")
+	}
+	return password, nil
+}
+
+// readPasswordLine reads up to the first newline, without the line ending
+func readPasswordLine(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// passwordEnviron returns the current environment with the backup password set for ios_backup
+// Passing it through the environment keeps it out of process listings
+func passwordEnviron(password string) []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, backupPasswordEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	return append(env, backupPasswordEnv+"="+password)
+}
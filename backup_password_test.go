@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// TestReadBackupPassword tests the password sources
+func TestReadBackupPassword(t *testing.T) {
+	// No source configured
+	if password, err := ReadBackupPassword(PasswordOptions{FD: -1}, nil); err != nil || password != "" {
+		t.Errorf("Expected no password, got %q, %v", password, err)
+	}
+
+	// Environment variable, removed after reading
+	t.Setenv("TEST_BACKUP_PW", "env secret")
+	password, err := ReadBackupPassword(PasswordOptions{EnvVar: "TEST_BACKUP_PW", FD: -1}, nil)
+	if err != nil || password != "env secret" {
+		t.Errorf("Expected env password, got %q, %v", password, err)
+	}
+	if _, ok := os.LookupEnv("TEST_BACKUP_PW"); ok {
+		t.Error("Password variable should be removed from the environment")
+	}
+	if _, err := ReadBackupPassword(PasswordOptions{EnvVar: "TEST_BACKUP_PW", FD: -1}, nil); err == nil {
+		t.Error("Expected error for unset variable")
+	}
+
+	// Stdin, first line only
+	password, err = ReadBackupPassword(PasswordOptions{FD: -1, Stdin: true}, strings.NewReader("stdin secret\r\nrest\n"))
+	if err != nil || password != "stdin secret" {
+		t.Errorf("Expected stdin password, got %q, %v", password, err)
+	}
+	if _, err := ReadBackupPassword(PasswordOptions{FD: -1, Stdin: true}, strings.NewReader("\n")); err == nil {
+		t.Error("Expected error for empty password")
+	}
+
+	// File descriptor (a duplicate, since ReadBackupPassword closes the descriptor it reads)
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+	defer r.Close()
+	w.WriteString("fd secret\n")
+	w.Close()
+	fd, err := syscall.Dup(int(r.Fd()))
+	if err != nil {
+		t.Fatalf("Failed to duplicate descriptor: %v", err)
+	}
+	password, err = ReadBackupPassword(PasswordOptions{FD: fd}, nil)
+	if err != nil || password != "fd secret" {
+		t.Errorf("Expected fd password, got %q, %v", password, err)
+	}
+
+	// Multiple sources
+	if _, err := ReadBackupPassword(PasswordOptions{EnvVar: "X", FD: -1, Stdin: true}, nil); err == nil {
+		t.Error("Expected error for multiple sources")
+	}
+}
+
+// TestPasswordPassedThroughEnvironment tests that ios_backup gets the password via BACKUP_PASSWORD
+// and that it is redacted from forwarded output
+func TestPasswordPassedThroughEnvironment(t *testing.T) {
+	tempDir := t.TempDir()
+	backupDir := filepath.Join(tempDir, "backup")
+
+	mockIosBackup := filepath.Join(tempDir, "ios_backup_mock")
+	script := "#!/bin/bash\necho \"args: $*\"\necho \"password: $BACKUP_PASSWORD\"\n"
+	if err := os.WriteFile(mockIosBackup, []byte(script), 0755); err != nil {
+		t.Fatalf("Failed to create mock ios_backup: %v", err)
+	}
+
+	runner, err := NewBackupRunner(backupDir, mockIosBackup, false, NewBackupTransformer())
+	if err != nil {
+		t.Fatalf("Failed to create runner: %v", err)
+	}
+	var output bytes.Buffer
+	runner.SetConsoleOutput(&output)
+	runner.SetPassword("s3cret-pw")
+
+	if err := runner.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if strings.Contains(output.String(), "s3cret-pw") {
+		t.Errorf("Password leaked into output: %s", output.String())
+	}
+	if !strings.Contains(output.String(), "password: ********") {
+		t.Errorf("ios_backup should have received the password, output: %s", output.String())
+	}
+}
+
+// TestEncryptionFailuresAreTyped tests that password failures surface as BackupError kinds
+func TestEncryptionFailuresAreTyped(t *testing.T) {
+	cases := []struct {
+		name   string
+		output string
+		kind   BackupErrorKind
+	}{
+		{"password-required", "ERROR: Can't get password input in non-interactive mode. Either pass password(s) on the command line, or enable interactive mode with -i or --interactive.", ErrKindPasswordRequired},
+		{"wrong-password", "ErrorCode 207: Wrong password", ErrKindWrongPassword},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			mockIosBackup := filepath.Join(tempDir, "ios_backup_mock")
+			script := "#!/bin/bash\necho 'Backup will be encrypted.'\ncat >&2 <<'EOF'\n" + c.output + "\nEOF\nexit 1\n"
+			if err := os.WriteFile(mockIosBackup, []byte(script), 0755); err != nil {
+				t.Fatalf("Failed to create mock ios_backup: %v", err)
+			}
+
+			runner, err := NewBackupRunner(filepath.Join(tempDir, "backup"), mockIosBackup, false, NewBackupTransformer())
+			if err != nil {
+				t.Fatalf("Failed to create runner: %v", err)
+			}
+			runner.SetConsoleOutput(&bytes.Buffer{})
+
+			err = runner.Run()
+			var backupErr *BackupError
+			if !errors.As(err, &backupErr) {
+				t.Fatalf("Expected *BackupError, got %v", err)
+			}
+			if backupErr.Kind != c.kind {
+				t.Errorf("Expected kind %s, got %s", c.kind, backupErr.Kind)
+			}
+			if backupErr.Unwrap() == nil {
+				t.Error("BackupError should wrap the ios_backup exit error")
+			}
+		})
+	}
+}
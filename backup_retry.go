@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Retry defaults for -retries, -retry-backoff, -retry-max-backoff and -retry-on
+const (
+	defaultRetries         = 3
+	defaultRetryBackoff    = 10 * time.Second
+	defaultRetryMaxBackoff = 2 * time.Minute
+	defaultRetryOn         = "device-disconnected,device-locked,stalled"
+)
+
+// RetryPolicy decides whether a failed ios_backup run is restarted and how long to wait first
+// A restart runs ios_backup against the same directory, so it continues the incremental snapshot
+type RetryPolicy struct {
+	Retries    int               // Restarts after the first run (0 disables retrying)
+	Backoff    time.Duration     // Wait before the first restart, doubled for each further one
+	MaxBackoff time.Duration     // Upper bound for the wait
+	Retryable  []BackupErrorKind // Failure kinds that are worth a restart
+}
+
+// DefaultRetryPolicy returns the policy used when no -retry flags are given
+func DefaultRetryPolicy() RetryPolicy {
+	kinds, _ := ParseRetryableKinds(defaultRetryOn)
+	return RetryPolicy{
+		Retries:    defaultRetries,
+		Backoff:    defaultRetryBackoff,
+		MaxBackoff: defaultRetryMaxBackoff,
+		Retryable:  kinds,
+	}
+}
+
+// ShouldRetry reports whether the run that failed with err on the given attempt (1-based) should be restarted
+func (p RetryPolicy) ShouldRetry(err error, attempt int) bool {
+	if err == nil || attempt > p.Retries {
+		return false
+	}
+	kind := backupErrorKind(err)
+	for _, retryable := range p.Retryable {
+		if kind == retryable {
+			return true
+		}
+	}
+	return false
+}
+
+// Delay returns the wait before restarting after the given failed attempt (1-based)
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	delay := p.Backoff
+	for i := 1; i < attempt && (p.MaxBackoff <= 0 || delay < p.MaxBackoff); i++ {
+		delay *= 2
+	}
+	if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+		return p.MaxBackoff
+	}
+	return delay
+}
+
+// ParseRetryableKinds parses a comma-separated list of failure kinds
+// e.g. "device-disconnected,device-locked"; an empty string means nothing is retried
+func ParseRetryableKinds(s string) ([]BackupErrorKind, error) {
+	var kinds []BackupErrorKind
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		kind, ok := lookupBackupErrorKind(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown failure kind %q (known: %s)", name, joinKinds(backupErrorKinds))
+		}
+		kinds = append(kinds, kind)
+	}
+	return kinds, nil
+}
+
+// lookupBackupErrorKind returns the failure kind with the given name
+func lookupBackupErrorKind(name string) (BackupErrorKind, bool) {
+	for _, kind := range backupErrorKinds {
+		if string(kind) == name {
+			return kind, true
+		}
+	}
+	return "", false
+}
+
+// joinKinds formats failure kinds as a comma-separated list
+func joinKinds(kinds []BackupErrorKind) string {
+	names := make([]string, len(kinds))
+	for i, kind := range kinds {
+		names[i] = string(kind)
+	}
+	return strings.Join(names, ", ")
+}
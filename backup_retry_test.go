@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRetryPolicy tests retry decisions and backoff
+func TestRetryPolicy(t *testing.T) {
+	policy := RetryPolicy{
+		Retries:    2,
+		Backoff:    time.Second,
+		MaxBackoff: 3 * time.Second,
+		Retryable:  []BackupErrorKind{ErrKindDeviceDisconnected},
+	}
+
+	disconnected := &BackupError{Kind: ErrKindDeviceDisconnected}
+	if !policy.ShouldRetry(disconnected, 1) || !policy.ShouldRetry(disconnected, 2) {
+		t.Error("Disconnects should be retried twice")
+	}
+	if policy.ShouldRetry(disconnected, 3) {
+		t.Error("Retries should stop after the configured count")
+	}
+	if policy.ShouldRetry(&BackupError{Kind: ErrKindWrongPassword}, 1) {
+		t.Error("Wrong password should not be retried")
+	}
+	if policy.ShouldRetry(errors.New("ios_backup not found"), 1) || policy.ShouldRetry(nil, 1) {
+		t.Error("Unclassified errors and success should not be retried")
+	}
+
+	for attempt, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 3 * time.Second, 10: 3 * time.Second} {
+		if got := policy.Delay(attempt); got != want {
+			t.Errorf("Delay(%d) = %s, expected %s", attempt, got, want)
+		}
+	}
+
+	kinds, err := ParseRetryableKinds(" device-locked, backup-failed ,")
+	if err != nil || len(kinds) != 2 || kinds[0] != ErrKindDeviceLocked || kinds[1] != ErrKindBackupFailed {
+		t.Errorf("Unexpected kinds %v, %v", kinds, err)
+	}
+	if _, err := ParseRetryableKinds("usb-hiccup"); err == nil {
+		t.Error("Expected error for unknown kind")
+	}
+}
+
+// TestRunRetriesAfterDisconnect tests that ios_backup is restarted after a disconnect
+// and that files reported by both runs are transformed once
+func TestRunRetriesAfterDisconnect(t *testing.T) {
+	tempDir := t.TempDir()
+	udid := "00008110-000E785101F2401E"
+	backupDir := filepath.Join(tempDir, udid)
+
+	firstFile := filepath.Join(backupDir, "Snapshot", "aa", "aa11")
+	secondFile := filepath.Join(backupDir, "Snapshot", "bb", "bb22")
+	for _, path := range []string{firstFile, secondFile} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		writeTestPNG(t, path, 40, 40, color.RGBA{0, 255, 0, 255})
+	}
+
+	// First run saves one file and loses the device, the second reports it again and finishes
+	attemptsFile := filepath.Join(tempDir, "attempts")
+	mockIosBackup := filepath.Join(tempDir, "ios_backup_mock")
+	script := "#!/bin/bash\n" +
+		"n=$(( $(cat '" + attemptsFile + "' 2>/dev/null || echo 0) + 1 ))\n" +
+		"echo $n > '" + attemptsFile + "'\n" +
+		"echo 'FILE_SAVED: path=" + udid + "/Snapshot/aa/aa11 domain=MediaDomain-Library/SMS/Attachments/IMG_1.PNG' >&2\n" +
+		"if [ $n -eq 1 ]; then echo 'ERROR: Device disconnected' >&2; exit 1; fi\n" +
+		"echo 'FILE_SAVED: path=" + udid + "/Snapshot/bb/bb22 domain=MediaDomain-Library/SMS/Attachments/IMG_2.PNG' >&2\n"
+	if err := os.WriteFile(mockIosBackup, []byte(script), 0755); err != nil {
+		t.Fatalf("Failed to create mock ios_backup: %v", err)
+	}
+
+	events := captureEvents(t)
+	runner, err := NewBackupRunner(backupDir, mockIosBackup, false, NewBackupTransformer())
+	if err != nil {
+		t.Fatalf("Failed to create runner: %v", err)
+	}
+	runner.SetConsoleOutput(&bytes.Buffer{})
+	runner.SetRetryPolicy(RetryPolicy{
+		Retries:   2,
+		Backoff:   10 * time.Millisecond,
+		Retryable: []BackupErrorKind{ErrKindDeviceDisconnected},
+	})
+
+	if err := runner.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	attempts, _ := os.ReadFile(attemptsFile)
+	if strings.TrimSpace(string(attempts)) != "2" {
+		t.Errorf("Expected 2 ios_backup runs, got %q", attempts)
+	}
+	if !isJPEGFile(t, firstFile) || !isJPEGFile(t, secondFile) {
+		t.Error("Both files should have been converted")
+	}
+	if runner.totalCount != 2 {
+		t.Errorf("Expected 2 transformations, got %d", runner.totalCount)
+	}
+
+	started := map[string]int{}
+	retries := 0
+	for _, event := range decodeEvents(t, events) {
+		switch event["type"] {
+		case EventTransformStarted:
+			started[event["path"].(string)]++
+		case EventBackupRetry:
+			retries++
+			if event["attempt"] != float64(2) || event["error_kind"] != string(ErrKindDeviceDisconnected) {
+				t.Errorf("Unexpected retry event: %v", event)
+			}
+		}
+	}
+	if retries != 1 {
+		t.Errorf("Expected 1 backup_retry event, got %d", retries)
+	}
+	if started[firstFile] != 1 || started[secondFile] != 1 {
+		t.Errorf("Each file should be transformed once, got %v", started)
+	}
+}
+
+// TestRunDoesNotRetryWrongPassword tests that failures outside the policy end the run
+func TestRunDoesNotRetryWrongPassword(t *testing.T) {
+	tempDir := t.TempDir()
+	attemptsFile := filepath.Join(tempDir, "attempts")
+	mockIosBackup := filepath.Join(tempDir, "ios_backup_mock")
+	script := "#!/bin/bash\necho run >> '" + attemptsFile + "'\necho 'ErrorCode 207: Wrong password' >&2\nexit 1\n"
+	if err := os.WriteFile(mockIosBackup, []byte(script), 0755); err != nil {
+		t.Fatalf("Failed to create mock ios_backup: %v", err)
+	}
+
+	runner, err := NewBackupRunner(filepath.Join(tempDir, "backup"), mockIosBackup, false, NewBackupTransformer())
+	if err != nil {
+		t.Fatalf("Failed to create runner: %v", err)
+	}
+	runner.SetConsoleOutput(&bytes.Buffer{})
+	runner.SetRetryPolicy(RetryPolicy{Retries: 3, Backoff: time.Millisecond, Retryable: []BackupErrorKind{ErrKindDeviceDisconnected, ErrKindBackupFailed}})
+
+	if kind := backupErrorKind(runner.Run()); kind != ErrKindWrongPassword {
+		t.Errorf("Expected %s, got %q", ErrKindWrongPassword, kind)
+	}
+	attempts, _ := os.ReadFile(attemptsFile)
+	if strings.Count(string(attempts), "run") != 1 {
+		t.Errorf("Expected a single ios_backup run, got %q", attempts)
+	}
+}
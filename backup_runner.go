@@ -6,18 +6,26 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const maxOutputLineBytes = 1024 * 1024
 
+// defaultRunTimeout is the longest a single ios_backup run may take
+const defaultRunTimeout = 24 * time.Hour
+
 var fileSavedRe = regexp.MustCompile(`path=([^\s]+)(?:\s+domain=([^\s]+))?`)
 
+var (
+	linePathRe   = regexp.MustCompile(`path=([^\s]+)`)
+	lineDomainRe = regexp.MustCompile(`domain=([^\s]+)`)
+)
+
 // truncateString safely truncates a string to maxLen characters
 func truncateString(s string, maxLen int) string {
 	if len(s) <= maxLen {
@@ -80,35 +88,83 @@ type BackupRunner struct {
 	backupDir    string
 	iosBackup    string
 	verbose      bool
-	logFile      *os.File       // Optional log file for output
+	domains      []string  // ios_backup --domain filters (empty means whole device)
+	udid         string    // Device to back up (empty lets ios_backup pick)
+	network      bool      // Connect to the device over the network
+	password     string    // Encrypted backup password, passed to ios_backup via its environment
+	discovery    string    // Discovery method recorded in FileTiming: "ios_backup" or "replay"
+	logFile      *os.File  // Optional log file for output
+	consoleOut   io.Writer // Where forwarded ios_backup stdout goes (stdout unless it is reserved for events)
 	transformer  *BackupTransformer
 	stopChan     chan struct{}
 	wg           sync.WaitGroup // Tracks main goroutines
-	processingWg sync.WaitGroup // Tracks file processing goroutines
-	activeCount  int64          // Number of files currently being processed
-	totalCount   int64          // Total number of files processed or being processed
-	countMu      sync.Mutex     // Protects queue counters
+	processingWg sync.WaitGroup // Tracks queued and in-flight file jobs
+	scheduler    *WorkScheduler // Bounded worker pool for file processing
+	progress     *ProgressTracker
+	retry        RetryPolicy           // When a failed ios_backup run is restarted
+	attempt      int                   // Current ios_backup run (1-based)
+	savedFiles   map[string]*savedFile // Files already handed to the worker pool, by path
+	savedMu      sync.Mutex            // Protects savedFiles
+	idleTimeout  time.Duration         // Silence before the watchdog checks the device (0 disables)
+	idleRestart  time.Duration         // Silence before the watchdog terminates ios_backup (0 disables)
+	activity     activityMonitor       // When ios_backup last printed anything
+	checkDevice  func() (bool, error)  // Whether the device is still connected (replaced in tests)
+	activeCount  int64                 // Number of files currently being processed
+	queuedCount  int64                 // Number of files waiting for a worker
+	totalCount   int64                 // Total number of files processed or being processed
+	countMu      sync.Mutex            // Protects queue counters
+	failure      *BackupError          // First failure recognised in ios_backup output
+	failureMu    sync.Mutex            // Protects failure
+	encrypted    atomic.Bool           // ios_backup reported an encrypted backup (files arrive as ciphertext)
+	procs        ProcessRunner         // Runs ios_backup
+	runTimeout   time.Duration         // Longest a single ios_backup run may take
 	cmdMu        sync.Mutex
-	cmd          *exec.Cmd
+	proc         Process // Running ios_backup, if any
 	ctxCancel    context.CancelFunc
 	stopOnce     sync.Once
+	drainTimeout time.Duration // How long Stop waits for queued files (0 waits indefinitely)
+	forceChan    chan struct{} // Closed by ForceStop
+	forceOnce    sync.Once
+	aborted      atomic.Bool        // Stop gave up on the remaining work
+	workCtx      context.Context    // Parent context of every conversion
+	cancelWork   context.CancelFunc // Cancels in-flight conversions when Stop gives up on them
+	report       *RunReport         // Optional per-file report
+	fixManifest  bool               // Rewrite the Manifest.db metadata of converted files after the backup
 }
 
 // NewBackupRunner creates a new backup runner that calls ios_backup
 func NewBackupRunner(backupDir string, iosBackupPath string, verbose bool, transformer *BackupTransformer) (*BackupRunner, error) {
 	runner := &BackupRunner{
-		backupDir:   backupDir,
-		iosBackup:   iosBackupPath,
-		verbose:     verbose,
-		transformer: transformer,
-		stopChan:    make(chan struct{}),
+		backupDir:    backupDir,
+		iosBackup:    iosBackupPath,
+		verbose:      verbose,
+		domains:      builtinProfiles[defaultProfileName].Domains,
+		discovery:    "ios_backup",
+		consoleOut:   os.Stdout,
+		transformer:  transformer,
+		progress:     NewProgressTracker(),
+		retry:        DefaultRetryPolicy(),
+		savedFiles:   make(map[string]*savedFile),
+		idleTimeout:  defaultIdleTimeout,
+		idleRestart:  defaultIdleRestart,
+		stopChan:     make(chan struct{}),
+		forceChan:    make(chan struct{}),
+		drainTimeout: defaultDrainTimeout,
+		procs:        ExecRunner{},
+		runTimeout:   defaultRunTimeout,
+		fixManifest:  true,
 	}
 	
+	runner.scheduler = NewWorkScheduler(defaultWorkerCount(), defaultQueueSize, runner.runJob)
+	runner.checkDevice = runner.deviceConnected
+	runner.workCtx, runner.cancelWork = context.WithCancel(context.Background())
+
 	// Set up queue depth tracking functions in transformer
+	// Active includes files still waiting in the scheduler queue
 	transformer.queueDepth = func() (int64, int64) {
 		runner.countMu.Lock()
 		defer runner.countMu.Unlock()
-		return runner.activeCount, runner.totalCount
+		return runner.activeCount + runner.queuedCount, runner.totalCount
 	}
 	transformer.incrementTotal = func() {
 		runner.countMu.Lock()
@@ -119,14 +175,86 @@ func NewBackupRunner(backupDir string, iosBackupPath string, verbose bool, trans
 	return runner, nil
 }
 
+// SetProcessRunner replaces how ios_backup is found and run (e.g. with a FakeRunner in tests)
+// The transformer's converters are configured separately with BackupTransformer.SetProcessRunner
+func (br *BackupRunner) SetProcessRunner(procs ProcessRunner) {
+	br.procs = procs
+}
+
 // SetLogFile sets an optional log file for capturing output
 func (br *BackupRunner) SetLogFile(logFile *os.File) {
 	br.logFile = logFile
 }
 
-// processFile processes a saved file reported by ios_backup
+// SetReport records the result of every processed file in a report
+func (br *BackupRunner) SetReport(report *RunReport) {
+	br.report = report
+}
+
+// SetManifestUpdate sets whether converted files get their Manifest.db size, digest and mtime rewritten
+// once ios_backup has written the manifest (enabled by default)
+func (br *BackupRunner) SetManifestUpdate(enabled bool) {
+	br.fixManifest = enabled
+}
+
+// SetConcurrency sets the number of transformation workers and the queue size
+// Must be called before any files are reported
+func (br *BackupRunner) SetConcurrency(workers int, queueSize int) {
+	br.scheduler.Close()
+	br.scheduler = NewWorkScheduler(workers, queueSize, br.runJob)
+}
+
+// SetConsoleOutput sets where forwarded ios_backup stdout lines are written
+func (br *BackupRunner) SetConsoleOutput(w io.Writer) {
+	br.consoleOut = w
+}
+
+// SetDevice selects the device passed to ios_backup with -u (and -n for network devices)
+func (br *BackupRunner) SetDevice(udid string, network bool) {
+	br.udid = udid
+	br.network = network
+}
+
+// SetPassword sets the encrypted backup password for ios_backup
+func (br *BackupRunner) SetPassword(password string) {
+	br.password = password
+}
+
+// SetDrainTimeout sets how long Stop waits for queued files before abandoning them (0 waits indefinitely)
+func (br *BackupRunner) SetDrainTimeout(timeout time.Duration) {
+	br.drainTimeout = timeout
+}
+
+// SetRetryPolicy sets when a failed ios_backup run is restarted
+func (br *BackupRunner) SetRetryPolicy(policy RetryPolicy) {
+	br.retry = policy
+}
+
+// SetWatchdog sets how long ios_backup may stay silent before the device is checked
+// and before ios_backup is terminated (0 disables either)
+func (br *BackupRunner) SetWatchdog(idleTimeout time.Duration, idleRestart time.Duration) {
+	br.idleTimeout = idleTimeout
+	br.idleRestart = idleRestart
+}
+
+// Progress returns the progress model built from ios_backup output
+func (br *BackupRunner) Progress() *ProgressTracker {
+	return br.progress
+}
+
+// WorkContext returns the context conversions run under; it is cancelled when Stop abandons work
+func (br *BackupRunner) WorkContext() context.Context {
+	return br.workCtx
+}
+
+// SetDomains sets the ios_backup --domain filters (empty backs up the whole device)
+func (br *BackupRunner) SetDomains(domains []string) {
+	br.domains = domains
+}
+
+// processFile processes a saved file reported by ios_backup and returns the transformation result
 // This function includes panic recovery to prevent crashes from malformed files
-func (br *BackupRunner) processFile(filePath string, domain string) {
+func (br *BackupRunner) processFile(filePath string, domain string) (result TransformResult) {
 	// Recover from any panics to prevent crash
 	defer func() {
 		if r := recover(); r != nil {
@@ -134,14 +262,19 @@ func (br *BackupRunner) processFile(filePath string, domain string) {
 		}
 	}()
 
+	// Encrypted files can only be decrypted with keys from Manifest.db, which is written at the end
+	if br.encrypted.Load() {
+		return result
+	}
+
 	// Skip if file no longer exists
 	stat, err := os.Stat(filePath)
 	if os.IsNotExist(err) {
-		return
+		return result
 	}
 	if err != nil {
 		errorLog.Printf("Error stating file %s: %v", filePath, err)
-		return
+		return result
 	}
 
 	// Extract file extension from domain (which contains original filename)
@@ -152,7 +285,8 @@ func (br *BackupRunner) processFile(filePath string, domain string) {
 	timing := &FileTiming{
 		CreatedTime:     stat.ModTime(),
 		DiscoveredTime:  time.Now(),
-		DiscoveryMethod: "ios_backup",
+		DiscoveryMethod: br.discovery,
+		Domain:          domain,
 	}
 
 	// Increment active count when starting to process
@@ -161,12 +295,13 @@ func (br *BackupRunner) processFile(filePath string, domain string) {
 	br.countMu.Unlock()
 
 	// Process the file with the extension from the domain
-	br.transformer.ProcessFileByExtension(filePath, fileExt, timing)
+	result = br.transformer.ProcessFileByExtension(br.workCtx, filePath, fileExt, timing)
+	br.report.Record(filePath, domain, result)
 
 	// Decrement active count when done
 	br.countMu.Lock()
 	br.activeCount--
-	wasLastJob := br.activeCount == 0
+	wasLastJob := br.activeCount == 0 && br.queuedCount == 0
 	totalProcessed := br.totalCount
 	br.countMu.Unlock()
 
@@ -174,6 +309,107 @@ func (br *BackupRunner) processFile(filePath string, domain string) {
 	if wasLastJob && totalProcessed > 0 {
 		infoLog.Printf("All jobs completed. Total files processed: %d", totalProcessed)
 	}
+	return result
+}
+
+// savedFile tracks a file handed to the worker pool so repeated FILE_SAVED lines don't convert it twice
+type savedFile struct {
+	domain    string    // ios_backup domain the file was reported with
+	pending   bool      // Queued or being processed
+	started   bool      // A worker has picked the file up
+	size      int64     // Size once processed
+	modTime   time.Time // Modification time once processed
+	converted bool      // Processing left a converted file, whose Manifest.db metadata must be rewritten
+}
+
+// claimFile reports whether a saved file needs processing and marks it pending if so
+// A restarted ios_backup reports files again; they are only reprocessed if ios_backup rewrote them
+func (br *BackupRunner) claimFile(filePath string, domain string) bool {
+	br.savedMu.Lock()
+	defer br.savedMu.Unlock()
+
+	if state, ok := br.savedFiles[filePath]; ok {
+		if state.pending {
+			return false
+		}
+		stat, err := os.Stat(filePath)
+		if err != nil || (stat.Size() == state.size && stat.ModTime().Equal(state.modTime)) {
+			return false
+		}
+	}
+	br.savedFiles[filePath] = &savedFile{domain: domain, pending: true}
+	return true
+}
+
+// startFile marks a claimed file as picked up by a worker
+func (br *BackupRunner) startFile(filePath string) {
+	br.savedMu.Lock()
+	defer br.savedMu.Unlock()
+	if state, ok := br.savedFiles[filePath]; ok {
+		state.started = true
+	}
+}
+
+// releaseFile records the state of a file once its job has finished
+func (br *BackupRunner) releaseFile(filePath string, result TransformResult) {
+	br.savedMu.Lock()
+	defer br.savedMu.Unlock()
+
+	state := &savedFile{converted: result.Outcome == OutcomeConverted || result.Outcome == OutcomeAlreadyDone}
+	if previous, ok := br.savedFiles[filePath]; ok {
+		state.domain = previous.domain
+	}
+	if stat, err := os.Stat(filePath); err == nil {
+		state.size = stat.Size()
+		state.modTime = stat.ModTime()
+	}
+	br.savedFiles[filePath] = state
+}
+
+// enqueueFile hands a saved file to the worker pool
+// Blocks while the queue is full so the output readers slow down instead of piling up work
+func (br *BackupRunner) enqueueFile(filePath string, domain string) {
+	eventLog.Emit(Event{Type: EventFileSaved, Path: filePath, Domain: domain})
+	backupMetrics.FileSaved(domain)
+	if !br.claimFile(filePath, domain) {
+		if br.verbose {
+			infoLog.Printf("DEBUG: Skipping %s: already processed", filepath.Base(filePath))
+		}
+		return
+	}
+	br.progress.FileReceived()
+	br.submitFile(filePath, domain)
+}
+
+// submitFile queues a claimed file for a worker
+func (br *BackupRunner) submitFile(filePath string, domain string) {
+	br.processingWg.Add(1)
+	br.countMu.Lock()
+	br.queuedCount++
+	br.countMu.Unlock()
+
+	// While the queue is full nothing reads ios_backup's output, so its silence is not a stall
+	br.activity.pause()
+	defer br.activity.resume(time.Now())
+	br.scheduler.Submit(fileJob{filePath: filePath, domain: domain})
+}
+
+// runJob processes a queued file on a worker
+func (br *BackupRunner) runJob(job fileJob) {
+	defer br.processingWg.Done()
+
+	br.countMu.Lock()
+	br.queuedCount--
+	br.countMu.Unlock()
+
+	// After an abandoned shutdown the remaining queue is left for the next run
+	if br.aborted.Load() {
+		return
+	}
+
+	br.startFile(job.filePath)
+	result := br.processFile(job.filePath, job.domain)
+	br.releaseFile(job.filePath, result)
 }
 
 // parseSavedFileLine parses a FILE_SAVED line from ios_backup stderr
@@ -223,6 +459,12 @@ func (br *BackupRunner) parseSavedFileLine(line string) (string, string) {
 
 	// Verify file exists
 	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+		// When replaying a finished backup the Snapshot contents have been moved into the backup root
+		if snapshotless := withoutSnapshotDir(fullPath); snapshotless != fullPath {
+			if _, err := os.Stat(snapshotless); err == nil {
+				return snapshotless, domain
+			}
+		}
 		if br.verbose {
 			errorLog.Printf("DEBUG: File does not exist: %s", fullPath)
 		}
@@ -232,71 +474,159 @@ func (br *BackupRunner) parseSavedFileLine(line string) (string, string) {
 	return fullPath, domain
 }
 
+// withoutSnapshotDir removes the Snapshot directory from a backup file path
+// e.g. <udid>/Snapshot/ab/abcd... -> <udid>/ab/abcd...
+func withoutSnapshotDir(filePath string) string {
+	dir, name := filepath.Split(filePath)
+	hashDir := filepath.Base(dir)
+	snapshotDir := filepath.Dir(filepath.Clean(dir))
+	if filepath.Base(snapshotDir) != "Snapshot" {
+		return filePath
+	}
+	return filepath.Join(filepath.Dir(snapshotDir), hashDir, name)
+}
+
 // Run executes ios_backup and processes files as they're reported
+// Failures the retry policy accepts restart ios_backup against the same backup directory
 func (br *BackupRunner) Run() error {
+	start := time.Now()
+	br.resumeUnfinished()
+	var err error
+	for attempt := 1; ; attempt++ {
+		br.attempt = attempt
+		err = br.run()
+		if !br.retry.ShouldRetry(err, attempt) || !br.waitForRetry(err, attempt) {
+			break
+		}
+	}
+	// Encrypted backups are converted after the run, which updates the manifest itself
+	if err == nil && br.fixManifest && !br.encrypted.Load() {
+		err = br.updateManifestMetadata()
+	}
+	br.emitRunCompleted(start, err)
+	return err
+}
+
+// waitForRetry waits out the backoff after a failed attempt
+// Returns false if the runner was stopped in the meantime
+func (br *BackupRunner) waitForRetry(err error, attempt int) bool {
+	delay := br.retry.Delay(attempt)
+	errorLog.Printf("Backup attempt %d failed: %v", attempt, err)
+	infoLog.Printf("Restarting ios_backup in %s (retry %d of %d)", delay, attempt, br.retry.Retries)
+	eventLog.Emit(Event{
+		Type:      EventBackupRetry,
+		BackupDir: br.backupDir,
+		Attempt:   attempt + 1,
+		RetryInMs: millis(delay),
+		Error:     err.Error(),
+		ErrorKind: string(backupErrorKind(err)),
+	})
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-br.stopChan:
+		return false
+	case <-br.workCtx.Done():
+		return false
+	}
+}
+
+// emitRunCompleted emits the run_completed event
+func (br *BackupRunner) emitRunCompleted(start time.Time, err error) {
+	br.countMu.Lock()
+	total := br.totalCount
+	br.countMu.Unlock()
+
+	success := err == nil
+	event := Event{
+		Type:           EventRunCompleted,
+		BackupDir:      br.backupDir,
+		Replay:         br.discovery == "replay",
+		Success:        &success,
+		FilesProcessed: &total,
+		DurationMs:     millis(time.Since(start)),
+	}
+	if err != nil {
+		event.Error = err.Error()
+		event.ErrorKind = string(backupErrorKind(err))
+		event.Remediation = errorRemediation(err)
+	}
+	eventLog.Emit(event)
+}
+
+// commandArgs builds the ios_backup arguments for a backup into backupParent
+func (br *BackupRunner) commandArgs(backupParent string) []string {
+	var args []string
+	if br.udid != "" {
+		args = append(args, "-u", br.udid)
+	}
+	if br.network {
+		args = append(args, "-n")
+	}
+	for _, domain := range br.domains {
+		args = append(args, "--domain", domain)
+	}
+	return append(args, "backup", backupParent)
+}
+
+// run starts ios_backup and waits for it and all file processing to finish
+func (br *BackupRunner) run() error {
 	// Find ios_backup executable
-	iosBackupPath, found := findExecutable(br.iosBackup)
+	iosBackupPath, found := br.procs.LookPath(br.iosBackup)
 	if !found {
 		return fmt.Errorf("ios_backup not found: %s", br.iosBackup)
 	}
 
+	// Failures seen by an earlier attempt don't apply to this one
+	br.failureMu.Lock()
+	br.failure = nil
+	br.failureMu.Unlock()
+
 	// Get parent directory of backup (ios_backup expects parent dir as backup destination)
 	backupParent := filepath.Dir(br.backupDir)
 	
-	// Create context with timeout for the command (24 hours max)
+	// Create context with timeout for the command (24 hours by default)
 	// This prevents indefinite hangs if ios_backup has issues
-	ctx, cancel := context.WithTimeout(context.Background(), 24*time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), br.runTimeout)
 	defer cancel()
 
-	// Build command arguments with domain filters
-	args := []string{
-		"--domain", "*SMS*",
-		"--domain", "*sms*",
-		"--domain", "*AddressBook*",
-		"--domain", "*WhatsApp*",
-		"--domain", "*whatsapp*",
-		"--domain", "*ChatStorage.sqlite*",
-		"--domain", "*Message/Media/*", // WhatsApp media
-		"backup",
-		backupParent,
-	}
-
-	// Start ios_backup with domain filters
-	cmd := exec.CommandContext(ctx, iosBackupPath, args...)
+	// Start ios_backup with device selection and domain filters
+	spec := ProcessSpec{Path: iosBackupPath, Args: br.commandArgs(backupParent)}
+	if br.password != "" {
+		spec.Env = passwordEnviron(br.password)
+	}
+	proc, err := br.procs.Start(ctx, spec)
+	if err != nil {
+		return fmt.Errorf("failed to start ios_backup: %v", err)
+	}
 	br.cmdMu.Lock()
-	br.cmd = cmd
+	br.proc = proc
 	br.ctxCancel = cancel
 	br.cmdMu.Unlock()
 	defer func() {
 		br.cmdMu.Lock()
-		br.cmd = nil
+		br.proc = nil
 		br.ctxCancel = nil
 		br.cmdMu.Unlock()
 	}()
-	
-	// Set up stdout and stderr pipes
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return fmt.Errorf("failed to create stdout pipe: %v", err)
-	}
-	
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return fmt.Errorf("failed to create stderr pipe: %v", err)
-	}
-
-	// Start the command
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start ios_backup: %v", err)
-	}
+	stdout, stderr := proc.Stdout(), proc.Stderr()
 
 	infoLog.Printf("Started ios_backup backup to: %s", br.backupDir)
+	eventLog.Emit(Event{Type: EventBackupStarted, BackupDir: br.backupDir, Domains: br.domains, Attempt: br.attempt})
+
+	// Watch for ios_backup going silent
+	br.activity.touch("", time.Now())
+	watchDone := make(chan struct{})
+	go br.watch(watchDone, cancel)
 
 	// Process stdout (forward to console and parse for FILE_SAVED lines)
 	stdoutErrChan := make(chan error, 1)
 	br.wg.Add(1)
 	go func() {
-		stdoutErrChan <- br.processOutput(stdout, os.Stdout)
+		stdoutErrChan <- br.processOutput(stdout, br.consoleOut)
 	}()
 
 	// Process stderr (forward to console and parse for FILE_SAVED lines)
@@ -306,11 +636,13 @@ func (br *BackupRunner) Run() error {
 		stderrErrChan <- br.processStderr(stderr)
 	}()
 
-	// Wait for command to complete
-	err = cmd.Wait()
-	
-	// Wait for output processors to finish
+	// Wait for output processors to drain the pipes before Wait closes them
+	// (calling Wait first can drop the last lines of a short-lived process)
 	br.wg.Wait()
+
+	// Wait for command to complete
+	err = proc.Wait()
+	close(watchDone)
 	
 	// Check for output processing errors
 	var outputErrors []string
@@ -327,9 +659,15 @@ func (br *BackupRunner) Run() error {
 	// Report any command errors
 	if err != nil {
 		if ctx.Err() == context.DeadlineExceeded {
-			return fmt.Errorf("ios_backup timed out after 24 hours")
+			return fmt.Errorf("ios_backup timed out after %s", br.runTimeout)
+		}
+		if failure := br.outputFailure(err); failure != nil {
+			return failure
 		}
-		return fmt.Errorf("ios_backup failed: %v", err)
+		if kind := classifyExitStatus(err); kind != "" {
+			return &BackupError{Kind: kind, Err: err}
+		}
+		return &BackupError{Kind: ErrKindBackupFailed, Err: err}
 	}
 
 	// Report output processing errors as warnings (non-fatal)
@@ -341,6 +679,156 @@ func (br *BackupRunner) Run() error {
 	return nil
 }
 
+// Replay processes a recorded ios_backup stdout/stderr capture (e.g. a -log-file) instead of running ios_backup
+// FILE_SAVED lines go through the same parsing and transformation path as a live backup
+func (br *BackupRunner) Replay(logPath string) error {
+	start := time.Now()
+	br.discovery = "replay"
+	br.resumeUnfinished()
+	err := br.replay(logPath)
+	br.emitRunCompleted(start, err)
+	return err
+}
+
+// replay feeds each FILE_SAVED line of a recorded log to the worker pool
+func (br *BackupRunner) replay(logPath string) error {
+	file, err := os.Open(logPath)
+	if err != nil {
+		return fmt.Errorf("failed to open replay log: %v", err)
+	}
+	defer file.Close()
+
+	infoLog.Printf("Replaying ios_backup output from: %s", logPath)
+	eventLog.Emit(Event{Type: EventBackupStarted, BackupDir: br.backupDir, Replay: true})
+
+	reader := bufio.NewReader(file)
+	filesSeen := 0
+	lineCount := 0
+	var readErr error
+
+	for {
+		line, err, _ := readOutputLine(reader)
+		if err != nil && err != io.EOF {
+			readErr = fmt.Errorf("read error on replay log: %v", err)
+			break
+		}
+		if len(line) > 0 {
+			lineCount++
+			if filePath, domain := br.parseSavedFileLine(line); filePath != "" {
+				filesSeen++
+				if br.verbose {
+					infoLog.Printf("DEBUG: Replaying FILE_SAVED #%d: %s (domain: %s)", filesSeen, filepath.Base(filePath), domain)
+				}
+				br.enqueueFile(filePath, domain)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+
+	// Wait for all file processing to complete
+	br.processingWg.Wait()
+
+	if readErr != nil {
+		return readErr
+	}
+
+	infoLog.Printf("Replay completed: %d lines read, %d saved files processed", lineCount, filesSeen)
+	return nil
+}
+
+// redact hides the backup password in output that is printed or logged
+func (br *BackupRunner) redact(line string) string {
+	if br.password == "" {
+		return line
+	}
+	return strings.ReplaceAll(line, br.password, "********")
+}
+
+// noteEncryption detects that ios_backup is saving an encrypted backup
+func (br *BackupRunner) noteEncryption(line string) {
+	if !strings.HasPrefix(strings.TrimSpace(line), "Backup will be encrypted.") || br.encrypted.Swap(true) {
+		return
+	}
+	if br.password != "" {
+		infoLog.Printf("Backup is encrypted: media will be transformed after the backup completes")
+	} else {
+		infoLog.Printf("Backup is encrypted: media can't be transformed during the backup without the backup password")
+	}
+}
+
+// Encrypted reports whether ios_backup said the backup is encrypted
+func (br *BackupRunner) Encrypted() bool {
+	return br.encrypted.Load()
+}
+
+// recordFailure remembers the first ios_backup output line that identifies a known failure
+func (br *BackupRunner) recordFailure(line string) {
+	kind := classifyOutputLine(line)
+	if kind == "" {
+		return
+	}
+	br.failureMu.Lock()
+	defer br.failureMu.Unlock()
+	if br.failure == nil {
+		br.failure = &BackupError{Kind: kind, Detail: strings.TrimSpace(br.redact(line))}
+	}
+}
+
+// setFailure replaces the recorded failure, e.g. when the watchdog terminates ios_backup
+func (br *BackupRunner) setFailure(failure *BackupError) {
+	br.failureMu.Lock()
+	defer br.failureMu.Unlock()
+	br.failure = failure
+}
+
+// outputFailure returns a typed error for a failure seen in the output, or nil if none was seen
+func (br *BackupRunner) outputFailure(err error) error {
+	br.failureMu.Lock()
+	defer br.failureMu.Unlock()
+	if br.failure == nil {
+		return nil
+	}
+	return &BackupError{Kind: br.failure.Kind, Detail: br.failure.Detail, Err: err}
+}
+
+// emitLineEvent emits events and counts metrics for FILE_FILTERED lines
+func (br *BackupRunner) emitLineEvent(line string) {
+	if (eventLog == nil && backupMetrics == nil) || !strings.HasPrefix(line, "FILE_FILTERED:") {
+		return
+	}
+
+	event := Event{Type: EventFileFiltered}
+	if m := linePathRe.FindStringSubmatch(line); m != nil {
+		event.Path = m[1]
+	}
+	if m := lineDomainRe.FindStringSubmatch(line); m != nil {
+		event.Domain = m[1]
+	}
+	backupMetrics.FileFiltered(event.Domain)
+	eventLog.Emit(event)
+}
+
+// handleProgressLine feeds a progress line into the progress model and reports it
+// e.g. "[=====     ]  45% (1.2 MB/2.7 MB)" or "Receiving files"
+// Returns false for lines that are not progress output
+func (br *BackupRunner) handleProgressLine(line string) bool {
+	now := time.Now()
+	snapshot, ok := br.progress.Update(line, now)
+	if !ok {
+		return false
+	}
+
+	eventLog.Emit(snapshot.event(line))
+
+	// In verbose mode the raw progress bars are forwarded instead
+	if !br.verbose && br.progress.ShouldReport(now) {
+		infoLog.Printf("Progress: %s", snapshot)
+	}
+	return true
+}
+
 // processOutput processes output from stdout, parsing for FILE_SAVED lines and forwarding to console
 func (br *BackupRunner) processOutput(pipe io.Reader, output io.Writer) error {
 	defer br.wg.Done()
@@ -376,12 +864,22 @@ func (br *BackupRunner) processOutput(pipe io.Reader, output io.Writer) error {
 
 // processOutputLine handles a single line of stdout output
 func (br *BackupRunner) processOutputLine(line string, filesSeen *int, lineCount int, output io.Writer, truncated bool) {
+	br.activity.touch(line, time.Now())
+
+	// Only the printed copy is redacted; parsing uses the original line
+	display := br.redact(line)
+
 	// Log unusually long lines to diagnose buffer issues
 	if len(line) > 1024 || truncated {
 		errorLog.Printf("WARNING: Unusually long line in stdout (%d bytes, line #%d). First 100 chars: %s...", 
-			len(line), lineCount, truncateString(line, 100))
+			len(line), lineCount, truncateString(display, 100))
 	}
 	
+	br.recordFailure(line)
+	br.noteEncryption(line)
+	br.emitLineEvent(line)
+	isProgress := br.handleProgressLine(line)
+
 	// Parse for FILE_SAVED lines (they might be in stdout)
 	filePath, domain := br.parseSavedFileLine(line)
 	if filePath != "" {
@@ -389,17 +887,8 @@ func (br *BackupRunner) processOutputLine(line string, filesSeen *int, lineCount
 		if br.verbose {
 			infoLog.Printf("DEBUG: Detected FILE_SAVED #%d in stdout: %s (domain: %s)", *filesSeen, filepath.Base(filePath), domain)
 		}
-		// Process the file asynchronously with panic recovery
-		br.processingWg.Add(1)
-		go func(fp string, dom string) {
-			defer func() {
-				if r := recover(); r != nil {
-					errorLog.Printf("PANIC recovered in file processing goroutine: %v", r)
-				}
-				br.processingWg.Done()
-			}()
-			br.processFile(fp, dom)
-		}(filePath, domain)
+		// Queue the file for the worker pool
+		br.enqueueFile(filePath, domain)
 	}
 	
 	// Filter out noise unless verbose mode is enabled
@@ -410,15 +899,17 @@ func (br *BackupRunner) processOutputLine(line string, filesSeen *int, lineCount
 			shouldOutput = false
 		} else if strings.HasPrefix(line, "FILE_FILTERED:") || strings.HasPrefix(line, "Receiving domain:") {
 			shouldOutput = false
+		} else if isProgress {
+			shouldOutput = false // Replaced by progress summaries
 		}
 	}
 	
 	if shouldOutput {
-		fmt.Fprintln(output, line)
-		// Also write to log file if specified
-		if br.logFile != nil {
-			fmt.Fprintln(br.logFile, line)
-		}
+		fmt.Fprintln(output, display)
+	}
+	// Also write to log file if specified (raw progress lines are kept for later analysis)
+	if br.logFile != nil && (shouldOutput || isProgress) {
+		fmt.Fprintln(br.logFile, display)
 	}
 }
 
@@ -461,12 +952,22 @@ func (br *BackupRunner) processStderr(pipe io.Reader) error {
 
 // processStderrLine handles a single line of stderr output
 func (br *BackupRunner) processStderrLine(line string, filesSeen *int, lineCount int, truncated bool) {
+	br.activity.touch(line, time.Now())
+
+	// Only the printed copy is redacted; parsing uses the original line
+	display := br.redact(line)
+
 	// Log unusually long lines to diagnose buffer issues
 	if len(line) > 1024 || truncated {
 		errorLog.Printf("WARNING: Unusually long line in stderr (%d bytes, line #%d). First 100 chars: %s...", 
-			len(line), lineCount, truncateString(line, 100))
+			len(line), lineCount, truncateString(display, 100))
 	}
 	
+	br.recordFailure(line)
+	br.noteEncryption(line)
+	br.emitLineEvent(line)
+	isProgress := br.handleProgressLine(line)
+
 	// Filter out noise unless verbose mode is enabled
 	shouldForward := true
 	if !br.verbose {
@@ -475,16 +976,18 @@ func (br *BackupRunner) processStderrLine(line string, filesSeen *int, lineCount
 			shouldForward = false
 		} else if strings.HasPrefix(line, "FILE_FILTERED:") || strings.HasPrefix(line, "Receiving domain:") {
 			shouldForward = false // Skip these lines in non-verbose mode
+		} else if isProgress {
+			shouldForward = false // Replaced by progress summaries
 		}
 	}
 	
 	// Forward the line to stderr (if not filtered)
 	if shouldForward {
-		fmt.Fprintln(os.Stderr, line)
-		// Also write to log file if specified
-		if br.logFile != nil {
-			fmt.Fprintln(br.logFile, line)
-		}
+		fmt.Fprintln(os.Stderr, display)
+	}
+	// Also write to log file if specified (raw progress lines are kept for later analysis)
+	if br.logFile != nil && (shouldForward || isProgress) {
+		fmt.Fprintln(br.logFile, display)
 	}
 	
 	// Parse for FILE_SAVED lines
@@ -494,52 +997,86 @@ func (br *BackupRunner) processStderrLine(line string, filesSeen *int, lineCount
 		if br.verbose {
 			infoLog.Printf("DEBUG: Detected FILE_SAVED #%d: %s (domain: %s)", *filesSeen, filepath.Base(filePath), domain)
 		}
-		// Process the file asynchronously with panic recovery
-		br.processingWg.Add(1)
-		go func(fp string, dom string) {
-			defer func() {
-				if r := recover(); r != nil {
-					errorLog.Printf("PANIC recovered in file processing goroutine: %v", r)
-				}
-				br.processingWg.Done()
-			}()
-			br.processFile(fp, dom)
-		}(filePath, domain)
+		// Queue the file for the worker pool
+		br.enqueueFile(filePath, domain)
 	}
 }
 
-// Stop stops the backup runner gracefully
-func (br *BackupRunner) Stop() {
+// Stop stops the backup runner gracefully, waiting up to the drain timeout for queued files
+// Returns false if the deadline passed or ForceStop was called; running conversions are then killed
+// and the unfinished files are written to the unfinished-work report for the next run
+func (br *BackupRunner) Stop() bool {
 	infoLog.Println("Shutdown requested, waiting for all files to be processed...")
 	br.stopOnce.Do(func() {
+		close(br.stopChan)
+
 		br.cmdMu.Lock()
 		cancel := br.ctxCancel
-		cmd := br.cmd
+		proc := br.proc
 		br.cmdMu.Unlock()
 
 		if cancel != nil {
 			cancel()
 		}
 
-		if cmd != nil && cmd.Process != nil {
-			_ = cmd.Process.Signal(os.Interrupt)
-			go func(p *os.Process) {
+		if proc != nil {
+			_ = proc.Signal(os.Interrupt)
+			go func(p Process) {
 				time.Sleep(5 * time.Second)
 				_ = p.Kill()
-			}(cmd.Process)
+			}(proc)
 		}
 	})
 
-	// Wait for output processors to finish
-	br.wg.Wait()
-	
-	// Wait for all file processing to complete
-	br.processingWg.Wait()
+	// Wait for output processors and file processing, up to the drain deadline
+	if reason := br.waitForDrain(); reason != "" {
+		// Wedged workers would block Close, so the scheduler is left to the exiting process
+		br.abandonWork(reason)
+		return false
+	}
+	br.scheduler.Close()
 	
 	br.countMu.Lock()
 	finalTotal := br.totalCount
 	br.countMu.Unlock()
 	
 	infoLog.Printf("Backup runner stopped. Total files processed: %d", finalTotal)
+	return true
+}
+
+// ForceStop makes a pending or running Stop give up on unfinished work immediately
+// e.g. on a second Ctrl+C
+func (br *BackupRunner) ForceStop() {
+	br.forceOnce.Do(func() {
+		close(br.forceChan)
+	})
+}
+
+// waitForDrain waits for the output readers and all file jobs
+// Returns "" once everything finished, or why it stopped waiting
+func (br *BackupRunner) waitForDrain() string {
+	drained := make(chan struct{})
+	go func() {
+		br.wg.Wait()
+		br.processingWg.Wait()
+		close(drained)
+	}()
+
+	var deadline <-chan time.Time
+	if br.drainTimeout > 0 {
+		timer := time.NewTimer(br.drainTimeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	select {
+	case <-drained:
+		return ""
+	case <-deadline:
+		errorLog.Printf("Files still processing after %s", br.drainTimeout)
+		return unfinishedReasonDeadline
+	case <-br.forceChan:
+		return unfinishedReasonForced
+	}
 }
 
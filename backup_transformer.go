@@ -2,11 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"image"
 	"image/gif"
 	"image/jpeg"
 	"image/png"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -108,6 +110,13 @@ func findExecutable(name string) (string, bool) {
 	return "", false
 }
 
+// defaultTransformTimeout is how long a single file's conversion may take (-transform-timeout)
+const defaultTransformTimeout = 5 * time.Minute
+
+// errFileTimeout is the cancellation cause when a file's conversion runs out of -transform-timeout
+// It tells a conversion that failed from one cut short by shutdown, which is left for the next run
+var errFileTimeout = errors.New("transform timeout exceeded")
+
 // Image resize constants (matching Dart PdfConfig)
 const (
 	standardImageWidth = 500 // Standard image width for PDF
@@ -115,9 +124,9 @@ const (
 )
 
 // resizeImage resizes an image to the specified width while maintaining aspect ratio
-// Uses a simple nearest-neighbor algorithm - good enough for our use case
+// Resamples with the given filter (see resample.go) so small text stays legible
 // Includes memory allocation guards to prevent OOM crashes
-func resizeImage(img image.Image, maxWidth int) (image.Image, error) {
+func resizeImage(ctx context.Context, img image.Image, maxWidth int, filter ResampleFilter) (image.Image, error) {
 	bounds := img.Bounds()
 	width := bounds.Dx()
 	height := bounds.Dy()
@@ -164,24 +173,43 @@ func resizeImage(img image.Image, maxWidth int) (image.Image, error) {
 		return nil, fmt.Errorf("failed to allocate memory for resized image")
 	}
 
-	// Simple nearest-neighbor resize
-	for y := 0; y < newHeight; y++ {
-		for x := 0; x < maxWidth; x++ {
-			srcX := bounds.Min.X + (x*width)/maxWidth
-			srcY := bounds.Min.Y + (y*height)/newHeight
-			resized.Set(x, y, img.At(srcX, srcY))
-		}
+	if err := resample(ctx, resized, img, filter); err != nil {
+		return nil, err
 	}
 
 	return resized, nil
 }
 
-// FileTiming holds timing information for file processing
+// contextReader fails reads once its context is done, so long image decodes stop promptly
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, fmt.Errorf("read cancelled: %v", err)
+	}
+	return cr.r.Read(p)
+}
+
+// acquire takes a slot of a concurrency semaphore, giving up when the context is done
+func acquire(ctx context.Context, semaphore chan struct{}) error {
+	select {
+	case semaphore <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("cancelled while waiting for a conversion slot: %v", ctx.Err())
+	}
+}
+
+// FileTiming holds timing and discovery information for file processing
 type FileTiming struct {
 	CreatedTime             time.Time // Time the file was created (ModTime)
 	DiscoveredTime          time.Time // Time the file was discovered
 	TransformationStartTime time.Time // Time transformation started
 	DiscoveryMethod         string    // How the file was discovered: "notify" or "scan"
+	Domain                  string    // ios_backup "<domain>-<relativePath>" key of the file (for provenance records)
 }
 
 // BackupTransformer handles conversion of backup files
@@ -194,6 +222,19 @@ type BackupTransformer struct {
 	// Queue depth tracking (set by BackupRunner)
 	queueDepth     func() (active int64, total int64) // Function to get current queue depth
 	incrementTotal func()                             // Function to increment total count when transformation starts
+
+	journal     *TransformJournal // Optional record of completed conversions (nil disables resume)
+	provenance  *ProvenanceStore  // Optional record of what converted files originally were
+	quarantine  *Quarantine       // Optional keeper of originals (nil overwrites them)
+	dryRun      bool              // Plan conversions without writing anything
+	planMu      sync.Mutex
+	planned     DryRunTotals   // Files a dry run would convert
+	fileTimeout time.Duration  // Longest a single file's conversion may take (0 disables)
+	resample    ResampleFilter // Filter for downscaling images to standardImageWidth
+	procs       ProcessRunner  // Runs heic-converter, ffmpeg and ffprobe
+
+	pendingMu sync.Mutex
+	pending   map[string]*pendingConversion // Conversions in flight by file path, recorded just before the original is replaced
 }
 
 // NewBackupTransformer creates a new backup transformer
@@ -208,7 +249,19 @@ func NewBackupTransformer() *BackupTransformer {
 		videoSemaphore: videoSem,
 		heicSemaphore:  heicSem,
 		gifSemaphore:   gifSem,
+		fileTimeout:    defaultTransformTimeout,
+		resample:       resampleFilters[defaultResampleFilter],
+		pending:        make(map[string]*pendingConversion),
+		procs:          ExecRunner{},
+	}
+}
+
+// QueueDepth returns the active and total file counts, or zeros when nothing tracks them
+func (bt *BackupTransformer) QueueDepth() (int64, int64) {
+	if bt.queueDepth == nil {
+		return 0, 0
 	}
+	return bt.queueDepth()
 }
 
 // getQueueDepthString returns a formatted queue depth string like "(2 of 99)"
@@ -223,38 +276,349 @@ func (bt *BackupTransformer) getQueueDepthString() string {
 	return fmt.Sprintf("(%d of %d) ", active, total)
 }
 
-// ProcessFileByExtension processes a file based on its file extension from ios_backup domain
-// This is faster and more reliable than content detection since ios_backup provides the original filename
-func (bt *BackupTransformer) ProcessFileByExtension(filePath string, fileExt string, timing *FileTiming) {
-	// Set transformation start time
-	if timing != nil {
-		timing.TransformationStartTime = time.Now()
-	}
+// TransformOutcome describes what happened to a file passed to ProcessFileByExtension
+type TransformOutcome string
+
+const (
+	OutcomeConverted   TransformOutcome = "converted"    // File was replaced with a JPEG
+	OutcomeSkipped     TransformOutcome = "skipped"      // Not a media file, or conversion was not possible (e.g. tool missing)
+	OutcomeFailed      TransformOutcome = "failed"       // Conversion was attempted and failed, original kept
+	OutcomeAlreadyDone TransformOutcome = "already-done" // Journal shows the file was converted by an earlier run
+	OutcomePlanned     TransformOutcome = "planned"      // Dry run: file would be converted (SizeAfter is an estimate)
+)
+
+// TransformResult is the result of processing a single file
+type TransformResult struct {
+	Action     string // Conversion applied, e.g. "heic->jpeg" (empty for non-media files)
+	Outcome    TransformOutcome
+	Err        error         // Failure or skip reason
+	SizeBefore int64         // File size before the transformation
+	SizeAfter  int64         // File size afterwards (same as SizeBefore unless converted)
+	Duration   time.Duration // Transformation start -> done
+	Width      int           // Current dimensions (dry runs only, 0 when unknown)
+	Height     int
+}
+
+// pendingConversion is what the journal and provenance records need to know about a conversion in flight
+type pendingConversion struct {
+	fileExt    string
+	sourceHash string
+	action     string
+	original   ProvenanceRecord
+	outputHash string // Set once the output is recorded, before it replaces the original
+}
+
+// skipError marks a conversion that was deliberately not attempted
+type skipError struct {
+	reason string
+}
+
+func (e *skipError) Error() string {
+	return e.reason
+}
 
-	// Process based on file extension (case-insensitive)
+// converterFor returns the action name and converter for a file extension
+// Returns a nil converter for files that are not transformed
+func (bt *BackupTransformer) converterFor(fileExt string) (string, func(context.Context, string) error) {
 	switch fileExt {
 	case ".heic":
-		bt.convertHeicToJpeg(filePath)
+		return "heic->jpeg", bt.convertHeicToJpeg
 	case ".gif":
-		bt.convertGifToJpeg(filePath)
+		return "gif->jpeg", bt.convertGifToJpeg
 	case ".jpg", ".jpeg":
-		bt.resizeJpeg(filePath)
+		return "jpeg-resize", bt.resizeJpeg
 	case ".png":
-		bt.convertPngToJpeg(filePath)
+		return "png->jpeg", bt.convertPngToJpeg
 	case ".webp":
-		bt.convertWebpToJpeg(filePath)
+		return "webp->jpeg", bt.convertWebpToJpeg
 	case ".mp4", ".mov", ".avi", ".mpg", ".mpeg", ".wmv", ".flv", ".webm", ".mkv", ".m4v",
 		".3gp", ".3gpp", ".ts", ".m2ts", ".mts", ".vob", ".asf", ".ogv", ".ogg", ".f4v":
-		bt.convertVideoToJpeg(filePath)
+		return "video->jpeg", bt.convertVideoToJpeg
 	default:
 		// Not a media file, skip (ios_backup already filtered what we need)
+		return "", nil
+	}
+}
+
+// SetProvenance records the original of every converted file in a provenance database
+func (bt *BackupTransformer) SetProvenance(provenance *ProvenanceStore) {
+	bt.provenance = provenance
+}
+
+// SetQuarantine moves the originals of converted files into quarantine instead of overwriting them
+func (bt *BackupTransformer) SetQuarantine(quarantine *Quarantine) {
+	bt.quarantine = quarantine
+}
+
+// SetJournal enables the transformation journal so completed work is skipped on rerun
+func (bt *BackupTransformer) SetJournal(journal *TransformJournal) {
+	bt.journal = journal
+}
+
+// SetProcessRunner replaces how external tools are found and run (e.g. with a FakeRunner in tests)
+func (bt *BackupTransformer) SetProcessRunner(procs ProcessRunner) {
+	bt.procs = procs
+}
+
+// SetFileTimeout sets how long a single file's conversion may take, including waiting for a conversion slot (0 disables)
+func (bt *BackupTransformer) SetFileTimeout(timeout time.Duration) {
+	bt.fileTimeout = timeout
+}
+
+// SetResampleFilter sets the filter used to downscale images (-resample)
+func (bt *BackupTransformer) SetResampleFilter(filter ResampleFilter) {
+	bt.resample = filter
+}
+
+// ProcessFileByExtension processes a file based on its file extension from ios_backup domain
+// This is faster and more reliable than content detection since ios_backup provides the original filename
+// Cancelling ctx kills running external tools and stops Go decoding; temp files are removed either way
+func (bt *BackupTransformer) ProcessFileByExtension(ctx context.Context, filePath string, fileExt string, timing *FileTiming) TransformResult {
+	// Set transformation start time
+	start := time.Now()
+	if timing != nil {
+		timing.TransformationStartTime = start
+	}
+
+	sizeBefore := fileSize(filePath)
+
+	// Process based on file extension (case-insensitive), or the content when the extension is missing or wrong
+	fileExt = bt.resolveExtension(filePath, strings.ToLower(fileExt))
+	action, convert := bt.converterFor(fileExt)
+	if convert == nil {
+		return TransformResult{Outcome: OutcomeSkipped, SizeBefore: sizeBefore, SizeAfter: sizeBefore}
+	}
+
+	startEvent := Event{Type: EventTransformStarted, Path: filePath, Action: action}
+	if timing != nil && !timing.DiscoveredTime.IsZero() {
+		startEvent.QueueWaitMs = millis(start.Sub(timing.DiscoveredTime))
+	}
+	eventLog.Emit(startEvent)
+	if bt.fileTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, bt.fileTimeout, errFileTimeout)
+		defer cancel()
+	}
+	var domain string
+	if timing != nil {
+		domain = timing.Domain
+	}
+	var result TransformResult
+	if bt.dryRun {
+		result = bt.planTransform(ctx, filePath, action)
+	} else {
+		result = bt.processWithConverter(ctx, filePath, fileExt, domain, action, convert)
+	}
+	result.Duration = time.Since(start)
+	result.SizeBefore = sizeBefore
+	switch result.Outcome {
+	case OutcomeConverted:
+		result.SizeAfter = fileSize(filePath)
+	case OutcomePlanned:
+		// Estimated by planTransform
+	default:
+		result.SizeAfter = sizeBefore
+	}
+
+	endEvent := Event{
+		Type:       EventTransformFinished,
+		Path:       filePath,
+		Action:     action,
+		Outcome:    string(result.Outcome),
+		DurationMs: millis(result.Duration),
+	}
+	if result.Outcome == OutcomeFailed {
+		endEvent.Type = EventTransformFailed
+	}
+	if result.Err != nil {
+		endEvent.Error = result.Err.Error()
+	}
+	eventLog.Emit(endEvent)
+	backupMetrics.TransformFinished(result, timing)
+
+	return result
+}
+
+// processWithConverter runs a converter, consulting and updating the journal and provenance records when enabled
+func (bt *BackupTransformer) processWithConverter(ctx context.Context, filePath string, fileExt string, domain string, action string, convert func(context.Context, string) error) TransformResult {
+	// Hash the original for the journal and the provenance record
+	var sourceHash string
+	if bt.journal != nil || bt.provenance != nil {
+		hash, err := hashFile(filePath)
+		if err != nil {
+			errorLog.Printf("Error hashing %s: %v", filepath.Base(filePath), err)
+		} else {
+			sourceHash = hash
+		}
+	}
+
+	// Consult the journal so files converted by an interrupted run are not converted twice
+	if bt.journal != nil && sourceHash != "" {
+		entry, err := bt.journal.Lookup(filePath)
+		if err != nil {
+			errorLog.Printf("Error reading journal for %s: %v", filepath.Base(filePath), err)
+		} else if entry != nil && entry.Outcome == OutcomeConverted && entry.OutputHash == sourceHash {
+			infoLog.Printf("Skipping %s: already converted by a previous run", filepath.Base(filePath))
+			return TransformResult{Action: action, Outcome: OutcomeAlreadyDone}
+		}
+	}
+
+	// The original is described before the converter overwrites it
+	var original ProvenanceRecord
+	if bt.provenance != nil && sourceHash != "" {
+		original.Domain, original.RelativePath = splitDomainKey(domain)
+		original.OriginalSize = fileSize(filePath)
+		original.OriginalHash = sourceHash
+		original.DetectedFormat = detectFormat(filePath, fileExt)
+	}
+
+	// The records are written by replaceOriginal before the output is moved over the original,
+	// so a run killed right after the rename still finds the file converted
+	pending := &pendingConversion{fileExt: fileExt, sourceHash: sourceHash, action: action, original: original}
+	if sourceHash != "" {
+		bt.pendingMu.Lock()
+		bt.pending[filePath] = pending
+		bt.pendingMu.Unlock()
+		defer func() {
+			bt.pendingMu.Lock()
+			delete(bt.pending, filePath)
+			bt.pendingMu.Unlock()
+		}()
+	}
+
+	result := TransformResult{Action: action, Outcome: OutcomeConverted}
+	if err := convert(ctx, filePath); err != nil {
+		result.Err = err
+		if _, skipped := err.(*skipError); skipped {
+			result.Outcome = OutcomeSkipped
+		} else {
+			result.Outcome = OutcomeFailed
+		}
+	}
+
+	// A cancelled conversion says nothing about the file, so it is left for the next run to retry;
+	// one that ran out of time failed like any other
+	if result.Outcome == OutcomeFailed && ctx.Err() != nil {
+		if context.Cause(ctx) != errFileTimeout {
+			infoLog.Printf("Conversion of %s cancelled: %v", filepath.Base(filePath), ctx.Err())
+			return result
+		}
+		result.Err = fmt.Errorf("timed out after %s: %v", bt.fileTimeout, result.Err)
+	}
+	if sourceHash == "" || (result.Outcome == OutcomeConverted && pending.outputHash != "") {
+		return result
+	}
+
+	// Converted without replaceOriginal having recorded it (the output could not be hashed)
+	var outputHash string
+	if result.Outcome == OutcomeConverted {
+		hash, err := hashFile(filePath)
+		if err != nil {
+			errorLog.Printf("Error hashing converted file %s: %v", filepath.Base(filePath), err)
+			return result
+		}
+		outputHash = hash
+	}
+	if bt.journal != nil {
+		bt.recordJournal(filePath, fileExt, sourceHash, outputHash, result)
+	}
+	if bt.provenance != nil && result.Outcome == OutcomeConverted {
+		bt.recordProvenance(filePath, filePath, original, action, outputHash)
+	}
+
+	return result
+}
+
+// replaceOriginal moves a converter's output over the original file
+// The journal entry and provenance record are written first; if the replace fails the provenance
+// record is rolled back, and processWithConverter overwrites the journal entry with the failure
+func (bt *BackupTransformer) replaceOriginal(filePath string, outputPath string) error {
+	bt.pendingMu.Lock()
+	pending := bt.pending[filePath]
+	bt.pendingMu.Unlock()
+	if pending == nil {
+		return bt.quarantine.Replace(filePath, outputPath)
+	}
+
+	outputHash, err := hashFile(outputPath)
+	if err != nil {
+		errorLog.Printf("Error hashing converted file %s: %v", filepath.Base(filePath), err)
+		return bt.quarantine.Replace(filePath, outputPath)
+	}
+
+	var previous *ProvenanceRecord
+	if bt.provenance != nil {
+		if previous, err = bt.provenance.Lookup(filepath.Base(filePath)); err != nil {
+			errorLog.Printf("Error reading provenance for %s: %v", filepath.Base(filePath), err)
+		}
+	}
+	if bt.journal != nil {
+		bt.recordJournal(filePath, pending.fileExt, pending.sourceHash, outputHash, TransformResult{Outcome: OutcomeConverted})
+	}
+	if bt.provenance != nil {
+		bt.recordProvenance(filePath, outputPath, pending.original, pending.action, outputHash)
+	}
+
+	if err := bt.quarantine.Replace(filePath, outputPath); err != nil {
+		if bt.provenance != nil {
+			bt.rollbackProvenance(filepath.Base(filePath), previous)
+		}
+		return err
+	}
+	pending.outputHash = outputHash
+	return nil
+}
+
+// recordJournal stores the outcome of a conversion in the journal
+func (bt *BackupTransformer) recordJournal(filePath string, fileExt string, sourceHash string, outputHash string, result TransformResult) {
+	entry := JournalEntry{
+		Path:        filePath,
+		OriginalExt: fileExt,
+		SourceHash:  sourceHash,
+		OutputHash:  outputHash,
+		Outcome:     result.Outcome,
+	}
+	if result.Err != nil {
+		entry.Error = result.Err.Error()
+	}
+	if err := bt.journal.Record(entry); err != nil {
+		errorLog.Printf("Error writing journal entry for %s: %v", filepath.Base(filePath), err)
+	}
+}
+
+// recordProvenance stores where a converted file came from in the provenance database
+// outputPath is the converted file, which may not have replaced filePath yet
+func (bt *BackupTransformer) recordProvenance(filePath string, outputPath string, original ProvenanceRecord, action string, outputHash string) {
+	rec := original
+	rec.FileID = filepath.Base(filePath)
+	rec.Transform = action
+	rec.OutputWidth, rec.OutputHeight = imageDimensions(outputPath)
+	rec.OutputSize = fileSize(outputPath)
+	rec.OutputHash = outputHash
+	if err := bt.provenance.Record(rec); err != nil {
+		errorLog.Printf("Error writing provenance for %s: %v", filepath.Base(filePath), err)
+	}
+}
+
+// rollbackProvenance puts back the provenance record a failed replace had overwritten
+func (bt *BackupTransformer) rollbackProvenance(fileID string, previous *ProvenanceRecord) {
+	var err error
+	if previous != nil {
+		err = bt.provenance.Record(*previous)
+	} else {
+		err = bt.provenance.Delete(fileID)
+	}
+	if err != nil {
+		errorLog.Printf("Error rolling back provenance for %s: %v", fileID, err)
 	}
 }
 
 // convertHeicToJpeg converts a HEIC file to JPEG, overwriting the original
 // Uses heic-converter external tool
-func (bt *BackupTransformer) convertHeicToJpeg(heicFilePath string) {
-	bt.heicSemaphore <- struct{}{}        // Acquire semaphore
+func (bt *BackupTransformer) convertHeicToJpeg(ctx context.Context, heicFilePath string) error {
+	if err := acquire(ctx, bt.heicSemaphore); err != nil {
+		return err
+	}
 	defer func() { <-bt.heicSemaphore }() // Release semaphore
 
 	// Increment total count when transformation actually starts
@@ -268,17 +632,17 @@ func (bt *BackupTransformer) convertHeicToJpeg(heicFilePath string) {
 	transformStart := time.Now()
 
 	// Try to find heic-converter in project root, then PATH
-	heicConverter, found := findExecutable("heic-converter")
+	heicConverter, found := bt.procs.LookPath("heic-converter")
 	if !found {
 		infoLog.Printf("HEIC converter not found in project root or PATH, skipping conversion for %s", filepath.Base(heicFilePath))
-		return
+		return &skipError{reason: "heic-converter not found"}
 	}
 
 	// Create temporary output file
 	tempJpeg, err := os.CreateTemp(filepath.Dir(heicFilePath), "heic_conv_*.jpg")
 	if err != nil {
 		errorLog.Printf("Error creating temp file for HEIC conversion: %v", err)
-		return
+		return fmt.Errorf("failed to create temp file: %v", err)
 	}
 	tempJpegPath := tempJpeg.Name()
 	if err := tempJpeg.Close(); err != nil {
@@ -296,32 +660,33 @@ func (bt *BackupTransformer) convertHeicToJpeg(heicFilePath string) {
 	}()
 
 	// Run conversion with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	runCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
-	cmd := exec.CommandContext(ctx, heicConverter, heicFilePath, tempJpegPath)
-	output, err := cmd.CombinedOutput()
+	output, err := runTool(runCtx, bt.procs, heicConverter, heicFilePath, tempJpegPath)
 	if err != nil {
 		// Provide better error context
-		if ctx.Err() == context.DeadlineExceeded {
+		if ctx.Err() != nil {
+			return fmt.Errorf("heic-converter cancelled: %v", ctx.Err())
+		} else if runCtx.Err() == context.DeadlineExceeded {
 			errorLog.Printf("HEIC conversion timed out after 30 seconds for %s", heicFilePath)
-		} else if exitErr, ok := err.(*exec.ExitError); ok {
+		} else if exitCode, ok := processExitCode(err); ok {
 			errorLog.Printf("HEIC converter crashed or failed for %s: exit code %d, output: %s",
-				heicFilePath, exitErr.ExitCode(), string(output))
+				heicFilePath, exitCode, string(output))
 		} else {
 			errorLog.Printf("HEIC conversion failed for %s: %v, output: %s", heicFilePath, err, string(output))
 		}
-		return
+		return fmt.Errorf("heic-converter failed: %v", err)
 	}
 
 	// Check if temp file was created successfully
 	if _, err := os.Stat(tempJpegPath); os.IsNotExist(err) {
 		errorLog.Printf("HEIC conversion failed: output file not created")
-		return
+		return fmt.Errorf("heic-converter did not create an output file")
 	}
 
 	// Resize the converted JPEG image
-	resizedJpegPath, err := resizeJpegImage(tempJpegPath, standardImageWidth)
+	resizedJpegPath, err := resizeJpegImage(ctx, tempJpegPath, standardImageWidth, bt.resample)
 	if err != nil {
 		errorLog.Printf("Error resizing HEIC-converted JPEG: %v, using original size", err)
 		// Continue with original size if resize fails
@@ -334,9 +699,9 @@ func (bt *BackupTransformer) convertHeicToJpeg(heicFilePath string) {
 	}
 
 	// Replace original file with resized JPEG
-	if err := os.Rename(resizedJpegPath, heicFilePath); err != nil {
+	if err := bt.replaceOriginal(heicFilePath, resizedJpegPath); err != nil {
 		errorLog.Printf("Error replacing original HEIC file: %v", err)
-		return
+		return fmt.Errorf("failed to replace original file: %v", err)
 	}
 
 	// Don't cleanup temp file since we successfully renamed it
@@ -344,12 +709,15 @@ func (bt *BackupTransformer) convertHeicToJpeg(heicFilePath string) {
 
 	duration := time.Since(transformStart)
 	infoLog.Printf("%sSuccessfully converted and resized HEIC to JPEG: %s [duration: %v]", bt.getQueueDepthString(), filepath.Base(heicFilePath), duration)
+	return nil
 }
 
 // convertGifToJpeg converts a GIF file to JPEG, overwriting the original
 // Uses Go's standard library for pure Go implementation
-func (bt *BackupTransformer) convertGifToJpeg(gifFilePath string) {
-	bt.gifSemaphore <- struct{}{}        // Acquire semaphore
+func (bt *BackupTransformer) convertGifToJpeg(ctx context.Context, gifFilePath string) error {
+	if err := acquire(ctx, bt.gifSemaphore); err != nil {
+		return err
+	}
 	defer func() { <-bt.gifSemaphore }() // Release semaphore
 
 	// Increment total count when transformation actually starts
@@ -366,29 +734,29 @@ func (bt *BackupTransformer) convertGifToJpeg(gifFilePath string) {
 	file, err := os.Open(gifFilePath)
 	if err != nil {
 		errorLog.Printf("Error opening GIF file: %v", err)
-		return
+		return fmt.Errorf("failed to open GIF: %v", err)
 	}
 	defer file.Close()
 
 	// Decode GIF
-	gifImg, err := gif.Decode(file)
+	gifImg, err := gif.Decode(&contextReader{ctx: ctx, r: file})
 	if err != nil {
 		errorLog.Printf("Error decoding GIF: %v", err)
-		return
+		return fmt.Errorf("failed to decode GIF: %v", err)
 	}
 
 	// Resize GIF image before encoding as JPEG
-	resizedImg, err := resizeImage(gifImg, standardImageWidth)
+	resizedImg, err := resizeImage(ctx, gifImg, standardImageWidth, bt.resample)
 	if err != nil {
 		errorLog.Printf("Error resizing GIF image: %v", err)
-		return
+		return fmt.Errorf("failed to resize GIF: %v", err)
 	}
 
 	// Create temporary output file
 	tempJpeg, err := os.CreateTemp(filepath.Dir(gifFilePath), "gif_conv_*.jpg")
 	if err != nil {
 		errorLog.Printf("Error creating temp file for GIF conversion: %v", err)
-		return
+		return fmt.Errorf("failed to create temp file: %v", err)
 	}
 	tempJpegPath := tempJpeg.Name()
 
@@ -406,7 +774,7 @@ func (bt *BackupTransformer) convertGifToJpeg(gifFilePath string) {
 	// Encode resized image as JPEG with quality 85 (matching Dart implementation)
 	if err := jpeg.Encode(tempJpeg, resizedImg, &jpeg.Options{Quality: jpegQuality}); err != nil {
 		errorLog.Printf("Error encoding JPEG: %v", err)
-		return
+		return fmt.Errorf("failed to encode JPEG: %v", err)
 	}
 
 	// Close the file before rename
@@ -415,9 +783,9 @@ func (bt *BackupTransformer) convertGifToJpeg(gifFilePath string) {
 	}
 
 	// Replace original file with converted JPEG
-	if err := os.Rename(tempJpegPath, gifFilePath); err != nil {
+	if err := bt.replaceOriginal(gifFilePath, tempJpegPath); err != nil {
 		errorLog.Printf("Error replacing original GIF file: %v", err)
-		return
+		return fmt.Errorf("failed to replace original file: %v", err)
 	}
 
 	// Don't cleanup temp file since we successfully renamed it
@@ -425,10 +793,11 @@ func (bt *BackupTransformer) convertGifToJpeg(gifFilePath string) {
 
 	duration := time.Since(transformStart)
 	infoLog.Printf("%sSuccessfully converted and resized GIF to JPEG: %s [duration: %v]", bt.getQueueDepthString(), filepath.Base(gifFilePath), duration)
+	return nil
 }
 
 // resizeJpeg resizes a JPEG file to the standard width, overwriting the original
-func (bt *BackupTransformer) resizeJpeg(jpegFilePath string) {
+func (bt *BackupTransformer) resizeJpeg(ctx context.Context, jpegFilePath string) error {
 	// Increment total count when transformation actually starts
 	if bt.incrementTotal != nil {
 		bt.incrementTotal()
@@ -440,27 +809,28 @@ func (bt *BackupTransformer) resizeJpeg(jpegFilePath string) {
 	transformStart := time.Now()
 
 	// Resize the JPEG image
-	resizedJpegPath, err := resizeJpegImage(jpegFilePath, standardImageWidth)
+	resizedJpegPath, err := resizeJpegImage(ctx, jpegFilePath, standardImageWidth, bt.resample)
 	if err != nil {
 		errorLog.Printf("Error resizing JPEG: %v, keeping original size", err)
-		return
+		return fmt.Errorf("failed to resize JPEG: %v", err)
 	}
 
 	// Replace original file with resized JPEG
-	if err := os.Rename(resizedJpegPath, jpegFilePath); err != nil {
+	if err := bt.replaceOriginal(jpegFilePath, resizedJpegPath); err != nil {
 		errorLog.Printf("Error replacing original JPEG file: %v", err)
 		if rmErr := os.Remove(resizedJpegPath); rmErr != nil && !os.IsNotExist(rmErr) {
 			errorLog.Printf("Warning: failed to cleanup resized file: %v", rmErr)
 		}
-		return
+		return fmt.Errorf("failed to replace original file: %v", err)
 	}
 
 	duration := time.Since(transformStart)
 	infoLog.Printf("%sSuccessfully resized JPEG: %s [duration: %v]", bt.getQueueDepthString(), filepath.Base(jpegFilePath), duration)
+	return nil
 }
 
 // convertPngToJpeg converts a PNG file to JPEG and resizes it, overwriting the original
-func (bt *BackupTransformer) convertPngToJpeg(pngFilePath string) {
+func (bt *BackupTransformer) convertPngToJpeg(ctx context.Context, pngFilePath string) error {
 	// Increment total count when transformation actually starts
 	if bt.incrementTotal != nil {
 		bt.incrementTotal()
@@ -475,29 +845,29 @@ func (bt *BackupTransformer) convertPngToJpeg(pngFilePath string) {
 	file, err := os.Open(pngFilePath)
 	if err != nil {
 		errorLog.Printf("Error opening PNG file: %v", err)
-		return
+		return fmt.Errorf("failed to open PNG: %v", err)
 	}
 	defer file.Close()
 
 	// Decode PNG
-	pngImg, err := png.Decode(file)
+	pngImg, err := png.Decode(&contextReader{ctx: ctx, r: file})
 	if err != nil {
 		errorLog.Printf("Error decoding PNG: %v", err)
-		return
+		return fmt.Errorf("failed to decode PNG: %v", err)
 	}
 
 	// Resize PNG image before encoding as JPEG
-	resizedImg, err := resizeImage(pngImg, standardImageWidth)
+	resizedImg, err := resizeImage(ctx, pngImg, standardImageWidth, bt.resample)
 	if err != nil {
 		errorLog.Printf("Error resizing PNG image: %v", err)
-		return
+		return fmt.Errorf("failed to resize PNG: %v", err)
 	}
 
 	// Create temporary output file
 	tempJpeg, err := os.CreateTemp(filepath.Dir(pngFilePath), "png_conv_*.jpg")
 	if err != nil {
 		errorLog.Printf("Error creating temp file for PNG conversion: %v", err)
-		return
+		return fmt.Errorf("failed to create temp file: %v", err)
 	}
 	tempJpegPath := tempJpeg.Name()
 
@@ -515,7 +885,7 @@ func (bt *BackupTransformer) convertPngToJpeg(pngFilePath string) {
 	// Encode resized image as JPEG with quality 85 (matching Dart implementation)
 	if err := jpeg.Encode(tempJpeg, resizedImg, &jpeg.Options{Quality: jpegQuality}); err != nil {
 		errorLog.Printf("Error encoding JPEG: %v", err)
-		return
+		return fmt.Errorf("failed to encode JPEG: %v", err)
 	}
 
 	// Close the file before rename
@@ -524,9 +894,9 @@ func (bt *BackupTransformer) convertPngToJpeg(pngFilePath string) {
 	}
 
 	// Replace original file with converted JPEG
-	if err := os.Rename(tempJpegPath, pngFilePath); err != nil {
+	if err := bt.replaceOriginal(pngFilePath, tempJpegPath); err != nil {
 		errorLog.Printf("Error replacing original PNG file: %v", err)
-		return
+		return fmt.Errorf("failed to replace original file: %v", err)
 	}
 
 	// Don't cleanup temp file since we successfully renamed it
@@ -534,10 +904,11 @@ func (bt *BackupTransformer) convertPngToJpeg(pngFilePath string) {
 
 	duration := time.Since(transformStart)
 	infoLog.Printf("%sSuccessfully converted and resized PNG to JPEG: %s [duration: %v]", bt.getQueueDepthString(), filepath.Base(pngFilePath), duration)
+	return nil
 }
 
 // convertWebpToJpeg converts a WEBP file to JPEG and resizes it, overwriting the original
-func (bt *BackupTransformer) convertWebpToJpeg(webpFilePath string) {
+func (bt *BackupTransformer) convertWebpToJpeg(ctx context.Context, webpFilePath string) error {
 	// Increment total count when transformation actually starts
 	if bt.incrementTotal != nil {
 		bt.incrementTotal()
@@ -552,29 +923,29 @@ func (bt *BackupTransformer) convertWebpToJpeg(webpFilePath string) {
 	file, err := os.Open(webpFilePath)
 	if err != nil {
 		errorLog.Printf("Error opening WEBP file: %v", err)
-		return
+		return fmt.Errorf("failed to open WEBP: %v", err)
 	}
 	defer file.Close()
 
 	// Decode WEBP
-	webpImg, err := webp.Decode(file)
+	webpImg, err := webp.Decode(&contextReader{ctx: ctx, r: file})
 	if err != nil {
 		errorLog.Printf("Error decoding WEBP: %v", err)
-		return
+		return fmt.Errorf("failed to decode WEBP: %v", err)
 	}
 
 	// Resize WEBP image before encoding as JPEG
-	resizedImg, err := resizeImage(webpImg, standardImageWidth)
+	resizedImg, err := resizeImage(ctx, webpImg, standardImageWidth, bt.resample)
 	if err != nil {
 		errorLog.Printf("Error resizing WEBP image: %v", err)
-		return
+		return fmt.Errorf("failed to resize WEBP: %v", err)
 	}
 
 	// Create temporary output file
 	tempJpeg, err := os.CreateTemp(filepath.Dir(webpFilePath), "webp_conv_*.jpg")
 	if err != nil {
 		errorLog.Printf("Error creating temp file for WEBP conversion: %v", err)
-		return
+		return fmt.Errorf("failed to create temp file: %v", err)
 	}
 	tempJpegPath := tempJpeg.Name()
 
@@ -592,7 +963,7 @@ func (bt *BackupTransformer) convertWebpToJpeg(webpFilePath string) {
 	// Encode resized image as JPEG with quality 85 (matching Dart implementation)
 	if err := jpeg.Encode(tempJpeg, resizedImg, &jpeg.Options{Quality: jpegQuality}); err != nil {
 		errorLog.Printf("Error encoding JPEG: %v", err)
-		return
+		return fmt.Errorf("failed to encode JPEG: %v", err)
 	}
 
 	// Close the file before rename
@@ -601,9 +972,9 @@ func (bt *BackupTransformer) convertWebpToJpeg(webpFilePath string) {
 	}
 
 	// Replace original file with converted JPEG
-	if err := os.Rename(tempJpegPath, webpFilePath); err != nil {
+	if err := bt.replaceOriginal(webpFilePath, tempJpegPath); err != nil {
 		errorLog.Printf("Error replacing original WEBP file: %v", err)
-		return
+		return fmt.Errorf("failed to replace original file: %v", err)
 	}
 
 	// Don't cleanup temp file since we successfully renamed it
@@ -611,12 +982,15 @@ func (bt *BackupTransformer) convertWebpToJpeg(webpFilePath string) {
 
 	duration := time.Since(transformStart)
 	infoLog.Printf("%sSuccessfully converted and resized WEBP to JPEG: %s [duration: %v]", bt.getQueueDepthString(), filepath.Base(webpFilePath), duration)
+	return nil
 }
 
 // convertVideoToJpeg generates a JPEG thumbnail from a video, overwriting the original
 // Uses ffmpeg via exec (requires ffmpeg to be available)
-func (bt *BackupTransformer) convertVideoToJpeg(videoFilePath string) {
-	bt.videoSemaphore <- struct{}{}        // Acquire semaphore
+func (bt *BackupTransformer) convertVideoToJpeg(ctx context.Context, videoFilePath string) error {
+	if err := acquire(ctx, bt.videoSemaphore); err != nil {
+		return err
+	}
 	defer func() { <-bt.videoSemaphore }() // Release semaphore
 
 	// Increment total count when transformation actually starts
@@ -630,27 +1004,30 @@ func (bt *BackupTransformer) convertVideoToJpeg(videoFilePath string) {
 	transformStart := time.Now()
 
 	// Check if the file has a video stream before attempting thumbnail generation
-	if !bt.hasVideoStream(videoFilePath) {
+	if !bt.hasVideoStream(ctx, videoFilePath) {
+		if ctx.Err() != nil {
+			return fmt.Errorf("ffprobe cancelled: %v", ctx.Err())
+		}
 		infoLog.Printf("%sSkipping video thumbnail generation - file has no video stream (audio-only): %s", bt.getQueueDepthString(), filepath.Base(videoFilePath))
-		return
+		return &skipError{reason: "file has no video stream (audio-only)"}
 	}
 
 	// Determine seek position (similar to Dart implementation)
-	seekSeconds := bt.determineThumbnailSeekSeconds(videoFilePath)
+	seekSeconds := bt.determineThumbnailSeekSeconds(ctx, videoFilePath)
 	seekTimestamp := formatSeekTimestamp(seekSeconds)
 
 	// Try to find ffmpeg in project root, then PATH
-	ffmpegPath, found := findExecutable("ffmpeg")
+	ffmpegPath, found := bt.procs.LookPath("ffmpeg")
 	if !found {
 		infoLog.Printf("ffmpeg not found in project root or PATH, skipping video conversion for %s", filepath.Base(videoFilePath))
-		return
+		return &skipError{reason: "ffmpeg not found"}
 	}
 
 	// Create temporary output file
 	tempJpeg, err := os.CreateTemp(filepath.Dir(videoFilePath), "video_thumb_*.jpg")
 	if err != nil {
 		errorLog.Printf("Error creating temp file for video conversion: %v", err)
-		return
+		return fmt.Errorf("failed to create temp file: %v", err)
 	}
 	tempJpegPath := tempJpeg.Name()
 	if err := tempJpeg.Close(); err != nil {
@@ -668,7 +1045,7 @@ func (bt *BackupTransformer) convertVideoToJpeg(videoFilePath string) {
 	}()
 
 	// Run ffmpeg to extract thumbnail with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	runCtx, cancel := context.WithTimeout(ctx, 60*time.Second)
 	defer cancel()
 
 	args := []string{
@@ -681,29 +1058,30 @@ func (bt *BackupTransformer) convertVideoToJpeg(videoFilePath string) {
 		tempJpegPath,
 	}
 
-	cmd := exec.CommandContext(ctx, ffmpegPath, args...)
-	output, err := cmd.CombinedOutput()
+	output, err := runTool(runCtx, bt.procs, ffmpegPath, args...)
 	if err != nil {
 		// Provide better error context
-		if ctx.Err() == context.DeadlineExceeded {
+		if ctx.Err() != nil {
+			return fmt.Errorf("ffmpeg cancelled: %v", ctx.Err())
+		} else if runCtx.Err() == context.DeadlineExceeded {
 			errorLog.Printf("Video thumbnail generation timed out after 60 seconds for %s", videoFilePath)
-		} else if exitErr, ok := err.(*exec.ExitError); ok {
+		} else if exitCode, ok := processExitCode(err); ok {
 			errorLog.Printf("ffmpeg crashed or failed for %s: exit code %d, output: %s",
-				videoFilePath, exitErr.ExitCode(), string(output))
+				videoFilePath, exitCode, string(output))
 		} else {
 			errorLog.Printf("Video thumbnail generation failed for %s: %v, output: %s", videoFilePath, err, string(output))
 		}
-		return
+		return fmt.Errorf("ffmpeg failed: %v", err)
 	}
 
 	// Check if temp file was created successfully
 	if _, err := os.Stat(tempJpegPath); os.IsNotExist(err) {
 		errorLog.Printf("Video conversion failed: output file not created")
-		return
+		return fmt.Errorf("ffmpeg did not create an output file")
 	}
 
 	// Resize the video thumbnail
-	resizedJpegPath, err := resizeJpegImage(tempJpegPath, standardImageWidth)
+	resizedJpegPath, err := resizeJpegImage(ctx, tempJpegPath, standardImageWidth, bt.resample)
 	if err != nil {
 		errorLog.Printf("Error resizing video thumbnail: %v, using original size", err)
 		// Continue with original size if resize fails
@@ -716,9 +1094,9 @@ func (bt *BackupTransformer) convertVideoToJpeg(videoFilePath string) {
 	}
 
 	// Replace original file with resized JPEG thumbnail
-	if err := os.Rename(resizedJpegPath, videoFilePath); err != nil {
+	if err := bt.replaceOriginal(videoFilePath, resizedJpegPath); err != nil {
 		errorLog.Printf("Error replacing original video file: %v", err)
-		return
+		return fmt.Errorf("failed to replace original file: %v", err)
 	}
 
 	// Don't cleanup temp file since we successfully renamed it
@@ -726,6 +1104,7 @@ func (bt *BackupTransformer) convertVideoToJpeg(videoFilePath string) {
 
 	duration := time.Since(transformStart)
 	infoLog.Printf("%sSuccessfully converted and resized video to JPEG thumbnail: %s [duration: %v]", bt.getQueueDepthString(), filepath.Base(videoFilePath), duration)
+	return nil
 }
 
 const (
@@ -734,8 +1113,8 @@ const (
 )
 
 // determineThumbnailSeekSeconds determines the seek position for video thumbnail extraction
-func (bt *BackupTransformer) determineThumbnailSeekSeconds(videoFilePath string) float64 {
-	duration := bt.probeVideoDuration(videoFilePath)
+func (bt *BackupTransformer) determineThumbnailSeekSeconds(ctx context.Context, videoFilePath string) float64 {
+	duration := bt.probeVideoDuration(ctx, videoFilePath)
 	if duration == nil {
 		infoLog.Printf("Video duration unavailable, defaulting to first frame for thumbnail")
 		return fallbackThumbnailSeekSeconds
@@ -756,15 +1135,15 @@ func (bt *BackupTransformer) determineThumbnailSeekSeconds(videoFilePath string)
 
 // hasVideoStream checks if a video file contains a video stream
 // Uses ffprobe via exec (requires ffprobe to be available)
-func (bt *BackupTransformer) hasVideoStream(videoFilePath string) bool {
+func (bt *BackupTransformer) hasVideoStream(ctx context.Context, videoFilePath string) bool {
 	// Try to find ffprobe in project root, then PATH
-	ffprobePath, found := findExecutable("ffprobe")
+	ffprobePath, found := bt.procs.LookPath("ffprobe")
 	if !found {
 		// If ffprobe is not available, assume video stream exists and let ffmpeg handle the error
 		return true
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	runCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
 	args := []string{
@@ -775,8 +1154,7 @@ func (bt *BackupTransformer) hasVideoStream(videoFilePath string) bool {
 		videoFilePath,
 	}
 
-	cmd := exec.CommandContext(ctx, ffprobePath, args...)
-	output, err := cmd.CombinedOutput()
+	output, err := runTool(runCtx, bt.procs, ffprobePath, args...)
 	if err != nil {
 		// If ffprobe fails, assume no video stream
 		return false
@@ -789,15 +1167,15 @@ func (bt *BackupTransformer) hasVideoStream(videoFilePath string) bool {
 
 // probeVideoDuration probes the video file to get its duration
 // Uses ffprobe via exec (requires ffprobe to be available)
-func (bt *BackupTransformer) probeVideoDuration(videoFilePath string) *float64 {
+func (bt *BackupTransformer) probeVideoDuration(ctx context.Context, videoFilePath string) *float64 {
 	// Try to find ffprobe in project root, then PATH
-	ffprobePath, found := findExecutable("ffprobe")
+	ffprobePath, found := bt.procs.LookPath("ffprobe")
 	if !found {
 		infoLog.Printf("ffprobe not found in project root or PATH, cannot determine video duration")
 		return nil
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	runCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
 	args := []string{
@@ -807,8 +1185,7 @@ func (bt *BackupTransformer) probeVideoDuration(videoFilePath string) *float64 {
 		videoFilePath,
 	}
 
-	cmd := exec.CommandContext(ctx, ffprobePath, args...)
-	output, err := cmd.CombinedOutput()
+	output, err := runTool(runCtx, bt.procs, ffprobePath, args...)
 	if err != nil {
 		errorLog.Printf("ffprobe duration lookup failed: %v", err)
 		return nil
@@ -849,8 +1226,8 @@ func formatSeekTimestamp(seconds float64) string {
 	return formatted
 }
 
-// resizeJpegImage reads a JPEG file, resizes it, and writes a new resized JPEG file
-func resizeJpegImage(jpegPath string, maxWidth int) (string, error) {
+// resizeJpegImage reads a JPEG file, resizes it with the given filter, and writes a new resized JPEG file
+func resizeJpegImage(ctx context.Context, jpegPath string, maxWidth int, filter ResampleFilter) (string, error) {
 	// Open and decode JPEG
 	file, err := os.Open(jpegPath)
 	if err != nil {
@@ -862,13 +1239,13 @@ func resizeJpegImage(jpegPath string, maxWidth int) (string, error) {
 		}
 	}()
 
-	jpegImg, err := jpeg.Decode(file)
+	jpegImg, err := jpeg.Decode(&contextReader{ctx: ctx, r: file})
 	if err != nil {
 		return "", fmt.Errorf("failed to decode JPEG: %v", err)
 	}
 
 	// Resize the image
-	resizedImg, err := resizeImage(jpegImg, maxWidth)
+	resizedImg, err := resizeImage(ctx, jpegImg, maxWidth, filter)
 	if err != nil {
 		return "", fmt.Errorf("failed to resize image: %v", err)
 	}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sniffHeaderSize is how much of a file is read to detect its type
+// 512 bytes covers the ftyp box of ISO media files with long compatible brand lists
+const sniffHeaderSize = 512
+
+// heifBrands are ftyp brands of HEIC/HEIF still images (and image sequences)
+var heifBrands = map[string]bool{
+	"heic": true, "heix": true, "heim": true, "heis": true,
+	"hevc": true, "hevx": true, "hevm": true, "hevs": true,
+	"mif1": true, "msf1": true, "heif": true,
+}
+
+// audioExtensions are audio-only formats stored in containers that also hold video (Ogg, ISO media)
+// Their headers can't tell a voice note from a movie, so sniffing must not send them to the video converter
+var audioExtensions = map[string]bool{
+	".opus": true, ".oga": true, ".spx": true,
+	".m4a": true, ".m4b": true, ".m4r": true, ".m4p": true, ".aac": true,
+}
+
+// sniffFileType detects the type of a file from its header
+// Returns the canonical extension of the type (e.g. ".heic" or ".mov"), or "" when unrecognized
+func sniffFileType(filePath string) string {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	header := make([]byte, sniffHeaderSize)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return ""
+	}
+	return sniffHeader(header[:n])
+}
+
+// sniffHeader detects a file type from the first bytes of a file (see sniffFileType)
+func sniffHeader(h []byte) string {
+	switch {
+	case bytes.HasPrefix(h, []byte{0xFF, 0xD8, 0xFF}):
+		return ".jpg"
+	case bytes.HasPrefix(h, []byte("\x89PNG\r\n\x1a\n")):
+		return ".png"
+	case bytes.HasPrefix(h, []byte("GIF87a")), bytes.HasPrefix(h, []byte("GIF89a")):
+		return ".gif"
+	case len(h) >= 12 && bytes.Equal(h[:4], []byte("RIFF")) && bytes.Equal(h[8:12], []byte("WEBP")):
+		return ".webp"
+	case len(h) >= 12 && bytes.Equal(h[:4], []byte("RIFF")) && bytes.Equal(h[8:12], []byte("AVI ")):
+		return ".avi"
+	case len(h) >= 12 && bytes.Equal(h[4:8], []byte("ftyp")):
+		return sniffFtyp(h)
+	case len(h) >= 8 && isQuickTimeAtom(string(h[4:8])):
+		// Old QuickTime movies start with their atoms instead of an ftyp box
+		return ".mov"
+	case bytes.HasPrefix(h, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		if bytes.Contains(h, []byte("webm")) {
+			return ".webm"
+		}
+		return ".mkv"
+	case bytes.HasPrefix(h, []byte{0x00, 0x00, 0x01, 0xBA}), bytes.HasPrefix(h, []byte{0x00, 0x00, 0x01, 0xB3}):
+		return ".mpg"
+	case bytes.HasPrefix(h, []byte{0x30, 0x26, 0xB2, 0x75, 0x8E, 0x66, 0xCF, 0x11}):
+		return ".wmv"
+	case bytes.HasPrefix(h, []byte("FLV\x01")):
+		return ".flv"
+	case bytes.HasPrefix(h, []byte("OggS")):
+		return ".ogg"
+	case len(h) > 376 && h[0] == 0x47 && h[188] == 0x47 && h[376] == 0x47:
+		// MPEG transport stream: a sync byte every 188-byte packet
+		return ".ts"
+	}
+	return ""
+}
+
+// sniffFtyp detects the type of an ISO base media file (HEIF, MP4, MOV, 3GP) from its ftyp brands
+func sniffFtyp(h []byte) string {
+	size := int(binary.BigEndian.Uint32(h[:4]))
+	if size < 16 || size > len(h) {
+		size = len(h)
+	}
+	brands := []string{string(h[8:12])}
+	for off := 16; off+4 <= size; off += 4 {
+		brands = append(brands, string(h[off:off+4]))
+	}
+
+	// The major brand decides, except that generic brands (e.g. mif1) defer to a more specific compatible one
+	for _, brand := range brands {
+		switch {
+		case brand == "avif" || brand == "avis":
+			return ".avif"
+		case heifBrands[brand] && brand != "mif1" && brand != "msf1":
+			return ".heic"
+		}
+	}
+	switch major := brands[0]; {
+	case heifBrands[major]:
+		return ".heic"
+	case major == "qt  ":
+		return ".mov"
+	case strings.HasPrefix(major, "3gp"), strings.HasPrefix(major, "3g2"), strings.HasPrefix(major, "3ge"), strings.HasPrefix(major, "3gg"):
+		return ".3gp"
+	case major == "M4A " || major == "M4B " || major == "M4P ":
+		return ".m4a"
+	case major == "M4V " || major == "M4VH" || major == "M4VP":
+		return ".m4v"
+	}
+	return ".mp4"
+}
+
+// isQuickTimeAtom reports whether a box type can start a QuickTime movie without an ftyp box
+func isQuickTimeAtom(kind string) bool {
+	switch kind {
+	case "moov", "mdat", "wide", "pnot":
+		return true
+	}
+	return false
+}
+
+// formatForExtension returns the format name of a canonical extension, e.g. ".jpg" -> "jpeg"
+func formatForExtension(ext string) string {
+	if ext == ".jpg" {
+		return "jpeg"
+	}
+	return strings.TrimPrefix(ext, ".")
+}
+
+// resolveExtension picks the extension that selects a file's converter
+// The extension from the domain is kept unless it is missing or unknown, or the file's content says
+// it needs a different converter (e.g. a ".jpg" attachment that is really HEIC); mismatches are logged
+// Audio-only extensions are always kept
+func (bt *BackupTransformer) resolveExtension(filePath string, fileExt string) string {
+	if audioExtensions[fileExt] {
+		return fileExt
+	}
+	sniffed := sniffFileType(filePath)
+	if sniffed == "" {
+		return fileExt
+	}
+
+	action, convert := bt.converterFor(fileExt)
+	sniffedAction, _ := bt.converterFor(sniffed)
+	switch {
+	case convert == nil:
+		if sniffedAction != "" {
+			infoLog.Printf("Detected %s content in %s (extension %q), converting by content", formatForExtension(sniffed), filepath.Base(filePath), fileExt)
+		}
+		return sniffed
+	case action != sniffedAction && sniffedAction == "":
+		infoLog.Printf("Extension %s of %s does not match its content (%s), not converting", fileExt, filepath.Base(filePath), formatForExtension(sniffed))
+		return sniffed
+	case action != sniffedAction:
+		infoLog.Printf("Extension %s of %s does not match its content (%s), converting by content", fileExt, filepath.Base(filePath), formatForExtension(sniffed))
+		return sniffed
+	}
+	return fileExt
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// ftypHeader builds the start of an ISO base media file with the given major and compatible brands
+func ftypHeader(major string, compatible ...string) []byte {
+	box := make([]byte, 16, 16+4*len(compatible))
+	binary.BigEndian.PutUint32(box, uint32(16+4*len(compatible)))
+	copy(box[4:], "ftyp")
+	copy(box[8:], major)
+	for _, brand := range compatible {
+		box = append(box, brand...)
+	}
+	return append(box, "\x00\x00\x00\x08mdat"...)
+}
+
+// writeTestHEIC writes a file that looks like a HEIC image to content detection (only the header is real)
+func writeTestHEIC(t *testing.T, path string) {
+	t.Helper()
+	data := append(ftypHeader("heic", "mif1", "heic"), bytes.Repeat([]byte{0x42}, 2048)...)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Failed to write HEIC fixture: %v", err)
+	}
+}
+
+// TestSniffHeader tests file type detection from headers
+func TestSniffHeader(t *testing.T) {
+	ts := make([]byte, 400)
+	ts[0], ts[188], ts[376] = 0x47, 0x47, 0x47
+
+	tests := []struct {
+		name   string
+		header []byte
+		want   string
+	}{
+		{"jpeg", []byte{0xFF, 0xD8, 0xFF, 0xE0, 0, 0x10, 'J', 'F', 'I', 'F'}, ".jpg"},
+		{"png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), ".png"},
+		{"gif", []byte("GIF89a\x01\x00\x01\x00"), ".gif"},
+		{"webp", []byte("RIFF\x24\x00\x00\x00WEBPVP8 "), ".webp"},
+		{"avi", []byte("RIFF\x24\x00\x00\x00AVI LIST"), ".avi"},
+		{"heic", ftypHeader("heic", "mif1", "heic"), ".heic"},
+		{"heif with generic major brand", ftypHeader("mif1", "mif1", "heic"), ".heic"},
+		{"heif sequence", ftypHeader("msf1", "msf1"), ".heic"},
+		{"avif", ftypHeader("avif", "mif1", "avif"), ".avif"},
+		{"mov", ftypHeader("qt  ", "qt  "), ".mov"},
+		{"mov without ftyp", []byte("\x00\x00\x00\x08wide\x00\x00\x00\x00mdat"), ".mov"},
+		{"mp4", ftypHeader("isom", "isom", "iso2", "avc1", "mp41"), ".mp4"},
+		{"3gp", ftypHeader("3gp4", "isom", "3gp4"), ".3gp"},
+		{"m4a", ftypHeader("M4A ", "M4A ", "mp42", "isom"), ".m4a"},
+		{"webm", []byte("\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01\x42\x82\x84webm"), ".webm"},
+		{"mkv", []byte("\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01\x42\x82\x88matroska"), ".mkv"},
+		{"mpeg", []byte{0x00, 0x00, 0x01, 0xBA, 0x44}, ".mpg"},
+		{"transport stream", ts, ".ts"},
+		{"sqlite", []byte("SQLite format 3\x00"), ""},
+		{"text", []byte("hello world"), ""},
+		{"empty", nil, ""},
+	}
+	for _, tt := range tests {
+		if got := sniffHeader(tt.header); got != tt.want {
+			t.Errorf("%s: sniffHeader = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestProcessFileByContent tests that files without a usable extension are converted by their content
+func TestProcessFileByContent(t *testing.T) {
+	dir := t.TempDir()
+	transformer := NewBackupTransformer()
+	transformer.SetProcessRunner(NewFakeRunner())
+
+	// domain=(unknown) gives no extension
+	path := filepath.Join(dir, "unknown")
+	writeTestPNG(t, path, 800, 600, color.RGBA{0, 100, 200, 255})
+	if result := transformer.ProcessFileByExtension(context.Background(), path, "", nil); result.Outcome != OutcomeConverted || result.Action != "png->jpeg" {
+		t.Errorf("Expected the PNG to be converted by content, got %+v", result)
+	}
+	if !isJPEGFile(t, path) {
+		t.Error("Expected a JPEG after conversion")
+	}
+
+	// A ".jpg" attachment that is really a PNG goes to the PNG converter instead of failing the JPEG decoder
+	path = filepath.Join(dir, "mislabeled")
+	writeTestPNG(t, path, 800, 600, color.RGBA{0, 100, 200, 255})
+	if result := transformer.ProcessFileByExtension(context.Background(), path, ".jpg", nil); result.Outcome != OutcomeConverted || result.Action != "png->jpeg" {
+		t.Errorf("Expected the mislabeled PNG to be converted as PNG, got %+v", result)
+	}
+
+	// A ".jpg" that is really HEIC needs heic-converter (missing here, so it is skipped rather than failed)
+	path = filepath.Join(dir, "heic")
+	writeTestHEIC(t, path)
+	if result := transformer.ProcessFileByExtension(context.Background(), path, ".jpg", nil); result.Outcome != OutcomeSkipped || result.Action != "heic->jpeg" {
+		t.Errorf("Expected the HEIC to go to heic-converter, got %+v", result)
+	}
+
+	// Audio in containers shared with video (a WhatsApp voice note, an M4A with a generic brand) is not a video
+	audio := map[string][]byte{
+		".opus": append([]byte("OggS\x00\x02"), bytes.Repeat([]byte{0x42}, 512)...),
+		".m4a":  append(ftypHeader("mp42", "isom", "mp42"), bytes.Repeat([]byte{0x42}, 512)...),
+	}
+	for ext, data := range audio {
+		path = filepath.Join(dir, "voice"+ext)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+		if result := transformer.ProcessFileByExtension(context.Background(), path, ext, nil); result.Outcome != OutcomeSkipped || result.Action != "" {
+			t.Errorf("Expected the %s audio to be left alone, got %+v", ext, result)
+		}
+	}
+
+	// Files the sniffer doesn't know keep their extension
+	path = filepath.Join(dir, "sms.db")
+	if err := os.WriteFile(path, []byte("SQLite format 3\x00"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if result := transformer.ProcessFileByExtension(context.Background(), path, ".db", nil); result.Outcome != OutcomeSkipped || result.Action != "" {
+		t.Errorf("Expected the database to be left alone, got %+v", result)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// deviceToolTimeout bounds each idevice_id/ideviceinfo call
+	deviceToolTimeout = 15 * time.Second
+
+	connectionUSB     = "usb"
+	connectionNetwork = "network"
+)
+
+// Device is a connected iOS device
+type Device struct {
+	UDID           string `json:"udid"`
+	Name           string `json:"name"`
+	ProductType    string `json:"model"`       // e.g. "iPhone14,5"
+	ProductVersion string `json:"ios_version"` // e.g. "17.2.1"
+	Connection     string `json:"connection"`  // "usb" or "network"
+}
+
+// DeviceTools holds the paths of the libimobiledevice tools used for discovery
+type DeviceTools struct {
+	IdeviceID   string
+	IdeviceInfo string
+}
+
+// findDeviceTools locates idevice_id and ideviceinfo (libraries folder, project root or PATH)
+func findDeviceTools() (DeviceTools, error) {
+	ideviceID, found := findExecutable("idevice_id")
+	if !found {
+		return DeviceTools{}, fmt.Errorf("idevice_id not found in libraries folder, project root or PATH")
+	}
+	ideviceInfo, found := findExecutable("ideviceinfo")
+	if !found {
+		return DeviceTools{}, fmt.Errorf("ideviceinfo not found in libraries folder, project root or PATH")
+	}
+	return DeviceTools{IdeviceID: ideviceID, IdeviceInfo: ideviceInfo}, nil
+}
+
+// runDeviceTool runs a device tool with a timeout and returns its stdout
+func runDeviceTool(path string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), deviceToolTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, path, args...)
+	output, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("%s timed out after %v", path, deviceToolTimeout)
+	}
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+			return "", fmt.Errorf("%s failed: %v: %s", path, err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("%s failed: %v", path, err)
+	}
+	return string(output), nil
+}
+
+// parseDeviceIDs parses idevice_id -l/-n output (one UDID per line, possibly with a " (USB)" suffix)
+func parseDeviceIDs(output string) []string {
+	var udids []string
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || seen[fields[0]] {
+			continue
+		}
+		seen[fields[0]] = true
+		udids = append(udids, fields[0])
+	}
+	return udids
+}
+
+// parseDeviceInfo parses ideviceinfo "Key: value" output
+func parseDeviceInfo(output string) map[string]string {
+	info := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		// Nested values are indented; only top-level keys are needed
+		if strings.HasPrefix(line, " ") {
+			continue
+		}
+		key, value, found := strings.Cut(line, ": ")
+		if !found {
+			continue
+		}
+		info[key] = strings.TrimSpace(value)
+	}
+	return info
+}
+
+// ListDevices lists devices connected over USB and, optionally, over the network
+// A device reachable both ways is listed once as USB
+func ListDevices(tools DeviceTools, includeNetwork bool) ([]Device, error) {
+	var devices []Device
+	seen := make(map[string]bool)
+
+	connections := []string{connectionUSB}
+	if includeNetwork {
+		connections = append(connections, connectionNetwork)
+	}
+
+	for _, connection := range connections {
+		udids, err := listConnectedUDIDs(tools, connection)
+		if err != nil {
+			// Network discovery is best effort; USB devices are still worth listing
+			if connection == connectionNetwork && len(devices) > 0 {
+				errorLog.Printf("Warning: %v", err)
+				continue
+			}
+			return nil, err
+		}
+
+		for _, udid := range udids {
+			if seen[udid] {
+				continue
+			}
+			seen[udid] = true
+			devices = append(devices, describeDevice(tools, udid, connection))
+		}
+	}
+
+	return devices, nil
+}
+
+// ResolveBackupDevice picks the device to back up among those reachable over the given connection
+func ResolveBackupDevice(tools DeviceTools, udid string, network bool) (Device, error) {
+	connection := connectionUSB
+	if network {
+		connection = connectionNetwork
+	}
+
+	udids, err := listConnectedUDIDs(tools, connection)
+	if err != nil {
+		return Device{}, err
+	}
+
+	var devices []Device
+	for _, id := range udids {
+		devices = append(devices, describeDevice(tools, id, connection))
+	}
+	return SelectDevice(devices, udid)
+}
+
+// listConnectedUDIDs runs idevice_id for one connection type
+func listConnectedUDIDs(tools DeviceTools, connection string) ([]string, error) {
+	listFlag := "-l"
+	if connection == connectionNetwork {
+		listFlag = "-n"
+	}
+	output, err := runDeviceTool(tools.IdeviceID, listFlag)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s devices: %v", connection, err)
+	}
+	return parseDeviceIDs(output), nil
+}
+
+// describeDevice queries ideviceinfo for a device's name, model and iOS version
+// A device that can't be queried (e.g. not yet trusted) is still listed with its UDID
+func describeDevice(tools DeviceTools, udid string, connection string) Device {
+	device := Device{UDID: udid, Connection: connection}
+
+	args := []string{"-u", udid}
+	if connection == connectionNetwork {
+		args = append(args, "-n")
+	}
+	output, err := runDeviceTool(tools.IdeviceInfo, args...)
+	if err != nil {
+		errorLog.Printf("Warning: could not query device %s: %v", udid, err)
+		return device
+	}
+
+	info := parseDeviceInfo(output)
+	device.Name = info["DeviceName"]
+	device.ProductType = info["ProductType"]
+	device.ProductVersion = info["ProductVersion"]
+	return device
+}
+
+// SelectDevice picks the device to back up
+// With a UDID the device must be connected; without one exactly one device must be connected
+func SelectDevice(devices []Device, udid string) (Device, error) {
+	if udid != "" {
+		for _, device := range devices {
+			if device.UDID == udid {
+				return device, nil
+			}
+		}
+		return Device{}, &BackupError{Kind: ErrKindDeviceNotFound, Detail: fmt.Sprintf("device %s is not connected", udid)}
+	}
+
+	switch len(devices) {
+	case 0:
+		return Device{}, &BackupError{Kind: ErrKindDeviceNotFound}
+	case 1:
+		return devices[0], nil
+	default:
+		var udids []string
+		for _, device := range devices {
+			udids = append(udids, fmt.Sprintf("%s (%s)", device.UDID, deviceLabel(device)))
+		}
+		return Device{}, fmt.Errorf("%d devices connected, select one with -udid: %s", len(devices), strings.Join(udids, ", "))
+	}
+}
+
+// deviceLabel returns a short human description of a device
+func deviceLabel(device Device) string {
+	label := device.Name
+	if label == "" {
+		label = "unknown name"
+	}
+	if device.ProductType != "" {
+		label += ", " + device.ProductType
+	}
+	if device.ProductVersion != "" {
+		label += ", iOS " + device.ProductVersion
+	}
+	return label + ", " + device.Connection
+}
+
+// runDevicesCommand implements the "devices" subcommand and returns the process exit code
+func runDevicesCommand(args []string) int {
+	fs := flag.NewFlagSet("devices", flag.ExitOnError)
+	var (
+		network    = fs.Bool("network", true, "Include devices available over the network (Wi-Fi sync)")
+		jsonOutput = fs.Bool("json", false, "Print devices as a JSON array")
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s devices [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Lists connected iOS devices with name, model, iOS version and UDID.\n")
+		fmt.Fprintf(os.Stderr, "Pass the UDID to -udid to back up a specific device.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+
+	errorLog = log.New(os.Stderr, "", 0)
+
+	tools, err := findDeviceTools()
+	if err != nil {
+		errorLog.Printf("%v", err)
+		return 1
+	}
+	devices, err := ListDevices(tools, *network)
+	if err != nil {
+		errorLog.Printf("%v", err)
+		return 1
+	}
+
+	if *jsonOutput {
+		if devices == nil {
+			devices = []Device{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(devices); err != nil {
+			errorLog.Printf("Failed to write devices: %v", err)
+			return 1
+		}
+		return 0
+	}
+
+	if len(devices) == 0 {
+		fmt.Println("No devices connected")
+		return 0
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "UDID\tNAME\tMODEL\tIOS\tCONNECTION")
+	for _, device := range devices {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", device.UDID, valueOrDash(device.Name),
+			valueOrDash(device.ProductType), valueOrDash(device.ProductVersion), device.Connection)
+	}
+	tw.Flush()
+	return 0
+}
+
+// valueOrDash returns "-" for empty table cells
+func valueOrDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeMockDeviceTools creates idevice_id and ideviceinfo scripts reporting the given devices
+func writeMockDeviceTools(t *testing.T, usbOutput string, networkOutput string) DeviceTools {
+	t.Helper()
+	dir := t.TempDir()
+
+	ideviceID := filepath.Join(dir, "idevice_id")
+	idScript := "#!/bin/bash\n" +
+		"if [ \"$1\" = \"-n\" ]; then printf '" + networkOutput + "'; else printf '" + usbOutput + "'; fi\n"
+	if err := os.WriteFile(ideviceID, []byte(idScript), 0755); err != nil {
+		t.Fatalf("Failed to create mock idevice_id: %v", err)
+	}
+
+	ideviceInfo := filepath.Join(dir, "ideviceinfo")
+	infoScript := "#!/bin/bash\n" +
+		"case \"$2\" in\n" +
+		"  AAAA) printf 'BuildVersion: 21C66\\nDeviceName: Alice iPhone\\nProductType: iPhone14,5\\nProductVersion: 17.2.1\\nSupportedDeviceFamilies:\\n 1: 1\\n' ;;\n" +
+		"  BBBB) printf 'DeviceName: Work Phone\\nProductType: iPhone15,2\\nProductVersion: 16.6\\n' ;;\n" +
+		"  *) echo 'ERROR: Could not connect to lockdownd' >&2; exit 1 ;;\n" +
+		"esac\n"
+	if err := os.WriteFile(ideviceInfo, []byte(infoScript), 0755); err != nil {
+		t.Fatalf("Failed to create mock ideviceinfo: %v", err)
+	}
+
+	return DeviceTools{IdeviceID: ideviceID, IdeviceInfo: ideviceInfo}
+}
+
+// TestListDevices tests USB and network discovery with device details
+func TestListDevices(t *testing.T) {
+	tools := writeMockDeviceTools(t, "AAAA\\n", "AAAA\\nCCCC\\n")
+
+	devices, err := ListDevices(tools, true)
+	if err != nil {
+		t.Fatalf("ListDevices failed: %v", err)
+	}
+	if len(devices) != 2 {
+		t.Fatalf("Expected 2 devices, got %+v", devices)
+	}
+
+	want := Device{UDID: "AAAA", Name: "Alice iPhone", ProductType: "iPhone14,5", ProductVersion: "17.2.1", Connection: connectionUSB}
+	if devices[0] != want {
+		t.Errorf("Expected %+v, got %+v", want, devices[0])
+	}
+	// A device that can't be queried is still listed
+	if devices[1].UDID != "CCCC" || devices[1].Connection != connectionNetwork || devices[1].Name != "" {
+		t.Errorf("Unexpected network device: %+v", devices[1])
+	}
+
+	devices, err = ListDevices(tools, false)
+	if err != nil {
+		t.Fatalf("ListDevices failed: %v", err)
+	}
+	if len(devices) != 1 {
+		t.Errorf("Expected only USB devices, got %+v", devices)
+	}
+}
+
+// TestResolveBackupDevice tests device selection for a backup run
+func TestResolveBackupDevice(t *testing.T) {
+	single := writeMockDeviceTools(t, "AAAA\\n", "")
+	device, err := ResolveBackupDevice(single, "", false)
+	if err != nil || device.UDID != "AAAA" {
+		t.Errorf("Expected the only device to be selected, got %+v, %v", device, err)
+	}
+
+	multiple := writeMockDeviceTools(t, "AAAA\\nBBBB\\n", "")
+	if _, err := ResolveBackupDevice(multiple, "", false); err == nil || !strings.Contains(err.Error(), "-udid") {
+		t.Errorf("Expected an error asking for -udid, got %v", err)
+	}
+	device, err = ResolveBackupDevice(multiple, "BBBB", false)
+	if err != nil || device.Name != "Work Phone" {
+		t.Errorf("Expected BBBB to be selected, got %+v, %v", device, err)
+	}
+	if _, err := ResolveBackupDevice(multiple, "ZZZZ", false); err == nil {
+		t.Error("Expected an error for a device that is not connected")
+	}
+
+	if _, err := ResolveBackupDevice(writeMockDeviceTools(t, "", ""), "", false); err == nil {
+		t.Error("Expected an error when no devices are connected")
+	}
+}
+
+// TestParseDeviceIDs tests parsing idevice_id output
+func TestParseDeviceIDs(t *testing.T) {
+	got := parseDeviceIDs("00008110-000E785101F2401E (USB)\n\n00008030-001A2D8E0C38802E (Network)\n00008110-000E785101F2401E\n")
+	if len(got) != 2 || got[0] != "00008110-000E785101F2401E" || got[1] != "00008030-001A2D8E0C38802E" {
+		t.Errorf("Unexpected UDIDs: %v", got)
+	}
+}
+
+// TestBackupRunnerDeviceArgs tests that the selected device is passed to ios_backup
+func TestBackupRunnerDeviceArgs(t *testing.T) {
+	runner, err := NewBackupRunner(filepath.Join(t.TempDir(), "AAAA"), "ios_backup", false, NewBackupTransformer())
+	if err != nil {
+		t.Fatalf("Failed to create runner: %v", err)
+	}
+	runner.SetDomains([]string{"*SMS*"})
+	runner.SetDevice("AAAA", true)
+
+	got := strings.Join(runner.commandArgs("/backups"), " ")
+	want := "-u AAAA -n --domain *SMS* backup /backups"
+	if got != want {
+		t.Errorf("Expected args %q, got %q", want, got)
+	}
+}
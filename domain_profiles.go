@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	defaultProfileName = "messages"
+	profilesFileName   = "profiles.json" // Looked up next to the executable when -profiles-file is not set
+)
+
+// DomainProfile is a named set of ios_backup --domain filters
+// All means no filtering (the whole device is backed up); it must be set explicitly, so a profile
+// whose domains are missing or misspelled is rejected instead of backing up everything
+type DomainProfile struct {
+	Description string   `json:"description"`
+	Domains     []string `json:"domains,omitempty"`
+	All         bool     `json:"all,omitempty"`
+}
+
+// domainProfilesFile is the on-disk format of a profiles config file
+type domainProfilesFile struct {
+	Profiles map[string]DomainProfile `json:"profiles"`
+}
+
+// builtinProfiles are always available and can be overridden by the config file
+var builtinProfiles = map[string]DomainProfile{
+	"messages": {
+		Description: "Text messages, contacts and WhatsApp (default)",
+		Domains: []string{
+			"*SMS*",
+			"*sms*",
+			"*AddressBook*",
+			"*WhatsApp*",
+			"*whatsapp*",
+			"*ChatStorage.sqlite*",
+			"*Message/Media/*", // WhatsApp media
+		},
+	},
+	"whatsapp-only": {
+		Description: "WhatsApp chats and media only",
+		Domains: []string{
+			"*WhatsApp*",
+			"*whatsapp*",
+			"*ChatStorage.sqlite*",
+			"*Message/Media/*",
+		},
+	},
+	"calls-and-contacts": {
+		Description: "Call history and contacts",
+		Domains: []string{
+			"*CallHistory*",
+			"*AddressBook*",
+		},
+	},
+	"full": {
+		Description: "Entire device, no domain filtering",
+		All:         true,
+	},
+}
+
+// LoadDomainProfiles returns the built-in profiles merged with those from a config file
+// If configPath is empty, profiles.json next to the executable is used when present
+func LoadDomainProfiles(configPath string) (map[string]DomainProfile, error) {
+	profiles := make(map[string]DomainProfile, len(builtinProfiles))
+	for name, profile := range builtinProfiles {
+		profiles[name] = profile
+	}
+
+	explicit := configPath != ""
+	if !explicit {
+		configPath = filepath.Join(getExecutableDir(), profilesFileName)
+	}
+
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			return profiles, nil
+		}
+		return nil, fmt.Errorf("failed to read profiles file: %v", err)
+	}
+
+	// Unknown keys are errors, so a misspelled "domains" can't turn a profile into a whole-device backup
+	var config domainProfilesFile
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("failed to parse profiles file %s: %v", configPath, err)
+	}
+
+	for name, profile := range config.Profiles {
+		if strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("profiles file %s contains a profile with an empty name", configPath)
+		}
+		if err := validateProfile(profile); err != nil {
+			return nil, fmt.Errorf("invalid profile %q in %s: %v", name, configPath, err)
+		}
+		profiles[name] = profile
+	}
+
+	return profiles, nil
+}
+
+// validateProfile checks that a profile either lists domains or explicitly backs up the whole device
+func validateProfile(profile DomainProfile) error {
+	if profile.All {
+		if len(profile.Domains) > 0 {
+			return fmt.Errorf("\"all\" backs up every domain and cannot be combined with \"domains\"")
+		}
+		return nil
+	}
+	if len(profile.Domains) == 0 {
+		return fmt.Errorf("no domains (set \"all\": true to back up the whole device)")
+	}
+	for _, domain := range profile.Domains {
+		if strings.TrimSpace(domain) == "" {
+			return fmt.Errorf("empty domain filter")
+		}
+	}
+	return nil
+}
+
+// ResolveDomains returns the --domain filters for a profile with ad-hoc additions and exclusions applied
+func ResolveDomains(profiles map[string]DomainProfile, name string, add []string, exclude []string) ([]string, error) {
+	profile, ok := profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile %q (available: %s)", name, strings.Join(profileNames(profiles), ", "))
+	}
+
+	if profile.All && (len(add) > 0 || len(exclude) > 0) {
+		return nil, fmt.Errorf("profile %q backs up every domain, -domain and -exclude-domain cannot be combined with it", name)
+	}
+
+	var domains []string
+	seen := make(map[string]bool)
+	for _, domain := range append(append([]string{}, profile.Domains...), add...) {
+		if domain == "" || seen[domain] {
+			continue
+		}
+		seen[domain] = true
+		domains = append(domains, domain)
+	}
+
+	for _, excluded := range exclude {
+		if !seen[excluded] {
+			return nil, fmt.Errorf("cannot exclude %q: not part of profile %q", excluded, name)
+		}
+		for i, domain := range domains {
+			if domain == excluded {
+				domains = append(domains[:i], domains[i+1:]...)
+				break
+			}
+		}
+	}
+
+	if !profile.All && len(domains) == 0 {
+		return nil, fmt.Errorf("all domains of profile %q were excluded", name)
+	}
+
+	return domains, nil
+}
+
+// profileNames returns the profile names in sorted order
+func profileNames(profiles map[string]DomainProfile) []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// stringListFlag is a flag.Value that collects repeated string flags
+type stringListFlag []string
+
+func (s *stringListFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringListFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestResolveDomainsDefaultProfile tests that the default profile matches the original filters
+func TestResolveDomainsDefaultProfile(t *testing.T) {
+	domains, err := ResolveDomains(builtinProfiles, defaultProfileName, nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to resolve default profile: %v", err)
+	}
+
+	expected := []string{"*SMS*", "*sms*", "*AddressBook*", "*WhatsApp*", "*whatsapp*", "*ChatStorage.sqlite*", "*Message/Media/*"}
+	if !reflect.DeepEqual(domains, expected) {
+		t.Errorf("Expected %v, got %v", expected, domains)
+	}
+}
+
+// TestResolveDomainsAddAndExclude tests ad-hoc additions and exclusions
+func TestResolveDomainsAddAndExclude(t *testing.T) {
+	domains, err := ResolveDomains(builtinProfiles, "calls-and-contacts", []string{"*Voicemail*", "*AddressBook*"}, []string{"*CallHistory*"})
+	if err != nil {
+		t.Fatalf("Failed to resolve domains: %v", err)
+	}
+
+	expected := []string{"*AddressBook*", "*Voicemail*"}
+	if !reflect.DeepEqual(domains, expected) {
+		t.Errorf("Expected %v, got %v", expected, domains)
+	}
+
+	// Builtin profile must not be modified by resolution
+	if len(builtinProfiles["calls-and-contacts"].Domains) != 2 {
+		t.Errorf("Builtin profile was modified: %v", builtinProfiles["calls-and-contacts"].Domains)
+	}
+}
+
+// TestResolveDomainsErrors tests invalid profile selections
+func TestResolveDomainsErrors(t *testing.T) {
+	if _, err := ResolveDomains(builtinProfiles, "no-such-profile", nil, nil); err == nil {
+		t.Error("Expected error for unknown profile")
+	}
+	if _, err := ResolveDomains(builtinProfiles, "messages", nil, []string{"*NotThere*"}); err == nil {
+		t.Error("Expected error for excluding a domain that is not in the profile")
+	}
+	if _, err := ResolveDomains(builtinProfiles, "full", []string{"*SMS*"}, nil); err == nil {
+		t.Error("Expected error for adding domains to the full profile")
+	}
+
+	domains, err := ResolveDomains(builtinProfiles, "full", nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to resolve full profile: %v", err)
+	}
+	if len(domains) != 0 {
+		t.Errorf("Full profile should have no domain filters, got %v", domains)
+	}
+}
+
+// TestLoadDomainProfilesFromFile tests loading and overriding profiles from a config file
+func TestLoadDomainProfilesFromFile(t *testing.T) {
+	tempDir := t.TempDir()
+	configPath := filepath.Join(tempDir, "profiles.json")
+	config := `{
+		"profiles": {
+			"signal": {"description": "Signal only", "domains": ["*Signal*"]},
+			"messages": {"description": "SMS only", "domains": ["*SMS*"]}
+		}
+	}`
+	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	profiles, err := LoadDomainProfiles(configPath)
+	if err != nil {
+		t.Fatalf("Failed to load profiles: %v", err)
+	}
+
+	if got := profiles["signal"].Domains; !reflect.DeepEqual(got, []string{"*Signal*"}) {
+		t.Errorf("Expected signal profile from file, got %v", got)
+	}
+	if got := profiles["messages"].Domains; !reflect.DeepEqual(got, []string{"*SMS*"}) {
+		t.Errorf("Expected messages profile to be overridden, got %v", got)
+	}
+	if _, ok := profiles["whatsapp-only"]; !ok {
+		t.Error("Builtin profiles should still be available")
+	}
+
+	// Explicit missing file is an error
+	if _, err := LoadDomainProfiles(filepath.Join(tempDir, "missing.json")); err == nil {
+		t.Error("Expected error for missing explicit profiles file")
+	}
+
+	// Malformed file is an error
+	badPath := filepath.Join(tempDir, "bad.json")
+	if err := os.WriteFile(badPath, []byte("{not json"), 0644); err != nil {
+		t.Fatalf("Failed to write bad config: %v", err)
+	}
+	if _, err := LoadDomainProfiles(badPath); err == nil || !strings.Contains(err.Error(), "parse") {
+		t.Errorf("Expected parse error, got %v", err)
+	}
+}
+
+// TestLoadDomainProfilesRejectsWholeDeviceByMistake tests that profiles only back up everything when they say so
+func TestLoadDomainProfilesRejectsWholeDeviceByMistake(t *testing.T) {
+	tempDir := t.TempDir()
+	invalid := map[string]string{
+		"misspelled key":     `{"profiles": {"signal": {"description": "Signal", "domain": ["*Signal*"]}}}`,
+		"empty domains":      `{"profiles": {"signal": {"description": "Signal", "domains": []}}}`,
+		"overridden default": `{"profiles": {"messages": {"description": "SMS"}}}`,
+		"blank domain":       `{"profiles": {"signal": {"domains": ["*Signal*", " "]}}}`,
+		"all with domains":   `{"profiles": {"signal": {"all": true, "domains": ["*Signal*"]}}}`,
+		"unknown top-level":  `{"profile": {"signal": {"domains": ["*Signal*"]}}}`,
+	}
+	for name, config := range invalid {
+		configPath := filepath.Join(tempDir, "profiles.json")
+		if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+		if _, err := LoadDomainProfiles(configPath); err == nil {
+			t.Errorf("%s: expected the profiles file to be rejected", name)
+		}
+	}
+
+	configPath := filepath.Join(tempDir, "profiles.json")
+	if err := os.WriteFile(configPath, []byte(`{"profiles": {"everything": {"description": "Whole device", "all": true}}}`), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	profiles, err := LoadDomainProfiles(configPath)
+	if err != nil {
+		t.Fatalf("Failed to load profiles: %v", err)
+	}
+	if domains, err := ResolveDomains(profiles, "everything", nil, nil); err != nil || len(domains) != 0 {
+		t.Errorf("Expected a whole-device profile, got %v, %v", domains, err)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Output size estimate for a dry run: JPEG at jpegQuality averages about a quarter byte per pixel for photos
+const (
+	estimatedJPEGBytesPerPixel = 0.25
+	estimatedJPEGOverhead      = 600 // Headers and quantization tables
+)
+
+// DryRunTotals sums up the files a dry run would convert
+type DryRunTotals struct {
+	Files       int   // Files that would be converted
+	BytesBefore int64 // Their current size
+	BytesAfter  int64 // Their estimated size once converted
+}
+
+// SetDryRun makes ProcessFileByExtension only decide what it would do, without converting or writing anything
+// The journal is still consulted so files converted by an earlier run are reported as already done
+func (bt *BackupTransformer) SetDryRun(dryRun bool) {
+	bt.dryRun = dryRun
+}
+
+// DryRunTotals returns the files planned for conversion so far in a dry run
+func (bt *BackupTransformer) DryRunTotals() DryRunTotals {
+	bt.planMu.Lock()
+	defer bt.planMu.Unlock()
+	return bt.planned
+}
+
+// planTransform decides what a conversion would do to a file, reading it but writing nothing
+// Planned results carry the current dimensions and the estimated output size (SizeAfter)
+func (bt *BackupTransformer) planTransform(ctx context.Context, filePath string, action string) TransformResult {
+	if bt.incrementTotal != nil {
+		bt.incrementTotal()
+	}
+
+	if bt.journal != nil {
+		if hash, err := hashFile(filePath); err == nil {
+			entry, err := bt.journal.Lookup(filePath)
+			if err == nil && entry != nil && entry.Outcome == OutcomeConverted && entry.OutputHash == hash {
+				return TransformResult{Action: action, Outcome: OutcomeAlreadyDone}
+			}
+		}
+	}
+
+	// Same tool checks the conversion makes before touching the file
+	switch action {
+	case "heic->jpeg":
+		if _, found := bt.procs.LookPath("heic-converter"); !found {
+			return TransformResult{Action: action, Outcome: OutcomeSkipped, Err: &skipError{reason: "heic-converter not found"}}
+		}
+	case "video->jpeg":
+		if !bt.hasVideoStream(ctx, filePath) {
+			return TransformResult{Action: action, Outcome: OutcomeSkipped, Err: &skipError{reason: "file has no video stream (audio-only)"}}
+		}
+		if _, found := bt.procs.LookPath("ffmpeg"); !found {
+			return TransformResult{Action: action, Outcome: OutcomeSkipped, Err: &skipError{reason: "ffmpeg not found"}}
+		}
+	}
+
+	result := TransformResult{Action: action, Outcome: OutcomePlanned}
+	var err error
+	switch action {
+	case "heic->jpeg", "video->jpeg":
+		// Go can't decode these; when ffprobe can't either the estimate assumes a 4:3 frame
+		if result.Width, result.Height, err = bt.probeDimensions(ctx, filePath); err != nil {
+			infoLog.Printf("Cannot determine dimensions of %s, assuming 4:3: %v", filepath.Base(filePath), err)
+		}
+	default:
+		if result.Width, result.Height, err = decodeDimensions(filePath); err != nil {
+			result.Outcome = OutcomeFailed
+			result.Err = fmt.Errorf("failed to decode image: %v", err)
+			return result
+		}
+	}
+	result.SizeAfter = estimateJPEGSize(result.Width, result.Height, standardImageWidth)
+	size := fileSize(filePath)
+
+	bt.planMu.Lock()
+	bt.planned.Files++
+	bt.planned.BytesBefore += size
+	bt.planned.BytesAfter += result.SizeAfter
+	bt.planMu.Unlock()
+
+	infoLog.Printf("%sWould convert %s (%s): %s, %s -> ~%s", bt.getQueueDepthString(), filepath.Base(filePath), action,
+		formatDimensions(result.Width, result.Height), formatBytes(size), formatBytes(result.SizeAfter))
+	return result
+}
+
+// decodeDimensions reads the dimensions of an image Go can decode from its header
+func decodeDimensions(filePath string) (int, int, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	return config.Width, config.Height, nil
+}
+
+// probeDimensions reads the dimensions of the first video stream with ffprobe (HEIC images and videos)
+func (bt *BackupTransformer) probeDimensions(ctx context.Context, filePath string) (int, int, error) {
+	ffprobePath, found := bt.procs.LookPath("ffprobe")
+	if !found {
+		return 0, 0, fmt.Errorf("ffprobe not found")
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	args := []string{
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "stream=width,height",
+		"-of", "csv=p=0:s=x",
+		filePath,
+	}
+	output, err := runTool(runCtx, bt.procs, ffprobePath, args...)
+	if err != nil {
+		return 0, 0, fmt.Errorf("ffprobe failed: %v", err)
+	}
+
+	for _, line := range strings.Split(string(output), "\n") {
+		var width, height int
+		if _, err := fmt.Sscanf(strings.TrimSpace(line), "%dx%d", &width, &height); err == nil && width > 0 && height > 0 {
+			return width, height, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("unexpected ffprobe output %q", strings.TrimSpace(string(output)))
+}
+
+// estimateJPEGSize estimates the size of a JPEG resized to at most maxWidth (unknown dimensions assume a 4:3 frame)
+func estimateJPEGSize(width int, height int, maxWidth int) int64 {
+	if width <= 0 || height <= 0 {
+		width, height = maxWidth, maxWidth*3/4
+	}
+	if width > maxWidth {
+		height = height * maxWidth / width
+		width = maxWidth
+		if height < 1 {
+			height = 1
+		}
+	}
+	return int64(float64(width)*float64(height)*estimatedJPEGBytesPerPixel) + estimatedJPEGOverhead
+}
+
+// formatDimensions formats image dimensions like "4032x3024" ("unknown size" when not known)
+func formatDimensions(width int, height int) string {
+	if width <= 0 || height <= 0 {
+		return "unknown size"
+	}
+	return fmt.Sprintf("%dx%d", width, height)
+}
+
+// logDryRunSummary logs what a dry run would have converted and the projected savings
+func logDryRunSummary(totals DryRunTotals) {
+	infoLog.Printf("Dry run: %d files would be converted, %s -> ~%s (projected savings ~%s); nothing was changed",
+		totals.Files, formatBytes(totals.BytesBefore), formatBytes(totals.BytesAfter), formatBytes(totals.BytesBefore-totals.BytesAfter))
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestTransformBackupDryRun tests that a dry run reports planned conversions with estimates and changes nothing
+func TestTransformBackupDryRun(t *testing.T) {
+	backupDir := filepath.Join(t.TempDir(), "00008110-000E785101F2401E")
+	files := []testManifestFile{
+		{"aa00000000000000000000000000000000000001", "MediaDomain", "Library/SMS/Attachments/01/IMG_0001.PNG", 1},
+		{"bb00000000000000000000000000000000000002", "MediaDomain", "Library/SMS/Attachments/02/IMG_0002.HEIC", 1},
+		{"cc00000000000000000000000000000000000003", "MediaDomain", "Library/SMS/Attachments/03/clip.mov", 1},
+		{"dd00000000000000000000000000000000000004", "MediaDomain", "Library/SMS/Attachments/04/broken.png", 1},
+		{"ee00000000000000000000000000000000000005", "HomeDomain", "Library/SMS/sms.db", 1},
+	}
+	originals := make(map[string][]byte)
+	for i, f := range files {
+		path := filepath.Join(backupDir, f.fileID[:2], f.fileID)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		if i == 0 {
+			writeTestPNG(t, path, 1000, 800, color.RGBA{200, 30, 30, 255})
+		} else if err := os.WriteFile(path, bytes.Repeat([]byte{byte(i)}, 500000), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+		originals[path], _ = os.ReadFile(path)
+	}
+	createTestManifest(t, backupDir, files)
+
+	// ffprobe reports a video stream and 1920x1080 for both the HEIC and the video
+	procs := NewFakeRunner()
+	procs.Register("heic-converter", FakeTool{})
+	procs.Register("ffmpeg", FakeTool{})
+	procs.Register("ffprobe", FakeTool{Steps: []FakeStep{{Stdout: "video"}, {Stdout: "1920x1080"}}})
+	transformer := NewBackupTransformer()
+	transformer.SetProcessRunner(procs)
+	transformer.SetDryRun(true)
+	report := NewRunReport(backupDir)
+	report.SetDryRun(true)
+
+	summary, err := TransformBackup(context.Background(), transformer, TransformOptions{
+		BackupDir:      backupDir,
+		Workers:        2,
+		Report:         report,
+		UpdateManifest: true,
+	})
+	if err != nil {
+		t.Fatalf("TransformBackup failed: %v", err)
+	}
+	if summary.Outcomes[OutcomePlanned] != 3 || summary.Outcomes[OutcomeFailed] != 1 || summary.Outcomes[OutcomeConverted] != 0 {
+		t.Errorf("Expected 3 planned and 1 failed file, got %+v", summary.Outcomes)
+	}
+	if len(procs.Calls("heic-converter")) != 0 || len(procs.Calls("ffmpeg")) != 0 {
+		t.Error("A dry run must not run converters")
+	}
+
+	// Nothing in the backup changed
+	for path, data := range originals {
+		if current, _ := os.ReadFile(path); !bytes.Equal(current, data) {
+			t.Errorf("%s was modified by a dry run", path)
+		}
+	}
+	entries, _ := os.ReadDir(filepath.Dir(backupDir))
+	if len(entries) != 1 {
+		t.Errorf("A dry run must not create files next to the backup, found %d entries", len(entries))
+	}
+
+	totals := transformer.DryRunTotals()
+	if totals.Files != 3 || totals.BytesAfter >= totals.BytesBefore {
+		t.Errorf("Unexpected dry run totals %+v", totals)
+	}
+
+	report.Finish("completed", nil)
+	var buf bytes.Buffer
+	if err := report.WriteJSON(&buf); err != nil {
+		t.Fatalf("WriteJSON failed: %v", err)
+	}
+	var doc reportDocument
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatalf("Invalid report JSON: %v", err)
+	}
+	if !doc.DryRun || doc.Totals.Planned != 3 || doc.Totals.BytesSaved <= 0 {
+		t.Errorf("Unexpected dry run report totals: %+v", doc.Totals)
+	}
+	for _, entry := range doc.Files {
+		switch {
+		case strings.HasSuffix(entry.Domain, "IMG_0001.PNG"):
+			if entry.Width != 1000 || entry.Height != 800 || entry.BytesAfter != estimateJPEGSize(1000, 800, standardImageWidth) {
+				t.Errorf("Unexpected PNG plan: %+v", entry)
+			}
+		case strings.HasSuffix(entry.Domain, "clip.mov"):
+			if entry.Outcome != string(OutcomePlanned) || entry.Width != 1920 || entry.Height != 1080 {
+				t.Errorf("Unexpected video plan: %+v", entry)
+			}
+		case strings.HasSuffix(entry.Domain, "broken.png"):
+			if entry.Outcome != string(OutcomeFailed) || entry.Error == "" {
+				t.Errorf("Expected the undecodable PNG to fail, got %+v", entry)
+			}
+		}
+	}
+
+	buf.Reset()
+	if err := report.WriteHTML(&buf); err != nil || !strings.Contains(buf.String(), "(dry run)") || !strings.Contains(buf.String(), "1920x1080") {
+		t.Errorf("HTML report should show the dry run and dimensions: %v", err)
+	}
+}
+
+// TestDryRunSkipsLikeConversion tests that a dry run reports the same skips as a real conversion
+func TestDryRunSkipsLikeConversion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "IMG_0001")
+	if err := os.WriteFile(path, []byte("not really a HEIC"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	transformer := NewBackupTransformer()
+	transformer.SetProcessRunner(NewFakeRunner())
+	transformer.SetDryRun(true)
+
+	result := transformer.ProcessFileByExtension(context.Background(), path, ".heic", nil)
+	if result.Outcome != OutcomeSkipped || result.Err == nil || !strings.Contains(result.Err.Error(), "heic-converter") {
+		t.Errorf("Expected a skip for the missing heic-converter, got %+v", result)
+	}
+	if result.SizeAfter != result.SizeBefore {
+		t.Errorf("Skipped files keep their size, got %+v", result)
+	}
+}
+
+// TestEstimateJPEGSize tests the output size estimate for resized and small images
+func TestEstimateJPEGSize(t *testing.T) {
+	if got, want := estimateJPEGSize(4000, 3000, 500), int64(500*375/4+estimatedJPEGOverhead); got != want {
+		t.Errorf("estimateJPEGSize(4000x3000) = %d, want %d", got, want)
+	}
+	if got, want := estimateJPEGSize(200, 100, 500), int64(200*100/4+estimatedJPEGOverhead); got != want {
+		t.Errorf("Small images are not enlarged: got %d, want %d", got, want)
+	}
+	if estimateJPEGSize(0, 0, 500) != estimateJPEGSize(500, 375, 500) {
+		t.Error("Unknown dimensions should assume a 4:3 frame")
+	}
+}
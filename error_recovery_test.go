@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"image"
 	"image/color"
 	"image/gif"
@@ -31,7 +32,7 @@ func TestGIFConversionErrorRecovery(t *testing.T) {
 	}
 
 	// This should not crash
-	transformer.convertGifToJpeg(fakeGif)
+	transformer.convertGifToJpeg(context.Background(), fakeGif)
 
 	// Success if no crash
 }
@@ -48,7 +49,7 @@ func TestPNGConversionErrorRecovery(t *testing.T) {
 	}
 
 	// This should not crash
-	transformer.convertPngToJpeg(fakePng)
+	transformer.convertPngToJpeg(context.Background(), fakePng)
 
 	// Success if no crash
 }
@@ -65,7 +66,7 @@ func TestWEBPConversionErrorRecovery(t *testing.T) {
 	}
 
 	// This should not crash
-	transformer.convertWebpToJpeg(fakeWebp)
+	transformer.convertWebpToJpeg(context.Background(), fakeWebp)
 
 	// Success if no crash
 }
@@ -82,7 +83,7 @@ func TestJPEGResizeErrorRecovery(t *testing.T) {
 	}
 
 	// This should not crash
-	transformer.resizeJpeg(fakeJpeg)
+	transformer.resizeJpeg(context.Background(), fakeJpeg)
 
 	// Success if no crash
 }
@@ -99,7 +100,7 @@ func TestHEICConversionMissingTool(t *testing.T) {
 	}
 
 	// This should gracefully handle missing heic-converter
-	transformer.convertHeicToJpeg(testHeic)
+	transformer.convertHeicToJpeg(context.Background(), testHeic)
 
 	// Success if no crash
 }
@@ -116,7 +117,7 @@ func TestVideoConversionMissingTool(t *testing.T) {
 	}
 
 	// This should gracefully handle missing ffmpeg
-	transformer.convertVideoToJpeg(testVideo)
+	transformer.convertVideoToJpeg(context.Background(), testVideo)
 
 	// Success if no crash
 }
@@ -144,7 +145,7 @@ func TestValidGIFConversion(t *testing.T) {
 	f.Close()
 
 	// Convert
-	transformer.convertGifToJpeg(gifFile)
+	transformer.convertGifToJpeg(context.Background(), gifFile)
 
 	// Check that file still exists (should be converted to JPEG in place)
 	if _, err := os.Stat(gifFile); err != nil {
@@ -177,7 +178,7 @@ func TestValidPNGConversion(t *testing.T) {
 	f.Close()
 
 	// Convert
-	transformer.convertPngToJpeg(pngFile)
+	transformer.convertPngToJpeg(context.Background(), pngFile)
 
 	// Check that file still exists
 	if _, err := os.Stat(pngFile); err != nil {
@@ -216,7 +217,7 @@ func TestValidJPEGResize(t *testing.T) {
 	}
 
 	// Resize
-	transformer.resizeJpeg(jpegFile)
+	transformer.resizeJpeg(context.Background(), jpegFile)
 
 	// Check that file still exists and was resized
 	newInfo, err := os.Stat(jpegFile)
@@ -255,7 +256,7 @@ func TestTempFileCleanup(t *testing.T) {
 
 	// Convert (which creates temp files)
 	transformer := NewBackupTransformer()
-	transformer.convertPngToJpeg(pngFile)
+	transformer.convertPngToJpeg(context.Background(), pngFile)
 
 	// Count files after
 	filesAfter, err := os.ReadDir(tempDir)
@@ -276,7 +277,7 @@ func TestResizeJpegImageInvalidInput(t *testing.T) {
 	tempDir := t.TempDir()
 
 	// Non-existent file
-	_, err := resizeJpegImage(filepath.Join(tempDir, "nonexistent.jpg"), 500)
+	_, err := resizeJpegImage(context.Background(), filepath.Join(tempDir, "nonexistent.jpg"), 500, resampleFilters[defaultResampleFilter])
 	if err == nil {
 		t.Error("Expected error for non-existent file")
 	}
@@ -287,7 +288,7 @@ func TestResizeJpegImageInvalidInput(t *testing.T) {
 		t.Fatalf("Failed to create invalid JPEG: %v", err)
 	}
 
-	_, err = resizeJpegImage(invalidJpeg, 500)
+	_, err = resizeJpegImage(context.Background(), invalidJpeg, 500, resampleFilters[defaultResampleFilter])
 	if err == nil {
 		t.Error("Expected error for invalid JPEG")
 	}
@@ -323,7 +324,7 @@ func TestProcessFileByExtension(t *testing.T) {
 		}
 
 		// Process - should not crash
-		transformer.ProcessFileByExtension(testFile, tc.ext, &FileTiming{
+		transformer.ProcessFileByExtension(context.Background(), testFile, tc.ext, &FileTiming{
 			CreatedTime:     time.Now(),
 			DiscoveredTime:  time.Now(),
 			DiscoveryMethod: "test",
@@ -399,3 +400,59 @@ func TestFileSavedLineParsing(t *testing.T) {
 		}
 	}
 }
+
+// TestConversionCancellation tests that cancelling the caller context or hitting the per-file timeout
+// kills a running external converter promptly and leaves no temp files behind
+func TestConversionCancellation(t *testing.T) {
+	binDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(binDir, "heic-converter"), []byte("#!/bin/bash\nexec sleep 30\n"), 0755); err != nil {
+		t.Fatalf("Failed to create mock heic-converter: %v", err)
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	check := func(name string, ctx context.Context, transformer *BackupTransformer) {
+		tempDir := t.TempDir()
+		heicFile := filepath.Join(tempDir, "photo.heic")
+		if err := os.WriteFile(heicFile, []byte("not really heic"), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+
+		start := time.Now()
+		result := transformer.ProcessFileByExtension(ctx, heicFile, ".heic", nil)
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("%s: conversion took %s to stop", name, elapsed)
+		}
+		if result.Outcome != OutcomeFailed || result.Err == nil {
+			t.Errorf("%s: expected a failed outcome, got %+v", name, result)
+		}
+
+		entries, err := os.ReadDir(tempDir)
+		if err != nil {
+			t.Fatalf("Failed to read dir: %v", err)
+		}
+		if len(entries) != 1 || entries[0].Name() != "photo.heic" {
+			t.Errorf("%s: expected only the original file, got %v", name, entries)
+		}
+		if data, _ := os.ReadFile(heicFile); string(data) != "not really heic" {
+			t.Errorf("%s: original file was modified", name)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	check("cancelled", ctx, NewBackupTransformer())
+
+	transformer := NewBackupTransformer()
+	transformer.SetFileTimeout(100 * time.Millisecond)
+	check("timeout", context.Background(), transformer)
+
+	// Go decoding and resizing stop too
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := resizeImage(ctx, image.NewRGBA(image.Rect(0, 0, 1000, 1000)), 500, resampleFilters[defaultResampleFilter]); err == nil {
+		t.Error("Expected resize with a cancelled context to fail")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// eventSchemaVersion is bumped whenever an event field is renamed, removed or changes meaning
+// Adding new optional fields or event types does not change the version
+const eventSchemaVersion = 1
+
+// Event types emitted in -events json mode
+const (
+	EventBackupStarted     = "backup_started"
+	EventFileSaved         = "file_saved"
+	EventFileFiltered      = "file_filtered"
+	EventTransformStarted  = "transform_started"
+	EventTransformFinished = "transform_finished"
+	EventTransformFailed   = "transform_failed"
+	EventProgress          = "progress"
+	EventBackupRetry       = "backup_retry"
+	EventStallDetected     = "stall_detected"
+	EventRunCompleted      = "run_completed"
+)
+
+// Event is a single machine-readable event, written as one JSON object per line
+type Event struct {
+	Schema int       `json:"schema"`
+	Type   string    `json:"type"`
+	Time   time.Time `json:"time"`
+
+	// Backup events
+	BackupDir string   `json:"backup_dir,omitempty"`
+	Domains   []string `json:"domains,omitempty"`
+	Replay    bool     `json:"replay,omitempty"`
+	Attempt   int      `json:"attempt,omitempty"`     // ios_backup run number (backup_started, backup_retry)
+	RetryInMs *int64   `json:"retry_in_ms,omitempty"` // Backoff before the next attempt (backup_retry)
+	IdleMs    *int64   `json:"idle_ms,omitempty"`     // Time since ios_backup last printed anything (stall_detected)
+
+	// File events
+	Path    string `json:"path,omitempty"`
+	Domain  string `json:"domain,omitempty"`
+	Action  string `json:"action,omitempty"`  // e.g. "heic->jpeg", or the watchdog reaction for stall_detected
+	Outcome string `json:"outcome,omitempty"` // TransformOutcome for transform_finished/transform_failed
+
+	// Durations from FileTiming, in milliseconds
+	QueueWaitMs *int64 `json:"queue_wait_ms,omitempty"` // Discovered -> transformation start
+	DurationMs  *int64 `json:"duration_ms,omitempty"`   // Transformation start -> done (or whole run for run_completed)
+
+	// Progress events
+	Message         string   `json:"message,omitempty"` // Raw ios_backup output line
+	Percent         *float64 `json:"percent,omitempty"`
+	BytesReceived   *int64   `json:"bytes_received,omitempty"`
+	BytesTotal      *int64   `json:"bytes_total,omitempty"`
+	FilesReceived   *int64   `json:"files_received,omitempty"`
+	RateBytesPerSec *float64 `json:"rate_bytes_per_sec,omitempty"`
+	EtaSeconds      *int64   `json:"eta_seconds,omitempty"`
+
+	// Run completion
+	Success        *bool  `json:"success,omitempty"`
+	FilesProcessed *int64 `json:"files_processed,omitempty"`
+
+	Error       string `json:"error,omitempty"`
+	ErrorKind   string `json:"error_kind,omitempty"`  // BackupErrorKind for classified failures
+	Remediation string `json:"remediation,omitempty"` // What the user can do about a classified failure
+}
+
+// EventEmitter writes events as newline-delimited JSON
+// A nil *EventEmitter discards events, so callers don't need to check whether events are enabled
+type EventEmitter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// eventLog is the process-wide event stream (nil unless -events json is set)
+var eventLog *EventEmitter
+
+// NewEventEmitter creates an emitter writing to w
+func NewEventEmitter(w io.Writer) *EventEmitter {
+	return &EventEmitter{enc: json.NewEncoder(w)}
+}
+
+// Emit writes an event, filling in the schema version and timestamp
+func (e *EventEmitter) Emit(event Event) {
+	if e == nil {
+		return
+	}
+	event.Schema = eventSchemaVersion
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.enc.Encode(event); err != nil && errorLog != nil {
+		errorLog.Printf("Warning: failed to write event: %v", err)
+	}
+}
+
+// millis returns a duration in whole milliseconds for event fields
+func millis(d time.Duration) *int64 {
+	ms := d.Milliseconds()
+	return &ms
+}
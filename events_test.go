@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// captureEvents routes the event stream into a buffer for the duration of a test
+func captureEvents(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	previous := eventLog
+	eventLog = NewEventEmitter(&buf)
+	t.Cleanup(func() { eventLog = previous })
+	return &buf
+}
+
+// decodeEvents parses an NDJSON buffer
+func decodeEvents(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var events []map[string]interface{}
+	scanner := bufio.NewScanner(bytes.NewReader(buf.Bytes()))
+	for scanner.Scan() {
+		var event map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("Invalid event line %q: %v", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// TestEventEmitterSchema tests that every event carries the schema version and a timestamp
+func TestEventEmitterSchema(t *testing.T) {
+	buf := captureEvents(t)
+
+	eventLog.Emit(Event{Type: EventFileSaved, Path: "a/b", Domain: "MediaDomain-x.jpg"})
+	eventLog.Emit(Event{Type: EventProgress, Message: "[==  ] 10%"})
+
+	events := decodeEvents(t, buf)
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(events))
+	}
+	for _, event := range events {
+		if event["schema"] != float64(eventSchemaVersion) {
+			t.Errorf("Expected schema %d, got %v", eventSchemaVersion, event["schema"])
+		}
+		if event["time"] == nil || event["time"] == "" {
+			t.Errorf("Expected time in event %v", event)
+		}
+	}
+	if events[0]["path"] != "a/b" || events[0]["type"] != EventFileSaved {
+		t.Errorf("Unexpected file_saved event: %v", events[0])
+	}
+	if _, ok := events[0]["duration_ms"]; ok {
+		t.Errorf("Unset optional fields should be omitted: %v", events[0])
+	}
+
+	// A nil emitter discards events
+	var disabled *EventEmitter
+	disabled.Emit(Event{Type: EventProgress})
+}
+
+// TestReplayEmitsEvents tests the event sequence for a replayed backup
+func TestReplayEmitsEvents(t *testing.T) {
+	buf := captureEvents(t)
+
+	tempDir := t.TempDir()
+	backupDir := filepath.Join(tempDir, "udid")
+	pngPath := filepath.Join(backupDir, "aa", "aa11")
+	if err := os.MkdirAll(filepath.Dir(pngPath), 0755); err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	writeTestPNG(t, pngPath, 20, 20, color.RGBA{1, 2, 3, 255})
+
+	logPath := filepath.Join(tempDir, "backup.log")
+	logContent := "FILE_SAVED: path=udid/aa/aa11 domain=MediaDomain-Library/SMS/a.png\n"
+	if err := os.WriteFile(logPath, []byte(logContent), 0644); err != nil {
+		t.Fatalf("Failed to write log: %v", err)
+	}
+
+	runner, err := NewBackupRunner(backupDir, "ios_backup", false, NewBackupTransformer())
+	if err != nil {
+		t.Fatalf("Failed to create runner: %v", err)
+	}
+	if err := runner.Replay(logPath); err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+
+	var types []string
+	var finished map[string]interface{}
+	for _, event := range decodeEvents(t, buf) {
+		types = append(types, event["type"].(string))
+		if event["type"] == EventTransformFinished {
+			finished = event
+		}
+	}
+
+	expected := []string{EventBackupStarted, EventFileSaved, EventTransformStarted, EventTransformFinished, EventRunCompleted}
+	if len(types) != len(expected) {
+		t.Fatalf("Expected events %v, got %v", expected, types)
+	}
+	for i := range expected {
+		if types[i] != expected[i] {
+			t.Errorf("Event %d: expected %s, got %s", i, expected[i], types[i])
+		}
+	}
+
+	if finished["action"] != "png->jpeg" || finished["outcome"] != string(OutcomeConverted) {
+		t.Errorf("Unexpected transform_finished event: %v", finished)
+	}
+	if _, ok := finished["duration_ms"]; !ok {
+		t.Errorf("transform_finished should carry duration_ms: %v", finished)
+	}
+	if _, ok := finished["queue_wait_ms"]; ok {
+		t.Errorf("queue_wait_ms belongs on transform_started: %v", finished)
+	}
+}
+
+// TestLineEvents tests FILE_FILTERED and progress line events
+func TestLineEvents(t *testing.T) {
+	buf := captureEvents(t)
+
+	runner, err := NewBackupRunner(filepath.Join(t.TempDir(), "backup"), "ios_backup", false, NewBackupTransformer())
+	if err != nil {
+		t.Fatalf("Failed to create runner: %v", err)
+	}
+
+	runner.emitLineEvent("FILE_FILTERED: path=udid/Snapshot/ab/abcd domain=HomeDomain-Library/x.plist")
+	runner.handleProgressLine("[=========================                         ]  50% (1.2 MB/2.4 MB)")
+	runner.emitLineEvent("Some other line")
+	runner.handleProgressLine("Some other line")
+
+	events := decodeEvents(t, buf)
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(events))
+	}
+	if events[0]["type"] != EventFileFiltered || events[0]["domain"] != "HomeDomain-Library/x.plist" || events[0]["path"] != "udid/Snapshot/ab/abcd" {
+		t.Errorf("Unexpected file_filtered event: %v", events[0])
+	}
+	if events[1]["type"] != EventProgress || events[1]["percent"] != float64(50) || events[1]["bytes_total"] != float64(2400000) {
+		t.Errorf("Expected progress event, got %v", events[1])
+	}
+}
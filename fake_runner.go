@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FakeRunner is an in-process ProcessRunner whose tools follow a script instead of running
+// It lets end-to-end tests exercise the backup and conversion pipeline without ios_backup,
+// heic-converter, ffmpeg or ffprobe installed
+type FakeRunner struct {
+	mu    sync.Mutex
+	tools map[string]FakeTool
+	calls []FakeCall
+}
+
+// FakeTool scripts what a faked tool does each time it is run
+type FakeTool struct {
+	Steps    []FakeStep
+	ExitCode int // Exit status once all steps ran
+}
+
+// FakeStep is one step of a faked tool run
+type FakeStep struct {
+	Delay   time.Duration // Pause before the step (cut short when the process is killed or cancelled)
+	Stdout  string        // Line written to stdout
+	Stderr  string        // Line written to stderr
+	File    string        // File created with Data
+	FileArg int           // Create the file named by this argument instead (1-based, negative counts from the end)
+	Data    []byte
+}
+
+// FakeCall records a run of a faked tool
+type FakeCall struct {
+	Name string // Registered tool name
+	Args []string
+	Env  []string
+}
+
+// FakeExitError is returned by Wait when a faked tool exits with a non-zero status or is killed
+type FakeExitError struct {
+	Code   int    // Exit status (-1 when killed)
+	Signal string // Signal that ended the process, e.g. "killed"
+}
+
+// Error returns the status like *exec.ExitError does
+func (e *FakeExitError) Error() string {
+	if e.Signal != "" {
+		return "signal: " + e.Signal
+	}
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// ExitCode returns the exit status
+func (e *FakeExitError) ExitCode() int {
+	return e.Code
+}
+
+// NewFakeRunner creates a fake runner without any tools; unregistered tools are reported as not found
+func NewFakeRunner() *FakeRunner {
+	return &FakeRunner{tools: make(map[string]FakeTool)}
+}
+
+// Register scripts a tool, replacing an earlier script of the same name
+// Names are matched against the tool name or the base name of a tool path (e.g. "ios_backup")
+func (f *FakeRunner) Register(name string, tool FakeTool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tools[name] = tool
+}
+
+// Calls returns the recorded runs of a tool
+func (f *FakeRunner) Calls(name string) []FakeCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var calls []FakeCall
+	for _, call := range f.calls {
+		if call.Name == name {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// lookup finds the registered tool for a name or path
+func (f *FakeRunner) lookup(name string) (string, FakeTool, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, candidate := range []string{name, filepath.Base(name)} {
+		if tool, ok := f.tools[candidate]; ok {
+			return candidate, tool, true
+		}
+	}
+	return "", FakeTool{}, false
+}
+
+// LookPath reports whether a tool is registered
+func (f *FakeRunner) LookPath(name string) (string, bool) {
+	if _, _, ok := f.lookup(name); !ok {
+		return "", false
+	}
+	return name, true
+}
+
+// Start runs a registered tool's script in a goroutine
+func (f *FakeRunner) Start(ctx context.Context, spec ProcessSpec) (Process, error) {
+	name, tool, ok := f.lookup(spec.Path)
+	if !ok {
+		return nil, fmt.Errorf("fork/exec %s: no such file or directory", spec.Path)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	call := FakeCall{Name: name, Args: append([]string(nil), spec.Args...), Env: spec.Env}
+	f.mu.Lock()
+	f.calls = append(f.calls, call)
+	f.mu.Unlock()
+
+	stdoutR, stdoutW := io.Pipe()
+	stderrR, stderrW := io.Pipe()
+	p := &fakeProcess{
+		stdout: stdoutR,
+		stderr: stderrR,
+		done:   make(chan struct{}),
+		killed: make(chan string, 1),
+	}
+	go func() {
+		p.err = p.run(ctx, tool, call.Args, stdoutW, stderrW)
+		stdoutW.Close()
+		stderrW.Close()
+		close(p.done)
+	}()
+	return p, nil
+}
+
+// fakeProcess is a running FakeTool script
+type fakeProcess struct {
+	stdout *io.PipeReader
+	stderr *io.PipeReader
+	done   chan struct{}
+	killed chan string // Receives the signal name when the process is signalled
+	err    error
+}
+
+func (p *fakeProcess) Stdout() io.Reader { return p.stdout }
+func (p *fakeProcess) Stderr() io.Reader { return p.stderr }
+
+func (p *fakeProcess) Wait() error {
+	<-p.done
+	return p.err
+}
+
+// Signal ends the process like a tool that exits on the signal
+func (p *fakeProcess) Signal(sig os.Signal) error {
+	return p.kill(sig.String())
+}
+
+func (p *fakeProcess) Kill() error {
+	return p.kill("killed")
+}
+
+func (p *fakeProcess) kill(signal string) error {
+	select {
+	case <-p.done:
+		return os.ErrProcessDone
+	default:
+	}
+	select {
+	case p.killed <- signal:
+	default: // Already signalled
+	}
+	return nil
+}
+
+// run executes the steps and returns the error Wait reports
+func (p *fakeProcess) run(ctx context.Context, tool FakeTool, args []string, stdout io.Writer, stderr io.Writer) error {
+	for _, step := range tool.Steps {
+		if step.Delay > 0 {
+			timer := time.NewTimer(step.Delay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return &FakeExitError{Code: -1, Signal: "killed"}
+			case signal := <-p.killed:
+				timer.Stop()
+				return &FakeExitError{Code: -1, Signal: signal}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return &FakeExitError{Code: -1, Signal: "killed"}
+		case signal := <-p.killed:
+			return &FakeExitError{Code: -1, Signal: signal}
+		default:
+		}
+
+		// The file is written first so a step can report it, e.g. with a FILE_SAVED line
+		if path := step.filePath(args); path != "" {
+			err := os.MkdirAll(filepath.Dir(path), 0755)
+			if err == nil {
+				err = os.WriteFile(path, step.Data, 0644)
+			}
+			if err != nil {
+				fmt.Fprintf(stderr, "failed to write %s: %v\n", path, err)
+				return &FakeExitError{Code: 1}
+			}
+		}
+		if step.Stdout != "" {
+			fmt.Fprintln(stdout, step.Stdout)
+		}
+		if step.Stderr != "" {
+			fmt.Fprintln(stderr, step.Stderr)
+		}
+	}
+
+	if tool.ExitCode != 0 {
+		return &FakeExitError{Code: tool.ExitCode}
+	}
+	return nil
+}
+
+// filePath returns the file a step creates, or "" if it doesn't create one
+func (s FakeStep) filePath(args []string) string {
+	switch {
+	case s.FileArg > 0 && s.FileArg <= len(args):
+		return args[s.FileArg-1]
+	case s.FileArg < 0 && -s.FileArg <= len(args):
+		return args[len(args)+s.FileArg]
+	default:
+		return s.File
+	}
+}
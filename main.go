@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
@@ -8,6 +9,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -20,32 +22,94 @@ var (
 )
 
 func main() {
+	// Installed as ios_backup_sim the binary stands in for ios_backup
+	if isSimulatorName(os.Args[0]) {
+		os.Exit(runSimulateCommand(os.Args[1:]))
+	}
+
+	// Subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "transform":
+			os.Exit(runTransformCommand(os.Args[2:]))
+		case "devices":
+			os.Exit(runDevicesCommand(os.Args[2:]))
+		case "simulate":
+			os.Exit(runSimulateCommand(os.Args[2:]))
+		case "undo":
+			os.Exit(runUndoCommand(os.Args[2:]))
+		}
+	}
+
 	var (
-		backupDir  = flag.String("backup-dir", "", "Backup directory path (required)")
-		iosBackup  = flag.String("ios-backup", "ios_backup", "Path to ios_backup executable")
-		verbose    = flag.Bool("verbose", false, "Show verbose output including filtered files")
-		logFile    = flag.String("log-file", "", "Save output to a log file (optional)")
-		help       = flag.Bool("help", false, "Show usage information")
+		backupDir   = flag.String("backup-dir", "", "Backup directory path (required)")
+		iosBackup   = flag.String("ios-backup", "ios_backup", "Path to ios_backup executable")
+		verbose     = flag.Bool("verbose", false, "Show verbose output including filtered files")
+		logFile     = flag.String("log-file", "", "Save output to a log file (optional)")
+		profile     = flag.String("profile", defaultProfileName, "Domain filter profile to back up")
+		profiles    = flag.String("profiles-file", "", "Path to a JSON file with additional domain filter profiles (default: profiles.json next to the executable)")
+		listProfs   = flag.Bool("list-profiles", false, "List available domain filter profiles and exit")
+		workers     = flag.Int("workers", defaultWorkerCount(), "Number of concurrent file transformation workers")
+		queueSize   = flag.Int("queue-size", defaultQueueSize, "Maximum saved files waiting for a worker before output reading pauses")
+		replayLog   = flag.String("replay", "", "Reprocess a recorded ios_backup output log (e.g. from -log-file) instead of running ios_backup")
+		eventsMode  = flag.String("events", "", "Machine-readable event stream: \"json\" writes NDJSON events to stdout and moves human output to stderr")
+		useJournal  = flag.Bool("journal", true, "Record conversions in a journal next to the backup so interrupted runs resume")
+		fixManifest = flag.Bool("update-manifest", true, "Rewrite the size, digest and modification time of converted files in Manifest.db after the backup")
+		trackOrigin = flag.Bool("provenance", true, "Record the original of every converted file in a provenance database next to the backup")
+		quarantine  = flag.Bool("quarantine", false, "Move the originals of converted files into a quarantine directory instead of overwriting them (restore with the undo command)")
+		quarantDir  = flag.String("quarantine-dir", "", "Quarantine directory, implies -quarantine (default: <backup-dir>.quarantine next to the backup)")
+		dryRun      = flag.Bool("dry-run", false, "Report what would be converted and the projected savings without converting anything (the backup itself still runs)")
+		udid        = flag.String("udid", "", "UDID of the device to back up (required when several devices are connected, see the devices command)")
+		network     = flag.Bool("network", false, "Back up a device connected over the network instead of USB")
+		passwordOpt = passwordFlags(flag.CommandLine)
+		retries     = flag.Int("retries", defaultRetries, "Restart ios_backup this many times after a retryable failure (0 disables retrying)")
+		retryWait   = flag.Duration("retry-backoff", defaultRetryBackoff, "Wait before the first restart, doubled for each further restart")
+		retryMax    = flag.Duration("retry-max-backoff", defaultRetryMaxBackoff, "Longest wait between restarts")
+		idleTimeout = flag.Duration("idle-timeout", defaultIdleTimeout, "Log diagnostics and check the device when ios_backup prints nothing for this long (0 disables)")
+		idleRestart = flag.Duration("idle-restart", defaultIdleRestart, "Terminate ios_backup (and retry, see -retry-on stalled) when it prints nothing for this long (0 disables)")
+		resample    = flag.String("resample", defaultResampleFilter, "Filter for downscaling images: "+strings.Join(resampleFilterNames(), ", "))
+		fileTimeout = flag.Duration("transform-timeout", defaultTransformTimeout, "Give up on a file whose conversion takes longer than this (0 disables)")
+		drainTime   = flag.Duration("shutdown-timeout", defaultDrainTimeout, "On Ctrl+C/SIGTERM, wait this long for queued files before killing conversions and saving the rest for the next run (0 waits indefinitely)")
+		metricsAddr = flag.String("metrics-addr", "", "Serve Prometheus metrics on http://<addr>/metrics, e.g. 127.0.0.1:9100 (off by default)")
+		retryOn     = flag.String("retry-on", defaultRetryOn, "Comma-separated failure kinds that restart ios_backup ("+joinKinds(backupErrorKinds)+")")
+		help        = flag.Bool("help", false, "Show usage information")
+		addDomains  stringListFlag
+		exclDomains stringListFlag
+		reports     stringListFlag
 	)
+	flag.Var(&reports, "report", "Write a per-file report when the run ends: HTML for .html paths, JSON otherwise (repeatable)")
+	flag.Var(&addDomains, "domain", "Additional ios_backup domain filter (repeatable)")
+	flag.Var(&exclDomains, "exclude-domain", "Domain filter to remove from the selected profile (repeatable)")
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "iOS Backup Transformer - Runs ios_backup and converts media files during backup\n\n")
-		fmt.Fprintf(os.Stderr, "Usage: %s -backup-dir <backup_directory>\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s -backup-dir <backup_directory>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s transform -backup-dir <backup_directory> [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s undo -backup-dir <backup_directory> [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s devices [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s simulate -fixtures <dir> [options] backup <backup_parent>\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "Description:\n")
 		fmt.Fprintf(os.Stderr, "  This tool runs ios_backup (modified idevicebackup2) that filters files by domain.\n")
-		fmt.Fprintf(os.Stderr, "  It parses the ios_backup output and transforms media files as they are saved.\n\n")
+		fmt.Fprintf(os.Stderr, "  It parses the ios_backup output and transforms media files as they are saved.\n")
+		fmt.Fprintf(os.Stderr, "  The transform command converts media in an existing backup using its Manifest.db.\n")
+		fmt.Fprintf(os.Stderr, "  The undo command restores originals kept by -quarantine.\n")
+		fmt.Fprintf(os.Stderr, "  The devices command lists connected devices and their UDIDs.\n\n")
 		fmt.Fprintf(os.Stderr, "Options:\n")
 		flag.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\nExamples:\n")
 		fmt.Fprintf(os.Stderr, "  %s -backup-dir /path/to/ios/backup/00008110-000E785101F2401E\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s -backup-dir /path/to/ios/backup/00008110-000E785101F2401E -verbose\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -backup-dir /path/to/ios/backup/00008110-000E785101F2401E -udid 00008110-000E785101F2401E\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  BACKUP_PW=secret %s -backup-dir /path/to/ios/backup/00008110-000E785101F2401E -password-env BACKUP_PW\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s -backup-dir /path/to/ios/backup/00008110-000E785101F2401E -log-file backup.log\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "\nDomain filters (automatically applied):\n")
-		fmt.Fprintf(os.Stderr, "  - *SMS* / *sms* - Text messages\n")
-		fmt.Fprintf(os.Stderr, "  - *AddressBook* - Contacts\n")
-		fmt.Fprintf(os.Stderr, "  - *WhatsApp* / *whatsapp* - WhatsApp data\n")
-		fmt.Fprintf(os.Stderr, "  - *ChatStorage.sqlite* - WhatsApp chat database\n")
-		fmt.Fprintf(os.Stderr, "  - *Message/Media/* - WhatsApp media files\n")
+		fmt.Fprintf(os.Stderr, "  %s -backup-dir /path/to/ios/backup/00008110-000E785101F2401E -retries 5 -retry-on device-disconnected,backup-failed\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -backup-dir /path/to/ios/backup/00008110-000E785101F2401E -replay backup.log\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -backup-dir /path/to/ios/backup/00008110-000E785101F2401E -profile whatsapp-only\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -backup-dir /path/to/ios/backup/00008110-000E785101F2401E -domain '*Voicemail*' -exclude-domain '*sms*'\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nDomain filter profiles (select with -profile, list all with -list-profiles):\n")
+		for _, name := range profileNames(builtinProfiles) {
+			fmt.Fprintf(os.Stderr, "  - %s - %s\n", name, builtinProfiles[name].Description)
+		}
 		fmt.Fprintf(os.Stderr, "\nMedia transformations:\n")
 		fmt.Fprintf(os.Stderr, "  - HEIC images -> JPEG (resized to 500px width, requires heic-converter)\n")
 		fmt.Fprintf(os.Stderr, "  - GIF images -> JPEG (resized to 500px width, pure Go)\n")
@@ -55,18 +119,80 @@ func main() {
 		fmt.Fprintf(os.Stderr, "  - Videos (MP4, MOV, AVI, etc.) -> JPEG thumbnail (requires ffmpeg/ffprobe)\n")
 		fmt.Fprintf(os.Stderr, "\nNote: HEIC and video conversion require external tools (heic-converter, ffmpeg, ffprobe)\n")
 		fmt.Fprintf(os.Stderr, "      to be available in libraries folder, project root, or PATH.\n")
+		fmt.Fprintf(os.Stderr, "\nExit codes:\n")
+		printExitCodes(os.Stderr)
 	}
 
 	flag.Parse()
 
+	// Load domain filter profiles (built-ins plus optional config file)
+	domainProfiles, err := LoadDomainProfiles(*profiles)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load domain profiles: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *listProfs {
+		for _, name := range profileNames(domainProfiles) {
+			p := domainProfiles[name]
+			fmt.Printf("%s - %s\n", name, p.Description)
+			if p.All {
+				fmt.Printf("    (no domain filters, whole device)\n")
+			}
+			for _, domain := range p.Domains {
+				fmt.Printf("    %s\n", domain)
+			}
+		}
+		os.Exit(0)
+	}
+
 	if *help || *backupDir == "" {
 		flag.Usage()
 		os.Exit(1)
 	}
 
+	if *replayLog != "" && *logFile != "" && filepath.Clean(*replayLog) == filepath.Clean(*logFile) {
+		fmt.Fprintf(os.Stderr, "-replay and -log-file must be different files\n")
+		os.Exit(1)
+	}
+
+	domains, err := ResolveDomains(domainProfiles, *profile, addDomains, exclDomains)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid domain filters: %v\n", err)
+		os.Exit(1)
+	}
+
+	retryKinds, err := ParseRetryableKinds(*retryOn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -retry-on: %v\n", err)
+		os.Exit(1)
+	}
+	resampleFilter, err := ParseResampleFilter(*resample)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -resample: %v\n", err)
+		os.Exit(1)
+	}
+	if *retries < 0 {
+		fmt.Fprintf(os.Stderr, "-retries must not be negative\n")
+		os.Exit(1)
+	}
+
+	// The password goes to ios_backup through its environment, never on the command line
+	password, err := ReadBackupPassword(*passwordOpt, os.Stdin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read backup password: %v\n", err)
+		os.Exit(1)
+	}
+
+	// In -events json mode stdout carries only events, so human output moves to stderr
+	console, err := setupEvents(*eventsMode)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
 	// Set up log file if specified
 	var logFileHandle *os.File
-	var err error
 	if *logFile != "" {
 		logFileHandle, err = os.Create(*logFile)
 		if err != nil {
@@ -76,7 +202,7 @@ func main() {
 		defer logFileHandle.Close()
 		
 		// Create multi-writers to output to both console and file
-		infoWriter := io.MultiWriter(os.Stdout, logFileHandle)
+		infoWriter := io.MultiWriter(console, logFileHandle)
 		errorWriter := io.MultiWriter(os.Stderr, logFileHandle)
 		
 		infoLog = log.New(infoWriter, "", 0)
@@ -88,10 +214,12 @@ func main() {
 		
 		fmt.Fprintf(logFileHandle, "iOS Backup Transformer - Log started at %s\n", time.Now().Format(time.RFC3339))
 		fmt.Fprintf(logFileHandle, "Backup directory: %s\n", *backupDir)
-		fmt.Fprintf(logFileHandle, "Verbose: %v\n\n", *verbose)
+		fmt.Fprintf(logFileHandle, "Verbose: %v\n", *verbose)
+		fmt.Fprintf(logFileHandle, "Profile: %s\n", *profile)
+		fmt.Fprintf(logFileHandle, "Domains: %s\n\n", strings.Join(domains, " "))
 	} else {
 		// Initialize loggers: info to stdout, errors to stderr
-		infoLog = log.New(os.Stdout, "", 0)
+		infoLog = log.New(console, "", 0)
 		errorLog = log.New(os.Stderr, "", 0)
 		
 		// Replace standard log with errorLog for backward compatibility with log.Fatalf
@@ -111,6 +239,46 @@ func main() {
 
 	// Create backup transformer
 	transformer := NewBackupTransformer()
+	transformer.SetFileTimeout(*fileTimeout)
+	transformer.SetResampleFilter(resampleFilter)
+
+	// Open the transformation journal so a rerun skips files that were already converted
+	// A dry run only reads an existing journal and records nothing
+	var journal *TransformJournal
+	if *useJournal && (!*dryRun || fileExists(journalPathForBackup(*backupDir))) {
+		journal, err = OpenTransformJournal(journalPathForBackup(*backupDir), *backupDir)
+		if err != nil {
+			errorLog.Printf("Failed to open transformation journal: %v", err)
+			if logFileHandle != nil {
+				logFileHandle.Close()
+			}
+			os.Exit(1)
+		}
+		transformer.SetJournal(journal)
+	}
+
+	// Record what each converted file originally was so downstream tools can explain and verify it
+	var provenance *ProvenanceStore
+	if *trackOrigin && !*dryRun {
+		provenance, err = OpenProvenanceStore(provenancePathForBackup(*backupDir))
+		if err != nil {
+			errorLog.Printf("Failed to open provenance database: %v", err)
+			if journal != nil {
+				journal.Close()
+			}
+			if logFileHandle != nil {
+				logFileHandle.Close()
+			}
+			os.Exit(1)
+		}
+		transformer.SetProvenance(provenance)
+	}
+
+	// Keep originals instead of overwriting them when asked (e.g. for evidentiary copies)
+	if keeper := quarantineForBackup(*quarantine, *quarantDir, *backupDir); keeper != nil {
+		transformer.SetQuarantine(keeper)
+	}
+	transformer.SetDryRun(*dryRun)
 
 	// Create backup runner
 	runner, err := NewBackupRunner(*backupDir, *iosBackup, *verbose, transformer)
@@ -126,23 +294,110 @@ func main() {
 	if logFileHandle != nil {
 		runner.SetLogFile(logFileHandle)
 	}
+	runner.SetDomains(domains)
+	runner.SetConsoleOutput(console)
+	runner.SetPassword(password)
+	runner.SetWatchdog(*idleTimeout, *idleRestart)
+	runner.SetDrainTimeout(*drainTime)
+	runner.SetManifestUpdate(*fixManifest && !*dryRun)
+	runner.SetRetryPolicy(RetryPolicy{
+		Retries:    *retries,
+		Backoff:    *retryWait,
+		MaxBackoff: *retryMax,
+		Retryable:  retryKinds,
+	})
+
+	// Pick the device up front so several connected phones fail fast instead of backing up an arbitrary one
+	var device Device
+	if *replayLog == "" {
+		device, err = selectBackupDevice(*udid, *network, *backupDir)
+		if err != nil {
+			logFailure("Device selection failed", err)
+			if journal != nil {
+				journal.Close()
+			}
+			if provenance != nil {
+				provenance.Close()
+			}
+			if logFileHandle != nil {
+				logFileHandle.Close()
+			}
+			os.Exit(exitCodeForError(err))
+		}
+		runner.SetDevice(device.UDID, *network)
+	}
+	runner.SetConcurrency(*workers, *queueSize)
+
+	var report *RunReport
+	if len(reports) > 0 {
+		report = NewRunReport(*backupDir)
+		report.SetDryRun(*dryRun)
+		runner.SetReport(report)
+	}
+
+	// Expose metrics for long-running backups when asked to
+	if *metricsAddr != "" {
+		backupMetrics = NewMetrics()
+		backupMetrics.SetQueueDepth(transformer.QueueDepth)
+		server, addr, err := StartMetricsServer(*metricsAddr, backupMetrics)
+		if err != nil {
+			errorLog.Printf("Failed to start metrics server: %v", err)
+			if journal != nil {
+				journal.Close()
+			}
+			if provenance != nil {
+				provenance.Close()
+			}
+			if logFileHandle != nil {
+				logFileHandle.Close()
+			}
+			os.Exit(1)
+		}
+		defer server.Close()
+		fmt.Fprintf(console, "Metrics: http://%s/metrics\n", addr)
+	}
 
 	// Set up signal handling for graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
-	fmt.Printf("Starting iOS backup with media transformation...\n")
-	fmt.Printf("Backup directory: %s\n", *backupDir)
-	fmt.Printf("ios_backup: %s\n", *iosBackup)
-	fmt.Printf("\nMedia transformations enabled:\n")
-	fmt.Printf("  - Image formats: HEIC, GIF, PNG, WEBP, JPEG -> JPEG (500px width)\n")
-	fmt.Printf("  - Video formats: MP4, MOV, AVI, etc. -> JPEG thumbnail\n")
-	fmt.Printf("\nPress Ctrl+C or send SIGTERM to stop\n\n")
+	if *replayLog != "" {
+		fmt.Fprintf(console, "Replaying recorded ios_backup output with media transformation...\n")
+		fmt.Fprintf(console, "Backup directory: %s\n", *backupDir)
+		fmt.Fprintf(console, "Replay log: %s\n", *replayLog)
+	} else {
+		fmt.Fprintf(console, "Starting iOS backup with media transformation...\n")
+		fmt.Fprintf(console, "Backup directory: %s\n", *backupDir)
+		fmt.Fprintf(console, "ios_backup: %s\n", *iosBackup)
+		if device.UDID != "" {
+			fmt.Fprintf(console, "Device: %s (%s)\n", device.UDID, deviceLabel(device))
+		}
+	}
+	if len(domains) == 0 {
+		fmt.Fprintf(console, "Profile: %s (whole device)\n", *profile)
+	} else {
+		fmt.Fprintf(console, "Profile: %s (%s)\n", *profile, strings.Join(domains, " "))
+	}
+	if *dryRun {
+		fmt.Fprintf(console, "\nDry run: media files are inspected but not converted\n")
+	}
+	fmt.Fprintf(console, "\nMedia transformations enabled:\n")
+	fmt.Fprintf(console, "  - Image formats: HEIC, GIF, PNG, WEBP, JPEG -> JPEG (500px width)\n")
+	fmt.Fprintf(console, "  - Video formats: MP4, MOV, AVI, etc. -> JPEG thumbnail\n")
+	fmt.Fprintf(console, "\nPress Ctrl+C or send SIGTERM to stop (twice to stop without waiting for conversions)\n\n")
 
-	// Run backup in a goroutine
+	// Run backup (or replay a recorded log) in a goroutine
 	errChan := make(chan error, 1)
 	go func() {
-		errChan <- runner.Run()
+		if *replayLog != "" {
+			errChan <- runner.Replay(*replayLog)
+			return
+		}
+		err := runner.Run()
+		if err == nil && runner.Encrypted() {
+			err = transformEncryptedBackup(runner.WorkContext(), transformer, *backupDir, password, *workers, report, *fixManifest && !*dryRun)
+		}
+		errChan <- err
 	}()
 
 	// Wait for either completion or shutdown signal
@@ -150,22 +405,117 @@ func main() {
 	select {
 	case err := <-errChan:
 		if err != nil {
-			errorLog.Printf("Backup failed: %v", err)
-			exitCode = 1
+			logFailure("Backup failed", err)
+			exitCode = exitCodeForError(err)
 		} else {
-			fmt.Println("\nBackup completed successfully")
+			fmt.Fprintln(console, "\nBackup completed successfully")
 		}
 		runner.Stop()
+		writeReports(report, reports, reportStatus(err, false), err)
 	case <-sigChan:
-		fmt.Println("\nShutting down gracefully...")
-		runner.Stop()
-		fmt.Println("Shutdown complete")
+		fmt.Fprintln(console, "\nShutting down gracefully... (press Ctrl+C again to force exit)")
+		go func() {
+			<-sigChan
+			fmt.Fprintln(console, "\nForcing exit...")
+			runner.ForceStop()
+		}()
+		if runner.Stop() {
+			fmt.Fprintln(console, "Shutdown complete")
+		} else {
+			fmt.Fprintln(console, "Shutdown incomplete, unfinished files will be transformed by the next run")
+			exitCode = exitCodeFailure
+		}
+		writeReports(report, reports, reportStatus(nil, true), nil)
 	}
 	
+	if *dryRun {
+		logDryRunSummary(transformer.DryRunTotals())
+	}
+
 	// Cleanup and exit
+	if journal != nil {
+		journal.Close()
+	}
+	if provenance != nil {
+		provenance.Close()
+	}
 	if logFileHandle != nil {
 		logFileHandle.Close()
 	}
 	os.Exit(exitCode)
 }
 
+// setupEvents enables the event stream for an -events value and returns the writer for human console output
+func setupEvents(mode string) (io.Writer, error) {
+	switch mode {
+	case "":
+		return os.Stdout, nil
+	case "json":
+		eventLog = NewEventEmitter(os.Stdout)
+		return os.Stderr, nil
+	default:
+		return nil, fmt.Errorf("unknown -events mode %q (supported: json)", mode)
+	}
+}
+
+// logFailure logs an error together with what the user can do about it (for classified failures)
+func logFailure(what string, err error) {
+	errorLog.Printf("%s: %v", what, err)
+	if remediation := errorRemediation(err); remediation != "" {
+		errorLog.Printf("What to do: %s", remediation)
+	}
+}
+
+// selectBackupDevice resolves the device to back up
+// Without idevice_id/ideviceinfo the -udid value (if any) is passed through unchecked
+func selectBackupDevice(udid string, network bool, backupDir string) (Device, error) {
+	connection := connectionUSB
+	if network {
+		connection = connectionNetwork
+	}
+
+	tools, err := findDeviceTools()
+	if err != nil {
+		errorLog.Printf("Warning: cannot check connected devices: %v", err)
+		return Device{UDID: udid, Connection: connection}, nil
+	}
+
+	device, err := ResolveBackupDevice(tools, udid, network)
+	if err != nil {
+		return Device{}, err
+	}
+
+	// ios_backup writes the backup to <parent>/<udid>
+	if filepath.Base(backupDir) != device.UDID {
+		errorLog.Printf("Warning: ios_backup will write to %s, not the backup directory %s",
+			filepath.Join(filepath.Dir(backupDir), device.UDID), backupDir)
+	}
+	return device, nil
+}
+
+// transformEncryptedBackup transforms an encrypted backup from its Manifest.db once ios_backup has finished
+// Files of encrypted backups can't be transformed as they arrive because their keys are only in Manifest.db
+func transformEncryptedBackup(ctx context.Context, transformer *BackupTransformer, backupDir string, password string, workers int, report *RunReport, updateManifest bool) error {
+	if password == "" {
+		infoLog.Printf("Backup is encrypted and no password was given; run \"%s transform -backup-dir %s\" with the backup password to transform media",
+			os.Args[0], backupDir)
+		return nil
+	}
+
+	infoLog.Printf("Transforming encrypted backup using Manifest.db...")
+	summary, err := TransformBackup(ctx, transformer, TransformOptions{
+		BackupDir:      backupDir,
+		Workers:        workers,
+		Password:       password,
+		Report:         report,
+		UpdateManifest: updateManifest,
+	})
+	if err != nil {
+		return err
+	}
+
+	infoLog.Printf("Encrypted backup transformed: %d converted, %d already done, %d skipped, %d failed",
+		summary.Outcomes[OutcomeConverted], summary.Outcomes[OutcomeAlreadyDone],
+		summary.Outcomes[OutcomeSkipped], summary.Outcomes[OutcomeFailed])
+	return nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"database/sql"
 	"fmt"
+	"os"
 	"path/filepath"
 	"strings"
 
@@ -11,7 +12,8 @@ import (
 
 // ManifestAnalyzer provides functionality to query iOS backup manifest databases
 type ManifestAnalyzer struct {
-	db *sql.DB
+	db       *sql.DB
+	tempPath string // Decrypted copy of an encrypted Manifest.db, removed on Close
 }
 
 // FileManifestInfo contains information from the iOS backup manifest
@@ -43,6 +45,44 @@ func NewManifestAnalyzer(manifestPath string) (*ManifestAnalyzer, error) {
 	return &ManifestAnalyzer{db: db}, nil
 }
 
+// OpenBackupManifest opens the Manifest.db of a backup, decrypting it first if the backup is encrypted
+// The decryptor is nil for unencrypted backups
+func OpenBackupManifest(backupDir string, password string) (*ManifestAnalyzer, *BackupDecryptor, error) {
+	manifestPath := filepath.Join(backupDir, "Manifest.db")
+
+	encrypted, err := IsBackupEncrypted(backupDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !encrypted {
+		analyzer, err := NewManifestAnalyzer(manifestPath)
+		return analyzer, nil, err
+	}
+
+	decryptor, err := NewBackupDecryptor(backupDir, password)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tempFile, err := os.CreateTemp("", "Manifest-*.db")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create temp file for decrypted manifest: %v", err)
+	}
+	tempFile.Close()
+
+	if err := decryptor.DecryptManifest(tempFile.Name()); err != nil {
+		os.Remove(tempFile.Name())
+		return nil, nil, err
+	}
+	analyzer, err := NewManifestAnalyzer(tempFile.Name())
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return nil, nil, err
+	}
+	analyzer.tempPath = tempFile.Name()
+	return analyzer, decryptor, nil
+}
+
 // GetFileInfo retrieves manifest information for a given file hash
 func (ma *ManifestAnalyzer) GetFileInfo(fileHash string) (*FileManifestInfo, error) {
 	query := "SELECT fileID, domain, relativePath FROM Files WHERE fileID = ?"
@@ -199,6 +239,31 @@ func (ma *ManifestAnalyzer) GetDeletableFiles() ([]FileManifestInfo, error) {
 	return deletableFiles, nil
 }
 
+// ListFiles returns every regular file recorded in the manifest (directories and symlinks are skipped)
+func (ma *ManifestAnalyzer) ListFiles() ([]FileManifestInfo, error) {
+	// Files.flags: 1 = file, 2 = directory, 4 = symlink
+	query := "SELECT fileID, domain, relativePath FROM Files WHERE flags = 1 ORDER BY domain, relativePath"
+	rows, err := ma.db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list manifest files: %v", err)
+	}
+	defer rows.Close()
+
+	var files []FileManifestInfo
+	for rows.Next() {
+		var info FileManifestInfo
+		if err := rows.Scan(&info.FileID, &info.Domain, &info.RelativePath); err != nil {
+			continue
+		}
+		files = append(files, info)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list manifest files: %v", err)
+	}
+
+	return files, nil
+}
+
 // GetDomainSummary returns a summary of files by domain
 func (ma *ManifestAnalyzer) GetDomainSummary() (map[string]int, error) {
 	query := "SELECT domain, COUNT(*) as count FROM Files GROUP BY domain ORDER BY count DESC"
@@ -222,9 +287,22 @@ func (ma *ManifestAnalyzer) GetDomainSummary() (map[string]int, error) {
 	return summary, nil
 }
 
+// FileBlob returns the archived MBFile metadata (Files.file) for a file
+func (ma *ManifestAnalyzer) FileBlob(fileID string) ([]byte, error) {
+	var blob []byte
+	if err := ma.db.QueryRow("SELECT file FROM Files WHERE fileID = ?", fileID).Scan(&blob); err != nil {
+		return nil, fmt.Errorf("failed to read file metadata for %s: %v", fileID, err)
+	}
+	return blob, nil
+}
+
 // Close closes the database connection
 func (ma *ManifestAnalyzer) Close() error {
-	return ma.db.Close()
+	err := ma.db.Close()
+	if ma.tempPath != "" {
+		os.Remove(ma.tempPath)
+	}
+	return err
 }
 
 // ExtractFileHashFromPath extracts the file hash from a backup file path
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// FileMetadata is the archived MBFile metadata rewritten for a converted file
+type FileMetadata struct {
+	Size     int64     // Size of the file's contents (plaintext size for encrypted backups)
+	Modified time.Time // Written as LastModified
+	Digest   []byte    // SHA-1 of the stored file, only written to blobs that already have a Digest
+}
+
+// storedFileMetadata reads the metadata of a backup file
+// size overrides the stored size, e.g. with the plaintext size of an encrypted file (negative uses the stored size)
+func storedFileMetadata(filePath string, size int64) (FileMetadata, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return FileMetadata{}, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return FileMetadata{}, err
+	}
+	hasher := sha1.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return FileMetadata{}, err
+	}
+
+	meta := FileMetadata{Size: size, Modified: stat.ModTime(), Digest: hasher.Sum(nil)}
+	if size < 0 {
+		meta.Size = stat.Size()
+	}
+	return meta, nil
+}
+
+// collectFileMetadata reads the metadata of converted files, keyed by fileID
+// sizes holds plaintext sizes for encrypted backups (nil uses the stored sizes)
+// Files no longer in the backup are left out
+func collectFileMetadata(backupDir string, fileIDs []string, sizes map[string]int64) map[string]FileMetadata {
+	updates := make(map[string]FileMetadata, len(fileIDs))
+	for _, fileID := range fileIDs {
+		filePath, found := backupFilePath(backupDir, fileID)
+		if !found {
+			errorLog.Printf("Warning: converted file %s is missing from the backup, leaving its Manifest.db entry", fileID)
+			continue
+		}
+		size, ok := sizes[fileID]
+		if !ok {
+			size = -1
+		}
+		meta, err := storedFileMetadata(filePath, size)
+		if err != nil {
+			errorLog.Printf("Warning: cannot read converted file %s, leaving its Manifest.db entry: %v", fileID, err)
+			continue
+		}
+		updates[fileID] = meta
+	}
+	return updates
+}
+
+// updateMBFile rewrites the size, modification time and digest of an archived MBFile (Files.file blob)
+func updateMBFile(blob []byte, meta FileMetadata) ([]byte, error) {
+	archive, err := decodeKeyedArchive(blob)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode file metadata: %v", err)
+	}
+
+	archive.root["Size"] = meta.Size
+	archive.root["LastModified"] = meta.Modified.Unix()
+	if meta.Digest != nil {
+		archive.setData("Digest", meta.Digest)
+	}
+
+	encoded, err := encodeBinaryPlist(archive.top)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode file metadata: %v", err)
+	}
+	return encoded, nil
+}
+
+// UpdateFileMetadata rewrites the Files.file blobs of converted files in one transaction
+// Files missing from the manifest or without a blob are skipped
+// Returns the number of rows updated; on error nothing is changed
+func (ma *ManifestAnalyzer) UpdateFileMetadata(updates map[string]FileMetadata) (int, error) {
+	fileIDs := make([]string, 0, len(updates))
+	for fileID := range updates {
+		fileIDs = append(fileIDs, fileID)
+	}
+	sort.Strings(fileIDs)
+
+	tx, err := ma.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to start manifest transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	updated := 0
+	for _, fileID := range fileIDs {
+		var blob []byte
+		err := tx.QueryRow("SELECT file FROM Files WHERE fileID = ?", fileID).Scan(&blob)
+		if err == sql.ErrNoRows || (err == nil && len(blob) == 0) {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read file metadata for %s: %v", fileID, err)
+		}
+
+		rewritten, err := updateMBFile(blob, updates[fileID])
+		if err != nil {
+			return 0, fmt.Errorf("failed to update file metadata for %s: %v", fileID, err)
+		}
+		if _, err := tx.Exec("UPDATE Files SET file = ? WHERE fileID = ?", rewritten, fileID); err != nil {
+			return 0, fmt.Errorf("failed to write file metadata for %s: %v", fileID, err)
+		}
+		updated++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit manifest transaction: %v", err)
+	}
+	return updated, nil
+}
+
+// updateConvertedManifest rewrites the metadata of converted (or restored) files in an open manifest
+// For encrypted backups the analyzer works on a decrypted copy, which is encrypted back over Manifest.db
+func updateConvertedManifest(analyzer *ManifestAnalyzer, decryptor *BackupDecryptor, backupDir string, fileIDs []string, sizes map[string]int64) error {
+	updated, err := analyzer.UpdateFileMetadata(collectFileMetadata(backupDir, fileIDs, sizes))
+	if err != nil {
+		return fmt.Errorf("failed to update Manifest.db: %v", err)
+	}
+	if decryptor != nil && updated > 0 {
+		if err := decryptor.EncryptManifest(analyzer.tempPath); err != nil {
+			return fmt.Errorf("failed to update Manifest.db: %v", err)
+		}
+	}
+	infoLog.Printf("Updated Manifest.db metadata of %d files", updated)
+	return nil
+}
+
+// updateManifestMetadata rewrites the Manifest.db metadata of the files this run converted
+// Runs once ios_backup has written Manifest.db; backups without one are left alone
+func (br *BackupRunner) updateManifestMetadata() error {
+	br.savedMu.Lock()
+	var fileIDs []string
+	for filePath, state := range br.savedFiles {
+		if state.converted {
+			fileIDs = append(fileIDs, filepath.Base(filePath))
+		}
+	}
+	br.savedMu.Unlock()
+	if len(fileIDs) == 0 {
+		return nil
+	}
+
+	manifestPath := filepath.Join(br.backupDir, "Manifest.db")
+	if _, err := os.Stat(manifestPath); os.IsNotExist(err) {
+		errorLog.Printf("Warning: %s not found, cannot update the metadata of converted files", manifestPath)
+		return nil
+	}
+	analyzer, err := NewManifestAnalyzer(manifestPath)
+	if err != nil {
+		return fmt.Errorf("failed to update Manifest.db: %v", err)
+	}
+	defer analyzer.Close()
+	return updateConvertedManifest(analyzer, nil, br.backupDir, fileIDs, nil)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image/color"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestEncodeBinaryPlistRoundTrip tests that encoded plists decode to the same values
+func TestEncodeBinaryPlistRoundTrip(t *testing.T) {
+	long := make([]interface{}, 40)
+	for i := range long {
+		long[i] = int64(i * 1000)
+	}
+	value := map[string]interface{}{
+		"ascii":    "Library/SMS/Attachments/a.png",
+		"unicode":  "Fotos – Übersicht 📷",
+		"negative": int64(-42),
+		"large":    int64(1 << 40),
+		"uid":      plistUID(300),
+		"real":     1.5,
+		"flag":     true,
+		"data":     []byte{0, 1, 2, 0xff},
+		"long":     long,
+		"nested":   map[string]interface{}{"root": plistUID(1), "empty": []interface{}{}},
+	}
+	value["long key "+strings.Repeat("x", 20)] = "long string " + strings.Repeat("y", 300)
+
+	encoded, err := encodeBinaryPlist(value)
+	if err != nil {
+		t.Fatalf("encodeBinaryPlist failed: %v", err)
+	}
+	decoded, err := decodePlist(encoded)
+	if err != nil {
+		t.Fatalf("decodePlist failed: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, value) {
+		t.Errorf("Round trip mismatch:\n got %#v\nwant %#v", decoded, value)
+	}
+
+	// Dates are stored as seconds since 2001
+	when := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	encoded, err = encodeBinaryPlist([]interface{}{when})
+	if err != nil {
+		t.Fatalf("encodeBinaryPlist failed: %v", err)
+	}
+	decoded, err = decodePlist(encoded)
+	if dates, _ := decoded.([]interface{}); err != nil || len(dates) != 1 || !dates[0].(time.Time).Equal(when) {
+		t.Errorf("Expected date %v, got %v, %v", when, decoded, err)
+	}
+}
+
+// TestUpdateMBFile tests rewriting size, modification time and digest in archived MBFiles
+func TestUpdateMBFile(t *testing.T) {
+	modified := time.Unix(1700000000, 0)
+	meta := FileMetadata{Size: 777, Modified: modified, Digest: bytes.Repeat([]byte{0xab}, 20)}
+
+	archives := map[string]interface{}{
+		// Digest stored as a data object
+		"data": []interface{}{
+			"$null",
+			map[string]interface{}{"Size": int64(1), "LastModified": int64(2), "Digest": plistUID(2), "ProtectionClass": int64(3)},
+			[]byte{1, 2, 3},
+		},
+		// Digest wrapped in NSMutableData
+		"wrapped": []interface{}{
+			"$null",
+			map[string]interface{}{"Size": int64(1), "LastModified": int64(2), "Digest": plistUID(2), "ProtectionClass": int64(3)},
+			map[string]interface{}{"NS.data": []byte{1, 2, 3}},
+		},
+	}
+	for name, objects := range archives {
+		blob, err := encodeBinaryPlist(map[string]interface{}{
+			"$archiver": "NSKeyedArchiver",
+			"$top":      map[string]interface{}{"root": plistUID(1)},
+			"$objects":  objects,
+		})
+		if err != nil {
+			t.Fatalf("%s: encodeBinaryPlist failed: %v", name, err)
+		}
+
+		rewritten, err := updateMBFile(blob, meta)
+		if err != nil {
+			t.Fatalf("%s: updateMBFile failed: %v", name, err)
+		}
+		archive, err := decodeKeyedArchive(rewritten)
+		if err != nil {
+			t.Fatalf("%s: rewritten blob does not decode: %v", name, err)
+		}
+		if size, _ := archive.integer("Size"); size != 777 {
+			t.Errorf("%s: expected Size 777, got %d", name, size)
+		}
+		if mtime, _ := archive.integer("LastModified"); mtime != modified.Unix() {
+			t.Errorf("%s: expected LastModified %d, got %d", name, modified.Unix(), mtime)
+		}
+		if class, _ := archive.integer("ProtectionClass"); class != 3 {
+			t.Errorf("%s: other fields should be kept, got ProtectionClass %d", name, class)
+		}
+		if digest := archive.data("Digest"); !bytes.Equal(digest, meta.Digest) {
+			t.Errorf("%s: expected the new digest, got %x", name, digest)
+		}
+	}
+
+	// Blobs without a Digest don't gain one
+	blob, _ := encodeBinaryPlist(map[string]interface{}{
+		"$top":     map[string]interface{}{"root": plistUID(1)},
+		"$objects": []interface{}{"$null", map[string]interface{}{"Size": int64(1)}},
+	})
+	rewritten, err := updateMBFile(blob, meta)
+	if err != nil {
+		t.Fatalf("updateMBFile failed: %v", err)
+	}
+	if archive, _ := decodeKeyedArchive(rewritten); archive == nil || archive.root["Digest"] != nil {
+		t.Error("Digest should only be rewritten when present")
+	}
+}
+
+// TestTransformBackupUpdatesManifest tests that converted files get their new size in Manifest.db
+func TestTransformBackupUpdatesManifest(t *testing.T) {
+	backupDir := filepath.Join(t.TempDir(), "00008110-000E785101F2401E")
+	files := []simulatorFile{
+		{domain: "MediaDomain", relativePath: "Library/SMS/Attachments/01/IMG_0001.PNG"},
+		{domain: "MediaDomain", relativePath: "Library/SMS/Attachments/02/notes.txt"},
+	}
+	for i := range files {
+		files[i].fileID = simulatorFileID(files[i].domain, files[i].relativePath)
+		path := filepath.Join(backupDir, files[i].fileID[:2], files[i].fileID)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		if i == 0 {
+			writeTestPNG(t, path, 900, 600, color.RGBA{10, 20, 30, 255})
+		} else if err := os.WriteFile(path, []byte("hello"), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+		// Backdate the files so the rewritten modification time is distinguishable
+		old := time.Now().Add(-48 * time.Hour)
+		os.Chtimes(path, old, old)
+	}
+	if err := writeSimulatedManifest(backupDir, files); err != nil {
+		t.Fatalf("writeSimulatedManifest failed: %v", err)
+	}
+
+	summary, err := TransformBackup(context.Background(), NewBackupTransformer(), TransformOptions{
+		BackupDir:      backupDir,
+		Workers:        1,
+		UpdateManifest: true,
+	})
+	if err != nil {
+		t.Fatalf("TransformBackup failed: %v", err)
+	}
+	if summary.Outcomes[OutcomeConverted] != 1 {
+		t.Fatalf("Expected 1 converted file, got %+v", summary.Outcomes)
+	}
+
+	analyzer, err := NewManifestAnalyzer(filepath.Join(backupDir, "Manifest.db"))
+	if err != nil {
+		t.Fatalf("Failed to open manifest: %v", err)
+	}
+	defer analyzer.Close()
+	for i, file := range files {
+		blob, err := analyzer.FileBlob(file.fileID)
+		if err != nil {
+			t.Fatalf("FileBlob failed: %v", err)
+		}
+		archive, err := decodeKeyedArchive(blob)
+		if err != nil {
+			t.Fatalf("Rewritten blob does not decode: %v", err)
+		}
+		path := filepath.Join(backupDir, file.fileID[:2], file.fileID)
+		stat, _ := os.Stat(path)
+		size, _ := archive.integer("Size")
+		mtime, _ := archive.integer("LastModified")
+		if size != stat.Size() || mtime != stat.ModTime().Unix() {
+			t.Errorf("%s: manifest has size %d, mtime %d; file has %d, %d",
+				file.relativePath, size, mtime, stat.Size(), stat.ModTime().Unix())
+		}
+		if i == 0 && !isJPEGFile(t, path) {
+			t.Error("Expected the PNG to be converted")
+		}
+	}
+}
+
+// TestTransformEncryptedBackupUpdatesManifest tests that the re-encrypted Manifest.db records plaintext sizes
+func TestTransformEncryptedBackupUpdatesManifest(t *testing.T) {
+	fixture := createEncryptedBackup(t)
+
+	opts := TransformOptions{BackupDir: fixture.dir, Workers: 1, Password: fixture.password, UpdateManifest: true}
+	summary, err := TransformBackup(context.Background(), NewBackupTransformer(), opts)
+	if err != nil {
+		t.Fatalf("TransformBackup failed: %v", err)
+	}
+	if summary.Outcomes[OutcomeConverted] != 1 {
+		t.Fatalf("Expected 1 converted file, got %+v", summary.Outcomes)
+	}
+
+	decrypted := filepath.Join(t.TempDir(), "out.jpg")
+	if err := DecryptFile(fixture.fileKey, filepath.Join(fixture.dir, fixture.fileID[:2], fixture.fileID), decrypted); err != nil {
+		t.Fatalf("DecryptFile failed: %v", err)
+	}
+
+	analyzer, decryptor, err := OpenBackupManifest(fixture.dir, fixture.password)
+	if err != nil {
+		t.Fatalf("Re-encrypted Manifest.db does not open: %v", err)
+	}
+	defer analyzer.Close()
+	blob, err := analyzer.FileBlob(fixture.fileID)
+	if err != nil {
+		t.Fatalf("FileBlob failed: %v", err)
+	}
+	archive, err := decodeKeyedArchive(blob)
+	if err != nil {
+		t.Fatalf("Rewritten blob does not decode: %v", err)
+	}
+	if size, _ := archive.integer("Size"); size != fileSize(decrypted) {
+		t.Errorf("Expected the plaintext size %d, got %d", fileSize(decrypted), size)
+	}
+	if key, err := decryptor.FileKey(blob); err != nil || !bytes.Equal(key, fixture.fileKey) {
+		t.Errorf("File key should survive the rewrite, got %x, %v", key, err)
+	}
+}
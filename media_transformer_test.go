@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
@@ -127,7 +128,7 @@ func TestBackupTransformerWithAttachmentFiles(t *testing.T) {
 			DiscoveryMethod: "test",
 		}
 		// Use ProcessFileByExtension with derived extension
-		transformer.ProcessFileByExtension(destPath, fileExt, timing)
+		transformer.ProcessFileByExtension(context.Background(), destPath, fileExt, timing)
 
 			// Check if file still exists
 			if _, err := os.Stat(destPath); os.IsNotExist(err) {
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupMetrics collects Prometheus metrics when -metrics-addr is set (nil otherwise)
+var backupMetrics *Metrics
+
+// Histogram buckets in seconds
+var (
+	queueWaitBuckets         = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 1800, 3600}
+	transformDurationBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+)
+
+// Metrics holds the counters and histograms exposed on the metrics endpoint
+// All methods are safe to call on a nil *Metrics, which records nothing
+type Metrics struct {
+	filesSaved        *counterVec
+	filesFiltered     *counterVec
+	transforms        *counterVec
+	inputBytes        *counterVec
+	outputBytes       *counterVec
+	toolFailures      *counterVec
+	queueWait         *histogramVec
+	transformDuration *histogramVec
+
+	mu         sync.Mutex
+	queueDepth func() (active int64, total int64)
+}
+
+// NewMetrics creates an empty metrics registry
+func NewMetrics() *Metrics {
+	return &Metrics{
+		filesSaved: newCounterVec("iosbackup_files_saved_total",
+			"Files saved by ios_backup, by backup domain", "domain"),
+		filesFiltered: newCounterVec("iosbackup_files_filtered_total",
+			"Files skipped by the domain filter, by backup domain", "domain"),
+		transforms: newCounterVec("iosbackup_transforms_total",
+			"Finished transformations, by conversion type and outcome", "type", "outcome"),
+		inputBytes: newCounterVec("iosbackup_transform_input_bytes_total",
+			"Size of converted files before conversion", "type"),
+		outputBytes: newCounterVec("iosbackup_transform_output_bytes_total",
+			"Size of converted files after conversion", "type"),
+		toolFailures: newCounterVec("iosbackup_tool_failures_total",
+			"Failed runs of external tools (heic-converter, ffmpeg, ffprobe)", "tool"),
+		queueWait: newHistogramVec("iosbackup_transform_queue_wait_seconds",
+			"Time from a file being discovered to its transformation starting", queueWaitBuckets),
+		transformDuration: newHistogramVec("iosbackup_transform_duration_seconds",
+			"Time from a transformation starting to it finishing, by conversion type", transformDurationBuckets, "type"),
+	}
+}
+
+// SetQueueDepth sets the function reporting the active and total file counts
+func (m *Metrics) SetQueueDepth(queueDepth func() (int64, int64)) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.queueDepth = queueDepth
+	m.mu.Unlock()
+}
+
+// FileSaved counts a FILE_SAVED line; domain is the "<domain>-<relativePath>" key ios_backup prints
+func (m *Metrics) FileSaved(domain string) {
+	if m == nil {
+		return
+	}
+	m.filesSaved.Add(1, manifestDomain(domain))
+}
+
+// FileFiltered counts a FILE_FILTERED line
+func (m *Metrics) FileFiltered(domain string) {
+	if m == nil {
+		return
+	}
+	m.filesFiltered.Add(1, manifestDomain(domain))
+}
+
+// TransformFinished records a finished transformation and its latency from FileTiming
+// Sizes are only counted for converted files
+func (m *Metrics) TransformFinished(result TransformResult, timing *FileTiming) {
+	if m == nil {
+		return
+	}
+	m.transforms.Add(1, result.Action, string(result.Outcome))
+	if result.Outcome == OutcomeConverted {
+		m.inputBytes.Add(float64(result.SizeBefore), result.Action)
+		m.outputBytes.Add(float64(result.SizeAfter), result.Action)
+	}
+	m.transformDuration.Observe(result.Duration.Seconds(), result.Action)
+	if timing != nil && !timing.DiscoveredTime.IsZero() && !timing.TransformationStartTime.IsZero() {
+		m.queueWait.Observe(timing.TransformationStartTime.Sub(timing.DiscoveredTime).Seconds())
+	}
+}
+
+// ToolFailed counts a failed run of an external tool
+func (m *Metrics) ToolFailed(path string) {
+	if m == nil {
+		return
+	}
+	tool := filepath.Base(path)
+	m.toolFailures.Add(1, strings.TrimSuffix(tool, filepath.Ext(tool)))
+}
+
+// WriteText writes all metrics in the Prometheus text exposition format
+func (m *Metrics) WriteText(w io.Writer) error {
+	if m == nil {
+		return nil
+	}
+	var b strings.Builder
+	for _, counter := range []*counterVec{m.filesSaved, m.filesFiltered, m.transforms, m.inputBytes, m.outputBytes, m.toolFailures} {
+		counter.write(&b)
+	}
+
+	m.mu.Lock()
+	queueDepth := m.queueDepth
+	m.mu.Unlock()
+	var active, total int64
+	if queueDepth != nil {
+		active, total = queueDepth()
+	}
+	writeGauge(&b, "iosbackup_queue_active_files", "Files queued or being transformed", active)
+	writeGauge(&b, "iosbackup_queue_total_files", "Files handed to transformation so far", total)
+
+	m.queueWait.write(&b)
+	m.transformDuration.write(&b)
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// ServeHTTP serves the metrics on /metrics
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := m.WriteText(w); err != nil {
+		errorLog.Printf("Error writing metrics: %v", err)
+	}
+}
+
+// StartMetricsServer serves metrics on addr (e.g. "127.0.0.1:9100") until the server is closed
+// Returns the address actually listened on, which differs from addr when its port is 0
+func StartMetricsServer(addr string, m *Metrics) (*http.Server, string, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			errorLog.Printf("Metrics server stopped: %v", err)
+		}
+	}()
+	return server, listener.Addr().String(), nil
+}
+
+// containerDomainPrefixes start the domains of app and system containers, which carry the container id
+// e.g. "AppDomain-net.whatsapp.WhatsApp" or "SysSharedContainerDomain-systemgroup.com.apple.configurationprofiles"
+var containerDomainPrefixes = []string{
+	"AppDomainGroup-",
+	"AppDomainPlugin-",
+	"AppDomain-",
+	"SysContainerDomain-",
+	"SysSharedContainerDomain-",
+}
+
+// manifestDomain returns the backup domain of a "<domain>-<relativePath>" key
+// e.g. "MediaDomain-Library/SMS/a.jpg" -> "MediaDomain", "HomeDomain-foo-bar.plist" -> "HomeDomain",
+// "AppDomainGroup-group.net.whatsapp.WhatsApp.shared-Message/Media/a.jpg" -> "AppDomainGroup-group.net.whatsapp.WhatsApp.shared"
+// Fixed domains contain no '-', so they end at the first '-'; container ids may contain '-' but never '/',
+// so container domains end at the last '-' before the first '/'
+// A container file at the root without '/' is ambiguous: "AppDomain-com.x-foo-bar.plist" gives "AppDomain-com.x-foo"
+// (the key alone can't tell a '-' in the container id from one in the file name)
+func manifestDomain(key string) string {
+	for _, prefix := range containerDomainPrefixes {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		head := key
+		if slash := strings.Index(key, "/"); slash >= 0 {
+			head = key[:slash]
+		}
+		if dash := strings.LastIndex(head, "-"); dash >= len(prefix) {
+			return head[:dash]
+		}
+		return head
+	}
+	if dash := strings.Index(key, "-"); dash > 0 {
+		return key[:dash]
+	}
+	if key == "" {
+		return "unknown"
+	}
+	return key
+}
+
+// counterVec is a counter with labels
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64 // Keyed by the formatted label set
+}
+
+func newCounterVec(name string, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+// Add increases the counter for a set of label values
+func (c *counterVec) Add(value float64, labelValues ...string) {
+	key := formatLabels(c.labels, labelValues)
+	c.mu.Lock()
+	c.values[key] += value
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(b *strings.Builder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(b, "%s%s %s\n", c.name, key, formatFloat(c.values[key]))
+	}
+}
+
+// histogramVec is a histogram with labels
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram // Keyed by the label values joined with '\xff'
+}
+
+// histogram holds per-bucket (non-cumulative) counts
+type histogram struct {
+	labelValues []string
+	counts      []uint64 // One per bucket plus +Inf
+	sum         float64
+	count       uint64
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogram)}
+}
+
+// Observe records a value for a set of label values
+func (h *histogramVec) Observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogram{labelValues: labelValues, counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = series
+	}
+	bucket := sort.SearchFloat64s(h.buckets, value) // First bucket with an upper bound >= value
+	series.counts[bucket]++
+	series.sum += value
+	series.count++
+}
+
+func (h *histogramVec) write(b *strings.Builder) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	labels := append(append([]string(nil), h.labels...), "le")
+	for _, key := range keys {
+		series := h.series[key]
+		values := append(append([]string(nil), series.labelValues...), "")
+		var cumulative uint64
+		for i, count := range series.counts {
+			cumulative += count
+			values[len(values)-1] = "+Inf"
+			if i < len(h.buckets) {
+				values[len(values)-1] = formatFloat(h.buckets[i])
+			}
+			fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, formatLabels(labels, values), cumulative)
+		}
+		plain := formatLabels(h.labels, series.labelValues)
+		fmt.Fprintf(b, "%s_sum%s %s\n", h.name, plain, formatFloat(series.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", h.name, plain, series.count)
+	}
+}
+
+// writeGauge writes a single unlabelled gauge
+func writeGauge(b *strings.Builder, name string, help string, value int64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, value)
+}
+
+// formatLabels formats label pairs like {domain="MediaDomain"}, or "" without labels
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = name + `="` + escapeLabelValue(value) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// escapeLabelValue escapes backslashes, quotes and newlines in a label value
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// formatFloat formats a sample value the way Prometheus clients do
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// sortedKeys returns the keys of a map in order
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// fileSize returns the size of a file, or 0 if it can't be read
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image/color"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestManifestDomain tests splitting the domain off ios_backup's "<domain>-<relativePath>" keys
+func TestManifestDomain(t *testing.T) {
+	tests := map[string]string{
+		"MediaDomain-Library/SMS/Attachments/a.jpg":                             "MediaDomain",
+		"AppDomainGroup-group.net.whatsapp.WhatsApp.shared-Message/Media/a.jpg": "AppDomainGroup-group.net.whatsapp.WhatsApp.shared",
+		"HomeDomain-Library":                                                   "HomeDomain",
+		"HomeDomain-foo-bar.plist":                                             "HomeDomain",
+		"CameraRollDomain-Media/DCIM/100APPLE/IMG-0001.HEIC":                   "CameraRollDomain",
+		"AppDomain-com.example.my-app-Documents/a.jpg":                         "AppDomain-com.example.my-app",
+		"AppDomainPlugin-net.whatsapp.WhatsApp.ServiceExtension-Library/a.jpg": "AppDomainPlugin-net.whatsapp.WhatsApp.ServiceExtension",
+		"AppDomain-net.whatsapp.WhatsApp":                                      "AppDomain-net.whatsapp.WhatsApp",
+		"CameraRollDomain":                                                     "CameraRollDomain",
+		// Known limitation: without a '/' the last '-' is taken as the end of the container id
+		"AppDomain-com.x-foo-bar.plist": "AppDomain-com.x-foo",
+		"":                              "unknown",
+	}
+	for key, want := range tests {
+		if got := manifestDomain(key); got != want {
+			t.Errorf("manifestDomain(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+// TestMetricsExposition tests the text exposition of counters, gauges and histograms
+func TestMetricsExposition(t *testing.T) {
+	m := NewMetrics()
+	m.SetQueueDepth(func() (int64, int64) { return 2, 7 })
+	m.FileSaved("MediaDomain-Library/SMS/a.jpg")
+	m.FileSaved("MediaDomain-Library/SMS/b.jpg")
+	m.FileFiltered("HomeDomain-Library/Preferences/x.plist")
+	m.ToolFailed("/usr/local/bin/heic-converter.exe")
+
+	start := time.Now()
+	timing := &FileTiming{DiscoveredTime: start.Add(-2 * time.Second), TransformationStartTime: start}
+	m.TransformFinished(TransformResult{Action: "png->jpeg", Outcome: OutcomeConverted, SizeBefore: 1000, SizeAfter: 400,
+		Duration: 300 * time.Millisecond}, timing)
+	m.TransformFinished(TransformResult{Action: "heic->jpeg", Outcome: OutcomeFailed, SizeBefore: 500, SizeAfter: 500}, nil)
+	m.transforms.Add(1, `odd"type`, "converted")
+
+	var buf bytes.Buffer
+	if err := m.WriteText(&buf); err != nil {
+		t.Fatalf("WriteText failed: %v", err)
+	}
+	text := buf.String()
+	for _, want := range []string{
+		"# TYPE iosbackup_files_saved_total counter\n",
+		`iosbackup_files_saved_total{domain="MediaDomain"} 2` + "\n",
+		`iosbackup_files_filtered_total{domain="HomeDomain"} 1` + "\n",
+		`iosbackup_transforms_total{type="png->jpeg",outcome="converted"} 1` + "\n",
+		`iosbackup_transforms_total{type="heic->jpeg",outcome="failed"} 1` + "\n",
+		`iosbackup_transforms_total{type="odd\"type",outcome="converted"} 1` + "\n",
+		`iosbackup_transform_input_bytes_total{type="png->jpeg"} 1000` + "\n",
+		`iosbackup_transform_output_bytes_total{type="png->jpeg"} 400` + "\n",
+		`iosbackup_tool_failures_total{tool="heic-converter"} 1` + "\n",
+		"iosbackup_queue_active_files 2\n",
+		"iosbackup_queue_total_files 7\n",
+		"# TYPE iosbackup_transform_queue_wait_seconds histogram\n",
+		`iosbackup_transform_queue_wait_seconds_bucket{le="1"} 0` + "\n",
+		`iosbackup_transform_queue_wait_seconds_bucket{le="5"} 1` + "\n",
+		`iosbackup_transform_queue_wait_seconds_bucket{le="+Inf"} 1` + "\n",
+		"iosbackup_transform_queue_wait_seconds_sum 2\n",
+		"iosbackup_transform_queue_wait_seconds_count 1\n",
+		`iosbackup_transform_duration_seconds_bucket{type="png->jpeg",le="0.25"} 0` + "\n",
+		`iosbackup_transform_duration_seconds_bucket{type="png->jpeg",le="0.5"} 1` + "\n",
+		`iosbackup_transform_duration_seconds_count{type="png->jpeg"} 1` + "\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Missing %q in metrics:\n%s", want, text)
+		}
+	}
+	if strings.Contains(text, `iosbackup_transform_input_bytes_total{type="heic->jpeg"}`) {
+		t.Error("Sizes of failed conversions should not be counted")
+	}
+
+	// A nil registry records nothing
+	var disabled *Metrics
+	disabled.FileSaved("MediaDomain-x")
+	disabled.TransformFinished(TransformResult{Action: "png->jpeg"}, nil)
+}
+
+// TestMetricsServer tests that a transformation shows up on the metrics endpoint
+func TestMetricsServer(t *testing.T) {
+	m := NewMetrics()
+	backupMetrics = m
+	defer func() { backupMetrics = nil }()
+
+	server, addr, err := StartMetricsServer("127.0.0.1:0", m)
+	if err != nil {
+		t.Fatalf("Failed to start metrics server: %v", err)
+	}
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "abcd")
+	writeTestPNG(t, path, 1200, 900, color.RGBA{10, 120, 200, 255})
+	transformer := NewBackupTransformer()
+	m.SetQueueDepth(transformer.QueueDepth)
+	timing := &FileTiming{DiscoveredTime: time.Now()}
+	if result := transformer.ProcessFileByExtension(context.Background(), path, ".png", timing); result.Outcome != OutcomeConverted {
+		t.Fatalf("Expected the PNG to be converted, got %+v", result)
+	}
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatalf("Failed to fetch metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+	for _, want := range []string{
+		`iosbackup_transforms_total{type="png->jpeg",outcome="converted"} 1`,
+		`iosbackup_transform_queue_wait_seconds_count 1`,
+		`iosbackup_transform_duration_seconds_count{type="png->jpeg"} 1`,
+		"iosbackup_queue_total_files 0",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("Missing %q in metrics:\n%s", want, body)
+		}
+	}
+	if strings.Contains(string(body), `iosbackup_transform_input_bytes_total{type="png->jpeg"} 0`+"\n") {
+		t.Error("Expected the input size to be counted")
+	}
+}
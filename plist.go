@@ -0,0 +1,668 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Property list values decode to:
+//   dict -> map[string]interface{}, array/set -> []interface{}, string -> string,
+//   integer -> int64, real -> float64, bool -> bool, data -> []byte, date -> time.Time,
+//   UID (NSKeyedArchiver object reference) -> plistUID
+
+// plistUID is a binary plist UID, used by NSKeyedArchiver to reference objects
+type plistUID uint64
+
+// plistEpoch is the reference date for plist dates
+var plistEpoch = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// maxPlistDepth guards against reference cycles in malformed binary plists
+const maxPlistDepth = 256
+
+// decodePlist decodes a binary (bplist00) or XML property list
+func decodePlist(data []byte) (interface{}, error) {
+	if bytes.HasPrefix(data, []byte("bplist00")) {
+		return decodeBinaryPlist(data)
+	}
+	return decodeXMLPlist(data)
+}
+
+// bplistDecoder reads objects from a binary plist
+type bplistDecoder struct {
+	data    []byte
+	offsets []uint64
+	refSize int
+}
+
+// decodeBinaryPlist decodes a bplist00 property list
+func decodeBinaryPlist(data []byte) (interface{}, error) {
+	if len(data) < 8+32 {
+		return nil, fmt.Errorf("binary plist too short")
+	}
+
+	trailer := data[len(data)-32:]
+	offsetSize := int(trailer[6])
+	refSize := int(trailer[7])
+	numObjects := binary.BigEndian.Uint64(trailer[8:16])
+	topObject := binary.BigEndian.Uint64(trailer[16:24])
+	tableOffset := binary.BigEndian.Uint64(trailer[24:32])
+
+	if offsetSize < 1 || offsetSize > 8 || refSize < 1 || refSize > 8 {
+		return nil, fmt.Errorf("invalid binary plist trailer")
+	}
+	bodyEnd := uint64(len(data) - 32)
+	if numObjects == 0 || topObject >= numObjects || tableOffset > bodyEnd ||
+		numObjects > (bodyEnd-tableOffset)/uint64(offsetSize) {
+		return nil, fmt.Errorf("invalid binary plist offset table")
+	}
+
+	d := &bplistDecoder{data: data[:bodyEnd], refSize: refSize}
+	d.offsets = make([]uint64, numObjects)
+	for i := range d.offsets {
+		start := tableOffset + uint64(i*offsetSize)
+		d.offsets[i] = readBigEndian(data[start : start+uint64(offsetSize)])
+	}
+
+	return d.object(topObject, 0)
+}
+
+// readBigEndian reads an unsigned big-endian integer of 1-8 bytes
+func readBigEndian(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// bytesAt returns n bytes at off, checking bounds
+func (d *bplistDecoder) bytesAt(off uint64, n uint64) ([]byte, error) {
+	if off > uint64(len(d.data)) || n > uint64(len(d.data))-off {
+		return nil, fmt.Errorf("binary plist object out of range")
+	}
+	return d.data[off : off+n], nil
+}
+
+// count returns the element count of a variable length object and where its contents start
+func (d *bplistDecoder) count(off uint64, info byte) (uint64, uint64, error) {
+	if info != 0x0f {
+		return uint64(info), off + 1, nil
+	}
+	marker, err := d.bytesAt(off+1, 1)
+	if err != nil {
+		return 0, 0, err
+	}
+	if marker[0]>>4 != 0x1 {
+		return 0, 0, fmt.Errorf("invalid binary plist count")
+	}
+	n := uint64(1) << (marker[0] & 0x0f)
+	if n > 8 {
+		return 0, 0, fmt.Errorf("binary plist count too large")
+	}
+	b, err := d.bytesAt(off+2, n)
+	if err != nil {
+		return 0, 0, err
+	}
+	return readBigEndian(b), off + 2 + n, nil
+}
+
+// refs reads count object references starting at off
+func (d *bplistDecoder) refs(off uint64, count uint64) ([]uint64, error) {
+	if count > uint64(len(d.data)) {
+		return nil, fmt.Errorf("binary plist object out of range")
+	}
+	b, err := d.bytesAt(off, count*uint64(d.refSize))
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]uint64, count)
+	for i := range refs {
+		refs[i] = readBigEndian(b[i*d.refSize : (i+1)*d.refSize])
+	}
+	return refs, nil
+}
+
+// object decodes the object with the given reference
+func (d *bplistDecoder) object(ref uint64, depth int) (interface{}, error) {
+	if depth > maxPlistDepth {
+		return nil, fmt.Errorf("binary plist nested too deeply")
+	}
+	if ref >= uint64(len(d.offsets)) {
+		return nil, fmt.Errorf("invalid binary plist object reference %d", ref)
+	}
+	off := d.offsets[ref]
+	head, err := d.bytesAt(off, 1)
+	if err != nil {
+		return nil, err
+	}
+	kind, info := head[0]>>4, head[0]&0x0f
+
+	switch kind {
+	case 0x0:
+		switch info {
+		case 0x0:
+			return nil, nil
+		case 0x8:
+			return false, nil
+		case 0x9:
+			return true, nil
+		}
+		return nil, fmt.Errorf("unsupported binary plist marker 0x%02x", head[0])
+	case 0x1:
+		n := uint64(1) << info
+		if n > 16 {
+			return nil, fmt.Errorf("binary plist integer too large")
+		}
+		b, err := d.bytesAt(off+1, n)
+		if err != nil {
+			return nil, err
+		}
+		if n == 16 {
+			b = b[8:] // 128-bit integers only carry values that fit in the low 64 bits
+		}
+		return int64(readBigEndian(b)), nil
+	case 0x2:
+		n := uint64(1) << info
+		b, err := d.bytesAt(off+1, n)
+		if err != nil {
+			return nil, err
+		}
+		switch n {
+		case 4:
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+		case 8:
+			return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+		}
+		return nil, fmt.Errorf("unsupported binary plist real size %d", n)
+	case 0x3:
+		b, err := d.bytesAt(off+1, 8)
+		if err != nil {
+			return nil, err
+		}
+		seconds := math.Float64frombits(binary.BigEndian.Uint64(b))
+		return plistEpoch.Add(time.Duration(seconds * float64(time.Second))), nil
+	case 0x4, 0x5, 0x6:
+		n, start, err := d.count(off, info)
+		if err != nil {
+			return nil, err
+		}
+		if kind == 0x6 {
+			if n > uint64(len(d.data)) {
+				return nil, fmt.Errorf("binary plist object out of range")
+			}
+			b, err := d.bytesAt(start, n*2)
+			if err != nil {
+				return nil, err
+			}
+			units := make([]uint16, n)
+			for i := range units {
+				units[i] = binary.BigEndian.Uint16(b[i*2:])
+			}
+			return string(utf16.Decode(units)), nil
+		}
+		b, err := d.bytesAt(start, n)
+		if err != nil {
+			return nil, err
+		}
+		if kind == 0x5 {
+			return string(b), nil
+		}
+		return append([]byte(nil), b...), nil
+	case 0x8:
+		b, err := d.bytesAt(off+1, uint64(info)+1)
+		if err != nil {
+			return nil, err
+		}
+		return plistUID(readBigEndian(b)), nil
+	case 0xA, 0xC:
+		n, start, err := d.count(off, info)
+		if err != nil {
+			return nil, err
+		}
+		refs, err := d.refs(start, n)
+		if err != nil {
+			return nil, err
+		}
+		array := make([]interface{}, 0, len(refs))
+		for _, r := range refs {
+			v, err := d.object(r, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, v)
+		}
+		return array, nil
+	case 0xD:
+		n, start, err := d.count(off, info)
+		if err != nil {
+			return nil, err
+		}
+		refs, err := d.refs(start, n*2)
+		if err != nil {
+			return nil, err
+		}
+		dict := make(map[string]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			k, err := d.object(refs[i], depth+1)
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("binary plist dictionary key is not a string")
+			}
+			v, err := d.object(refs[n+i], depth+1)
+			if err != nil {
+				return nil, err
+			}
+			dict[key] = v
+		}
+		return dict, nil
+	}
+
+	return nil, fmt.Errorf("unsupported binary plist marker 0x%02x", head[0])
+}
+
+// decodeXMLPlist decodes an XML property list
+func decodeXMLPlist(data []byte) (interface{}, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no value in XML plist")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse XML plist: %v", err)
+		}
+		if start, ok := tok.(xml.StartElement); ok && start.Name.Local != "plist" {
+			return decodeXMLValue(dec, start)
+		}
+	}
+}
+
+// decodeXMLValue decodes the element that starts with start
+func decodeXMLValue(dec *xml.Decoder, start xml.StartElement) (interface{}, error) {
+	switch start.Name.Local {
+	case "dict":
+		dict := make(map[string]interface{})
+		var key *string
+		for {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse XML plist dict: %v", err)
+			}
+			switch t := tok.(type) {
+			case xml.StartElement:
+				if t.Name.Local == "key" {
+					var k string
+					if err := dec.DecodeElement(&k, &t); err != nil {
+						return nil, fmt.Errorf("failed to parse XML plist key: %v", err)
+					}
+					key = &k
+					continue
+				}
+				if key == nil {
+					return nil, fmt.Errorf("XML plist dict value without key")
+				}
+				v, err := decodeXMLValue(dec, t)
+				if err != nil {
+					return nil, err
+				}
+				dict[*key] = v
+				key = nil
+			case xml.EndElement:
+				// XML plists write NSKeyedArchiver UIDs as <dict><key>CF$UID</key><integer>N</integer></dict>
+				if uid, ok := dict["CF$UID"].(int64); ok && len(dict) == 1 {
+					return plistUID(uid), nil
+				}
+				return dict, nil
+			}
+		}
+	case "array":
+		array := []interface{}{}
+		for {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse XML plist array: %v", err)
+			}
+			switch t := tok.(type) {
+			case xml.StartElement:
+				v, err := decodeXMLValue(dec, t)
+				if err != nil {
+					return nil, err
+				}
+				array = append(array, v)
+			case xml.EndElement:
+				return array, nil
+			}
+		}
+	case "true", "false":
+		if err := dec.Skip(); err != nil {
+			return nil, fmt.Errorf("failed to parse XML plist bool: %v", err)
+		}
+		return start.Name.Local == "true", nil
+	}
+
+	var text string
+	if err := dec.DecodeElement(&text, &start); err != nil {
+		return nil, fmt.Errorf("failed to parse XML plist %s: %v", start.Name.Local, err)
+	}
+	text = strings.TrimSpace(text)
+
+	switch start.Name.Local {
+	case "string":
+		return text, nil
+	case "integer":
+		return strconv.ParseInt(text, 10, 64)
+	case "real":
+		return strconv.ParseFloat(text, 64)
+	case "data":
+		clean := strings.Map(func(r rune) rune {
+			if r == ' ' || r == '\t' || r == '\n' || r == '\r' {
+				return -1
+			}
+			return r
+		}, text)
+		return base64.StdEncoding.DecodeString(clean)
+	case "date":
+		return time.Parse(time.RFC3339, text)
+	}
+	return nil, fmt.Errorf("unsupported XML plist element <%s>", start.Name.Local)
+}
+
+// plistInt returns an integer plist value
+func plistInt(v interface{}) (int64, bool) {
+	n, ok := v.(int64)
+	return n, ok
+}
+
+// keyedArchive is a decoded NSKeyedArchiver plist
+type keyedArchive struct {
+	top     map[string]interface{} // Top-level dictionary ($objects, $top, ...)
+	objects []interface{}
+	root    map[string]interface{}
+}
+
+// decodeKeyedArchive decodes an NSKeyedArchiver plist and returns its root object
+func decodeKeyedArchive(data []byte) (*keyedArchive, error) {
+	v, err := decodePlist(data)
+	if err != nil {
+		return nil, err
+	}
+	top, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("keyed archive is not a dictionary")
+	}
+	objects, ok := top["$objects"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("keyed archive has no $objects")
+	}
+	archive := &keyedArchive{top: top, objects: objects}
+
+	topRefs, _ := top["$top"].(map[string]interface{})
+	root, ok := archive.resolve(topRefs["root"]).(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("keyed archive has no root object")
+	}
+	archive.root = root
+	return archive, nil
+}
+
+// resolve follows a UID reference into $objects (other values are returned unchanged)
+func (a *keyedArchive) resolve(v interface{}) interface{} {
+	uid, ok := v.(plistUID)
+	if !ok {
+		return v
+	}
+	if uint64(uid) >= uint64(len(a.objects)) {
+		return nil
+	}
+	return a.objects[uid]
+}
+
+// data returns a data field of the root object, unwrapping NSData/NSMutableData objects
+func (a *keyedArchive) data(key string) []byte {
+	switch v := a.resolve(a.root[key]).(type) {
+	case []byte:
+		return v
+	case map[string]interface{}:
+		if b, ok := a.resolve(v["NS.data"]).([]byte); ok {
+			return b
+		}
+	}
+	return nil
+}
+
+// setData replaces a data field of the root object in place, keeping NSData wrappers
+// A root without the field is left unchanged
+func (a *keyedArchive) setData(key string, value []byte) {
+	ref := a.root[key]
+	switch v := a.resolve(ref).(type) {
+	case []byte:
+		if uid, ok := ref.(plistUID); ok {
+			a.objects[uid] = value
+		} else {
+			a.root[key] = value
+		}
+	case map[string]interface{}:
+		if uid, ok := v["NS.data"].(plistUID); ok && uint64(uid) < uint64(len(a.objects)) {
+			a.objects[uid] = value
+		} else if _, ok := v["NS.data"].([]byte); ok {
+			v["NS.data"] = value
+		}
+	}
+}
+
+// integer returns an integer field of the root object
+func (a *keyedArchive) integer(key string) (int64, bool) {
+	return plistInt(a.resolve(a.root[key]))
+}
+
+// encodeBinaryPlist encodes a value as a bplist00 property list
+// Values use the same types decodePlist returns; dictionary keys are written in sorted order
+func encodeBinaryPlist(v interface{}) ([]byte, error) {
+	e := &bplistEncoder{}
+	if _, err := e.flatten(v, 0); err != nil {
+		return nil, err
+	}
+
+	e.refSize = bytesNeeded(uint64(len(e.nodes) - 1))
+	var buf bytes.Buffer
+	buf.WriteString("bplist00")
+	offsets := make([]uint64, len(e.nodes))
+	for i, node := range e.nodes {
+		offsets[i] = uint64(buf.Len())
+		if err := e.encode(&buf, node); err != nil {
+			return nil, err
+		}
+	}
+
+	tableOffset := uint64(buf.Len())
+	offsetSize := bytesNeeded(tableOffset)
+	for _, off := range offsets {
+		writeBigEndian(&buf, off, offsetSize)
+	}
+
+	trailer := make([]byte, 32)
+	trailer[6] = byte(offsetSize)
+	trailer[7] = byte(e.refSize)
+	binary.BigEndian.PutUint64(trailer[8:16], uint64(len(e.nodes)))
+	binary.BigEndian.PutUint64(trailer[16:24], 0)
+	binary.BigEndian.PutUint64(trailer[24:32], tableOffset)
+	buf.Write(trailer)
+	return buf.Bytes(), nil
+}
+
+// bplistEncoder writes objects to a binary plist
+// Values are first flattened into a list of objects so the reference size is known before encoding
+type bplistEncoder struct {
+	nodes   []bplistNode
+	refSize int
+}
+
+// bplistNode is a flattened object; containers refer to their elements by object index
+type bplistNode struct {
+	value interface{}
+	refs  []int // Array elements, or dictionary keys followed by values
+}
+
+// flatten adds a value and its elements to the object list and returns its index
+func (e *bplistEncoder) flatten(v interface{}, depth int) (int, error) {
+	if depth > maxPlistDepth {
+		return 0, fmt.Errorf("plist value nested too deeply")
+	}
+	index := len(e.nodes)
+	e.nodes = append(e.nodes, bplistNode{value: v})
+
+	var refs []int
+	switch value := v.(type) {
+	case []interface{}:
+		for _, element := range value {
+			ref, err := e.flatten(element, depth+1)
+			if err != nil {
+				return 0, err
+			}
+			refs = append(refs, ref)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		values := make([]int, 0, len(keys))
+		for _, key := range keys {
+			ref, err := e.flatten(key, depth+1)
+			if err != nil {
+				return 0, err
+			}
+			refs = append(refs, ref)
+		}
+		for _, key := range keys {
+			ref, err := e.flatten(value[key], depth+1)
+			if err != nil {
+				return 0, err
+			}
+			values = append(values, ref)
+		}
+		refs = append(refs, values...)
+	}
+	e.nodes[index].refs = refs
+	return index, nil
+}
+
+// encode writes a single object
+func (e *bplistEncoder) encode(buf *bytes.Buffer, node bplistNode) error {
+	switch v := node.value.(type) {
+	case nil:
+		buf.WriteByte(0x00)
+	case bool:
+		if v {
+			buf.WriteByte(0x09)
+		} else {
+			buf.WriteByte(0x08)
+		}
+	case int:
+		writePlistInt(buf, int64(v))
+	case int64:
+		writePlistInt(buf, v)
+	case float64:
+		buf.WriteByte(0x23)
+		writeBigEndian(buf, math.Float64bits(v), 8)
+	case time.Time:
+		buf.WriteByte(0x33)
+		writeBigEndian(buf, math.Float64bits(v.Sub(plistEpoch).Seconds()), 8)
+	case []byte:
+		writePlistCount(buf, 0x4, len(v))
+		buf.Write(v)
+	case string:
+		ascii := true
+		for i := 0; i < len(v); i++ {
+			if v[i] >= 0x80 {
+				ascii = false
+				break
+			}
+		}
+		if ascii {
+			writePlistCount(buf, 0x5, len(v))
+			buf.WriteString(v)
+			break
+		}
+		units := utf16.Encode([]rune(v))
+		writePlistCount(buf, 0x6, len(units))
+		for _, unit := range units {
+			writeBigEndian(buf, uint64(unit), 2)
+		}
+	case plistUID:
+		n := bytesNeeded(uint64(v))
+		buf.WriteByte(0x80 | byte(n-1))
+		writeBigEndian(buf, uint64(v), n)
+	case []interface{}:
+		writePlistCount(buf, 0xA, len(node.refs))
+		e.writeRefs(buf, node.refs)
+	case map[string]interface{}:
+		writePlistCount(buf, 0xD, len(node.refs)/2)
+		e.writeRefs(buf, node.refs)
+	default:
+		return fmt.Errorf("unsupported plist value of type %T", node.value)
+	}
+	return nil
+}
+
+// writeRefs writes object references
+func (e *bplistEncoder) writeRefs(buf *bytes.Buffer, refs []int) {
+	for _, ref := range refs {
+		writeBigEndian(buf, uint64(ref), e.refSize)
+	}
+}
+
+// writePlistInt writes an integer object; negative values always take 8 bytes
+func writePlistInt(buf *bytes.Buffer, v int64) {
+	n := 8
+	if v >= 0 {
+		n = bytesNeeded(uint64(v))
+	}
+	buf.WriteByte(0x10 | byte(bits.TrailingZeros(uint(n))))
+	writeBigEndian(buf, uint64(v), n)
+}
+
+// writePlistCount writes the marker of a variable length object and its element count
+func writePlistCount(buf *bytes.Buffer, kind byte, count int) {
+	if count < 0x0f {
+		buf.WriteByte(kind<<4 | byte(count))
+		return
+	}
+	buf.WriteByte(kind<<4 | 0x0f)
+	writePlistInt(buf, int64(count))
+}
+
+// bytesNeeded returns the smallest of 1, 2, 4 or 8 bytes that holds v
+func bytesNeeded(v uint64) int {
+	switch {
+	case v <= math.MaxUint8:
+		return 1
+	case v <= math.MaxUint16:
+		return 2
+	case v <= math.MaxUint32:
+		return 4
+	}
+	return 8
+}
+
+// writeBigEndian writes the low n bytes of v in big-endian order
+func writeBigEndian(buf *bytes.Buffer, v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		buf.WriteByte(byte(v >> (8 * uint(i))))
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// ProcessRunner starts the external tools (ios_backup, heic-converter, ffmpeg, ffprobe)
+// ExecRunner runs the real executables; tests substitute a FakeRunner
+type ProcessRunner interface {
+	// LookPath resolves a tool name (or path) to something Start can run, reporting false if it isn't available
+	LookPath(name string) (string, bool)
+	// Start starts a process; cancelling ctx kills it
+	Start(ctx context.Context, spec ProcessSpec) (Process, error)
+}
+
+// ProcessSpec describes a process to start
+type ProcessSpec struct {
+	Path string   // Resolved by LookPath
+	Args []string // Arguments, without the program name
+	Env  []string // Environment (nil inherits the current one)
+}
+
+// Process is a started process
+// Stdout and Stderr must be read to EOF before Wait is called
+type Process interface {
+	Stdout() io.Reader
+	Stderr() io.Reader
+	// Wait waits for the process to exit; a non-zero exit status is reported as an error with an ExitCode method
+	Wait() error
+	Signal(sig os.Signal) error
+	Kill() error
+}
+
+// exitCoder is implemented by errors that carry a process exit code (*exec.ExitError, *FakeExitError)
+type exitCoder interface {
+	ExitCode() int
+}
+
+// processExitCode returns the exit code carried by a process error
+func processExitCode(err error) (int, bool) {
+	var coder exitCoder
+	if errors.As(err, &coder) {
+		return coder.ExitCode(), true
+	}
+	return 0, false
+}
+
+// ExecRunner runs real executables found by findExecutable
+type ExecRunner struct{}
+
+// LookPath finds an executable in the libraries folder, next to the program, then on PATH
+func (ExecRunner) LookPath(name string) (string, bool) {
+	return findExecutable(name)
+}
+
+// Start starts an executable with its output connected to pipes
+func (ExecRunner) Start(ctx context.Context, spec ProcessSpec) (Process, error) {
+	cmd := exec.CommandContext(ctx, spec.Path, spec.Args...)
+	cmd.Env = spec.Env
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stdout pipe: %v", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stderr pipe: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &execProcess{cmd: cmd, stdout: stdout, stderr: stderr}, nil
+}
+
+// execProcess is a Process backed by os/exec
+type execProcess struct {
+	cmd    *exec.Cmd
+	stdout io.Reader
+	stderr io.Reader
+}
+
+func (p *execProcess) Stdout() io.Reader { return p.stdout }
+func (p *execProcess) Stderr() io.Reader { return p.stderr }
+func (p *execProcess) Wait() error       { return p.cmd.Wait() }
+
+func (p *execProcess) Signal(sig os.Signal) error {
+	return p.cmd.Process.Signal(sig)
+}
+
+func (p *execProcess) Kill() error {
+	return p.cmd.Process.Kill()
+}
+
+// runTool runs a tool to completion and returns its combined stdout and stderr
+func runTool(ctx context.Context, procs ProcessRunner, path string, args ...string) ([]byte, error) {
+	proc, err := procs.Start(ctx, ProcessSpec{Path: path, Args: args})
+	if err != nil {
+		if ctx.Err() == nil {
+			backupMetrics.ToolFailed(path)
+		}
+		return nil, err
+	}
+
+	var (
+		mu     sync.Mutex
+		output bytes.Buffer
+		wg     sync.WaitGroup
+	)
+	for _, r := range []io.Reader{proc.Stdout(), proc.Stderr()} {
+		wg.Add(1)
+		go func(r io.Reader) {
+			defer wg.Done()
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := r.Read(buf)
+				if n > 0 {
+					mu.Lock()
+					output.Write(buf[:n])
+					mu.Unlock()
+				}
+				if err != nil {
+					return
+				}
+			}
+		}(r)
+	}
+	wg.Wait()
+
+	err = proc.Wait()
+	if err != nil && ctx.Err() == nil {
+		backupMetrics.ToolFailed(path)
+	}
+	return output.Bytes(), err
+}
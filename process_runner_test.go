@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// encodeTestImage returns a solid-colour image encoded as PNG or JPEG
+func encodeTestImage(t *testing.T, format string, w int, h int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{R: 200, G: 100, B: 50, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	var err error
+	if format == "png" {
+		err = png.Encode(&buf, img)
+	} else {
+		err = jpeg.Encode(&buf, img, nil)
+	}
+	if err != nil {
+		t.Fatalf("Failed to encode test image: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// TestFakeRunnerEndToEnd runs a backup through a faked ios_backup and faked converters
+func TestFakeRunnerEndToEnd(t *testing.T) {
+	udid := "00008110-000E785101F2401E"
+	backupDir := filepath.Join(t.TempDir(), udid)
+	snapshot := func(name string) string {
+		return filepath.Join(backupDir, "Snapshot", name[:2], name)
+	}
+	saved := func(name string, domain string) string {
+		return "FILE_SAVED: path=" + udid + "/Snapshot/" + name[:2] + "/" + name + " domain=" + domain
+	}
+	thumbnail := encodeTestImage(t, "jpeg", 800, 600)
+
+	procs := NewFakeRunner()
+	procs.Register("ios_backup", FakeTool{Steps: []FakeStep{
+		{Stdout: "[==                       ]   3% (3.0 MB/100.0 MB)"},
+		{File: snapshot("aa11"), Data: encodeTestImage(t, "png", 1000, 500),
+			Stderr: saved("aa11", "MediaDomain-Library/SMS/Attachments/IMG_1.PNG")},
+		{Delay: 10 * time.Millisecond, File: snapshot("bb22"), Data: []byte("heic data"),
+			Stderr: saved("bb22", "MediaDomain-Library/SMS/Attachments/IMG_2.HEIC")},
+		{File: snapshot("cc33"), Data: []byte("video data"),
+			Stderr: saved("cc33", "MediaDomain-Library/SMS/Attachments/IMG_3.MOV")},
+		{Stdout: "[=========================] 100% (100.0 MB/100.0 MB)"},
+	}})
+	procs.Register("heic-converter", FakeTool{Steps: []FakeStep{{FileArg: 2, Data: thumbnail}}})
+	procs.Register("ffprobe", FakeTool{Steps: []FakeStep{{Stdout: "video"}}})
+	procs.Register("ffmpeg", FakeTool{Steps: []FakeStep{{FileArg: -1, Data: thumbnail}}})
+
+	transformer := NewBackupTransformer()
+	transformer.SetProcessRunner(procs)
+	runner, err := NewBackupRunner(backupDir, "ios_backup", false, transformer)
+	if err != nil {
+		t.Fatalf("Failed to create runner: %v", err)
+	}
+	runner.SetProcessRunner(procs)
+	runner.SetConsoleOutput(&bytes.Buffer{})
+	runner.SetDevice(udid, false)
+
+	if err := runner.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	for _, name := range []string{"aa11", "bb22", "cc33"} {
+		if !isJPEGFile(t, snapshot(name)) {
+			t.Errorf("Expected %s to be converted to JPEG", name)
+		}
+	}
+	if runner.totalCount != 3 {
+		t.Errorf("Expected 3 transformations, got %d", runner.totalCount)
+	}
+
+	calls := procs.Calls("ios_backup")
+	if len(calls) != 1 || !strings.Contains(strings.Join(calls[0].Args, " "), "-u "+udid) {
+		t.Errorf("Unexpected ios_backup calls: %+v", calls)
+	}
+	if calls := procs.Calls("heic-converter"); len(calls) != 1 || calls[0].Args[0] != snapshot("bb22") {
+		t.Errorf("Unexpected heic-converter calls: %+v", calls)
+	}
+	if calls := procs.Calls("ffprobe"); len(calls) != 2 {
+		t.Errorf("Expected stream and duration probes, got %+v", calls)
+	}
+}
+
+// TestFakeRunnerExitCodes tests that faked exit codes reach the failure classification
+func TestFakeRunnerExitCodes(t *testing.T) {
+	procs := NewFakeRunner()
+	procs.Register("ios_backup", FakeTool{
+		Steps:    []FakeStep{{Stderr: "Received 12 files from device."}},
+		ExitCode: 105,
+	})
+
+	runner, err := NewBackupRunner(filepath.Join(t.TempDir(), "backup"), "ios_backup", false, NewBackupTransformer())
+	if err != nil {
+		t.Fatalf("Failed to create runner: %v", err)
+	}
+	runner.SetProcessRunner(procs)
+	runner.SetConsoleOutput(&bytes.Buffer{})
+
+	err = runner.Run()
+	if backupErrorKind(err) != ErrKindDiskFull {
+		t.Errorf("Expected %s, got %v", ErrKindDiskFull, err)
+	}
+	if code, ok := processExitCode(err); !ok || code != 105 {
+		t.Errorf("Expected exit code 105, got %d (%v)", code, ok)
+	}
+}
+
+// TestFakeRunnerKill tests that cancelling and signalling end a delayed step
+func TestFakeRunnerKill(t *testing.T) {
+	procs := NewFakeRunner()
+	procs.Register("slow", FakeTool{Steps: []FakeStep{{Delay: time.Hour, Stdout: "never"}}})
+
+	if _, found := procs.LookPath("missing"); found {
+		t.Error("Unregistered tools should not be found")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	output, err := runTool(ctx, procs, "slow")
+	if code, ok := processExitCode(err); !ok || code != -1 || len(output) != 0 {
+		t.Errorf("Expected a killed process, got %v, %q", err, output)
+	}
+
+	proc, err := procs.Start(context.Background(), ProcessSpec{Path: "/usr/local/bin/slow"})
+	if err != nil {
+		t.Fatalf("Failed to start: %v", err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		proc.Signal(os.Interrupt)
+	}()
+	if err := proc.Wait(); err == nil || err.Error() != "signal: interrupt" {
+		t.Errorf("Expected the interrupt to end the process, got %v", err)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// progressRateWindow is how far back samples are kept when computing the transfer rate
+	progressRateWindow = 30 * time.Second
+	// progressReportInterval is the longest gap between console progress summaries
+	progressReportInterval = 10 * time.Second
+)
+
+// progressBarRe matches idevicebackup2 progress bars, e.g. "[=====     ]  45% (1.2 MB/2.7 MB)" or "[====] 100% Finished"
+var progressBarRe = regexp.MustCompile(`^\[[=>\-\s]*\]\s*(\d+(?:\.\d+)?)%\s*(?:\(([^/()]+)/([^/()]+)\))?`)
+
+// progressSizeRe matches a size printed by idevicebackup2 (1000-based units)
+var progressSizeRe = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*(Bytes|B|kB|KB|MB|GB|TB)$`)
+
+// ProgressSnapshot is the parsed state of a running backup
+type ProgressSnapshot struct {
+	Phase         string  // "receiving" once ios_backup reports it is receiving files
+	Percent       float64 // Overall percent complete, valid when HasPercent is set
+	HasPercent    bool
+	BytesReceived int64         // Bytes received so far (0 when ios_backup doesn't report sizes)
+	BytesTotal    int64         // Total bytes expected (0 when unknown)
+	FilesReceived int64         // FILE_SAVED lines seen so far
+	Rate          float64       // Transfer rate in bytes per second (0 when unknown)
+	ETA           time.Duration // Estimated time remaining (-1 when unknown)
+	Elapsed       time.Duration // Time since the first progress line
+}
+
+// String formats the snapshot for the console and log file
+// e.g. "45% (1.2 MB/2.7 MB), 120 files, 1.5 MB/s, ETA 2m10s"
+func (s ProgressSnapshot) String() string {
+	var parts []string
+	head := "receiving files"
+	if s.HasPercent {
+		head = fmt.Sprintf("%.0f%%", s.Percent)
+		if s.BytesTotal > 0 {
+			head += fmt.Sprintf(" (%s/%s)", formatBytes(s.BytesReceived), formatBytes(s.BytesTotal))
+		}
+	}
+	parts = append(parts, head)
+	parts = append(parts, fmt.Sprintf("%d files", s.FilesReceived))
+	if s.Rate > 0 {
+		parts = append(parts, formatBytes(int64(s.Rate))+"/s")
+	}
+	if s.ETA >= 0 {
+		parts = append(parts, "ETA "+s.ETA.Round(time.Second).String())
+	}
+	return strings.Join(parts, ", ")
+}
+
+// event converts the snapshot to a progress event carrying the raw line
+func (s ProgressSnapshot) event(line string) Event {
+	files := s.FilesReceived
+	event := Event{
+		Type:          EventProgress,
+		Message:       strings.TrimSpace(line),
+		FilesReceived: &files,
+	}
+	if s.HasPercent {
+		percent := s.Percent
+		event.Percent = &percent
+	}
+	if s.BytesTotal > 0 {
+		received, total := s.BytesReceived, s.BytesTotal
+		event.BytesReceived = &received
+		event.BytesTotal = &total
+	}
+	if s.Rate > 0 {
+		rate := s.Rate
+		event.RateBytesPerSec = &rate
+	}
+	if s.ETA >= 0 {
+		eta := int64(s.ETA.Round(time.Second) / time.Second)
+		event.EtaSeconds = &eta
+	}
+	return event
+}
+
+// progressSample is one point used for rate estimation
+type progressSample struct {
+	at      time.Time
+	bytes   int64
+	percent float64
+}
+
+// ProgressTracker builds a progress model from ios_backup output lines
+// Safe for concurrent use from the stdout and stderr readers
+type ProgressTracker struct {
+	mu            sync.Mutex
+	current       ProgressSnapshot
+	started       time.Time
+	samples       []progressSample
+	reported      bool
+	lastReported  time.Time
+	reportedLevel int // Whole percent at the last console summary
+}
+
+// NewProgressTracker creates an empty progress tracker
+func NewProgressTracker() *ProgressTracker {
+	return &ProgressTracker{current: ProgressSnapshot{ETA: -1}}
+}
+
+// FileReceived counts a file reported by a FILE_SAVED line
+func (pt *ProgressTracker) FileReceived() {
+	pt.mu.Lock()
+	pt.current.FilesReceived++
+	pt.mu.Unlock()
+}
+
+// Snapshot returns the current progress
+func (pt *ProgressTracker) Snapshot() ProgressSnapshot {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	return pt.current
+}
+
+// Update parses a line of ios_backup output
+// Returns false if the line is not progress output
+func (pt *ProgressTracker) Update(line string, now time.Time) (ProgressSnapshot, bool) {
+	trimmed := strings.TrimSpace(line)
+
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	if strings.HasPrefix(trimmed, "Receiving files") {
+		pt.start(now)
+		pt.current.Phase = "receiving"
+		pt.current.Elapsed = now.Sub(pt.started)
+		return pt.current, true
+	}
+
+	m := progressBarRe.FindStringSubmatch(trimmed)
+	if m == nil {
+		return pt.current, false
+	}
+	pt.start(now)
+
+	percent, _ := strconv.ParseFloat(m[1], 64)
+	pt.current.Percent = percent
+	pt.current.HasPercent = true
+	if m[2] != "" {
+		received, okReceived := parseProgressSize(m[2])
+		total, okTotal := parseProgressSize(m[3])
+		if okReceived && okTotal {
+			pt.current.BytesReceived = received
+			pt.current.BytesTotal = total
+		}
+	}
+
+	// A byte count going backwards means a new transfer started, so old samples no longer apply
+	if n := len(pt.samples); n > 0 && pt.current.BytesReceived < pt.samples[n-1].bytes {
+		pt.samples = nil
+	}
+	pt.samples = append(pt.samples, progressSample{at: now, bytes: pt.current.BytesReceived, percent: percent})
+	for len(pt.samples) > 2 && now.Sub(pt.samples[1].at) >= progressRateWindow {
+		pt.samples = pt.samples[1:]
+	}
+
+	pt.current.Elapsed = now.Sub(pt.started)
+	pt.estimate()
+	return pt.current, true
+}
+
+// start records the time of the first progress line
+func (pt *ProgressTracker) start(now time.Time) {
+	if pt.started.IsZero() {
+		pt.started = now
+	}
+}
+
+// estimate computes the rate and ETA from the sample window
+// Byte counts are preferred; percent alone is used when ios_backup doesn't print sizes
+func (pt *ProgressTracker) estimate() {
+	pt.current.Rate = 0
+	pt.current.ETA = -1
+
+	if pt.current.HasPercent && pt.current.Percent >= 100 {
+		pt.current.ETA = 0
+		return
+	}
+	if len(pt.samples) < 2 {
+		return
+	}
+
+	first, last := pt.samples[0], pt.samples[len(pt.samples)-1]
+	seconds := last.at.Sub(first.at).Seconds()
+	if seconds <= 0 {
+		return
+	}
+
+	if pt.current.BytesTotal > 0 && last.bytes > first.bytes {
+		pt.current.Rate = float64(last.bytes-first.bytes) / seconds
+		remaining := float64(pt.current.BytesTotal - pt.current.BytesReceived)
+		if remaining < 0 {
+			remaining = 0
+		}
+		pt.current.ETA = time.Duration(remaining / pt.current.Rate * float64(time.Second))
+		return
+	}
+
+	if last.percent > first.percent {
+		percentPerSecond := (last.percent - first.percent) / seconds
+		pt.current.ETA = time.Duration((100 - last.percent) / percentPerSecond * float64(time.Second))
+	}
+}
+
+// ShouldReport reports whether a console summary is due: the whole percent changed or the
+// report interval passed, so stalled backups still show signs of life
+func (pt *ProgressTracker) ShouldReport(now time.Time) bool {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	level := int(pt.current.Percent)
+	if pt.reported && level == pt.reportedLevel && now.Sub(pt.lastReported) < progressReportInterval {
+		return false
+	}
+	pt.reported = true
+	pt.reportedLevel = level
+	pt.lastReported = now
+	return true
+}
+
+// parseProgressSize parses sizes like "1.2 MB", "512.0 kB" or "42 Bytes"
+func parseProgressSize(s string) (int64, bool) {
+	m := progressSizeRe.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0, false
+	}
+	value, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, false
+	}
+
+	multiplier := 1.0
+	switch m[2] {
+	case "kB", "KB":
+		multiplier = 1e3
+	case "MB":
+		multiplier = 1e6
+	case "GB":
+		multiplier = 1e9
+	case "TB":
+		multiplier = 1e12
+	}
+	return int64(value * multiplier), true
+}
+
+// formatBytes formats a byte count the way idevicebackup2 does (1000-based units)
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1e9:
+		return fmt.Sprintf("%.1f GB", float64(n)/1e9)
+	case n >= 1e6:
+		return fmt.Sprintf("%.1f MB", float64(n)/1e6)
+	case n >= 1e3:
+		return fmt.Sprintf("%.1f kB", float64(n)/1e3)
+	default:
+		return fmt.Sprintf("%d Bytes", n)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestParseProgressSize tests parsing of idevicebackup2 sizes
+func TestParseProgressSize(t *testing.T) {
+	cases := []struct {
+		s    string
+		want int64
+		ok   bool
+	}{
+		{"1.2 MB", 1200000, true},
+		{"512.0 kB", 512000, true},
+		{"42 Bytes", 42, true},
+		{"2.7 GB", 2700000000, true},
+		{"Finished", 0, false},
+	}
+	for _, c := range cases {
+		got, ok := parseProgressSize(c.s)
+		if got != c.want || ok != c.ok {
+			t.Errorf("parseProgressSize(%q) = %d, %v; want %d, %v", c.s, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+// TestProgressTrackerBytes tests percent, rate and ETA from progress bars with sizes
+func TestProgressTrackerBytes(t *testing.T) {
+	tracker := NewProgressTracker()
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	if _, ok := tracker.Update("Receiving files", start); !ok {
+		t.Fatal("Receiving files should be a progress line")
+	}
+	if _, ok := tracker.Update("Receiving domain: HomeDomain", start); ok {
+		t.Error("Receiving domain is not a progress line")
+	}
+
+	tracker.Update("[==========                                        ]  20% (20.0 MB/100.0 MB)", start)
+	tracker.FileReceived()
+	tracker.FileReceived()
+	snapshot, ok := tracker.Update("[====================                              ]  40% (40.0 MB/100.0 MB)", start.Add(10*time.Second))
+	if !ok {
+		t.Fatal("Expected progress bar to parse")
+	}
+
+	if !snapshot.HasPercent || snapshot.Percent != 40 {
+		t.Errorf("Expected 40%%, got %v", snapshot.Percent)
+	}
+	if snapshot.BytesReceived != 40000000 || snapshot.BytesTotal != 100000000 {
+		t.Errorf("Unexpected bytes: %d/%d", snapshot.BytesReceived, snapshot.BytesTotal)
+	}
+	if snapshot.FilesReceived != 2 {
+		t.Errorf("Expected 2 files, got %d", snapshot.FilesReceived)
+	}
+	if snapshot.Rate != 2000000 {
+		t.Errorf("Expected 2 MB/s, got %v", snapshot.Rate)
+	}
+	if snapshot.ETA != 30*time.Second {
+		t.Errorf("Expected ETA 30s, got %v", snapshot.ETA)
+	}
+	if snapshot.Elapsed != 10*time.Second {
+		t.Errorf("Expected 10s elapsed, got %v", snapshot.Elapsed)
+	}
+
+	want := "40% (40.0 MB/100.0 MB), 2 files, 2.0 MB/s, ETA 30s"
+	if got := snapshot.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+
+	snapshot, _ = tracker.Update("[==================================================] 100% Finished", start.Add(40*time.Second))
+	if snapshot.Percent != 100 || snapshot.ETA != 0 {
+		t.Errorf("Expected finished progress, got %+v", snapshot)
+	}
+}
+
+// TestProgressTrackerPercentOnly tests ETA estimation when no sizes are printed
+func TestProgressTrackerPercentOnly(t *testing.T) {
+	tracker := NewProgressTracker()
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	snapshot, _ := tracker.Update("[=====     ]  10%", start)
+	if snapshot.ETA != -1 {
+		t.Errorf("ETA should be unknown after one sample, got %v", snapshot.ETA)
+	}
+
+	snapshot, _ = tracker.Update("[==========]  20%", start.Add(20*time.Second))
+	if snapshot.Rate != 0 {
+		t.Errorf("Rate should be unknown without sizes, got %v", snapshot.Rate)
+	}
+	if snapshot.ETA != 160*time.Second {
+		t.Errorf("Expected ETA 160s, got %v", snapshot.ETA)
+	}
+}
+
+// TestProgressTrackerShouldReport tests console summary throttling
+func TestProgressTrackerShouldReport(t *testing.T) {
+	tracker := NewProgressTracker()
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tracker.Update("[=    ]  5% (5.0 MB/100.0 MB)", start)
+	if !tracker.ShouldReport(start) {
+		t.Error("First progress should be reported")
+	}
+
+	tracker.Update("[=    ]  5% (5.2 MB/100.0 MB)", start.Add(time.Second))
+	if tracker.ShouldReport(start.Add(time.Second)) {
+		t.Error("Same percent within the interval should not be reported")
+	}
+
+	tracker.Update("[=    ]  6% (6.0 MB/100.0 MB)", start.Add(2*time.Second))
+	if !tracker.ShouldReport(start.Add(2 * time.Second)) {
+		t.Error("Percent change should be reported")
+	}
+
+	if !tracker.ShouldReport(start.Add(2*time.Second + progressReportInterval)) {
+		t.Error("Stalled progress should be reported after the interval")
+	}
+}
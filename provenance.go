@@ -0,0 +1,171 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// ProvenanceStore is a sidecar database recording what each converted backup file originally was
+// Downstream tooling uses it to explain and verify converted attachments, since the hashed
+// backup path of a 4 MB HEIC holds a small JPEG afterwards
+type ProvenanceStore struct {
+	db *sql.DB
+}
+
+// ProvenanceRecord describes the original of a converted file and the conversion applied
+type ProvenanceRecord struct {
+	FileID         string // Backup file name (SHA-1 of "<domain>-<relativePath>")
+	Domain         string // Manifest domain, e.g. "MediaDomain"
+	RelativePath   string // Path within the domain, e.g. "Library/SMS/Attachments/0a/IMG_0001.HEIC"
+	OriginalSize   int64
+	OriginalHash   string // SHA-256 of the original file
+	DetectedFormat string // Format of the original, e.g. "heic" or "png"
+	Transform      string // Conversion applied, e.g. "heic->jpeg"
+	OutputWidth    int
+	OutputHeight   int
+	OutputSize     int64
+	OutputHash     string // SHA-256 of the converted file
+	TransformedAt  time.Time
+}
+
+const provenanceSchema = `CREATE TABLE IF NOT EXISTS provenance (
+	file_id         TEXT PRIMARY KEY,
+	domain          TEXT NOT NULL,
+	relative_path   TEXT NOT NULL,
+	original_size   INTEGER NOT NULL,
+	original_sha256 TEXT NOT NULL,
+	detected_format TEXT NOT NULL,
+	transform       TEXT NOT NULL,
+	output_width    INTEGER NOT NULL,
+	output_height   INTEGER NOT NULL,
+	output_size     INTEGER NOT NULL,
+	output_sha256   TEXT NOT NULL,
+	transformed_at  TEXT NOT NULL
+)`
+
+// provenancePathForBackup returns the provenance database location next to a backup directory
+// e.g. /backups/00008110-000E785101F2401E -> /backups/00008110-000E785101F2401E.provenance.db
+func provenancePathForBackup(backupDir string) string {
+	backupDir = filepath.Clean(backupDir)
+	return filepath.Join(filepath.Dir(backupDir), filepath.Base(backupDir)+".provenance.db")
+}
+
+// OpenProvenanceStore opens or creates a provenance database
+func OpenProvenanceStore(path string) (*ProvenanceStore, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open provenance database: %v", err)
+	}
+
+	// Workers record conversions concurrently; a single connection serializes writes
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(provenanceSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize provenance database: %v", err)
+	}
+	return &ProvenanceStore{db: db}, nil
+}
+
+// Lookup returns the provenance of a backup file, or nil if it has none
+func (p *ProvenanceStore) Lookup(fileID string) (*ProvenanceRecord, error) {
+	row := p.db.QueryRow(`SELECT file_id, domain, relative_path, original_size, original_sha256, detected_format,
+		transform, output_width, output_height, output_size, output_sha256, transformed_at
+		FROM provenance WHERE file_id = ?`, fileID)
+
+	var rec ProvenanceRecord
+	var transformedAt string
+	err := row.Scan(&rec.FileID, &rec.Domain, &rec.RelativePath, &rec.OriginalSize, &rec.OriginalHash, &rec.DetectedFormat,
+		&rec.Transform, &rec.OutputWidth, &rec.OutputHeight, &rec.OutputSize, &rec.OutputHash, &transformedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to query provenance: %v", err)
+	}
+	rec.TransformedAt, _ = time.Parse(time.RFC3339Nano, transformedAt)
+	return &rec, nil
+}
+
+// Record stores the provenance of a converted file
+// When the file was converted again from an earlier output (e.g. a rerun without the journal),
+// the earlier record's original is kept so the record still describes the file ios_backup saved
+func (p *ProvenanceStore) Record(rec ProvenanceRecord) error {
+	if rec.TransformedAt.IsZero() {
+		rec.TransformedAt = time.Now()
+	}
+
+	previous, err := p.Lookup(rec.FileID)
+	if err != nil {
+		return err
+	}
+	if previous != nil && previous.OutputHash == rec.OriginalHash {
+		rec.Domain = previous.Domain
+		rec.RelativePath = previous.RelativePath
+		rec.OriginalSize = previous.OriginalSize
+		rec.OriginalHash = previous.OriginalHash
+		rec.DetectedFormat = previous.DetectedFormat
+		rec.Transform = previous.Transform
+	}
+
+	_, err = p.db.Exec(`INSERT OR REPLACE INTO provenance
+		(file_id, domain, relative_path, original_size, original_sha256, detected_format,
+		transform, output_width, output_height, output_size, output_sha256, transformed_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		rec.FileID, rec.Domain, rec.RelativePath, rec.OriginalSize, rec.OriginalHash, rec.DetectedFormat,
+		rec.Transform, rec.OutputWidth, rec.OutputHeight, rec.OutputSize, rec.OutputHash,
+		rec.TransformedAt.UTC().Format(time.RFC3339Nano))
+	if err != nil {
+		return fmt.Errorf("failed to write provenance record: %v", err)
+	}
+	return nil
+}
+
+// Delete removes the provenance of a backup file, e.g. once its original has been restored
+func (p *ProvenanceStore) Delete(fileID string) error {
+	if _, err := p.db.Exec(`DELETE FROM provenance WHERE file_id = ?`, fileID); err != nil {
+		return fmt.Errorf("failed to delete provenance record: %v", err)
+	}
+	return nil
+}
+
+// Close closes the provenance database
+func (p *ProvenanceStore) Close() error {
+	return p.db.Close()
+}
+
+// splitDomainKey splits ios_backup's "<domain>-<relativePath>" key into the manifest domain and relative path
+func splitDomainKey(key string) (string, string) {
+	domain := manifestDomain(key)
+	return domain, strings.TrimPrefix(strings.TrimPrefix(key, domain), "-")
+}
+
+// detectFormat returns the format of a file from its header (e.g. "heic" or "mov"),
+// otherwise from its original extension
+func detectFormat(filePath string, fileExt string) string {
+	if sniffed := sniffFileType(filePath); sniffed != "" {
+		return formatForExtension(sniffed)
+	}
+	return strings.TrimPrefix(strings.ToLower(fileExt), ".")
+}
+
+// imageDimensions returns the width and height of an image file, or zeros if it can't be decoded
+func imageDimensions(filePath string) (int, int) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, 0
+	}
+	defer file.Close()
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return 0, 0
+	}
+	return config.Width, config.Height
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestProvenanceRecorded tests that a conversion records the original file and the output
+func TestProvenanceRecorded(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenProvenanceStore(provenancePathForBackup(filepath.Join(dir, "backup")))
+	if err != nil {
+		t.Fatalf("Failed to open provenance store: %v", err)
+	}
+	defer store.Close()
+
+	fileID := "1276b26ae2d4f2d5ce874643b94e60aefa863441"
+	path := filepath.Join(dir, "backup", fileID[:2], fileID)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	writeTestPNG(t, path, 1000, 800, color.RGBA{200, 30, 30, 255})
+	originalHash, err := hashFile(path)
+	if err != nil {
+		t.Fatalf("Failed to hash original: %v", err)
+	}
+	originalSize := fileSize(path)
+
+	transformer := NewBackupTransformer()
+	transformer.SetProvenance(store)
+	timing := &FileTiming{Domain: "MediaDomain-Library/SMS/Attachments/0a/IMG_0001.PNG"}
+	if result := transformer.ProcessFileByExtension(context.Background(), path, ".png", timing); result.Outcome != OutcomeConverted {
+		t.Fatalf("Expected the PNG to be converted, got %+v", result)
+	}
+
+	rec, err := store.Lookup(fileID)
+	if err != nil || rec == nil {
+		t.Fatalf("Expected a provenance record, got %v, %v", rec, err)
+	}
+	outputHash, _ := hashFile(path)
+	if rec.Domain != "MediaDomain" || rec.RelativePath != "Library/SMS/Attachments/0a/IMG_0001.PNG" {
+		t.Errorf("Unexpected original path: %s / %s", rec.Domain, rec.RelativePath)
+	}
+	if rec.OriginalHash != originalHash || rec.OriginalSize != originalSize || rec.DetectedFormat != "png" {
+		t.Errorf("Unexpected original: %+v", rec)
+	}
+	if rec.Transform != "png->jpeg" || rec.OutputWidth != 500 || rec.OutputHeight != 400 {
+		t.Errorf("Unexpected conversion: %+v", rec)
+	}
+	if rec.OutputHash != outputHash || rec.OutputSize != fileSize(path) || rec.TransformedAt.IsZero() {
+		t.Errorf("Unexpected output: %+v", rec)
+	}
+
+	// Converting the output again keeps the original ios_backup saved
+	if err := store.Record(ProvenanceRecord{
+		FileID:         fileID,
+		Domain:         "MediaDomain",
+		RelativePath:   "Library/SMS/Attachments/0a/IMG_0001.PNG",
+		OriginalHash:   outputHash,
+		DetectedFormat: "jpeg",
+		Transform:      "jpeg->jpeg",
+		OutputHash:     "later",
+	}); err != nil {
+		t.Fatalf("Record failed: %v", err)
+	}
+	rec, err = store.Lookup(fileID)
+	if err != nil || rec.OriginalHash != originalHash || rec.DetectedFormat != "png" || rec.OutputHash != "later" {
+		t.Errorf("Expected the first original to be kept, got %+v, %v", rec, err)
+	}
+}
+
+// TestSplitDomainKey tests splitting ios_backup domain keys of fixed and container domains
+func TestSplitDomainKey(t *testing.T) {
+	tests := []struct {
+		key          string
+		domain       string
+		relativePath string
+	}{
+		{"AppDomainGroup-group.net.whatsapp.WhatsApp.shared-Message/Media/a.jpg", "AppDomainGroup-group.net.whatsapp.WhatsApp.shared", "Message/Media/a.jpg"},
+		{"AppDomain-com.example.my-app-Documents/a-b.jpg", "AppDomain-com.example.my-app", "Documents/a-b.jpg"},
+		{"SysSharedContainerDomain-systemgroup.com.apple.media.shared-Library/a.png", "SysSharedContainerDomain-systemgroup.com.apple.media.shared", "Library/a.png"},
+		{"HomeDomain-foo-bar.plist", "HomeDomain", "foo-bar.plist"},
+		{"MediaDomain-Library/SMS/Attachments/0a/10/IMG-0001/IMG-0001.HEIC", "MediaDomain", "Library/SMS/Attachments/0a/10/IMG-0001/IMG-0001.HEIC"},
+		{"CameraRollDomain-Media/DCIM/100-APPLE/IMG_0001.MOV", "CameraRollDomain", "Media/DCIM/100-APPLE/IMG_0001.MOV"},
+	}
+	for _, tt := range tests {
+		domain, rel := splitDomainKey(tt.key)
+		if domain != tt.domain || rel != tt.relativePath {
+			t.Errorf("splitDomainKey(%q) = %q, %q, want %q, %q", tt.key, domain, rel, tt.domain, tt.relativePath)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Quarantine keeps the originals of converted files instead of letting the conversion overwrite them
+// Originals are moved into a directory laid out like the finished backup (<xx>/<fileID>),
+// so a file can be put back with the undo command
+type Quarantine struct {
+	dir  string // Quarantined originals
+	root string // Backup directory the originals came from
+}
+
+// quarantinePathForBackup returns the default quarantine location next to a backup directory
+// e.g. /backups/00008110-000E785101F2401E -> /backups/00008110-000E785101F2401E.quarantine
+func quarantinePathForBackup(backupDir string) string {
+	backupDir = filepath.Clean(backupDir)
+	return filepath.Join(filepath.Dir(backupDir), filepath.Base(backupDir)+".quarantine")
+}
+
+// NewQuarantine returns a quarantine that keeps originals of files under root in dir
+func NewQuarantine(dir string, root string) *Quarantine {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		absDir = dir
+	}
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		absRoot = root
+	}
+	return &Quarantine{dir: absDir, root: absRoot}
+}
+
+// key returns the quarantine path of a backup file relative to the quarantine directory
+// Files still in a running backup's Snapshot directory are keyed by their finished location
+func (q *Quarantine) key(filePath string) (string, error) {
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(q.root, withoutSnapshotDir(absPath))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is not inside the backup %s", filePath, q.root)
+	}
+	return rel, nil
+}
+
+// Keep moves the original of a backup file into quarantine
+// Returns the quarantined path, or "" when an earlier original of the file is already kept
+// (e.g. when a converted file is converted again), in which case the file is left in place
+func (q *Quarantine) Keep(filePath string) (string, error) {
+	rel, err := q.key(filePath)
+	if err != nil {
+		return "", err
+	}
+	kept := filepath.Join(q.dir, rel)
+	if _, err := os.Lstat(kept); err == nil {
+		return "", nil
+	}
+	if err := os.MkdirAll(filepath.Dir(kept), 0755); err != nil {
+		return "", fmt.Errorf("failed to create quarantine directory: %v", err)
+	}
+	if err := moveFile(filePath, kept); err != nil {
+		return "", err
+	}
+	return kept, nil
+}
+
+// Replace moves a converted output over a backup file, quarantining the original first
+// A nil quarantine just overwrites the original; if the output can't be moved, the original is put back
+func (q *Quarantine) Replace(filePath string, outputPath string) error {
+	var kept string
+	if q != nil {
+		var err error
+		if kept, err = q.Keep(filePath); err != nil {
+			return fmt.Errorf("failed to quarantine original: %v", err)
+		}
+	}
+	if err := os.Rename(outputPath, filePath); err != nil {
+		if kept != "" {
+			if restoreErr := moveFile(kept, filePath); restoreErr != nil {
+				errorLog.Printf("Error putting back quarantined original %s: %v", kept, restoreErr)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// Files returns the quarantined originals, relative to the quarantine directory in sorted order
+func (q *Quarantine) Files() ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(q.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == q.dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if entry.Type().IsRegular() {
+			rel, err := filepath.Rel(q.dir, path)
+			if err != nil {
+				return err
+			}
+			files = append(files, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list quarantine: %v", err)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// Restore moves a quarantined original (as returned by Files) back into the backup, replacing the converted file
+// The original goes back to the Snapshot directory when the backup it came from never finished
+func (q *Quarantine) Restore(rel string) (string, error) {
+	target := filepath.Join(q.root, rel)
+	if _, err := os.Stat(target); os.IsNotExist(err) {
+		if snapshot := filepath.Join(q.root, "Snapshot", rel); fileExists(snapshot) {
+			target = snapshot
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", fmt.Errorf("failed to create backup directory: %v", err)
+	}
+	if err := moveFile(filepath.Join(q.dir, rel), target); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// fileExists reports whether a regular file exists at path
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// moveFile renames a file, copying it when src and dst are on different filesystems
+func moveFile(src string, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to move %s: %v", src, err)
+	}
+	defer in.Close()
+	stat, err := in.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to move %s: %v", src, err)
+	}
+
+	tempPath := dst + ".moving"
+	out, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, stat.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("failed to move %s: %v", src, err)
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		os.Chtimes(tempPath, stat.ModTime(), stat.ModTime())
+		err = os.Rename(tempPath, dst)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to move %s: %v", src, err)
+	}
+	return os.Remove(src)
+}
+
+// quarantineForBackup returns the quarantine selected by the -quarantine and -quarantine-dir flags, or nil
+// Giving a directory enables quarantining; otherwise it defaults to <backup>.quarantine
+func quarantineForBackup(enabled bool, dir string, backupDir string) *Quarantine {
+	if !enabled && dir == "" {
+		return nil
+	}
+	if dir == "" {
+		dir = quarantinePathForBackup(backupDir)
+	}
+	return NewQuarantine(dir, backupDir)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestTransformBackupQuarantine tests that originals are quarantined and undo restores them, filtered or all at once
+func TestTransformBackupQuarantine(t *testing.T) {
+	backupDir := filepath.Join(t.TempDir(), "00008110-000E785101F2401E")
+	files := []testManifestFile{
+		{"aa00000000000000000000000000000000000001", "MediaDomain", "Library/SMS/Attachments/01/IMG_0001.PNG", 1},
+		{"bb00000000000000000000000000000000000002", "AppDomainGroup-group.net.whatsapp.WhatsApp.shared", "Message/Media/IMG_0002.PNG", 1},
+	}
+	originals := make(map[string][]byte)
+	for _, f := range files {
+		path := filepath.Join(backupDir, f.fileID[:2], f.fileID)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		writeTestPNG(t, path, 900, 600, color.RGBA{10, 20, 30, 255})
+		originals[f.fileID], _ = os.ReadFile(path)
+	}
+	createTestManifest(t, backupDir, files)
+
+	transformer := NewBackupTransformer()
+	transformer.SetQuarantine(NewQuarantine(quarantinePathForBackup(backupDir), backupDir))
+	summary, err := TransformBackup(context.Background(), transformer, TransformOptions{BackupDir: backupDir, Workers: 2})
+	if err != nil {
+		t.Fatalf("TransformBackup failed: %v", err)
+	}
+	if summary.Outcomes[OutcomeConverted] != 2 {
+		t.Fatalf("Expected 2 converted files, got %+v", summary.Outcomes)
+	}
+	for _, f := range files {
+		kept, err := os.ReadFile(filepath.Join(quarantinePathForBackup(backupDir), f.fileID[:2], f.fileID))
+		if err != nil || !bytes.Equal(kept, originals[f.fileID]) {
+			t.Errorf("Expected the original of %s in quarantine: %v", f.fileID, err)
+		}
+		if !isJPEGFile(t, filepath.Join(backupDir, f.fileID[:2], f.fileID)) {
+			t.Errorf("Expected %s to be converted in place", f.fileID)
+		}
+	}
+
+	// Restore only the WhatsApp file
+	summary2, err := UndoQuarantine(UndoOptions{BackupDir: backupDir, DomainPatterns: testGlobs(t, "*whatsapp*")})
+	if err != nil {
+		t.Fatalf("UndoQuarantine failed: %v", err)
+	}
+	if summary2.Quarantined != 2 || summary2.Restored != 1 {
+		t.Errorf("Expected 1 of 2 originals restored, got %+v", summary2)
+	}
+	restored, _ := os.ReadFile(filepath.Join(backupDir, "bb", files[1].fileID))
+	if !bytes.Equal(restored, originals[files[1].fileID]) {
+		t.Error("Expected the WhatsApp original to be restored")
+	}
+	if !isJPEGFile(t, filepath.Join(backupDir, "aa", files[0].fileID)) {
+		t.Error("Files outside the filter should stay converted")
+	}
+
+	// Restore the rest
+	summary2, err = UndoQuarantine(UndoOptions{BackupDir: backupDir})
+	if err != nil || summary2.Restored != 1 {
+		t.Fatalf("Expected the remaining original restored, got %+v, %v", summary2, err)
+	}
+	restored, _ = os.ReadFile(filepath.Join(backupDir, "aa", files[0].fileID))
+	if !bytes.Equal(restored, originals[files[0].fileID]) {
+		t.Error("Expected the MediaDomain original to be restored")
+	}
+	if left, _ := NewQuarantine(quarantinePathForBackup(backupDir), backupDir).Files(); len(left) != 0 {
+		t.Errorf("Quarantine should be empty, has %v", left)
+	}
+}
+
+// TestQuarantineKeepsFirstOriginal tests that converting a converted file again keeps the first original
+func TestQuarantineKeepsFirstOriginal(t *testing.T) {
+	backupDir := filepath.Join(t.TempDir(), "backup")
+	path := filepath.Join(backupDir, "Snapshot", "ab", "ab01")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	quarantine := NewQuarantine(filepath.Join(t.TempDir(), "quarantine"), backupDir)
+
+	for i, content := range []string{"original", "first output", "second output"} {
+		if err := os.WriteFile(path+".out", []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write output: %v", err)
+		}
+		if i == 0 {
+			os.Rename(path+".out", path)
+			continue
+		}
+		if err := quarantine.Replace(path, path+".out"); err != nil {
+			t.Fatalf("Replace failed: %v", err)
+		}
+	}
+
+	// Files still in the Snapshot directory are kept under their finished layout
+	files, err := quarantine.Files()
+	if err != nil || len(files) != 1 || files[0] != filepath.Join("ab", "ab01") {
+		t.Fatalf("Unexpected quarantine contents %v, %v", files, err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "second output" {
+		t.Errorf("Expected the latest output in the backup, got %q", data)
+	}
+
+	// The backup never finished, so the original goes back into the Snapshot directory
+	target, err := quarantine.Restore(files[0])
+	if err != nil || target != path {
+		t.Fatalf("Expected restore to %s, got %s, %v", path, target, err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "original" {
+		t.Errorf("Expected the first original restored, got %q", data)
+	}
+}
+
+// TestTransformEncryptedBackupQuarantine tests that encrypted originals are quarantined as stored and restored with their size
+func TestTransformEncryptedBackupQuarantine(t *testing.T) {
+	fixture := createEncryptedBackup(t)
+	filePath := filepath.Join(fixture.dir, fixture.fileID[:2], fixture.fileID)
+	ciphertext, _ := os.ReadFile(filePath)
+
+	store, err := OpenProvenanceStore(provenancePathForBackup(fixture.dir))
+	if err != nil {
+		t.Fatalf("Failed to open provenance store: %v", err)
+	}
+	transformer := NewBackupTransformer()
+	transformer.SetProvenance(store)
+	transformer.SetQuarantine(NewQuarantine(quarantinePathForBackup(fixture.dir), fixture.dir))
+	opts := TransformOptions{BackupDir: fixture.dir, Workers: 1, Password: fixture.password, UpdateManifest: true}
+	if _, err := TransformBackup(context.Background(), transformer, opts); err != nil {
+		t.Fatalf("TransformBackup failed: %v", err)
+	}
+	store.Close()
+
+	kept, err := os.ReadFile(filepath.Join(quarantinePathForBackup(fixture.dir), fixture.fileID[:2], fixture.fileID))
+	if err != nil || !bytes.Equal(kept, ciphertext) {
+		t.Fatalf("Expected the encrypted original in quarantine: %v", err)
+	}
+
+	if _, err := UndoQuarantine(UndoOptions{BackupDir: fixture.dir, Password: fixture.password, UpdateManifest: true}); err != nil {
+		t.Fatalf("UndoQuarantine failed: %v", err)
+	}
+	if restored, _ := os.ReadFile(filePath); !bytes.Equal(restored, ciphertext) {
+		t.Error("Expected the encrypted original restored")
+	}
+
+	// Manifest.db records the original's plaintext size again
+	plain := filepath.Join(t.TempDir(), "plain.png")
+	if err := DecryptFile(fixture.fileKey, filePath, plain); err != nil {
+		t.Fatalf("DecryptFile failed: %v", err)
+	}
+	analyzer, _, err := OpenBackupManifest(fixture.dir, fixture.password)
+	if err != nil {
+		t.Fatalf("OpenBackupManifest failed: %v", err)
+	}
+	defer analyzer.Close()
+	blob, _ := analyzer.FileBlob(fixture.fileID)
+	archive, err := decodeKeyedArchive(blob)
+	if err != nil {
+		t.Fatalf("Failed to decode file metadata: %v", err)
+	}
+	if size, _ := archive.integer("Size"); size != fileSize(plain) {
+		t.Errorf("Expected Size %d after undo, got %d", fileSize(plain), size)
+	}
+}
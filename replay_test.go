@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// isJPEGFile reports whether a file starts with the JPEG magic bytes
+func isJPEGFile(t *testing.T, path string) bool {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", path, err)
+	}
+	return bytes.HasPrefix(data, []byte{0xFF, 0xD8, 0xFF})
+}
+
+// TestReplayProcessesRecordedLog tests that a recorded log drives the transformation path
+func TestReplayProcessesRecordedLog(t *testing.T) {
+	tempDir := t.TempDir()
+	udid := "00008110-000E785101F2401E"
+	backupDir := filepath.Join(tempDir, udid)
+
+	// One file still in the Snapshot directory, one already moved into the backup root
+	snapshotFile := filepath.Join(backupDir, "Snapshot", "aa", "aa11")
+	movedFile := filepath.Join(backupDir, "bb", "bb22")
+	for _, path := range []string{snapshotFile, movedFile} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		writeTestPNG(t, path, 40, 40, color.RGBA{0, 0, 255, 255})
+	}
+
+	// Mixed stdout/stderr capture with CRLF endings and progress noise
+	logContent := "iOS Backup Transformer - Log started at 2024-01-15T15:04:05Z\r\n" +
+		"Receiving files\r\n" +
+		"FILE_FILTERED: domain=HomeDomain-Library/Preferences/x.plist\r\n" +
+		"FILE_SAVED: path=" + udid + "/Snapshot/aa/aa11 domain=MediaDomain-Library/SMS/Attachments/IMG_1.PNG\r\n" +
+		"[=====                    ]  20%\r" +
+		"FILE_SAVED: path=" + udid + "/Snapshot/bb/bb22 domain=MediaDomain-Library/SMS/Attachments/IMG_2.png\n" +
+		"FILE_SAVED: path=" + udid + "/Snapshot/cc/cc33 domain=MediaDomain-Library/SMS/Attachments/missing.png\n"
+	logPath := filepath.Join(tempDir, "backup.log")
+	if err := os.WriteFile(logPath, []byte(logContent), 0644); err != nil {
+		t.Fatalf("Failed to write log: %v", err)
+	}
+
+	transformer := NewBackupTransformer()
+	runner, err := NewBackupRunner(backupDir, "ios_backup", false, transformer)
+	if err != nil {
+		t.Fatalf("Failed to create runner: %v", err)
+	}
+
+	if err := runner.Replay(logPath); err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+
+	if !isJPEGFile(t, snapshotFile) {
+		t.Error("Snapshot file should have been converted to JPEG")
+	}
+	if !isJPEGFile(t, movedFile) {
+		t.Error("File moved out of Snapshot should have been converted to JPEG")
+	}
+	if runner.totalCount != 2 {
+		t.Errorf("Expected 2 transformations, got %d", runner.totalCount)
+	}
+}
+
+// TestReplayMissingLog tests that a missing replay log is reported
+func TestReplayMissingLog(t *testing.T) {
+	tempDir := t.TempDir()
+	runner, err := NewBackupRunner(filepath.Join(tempDir, "backup"), "ios_backup", false, NewBackupTransformer())
+	if err != nil {
+		t.Fatalf("Failed to create runner: %v", err)
+	}
+
+	if err := runner.Replay(filepath.Join(tempDir, "missing.log")); err == nil {
+		t.Error("Expected error for missing replay log")
+	}
+}
+
+// TestWithoutSnapshotDir tests mapping Snapshot paths to their final location
+func TestWithoutSnapshotDir(t *testing.T) {
+	in := filepath.Join("backups", "udid", "Snapshot", "ab", "abcd")
+	want := filepath.Join("backups", "udid", "ab", "abcd")
+	if got := withoutSnapshotDir(in); got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+
+	plain := filepath.Join("backups", "udid", "ab", "abcd")
+	if got := withoutSnapshotDir(plain); got != plain {
+		t.Errorf("Expected unchanged path, got %s", got)
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reportSchemaVersion is bumped whenever a report field is renamed, removed or changes meaning
+const reportSchemaVersion = 1
+
+// RunReport collects what happened to every file handled by a run, for the -report file
+// Support staff use it to answer why a file is missing or unconverted without reading the log
+type RunReport struct {
+	mu        sync.Mutex
+	backupDir string
+	started   time.Time
+	finished  time.Time
+	status    string // "completed", "failed" or "interrupted"
+	dryRun    bool   // Sizes after conversion are estimates and nothing was converted
+	runErr    string
+	files     []ReportEntry
+	index     map[string]int // Path -> position in files
+}
+
+// ReportEntry describes one handled file
+type ReportEntry struct {
+	Path        string `json:"path"`
+	Domain      string `json:"domain"` // ios_backup "<domain>-<relativePath>" key
+	Extension   string `json:"extension"`
+	Action      string `json:"action,omitempty"` // Conversion applied, e.g. "heic->jpeg" (empty for non-media files)
+	Outcome     string `json:"outcome"`
+	BytesBefore int64  `json:"bytes_before"`
+	BytesAfter  int64  `json:"bytes_after"`     // Estimated for planned files in a dry run
+	Width       int    `json:"width,omitempty"` // Current dimensions (dry runs)
+	Height      int    `json:"height,omitempty"`
+	DurationMs  int64  `json:"duration_ms"`
+	Error       string `json:"error,omitempty"`
+}
+
+// ReportTotals sums up a group of report entries
+type ReportTotals struct {
+	Files       int   `json:"files"`
+	Converted   int   `json:"converted"`
+	AlreadyDone int   `json:"already_done"`
+	Skipped     int   `json:"skipped"`
+	Failed      int   `json:"failed"`
+	Planned     int   `json:"planned"` // Files a dry run would convert
+	BytesBefore int64 `json:"bytes_before"`
+	BytesAfter  int64 `json:"bytes_after"`
+	BytesSaved  int64 `json:"bytes_saved"` // Space saved by converted files (projected for planned files)
+}
+
+// reportDocument is the JSON layout of a report file
+type reportDocument struct {
+	Schema     int                     `json:"schema"`
+	BackupDir  string                  `json:"backup_dir"`
+	StartedAt  time.Time               `json:"started_at"`
+	FinishedAt time.Time               `json:"finished_at"`
+	Status     string                  `json:"status"`
+	DryRun     bool                    `json:"dry_run,omitempty"`
+	Error      string                  `json:"error,omitempty"`
+	Totals     ReportTotals            `json:"totals"`
+	ByType     map[string]ReportTotals `json:"by_type"`   // Keyed by action ("none" for files without a conversion)
+	ByDomain   map[string]ReportTotals `json:"by_domain"` // Keyed by backup domain, e.g. "MediaDomain"
+	Failed     []ReportEntry           `json:"failed"`
+	Files      []ReportEntry           `json:"files"`
+}
+
+// NewRunReport starts a report for a backup directory
+func NewRunReport(backupDir string) *RunReport {
+	return &RunReport{backupDir: backupDir, started: time.Now(), index: make(map[string]int)}
+}
+
+// SetDryRun marks the report as a dry run, whose planned files were not converted
+func (r *RunReport) SetDryRun(dryRun bool) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dryRun = dryRun
+}
+
+// Record adds the result of handling a file; a file handled again replaces its earlier entry
+// Safe to call on a nil *RunReport, which records nothing
+func (r *RunReport) Record(filePath string, domain string, result TransformResult) {
+	if r == nil {
+		return
+	}
+	entry := ReportEntry{
+		Path:        filePath,
+		Domain:      domain,
+		Extension:   strings.ToLower(filepath.Ext(domain)),
+		Action:      result.Action,
+		Outcome:     string(result.Outcome),
+		BytesBefore: result.SizeBefore,
+		BytesAfter:  result.SizeAfter,
+		Width:       result.Width,
+		Height:      result.Height,
+		DurationMs:  result.Duration.Milliseconds(),
+	}
+	if result.Err != nil {
+		entry.Error = result.Err.Error()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if i, ok := r.index[filePath]; ok {
+		r.files[i] = entry
+		return
+	}
+	r.index[filePath] = len(r.files)
+	r.files = append(r.files, entry)
+}
+
+// Finish marks the end of the run with its status ("completed", "failed" or "interrupted")
+func (r *RunReport) Finish(status string, err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.finished = time.Now()
+	r.status = status
+	r.runErr = ""
+	if err != nil {
+		r.runErr = err.Error()
+	}
+}
+
+// document builds the totals and failure list from the recorded entries
+func (r *RunReport) document() reportDocument {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	doc := reportDocument{
+		Schema:     reportSchemaVersion,
+		BackupDir:  r.backupDir,
+		StartedAt:  r.started,
+		FinishedAt: r.finished,
+		Status:     r.status,
+		DryRun:     r.dryRun,
+		Error:      r.runErr,
+		ByType:     make(map[string]ReportTotals),
+		ByDomain:   make(map[string]ReportTotals),
+		Failed:     []ReportEntry{},
+		Files:      append([]ReportEntry{}, r.files...),
+	}
+	sort.SliceStable(doc.Files, func(i, j int) bool { return doc.Files[i].Domain < doc.Files[j].Domain })
+
+	for _, entry := range doc.Files {
+		action := entry.Action
+		if action == "" {
+			action = "none"
+		}
+		doc.Totals.add(entry)
+		byType := doc.ByType[action]
+		byType.add(entry)
+		doc.ByType[action] = byType
+		domain := manifestDomain(entry.Domain)
+		byDomain := doc.ByDomain[domain]
+		byDomain.add(entry)
+		doc.ByDomain[domain] = byDomain
+
+		if entry.Outcome == string(OutcomeFailed) {
+			doc.Failed = append(doc.Failed, entry)
+		}
+	}
+	return doc
+}
+
+// add counts an entry in the totals
+func (t *ReportTotals) add(entry ReportEntry) {
+	t.Files++
+	switch TransformOutcome(entry.Outcome) {
+	case OutcomeConverted:
+		t.Converted++
+		t.BytesSaved += entry.BytesBefore - entry.BytesAfter
+	case OutcomeAlreadyDone:
+		t.AlreadyDone++
+	case OutcomeSkipped:
+		t.Skipped++
+	case OutcomeFailed:
+		t.Failed++
+	case OutcomePlanned:
+		t.Planned++
+		t.BytesSaved += entry.BytesBefore - entry.BytesAfter
+	}
+	t.BytesBefore += entry.BytesBefore
+	t.BytesAfter += entry.BytesAfter
+}
+
+// WriteJSON writes the report as indented JSON
+func (r *RunReport) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r.document())
+}
+
+// WriteHTML writes the report as a standalone HTML page
+func (r *RunReport) WriteHTML(w io.Writer) error {
+	return reportTemplate.Execute(w, r.document())
+}
+
+// WriteFile writes the report to a file, as HTML for .html/.htm paths and as JSON otherwise
+func (r *RunReport) WriteFile(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create report: %v", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".html", ".htm":
+		err = r.WriteHTML(file)
+	default:
+		err = r.WriteJSON(file)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write report %s: %v", path, err)
+	}
+	return nil
+}
+
+// reportStatus returns the report status for how a run ended
+func reportStatus(err error, interrupted bool) string {
+	switch {
+	case interrupted:
+		return "interrupted"
+	case err != nil:
+		return "failed"
+	default:
+		return "completed"
+	}
+}
+
+// writeReports finishes a report and writes it to every -report path, logging failures
+func writeReports(report *RunReport, paths []string, status string, err error) {
+	if report == nil {
+		return
+	}
+	report.Finish(status, err)
+	for _, path := range paths {
+		if err := report.WriteFile(path); err != nil {
+			errorLog.Printf("%v", err)
+			continue
+		}
+		infoLog.Printf("Report written to %s", path)
+	}
+}
+
+// reportTotalsTable is the input of the "totals" HTML template
+type reportTotalsTable struct {
+	Title  string
+	Totals map[string]ReportTotals
+	DryRun bool // Show the planned column
+}
+
+// reportTemplate renders the HTML report
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"bytes": func(n int64) string {
+		if n < 0 {
+			return "-" + formatBytes(-n)
+		}
+		return formatBytes(n)
+	},
+	"time": func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Format("2006-01-02 15:04:05")
+	},
+	"totalsTable": func(title string, totals map[string]ReportTotals, dryRun bool) reportTotalsTable {
+		return reportTotalsTable{Title: title, Totals: totals, DryRun: dryRun}
+	},
+	"sorted": func(m map[string]ReportTotals) []string {
+		keys := make([]string, 0, len(m))
+		for key := range m {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return keys
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Backup report{{if .DryRun}} (dry run){{end}} - {{.BackupDir}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+td.num { text-align: right; }
+tr.failed { background: #fdd; }
+</style>
+</head>
+<body>
+<h1>Backup report{{if .DryRun}} (dry run){{end}}</h1>
+{{if .DryRun}}<p>Nothing was converted. Sizes after conversion are estimates for the planned files.</p>{{end}}
+<p>
+Backup directory: {{.BackupDir}}<br>
+Started: {{time .StartedAt}}<br>
+Finished: {{time .FinishedAt}}<br>
+Status: {{.Status}}{{if .Error}} ({{.Error}}){{end}}
+</p>
+
+<h2>Summary</h2>
+<table>
+<tr><th>Files</th><th>Converted</th><th>Already done</th><th>Skipped</th><th>Failed</th>{{if .DryRun}}<th>Planned</th>{{end}}<th>Before</th><th>After</th><th>Saved</th></tr>
+{{with .Totals}}<tr><td class="num">{{.Files}}</td><td class="num">{{.Converted}}</td><td class="num">{{.AlreadyDone}}</td><td class="num">{{.Skipped}}</td><td class="num">{{.Failed}}</td>{{if $.DryRun}}<td class="num">{{.Planned}}</td>{{end}}<td class="num">{{bytes .BytesBefore}}</td><td class="num">{{bytes .BytesAfter}}</td><td class="num">{{bytes .BytesSaved}}</td></tr>{{end}}
+</table>
+
+{{define "totals"}}<table>
+<tr><th>{{.Title}}</th><th>Files</th><th>Converted</th><th>Already done</th><th>Skipped</th><th>Failed</th>{{if .DryRun}}<th>Planned</th>{{end}}<th>Before</th><th>After</th><th>Saved</th></tr>
+{{range $key := sorted .Totals}}{{with index $.Totals $key}}<tr><td>{{$key}}</td><td class="num">{{.Files}}</td><td class="num">{{.Converted}}</td><td class="num">{{.AlreadyDone}}</td><td class="num">{{.Skipped}}</td><td class="num">{{.Failed}}</td>{{if $.DryRun}}<td class="num">{{.Planned}}</td>{{end}}<td class="num">{{bytes .BytesBefore}}</td><td class="num">{{bytes .BytesAfter}}</td><td class="num">{{bytes .BytesSaved}}</td></tr>
+{{end}}{{end}}</table>{{end}}
+<h2>By type</h2>
+{{template "totals" (totalsTable "Type" .ByType .DryRun)}}
+
+<h2>By domain</h2>
+{{template "totals" (totalsTable "Domain" .ByDomain .DryRun)}}
+
+<h2>Failed files ({{len .Failed}})</h2>
+{{if .Failed}}<table>
+<tr><th>Domain</th><th>Action</th><th>Error</th><th>Path</th></tr>
+{{range .Failed}}<tr><td>{{.Domain}}</td><td>{{.Action}}</td><td>{{.Error}}</td><td>{{.Path}}</td></tr>
+{{end}}</table>{{else}}<p>None</p>{{end}}
+
+<h2>All files ({{len .Files}})</h2>
+<table>
+<tr><th>Domain</th><th>Extension</th><th>Action</th><th>Outcome</th>{{if .DryRun}}<th>Dimensions</th>{{end}}<th>Before</th><th>After</th><th>Duration</th><th>Error</th></tr>
+{{range .Files}}<tr{{if eq .Outcome "failed"}} class="failed"{{end}}><td>{{.Domain}}</td><td>{{.Extension}}</td><td>{{.Action}}</td><td>{{.Outcome}}</td>{{if $.DryRun}}<td class="num">{{if .Width}}{{.Width}}x{{.Height}}{{end}}</td>{{end}}<td class="num">{{bytes .BytesBefore}}</td><td class="num">{{bytes .BytesAfter}}</td><td class="num">{{.DurationMs}} ms</td><td>{{.Error}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
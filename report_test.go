@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRunReportTotals tests per-type and per-domain totals, replaced entries and the failure list
+func TestRunReportTotals(t *testing.T) {
+	report := NewRunReport("/backups/device")
+	report.Record("/b/aa/aa1", "MediaDomain-Library/SMS/IMG_1.HEIC",
+		TransformResult{Action: "heic->jpeg", Outcome: OutcomeFailed, Err: errors.New("first try"), SizeBefore: 3000, SizeAfter: 3000})
+	report.Record("/b/aa/aa1", "MediaDomain-Library/SMS/IMG_1.HEIC",
+		TransformResult{Action: "heic->jpeg", Outcome: OutcomeConverted, SizeBefore: 3000, SizeAfter: 1000, Duration: 250 * time.Millisecond})
+	report.Record("/b/bb/bb2", "AppDomain-net.whatsapp.WhatsApp-Media/<b>clip</b>.mov",
+		TransformResult{Action: "video->jpeg", Outcome: OutcomeFailed, Err: errors.New("ffmpeg not found"), SizeBefore: 500, SizeAfter: 500})
+	report.Record("/b/cc/cc3", "MediaDomain-Library/SMS/sms.db",
+		TransformResult{Outcome: OutcomeSkipped, SizeBefore: 200, SizeAfter: 200})
+	report.Finish(reportStatus(nil, false), nil)
+
+	var buf bytes.Buffer
+	if err := report.WriteJSON(&buf); err != nil {
+		t.Fatalf("WriteJSON failed: %v", err)
+	}
+	var doc reportDocument
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatalf("Invalid report JSON: %v", err)
+	}
+
+	if doc.Status != "completed" || len(doc.Files) != 3 {
+		t.Errorf("Unexpected report: status %q, %d files", doc.Status, len(doc.Files))
+	}
+	want := ReportTotals{Files: 3, Converted: 1, Skipped: 1, Failed: 1, BytesBefore: 3700, BytesAfter: 1700, BytesSaved: 2000}
+	if doc.Totals != want {
+		t.Errorf("Totals = %+v, want %+v", doc.Totals, want)
+	}
+	if got := doc.ByType["heic->jpeg"]; got.Converted != 1 || got.BytesSaved != 2000 {
+		t.Errorf("Unexpected heic->jpeg totals: %+v", got)
+	}
+	if got := doc.ByType["none"]; got.Skipped != 1 {
+		t.Errorf("Unexpected totals for files without a conversion: %+v", got)
+	}
+	if got := doc.ByDomain["MediaDomain"]; got.Files != 2 {
+		t.Errorf("Unexpected MediaDomain totals: %+v", got)
+	}
+	if len(doc.Failed) != 1 || doc.Failed[0].Error != "ffmpeg not found" || doc.Failed[0].Extension != ".mov" {
+		t.Errorf("Unexpected failed files: %+v", doc.Failed)
+	}
+
+	buf.Reset()
+	if err := report.WriteHTML(&buf); err != nil {
+		t.Fatalf("WriteHTML failed: %v", err)
+	}
+	html := buf.String()
+	if !strings.Contains(html, "ffmpeg not found") || !strings.Contains(html, "&lt;b&gt;clip&lt;/b&gt;.mov") {
+		t.Errorf("HTML report is missing the failure or does not escape names:\n%s", html)
+	}
+}
+
+// TestTransformBackupReport tests that the transform command writes JSON and HTML reports
+func TestTransformBackupReport(t *testing.T) {
+	backupDir := filepath.Join(t.TempDir(), "00008110-000E785101F2401E")
+	files := []testManifestFile{
+		{"aa00000000000000000000000000000000000001", "MediaDomain", "Library/SMS/Attachments/01/IMG_0001.PNG", 1},
+		{"bb00000000000000000000000000000000000002", "MediaDomain", "Library/SMS/Attachments/02/IMG_0002.HEIC", 1},
+	}
+	for _, f := range files {
+		path := filepath.Join(backupDir, f.fileID[:2], f.fileID)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		if strings.HasSuffix(f.relativePath, ".HEIC") {
+			writeTestHEIC(t, path)
+		} else {
+			writeTestPNG(t, path, 900, 600, color.RGBA{10, 20, 30, 255})
+		}
+	}
+	createTestManifest(t, backupDir, files)
+
+	// heic-converter rejects the file, so the HEIC conversion fails
+	procs := NewFakeRunner()
+	procs.Register("heic-converter", FakeTool{Steps: []FakeStep{{Stderr: "not a HEIF file"}}, ExitCode: 1})
+	transformer := NewBackupTransformer()
+	transformer.SetProcessRunner(procs)
+	report := NewRunReport(backupDir)
+	if _, err := TransformBackup(context.Background(), transformer, TransformOptions{
+		BackupDir: backupDir,
+		Workers:   2,
+		Report:    report,
+	}); err != nil {
+		t.Fatalf("TransformBackup failed: %v", err)
+	}
+
+	jsonPath := filepath.Join(t.TempDir(), "report.json")
+	htmlPath := filepath.Join(t.TempDir(), "report.html")
+	writeReports(report, []string{jsonPath, htmlPath}, "completed", nil)
+
+	data, err := os.ReadFile(jsonPath)
+	if err != nil {
+		t.Fatalf("Report not written: %v", err)
+	}
+	var doc reportDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("Invalid report JSON: %v", err)
+	}
+	if doc.Totals.Converted != 1 || doc.Totals.Failed != 1 || doc.Totals.BytesSaved <= 0 {
+		t.Errorf("Unexpected totals: %+v", doc.Totals)
+	}
+	if len(doc.Failed) != 1 || doc.Failed[0].Action != "heic->jpeg" || doc.Failed[0].Error == "" {
+		t.Errorf("Expected the HEIC failure with its reason, got %+v", doc.Failed)
+	}
+
+	html, err := os.ReadFile(htmlPath)
+	if err != nil || !strings.HasPrefix(string(html), "<!DOCTYPE html>") {
+		t.Errorf("HTML report not written: %v", err)
+	}
+}
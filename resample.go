@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"sort"
+	"strings"
+)
+
+// defaultResampleFilter is used for downscaling unless -resample picks another filter
+// Lanczos keeps the small text of chat screenshots legible at 500px without visible ringing
+const defaultResampleFilter = "lanczos"
+
+// ResampleFilter is a resampling kernel for resizing images
+// When downscaling, the kernel is stretched over the source pixels that make up one output pixel,
+// so every source pixel contributes (area averaging) instead of a few being picked
+type ResampleFilter struct {
+	Name    string
+	Support float64                 // Kernel radius in pixels at 1:1 scale (0 picks the nearest pixel)
+	Kernel  func(x float64) float64 // Weight of a pixel at distance x
+}
+
+// resampleFilters are the filters selectable with -resample
+var resampleFilters = map[string]ResampleFilter{
+	"nearest":     {Name: "nearest"},
+	"box":         {Name: "box", Support: 0.5, Kernel: boxKernel},
+	"bilinear":    {Name: "bilinear", Support: 1, Kernel: bilinearKernel},
+	"catmull-rom": {Name: "catmull-rom", Support: 2, Kernel: catmullRomKernel},
+	"lanczos":     {Name: "lanczos", Support: 3, Kernel: lanczosKernel},
+}
+
+// ParseResampleFilter returns the resampling filter with the given name ("" selects the default)
+func ParseResampleFilter(name string) (ResampleFilter, error) {
+	if name == "" {
+		name = defaultResampleFilter
+	}
+	filter, ok := resampleFilters[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return ResampleFilter{}, fmt.Errorf("unknown resampling filter %q (available: %s)", name, strings.Join(resampleFilterNames(), ", "))
+	}
+	return filter, nil
+}
+
+// resampleFilterNames returns the names of the resampling filters in sorted order
+func resampleFilterNames() []string {
+	names := make([]string, 0, len(resampleFilters))
+	for name := range resampleFilters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// boxKernel averages the pixels under the output pixel
+func boxKernel(x float64) float64 {
+	if x >= -0.5 && x < 0.5 {
+		return 1
+	}
+	return 0
+}
+
+// bilinearKernel interpolates linearly between neighboring pixels (a triangle filter)
+func bilinearKernel(x float64) float64 {
+	x = math.Abs(x)
+	if x < 1 {
+		return 1 - x
+	}
+	return 0
+}
+
+// catmullRomKernel is the cubic convolution kernel with B=0, C=0.5
+func catmullRomKernel(x float64) float64 {
+	x = math.Abs(x)
+	switch {
+	case x < 1:
+		return (1.5*x-2.5)*x*x + 1
+	case x < 2:
+		return ((-0.5*x+2.5)*x-4)*x + 2
+	}
+	return 0
+}
+
+// lanczosKernel is the 3-lobed Lanczos kernel, a windowed sinc
+func lanczosKernel(x float64) float64 {
+	x = math.Abs(x)
+	if x < 3 {
+		return sinc(x) * sinc(x/3)
+	}
+	return 0
+}
+
+// sinc is the normalized sinc function sin(pi*x)/(pi*x)
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	x *= math.Pi
+	return math.Sin(x) / x
+}
+
+// resampleWeights are the source pixels (along one axis) that make up one output pixel
+type resampleWeights struct {
+	start   int       // First source pixel
+	weights []float32 // Weight of each source pixel from start on, summing to 1
+}
+
+// computeResampleWeights computes the contributions of srcSize source pixels to each of dstSize output pixels
+func computeResampleWeights(dstSize int, srcSize int, filter ResampleFilter) []resampleWeights {
+	scale := float64(srcSize) / float64(dstSize)
+	filterScale := math.Max(scale, 1) // Stretch the kernel when downscaling
+	support := filter.Support * filterScale
+
+	contributions := make([]resampleWeights, dstSize)
+	for i := range contributions {
+		center := (float64(i) + 0.5) * scale
+		if filter.Kernel == nil {
+			nearest := min(int(center), srcSize-1)
+			contributions[i] = resampleWeights{start: nearest, weights: []float32{1}}
+			continue
+		}
+
+		start := max(int(math.Floor(center-support+0.5)), 0)
+		end := min(int(math.Floor(center+support+0.5)), srcSize)
+		weights := make([]float64, 0, end-start)
+		var sum float64
+		for j := start; j < end; j++ {
+			w := filter.Kernel((float64(j) + 0.5 - center) / filterScale)
+			weights = append(weights, w)
+			sum += w
+		}
+		if sum == 0 {
+			// Kernel too narrow to reach any pixel center; fall back to the nearest pixel
+			nearest := min(int(center), srcSize-1)
+			contributions[i] = resampleWeights{start: nearest, weights: []float32{1}}
+			continue
+		}
+
+		normalized := make([]float32, len(weights))
+		for j, w := range weights {
+			normalized[j] = float32(w / sum)
+		}
+		contributions[i] = resampleWeights{start: start, weights: normalized}
+	}
+	return contributions
+}
+
+// resample scales src onto all of dst with the given filter, one axis at a time
+// Pixels are filtered as premultiplied RGBA; only the source rows under the current output row
+// are kept in memory, and cancellation is checked once per row
+func resample(ctx context.Context, dst *image.RGBA, src image.Image, filter ResampleFilter) error {
+	srcBounds := src.Bounds()
+	srcWidth, srcHeight := srcBounds.Dx(), srcBounds.Dy()
+	dstWidth, dstHeight := dst.Bounds().Dx(), dst.Bounds().Dy()
+	if srcWidth == 0 || srcHeight == 0 || dstWidth == 0 || dstHeight == 0 {
+		return nil
+	}
+
+	columns := computeResampleWeights(dstWidth, srcWidth, filter)
+	rows := computeResampleWeights(dstHeight, srcHeight, filter)
+
+	// Horizontally resampled source rows, loaded as the output rows need them
+	filtered := make(map[int][]float32)
+	var spare [][]float32
+	srcRow := image.NewRGBA(image.Rect(0, 0, srcWidth, 1))
+	loadRow := func(y int) []float32 {
+		if row, ok := filtered[y]; ok {
+			return row
+		}
+		draw.Draw(srcRow, srcRow.Bounds(), src, image.Pt(srcBounds.Min.X, srcBounds.Min.Y+y), draw.Src)
+		var row []float32
+		if n := len(spare); n > 0 {
+			row, spare = spare[n-1], spare[:n-1]
+		} else {
+			row = make([]float32, dstWidth*4)
+		}
+		for x, column := range columns {
+			var r, g, b, a float32
+			pix := srcRow.Pix[column.start*4:]
+			for i, w := range column.weights {
+				r += w * float32(pix[i*4])
+				g += w * float32(pix[i*4+1])
+				b += w * float32(pix[i*4+2])
+				a += w * float32(pix[i*4+3])
+			}
+			row[x*4], row[x*4+1], row[x*4+2], row[x*4+3] = r, g, b, a
+		}
+		filtered[y] = row
+		return row
+	}
+
+	for y, contribution := range rows {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("resize cancelled: %v", err)
+		}
+
+		// Rows above this output row's window are not needed again
+		for srcY, row := range filtered {
+			if srcY < contribution.start {
+				spare = append(spare, row)
+				delete(filtered, srcY)
+			}
+		}
+
+		window := make([][]float32, len(contribution.weights))
+		for i := range window {
+			window[i] = loadRow(contribution.start + i)
+		}
+
+		offset := dst.PixOffset(dst.Rect.Min.X, dst.Rect.Min.Y+y)
+		out := dst.Pix[offset : offset+dstWidth*4]
+		for x := 0; x < dstWidth*4; x += 4 {
+			var r, g, b, a float32
+			for i, w := range contribution.weights {
+				r += w * window[i][x]
+				g += w * window[i][x+1]
+				b += w * window[i][x+2]
+				a += w * window[i][x+3]
+			}
+			// Sharpening kernels overshoot; color may not exceed alpha in premultiplied RGBA
+			alpha := clampChannel(a)
+			out[x+3] = alpha
+			out[x] = min(clampChannel(r), alpha)
+			out[x+1] = min(clampChannel(g), alpha)
+			out[x+2] = min(clampChannel(b), alpha)
+		}
+	}
+	return nil
+}
+
+// clampChannel rounds a filtered channel value to 0-255
+func clampChannel(v float32) uint8 {
+	switch {
+	case v <= 0:
+		return 0
+	case v >= 255:
+		return 255
+	}
+	return uint8(v + 0.5)
+}
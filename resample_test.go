@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+var updateGolden = flag.Bool("update-golden", false, "Rewrite the golden images in testdata instead of comparing against them")
+
+// goldenTolerance allows for float rounding differences between CPU architectures
+const goldenTolerance = 2
+
+// chatScreenshot draws a small stand-in for a chat screenshot: message bubbles with crisp text
+// rendered at 3x like a phone display, a hairline separator and a gradient header
+func chatScreenshot() *image.RGBA {
+	const scale = 3
+	small := image.NewRGBA(image.Rect(0, 0, 200, 90))
+	draw.Draw(small, small.Bounds(), image.White, image.Point{}, draw.Src)
+	for x := 0; x < 200; x++ {
+		for y := 0; y < 14; y++ {
+			small.Set(x, y, color.RGBA{uint8(x), 120, 255 - uint8(x), 255})
+		}
+	}
+	draw.Draw(small, image.Rect(6, 22, 150, 44), image.NewUniform(color.RGBA{229, 229, 234, 255}), image.Point{}, draw.Src)
+	draw.Draw(small, image.Rect(50, 56, 194, 78), image.NewUniform(color.RGBA{0, 122, 255, 255}), image.Point{}, draw.Src)
+	drawer := font.Drawer{Dst: small, Src: image.Black, Face: basicfont.Face7x13}
+	drawer.Dot = fixed.P(10, 37)
+	drawer.DrawString("Invoice #4417 is due")
+	drawer.Src = image.White
+	drawer.Dot = fixed.P(54, 71)
+	drawer.DrawString("Paid 03/12, ref QX7")
+
+	img := image.NewRGBA(image.Rect(0, 0, 200*scale, 90*scale))
+	for y := 0; y < img.Bounds().Dy(); y++ {
+		for x := 0; x < img.Bounds().Dx(); x++ {
+			img.Set(x, y, small.At(x/scale, y/scale))
+		}
+	}
+	for x := 0; x < img.Bounds().Dx(); x++ {
+		img.Set(x, 150, color.Black)
+	}
+	return img
+}
+
+// TestResampleGolden compares downscaled chat screenshots against golden images in testdata
+// Run with -update-golden after an intended change to the resampler and check the new images by eye
+func TestResampleGolden(t *testing.T) {
+	src := chatScreenshot()
+	for _, name := range resampleFilterNames() {
+		resized, err := resizeImage(context.Background(), src, 250, resampleFilters[name])
+		if err != nil {
+			t.Fatalf("%s: resizeImage failed: %v", name, err)
+		}
+
+		goldenPath := filepath.Join("testdata", "resample_"+name+".png")
+		if *updateGolden {
+			if err := writePNG(goldenPath, resized); err != nil {
+				t.Fatalf("Failed to write golden image: %v", err)
+			}
+			continue
+		}
+
+		file, err := os.Open(goldenPath)
+		if err != nil {
+			t.Fatalf("Failed to open golden image (run with -update-golden to create it): %v", err)
+		}
+		golden, err := png.Decode(file)
+		file.Close()
+		if err != nil {
+			t.Fatalf("Failed to decode golden image: %v", err)
+		}
+		if golden.Bounds() != resized.Bounds() {
+			t.Errorf("%s: size %v, golden %v", name, resized.Bounds(), golden.Bounds())
+			continue
+		}
+		if diffs := countPixelDiffs(resized, golden, goldenTolerance); diffs > 0 {
+			t.Errorf("%s: %d pixels differ from %s", name, diffs, goldenPath)
+		}
+	}
+}
+
+// TestResampleAntiAliasing tests that fine detail averages out instead of aliasing like nearest-neighbor
+func TestResampleAntiAliasing(t *testing.T) {
+	// 1px black and white stripes, halved: every output pixel covers one of each
+	src := image.NewRGBA(image.Rect(0, 0, 1000, 40))
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 1000; x++ {
+			src.Set(x, y, color.Gray{uint8(255 * (x % 2))})
+		}
+	}
+
+	for _, name := range resampleFilterNames() {
+		resized, err := resizeImage(context.Background(), src, 500, resampleFilters[name])
+		if err != nil {
+			t.Fatalf("%s: resizeImage failed: %v", name, err)
+		}
+		// Skip the edges where the wider kernels are cut off
+		gray := color.GrayModel.Convert(resized.At(250, 10)).(color.Gray).Y
+		if name == "nearest" {
+			if gray != 0 && gray != 255 {
+				t.Errorf("nearest: expected a black or white pixel, got %d", gray)
+			}
+			continue
+		}
+		for x := 10; x < 490; x++ {
+			gray := color.GrayModel.Convert(resized.At(x, 10)).(color.Gray).Y
+			if gray < 120 || gray > 136 {
+				t.Errorf("%s: expected mid gray at x=%d, got %d", name, x, gray)
+				break
+			}
+		}
+	}
+}
+
+// TestResamplePreservesFlatColors tests that weights are normalized, so flat areas and edges keep their color
+func TestResamplePreservesFlatColors(t *testing.T) {
+	fill := color.RGBA{40, 160, 90, 255}
+	src := image.NewRGBA(image.Rect(10, 20, 1210, 920)) // Bounds need not start at 0
+	draw.Draw(src, src.Bounds(), image.NewUniform(fill), image.Point{}, draw.Src)
+
+	for _, name := range resampleFilterNames() {
+		resized, err := resizeImage(context.Background(), src, 500, resampleFilters[name])
+		if err != nil {
+			t.Fatalf("%s: resizeImage failed: %v", name, err)
+		}
+		if resized.Bounds() != image.Rect(0, 0, 500, 375) {
+			t.Fatalf("%s: unexpected bounds %v", name, resized.Bounds())
+		}
+		uniform := image.NewRGBA(resized.Bounds())
+		draw.Draw(uniform, uniform.Bounds(), image.NewUniform(fill), image.Point{}, draw.Src)
+		if diffs := countPixelDiffs(resized, uniform, 1); diffs > 0 {
+			t.Errorf("%s: %d pixels changed color", name, diffs)
+		}
+	}
+}
+
+// TestParseResampleFilter tests filter selection by name
+func TestParseResampleFilter(t *testing.T) {
+	if filter, err := ParseResampleFilter(""); err != nil || filter.Name != defaultResampleFilter {
+		t.Errorf("Expected the default filter, got %q, %v", filter.Name, err)
+	}
+	if filter, err := ParseResampleFilter("Catmull-Rom"); err != nil || filter.Name != "catmull-rom" {
+		t.Errorf("Expected catmull-rom, got %q, %v", filter.Name, err)
+	}
+	if _, err := ParseResampleFilter("bicubic"); err == nil {
+		t.Error("Expected an error for an unknown filter")
+	}
+}
+
+// countPixelDiffs counts the pixels whose channels differ by more than tolerance
+func countPixelDiffs(a image.Image, b image.Image, tolerance int) int {
+	diffs := 0
+	bounds := a.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c1 := color.NRGBAModel.Convert(a.At(x, y)).(color.NRGBA)
+			c2 := color.NRGBAModel.Convert(b.At(x, y)).(color.NRGBA)
+			if absDiff(c1.R, c2.R) > tolerance || absDiff(c1.G, c2.G) > tolerance ||
+				absDiff(c1.B, c2.B) > tolerance || absDiff(c1.A, c2.A) > tolerance {
+				diffs++
+			}
+		}
+	}
+	return diffs
+}
+
+// absDiff returns the difference of two channel values
+func absDiff(a uint8, b uint8) int {
+	if a > b {
+		return int(a - b)
+	}
+	return int(b - a)
+}
+
+// writePNG writes an image as PNG, creating the directory
+func writePNG(path string, img image.Image) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(file, img); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
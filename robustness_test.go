@@ -91,7 +91,7 @@ func TestMemoryAllocationGuard(t *testing.T) {
 	
 	// This should fail gracefully due to size guard
 	// Resize to 10000 width would create 10000x10000 image = 400MB
-	_, err := resizeImage(largeImg, 10000)
+	_, err := resizeImage(context.Background(), largeImg, 10000, resampleFilters[defaultResampleFilter])
 	if err == nil {
 		t.Error("Expected error for oversized image allocation, got nil")
 		return
@@ -115,7 +115,7 @@ func TestResizeImageSmallImage(t *testing.T) {
 	}
 	
 	// Resize should succeed
-	resized, err := resizeImage(img, 200)
+	resized, err := resizeImage(context.Background(), img, 200, resampleFilters[defaultResampleFilter])
 	if err != nil {
 		t.Fatalf("Failed to resize small image: %v", err)
 	}
@@ -132,7 +132,7 @@ func TestResizeImageLargeImage(t *testing.T) {
 	img := image.NewRGBA(image.Rect(0, 0, 1000, 1000))
 	
 	// Resize should succeed
-	resized, err := resizeImage(img, 500)
+	resized, err := resizeImage(context.Background(), img, 500, resampleFilters[defaultResampleFilter])
 	if err != nil {
 		t.Fatalf("Failed to resize large image: %v", err)
 	}
@@ -166,7 +166,7 @@ func TestDoubleCloseProtection(t *testing.T) {
 	f.Close()
 	
 	// Test resizeJpegImage which previously had double close issue
-	resized, err := resizeJpegImage(testJpeg, 50)
+	resized, err := resizeJpegImage(context.Background(), testJpeg, 50, resampleFilters[defaultResampleFilter])
 	if err != nil {
 		t.Fatalf("Failed to resize JPEG: %v", err)
 	}
@@ -191,40 +191,36 @@ func TestExternalToolTimeout(t *testing.T) {
 	}
 	
 	// This should fail gracefully with timeout or error, not crash
-	transformer.convertVideoToJpeg(fakeVideo)
+	transformer.convertVideoToJpeg(context.Background(), fakeVideo)
 	
 	// If we get here, no crash occurred
 }
 
 // TestBackupRunnerTimeout tests that ios_backup command has a timeout
 func TestBackupRunnerTimeout(t *testing.T) {
-	if testing.Short() {
-		t.Skip("Skipping timeout test in short mode")
-	}
-	
 	tempDir := t.TempDir()
 	backupDir := filepath.Join(tempDir, "backup")
-	
-	// Create a mock ios_backup that sleeps forever
-	mockIosBackup := filepath.Join(tempDir, "ios_backup_mock")
-	script := "#!/bin/bash\nsleep 10000\n"
-	if err := os.WriteFile(mockIosBackup, []byte(script), 0755); err != nil {
-		t.Fatalf("Failed to create mock ios_backup: %v", err)
-	}
-	
+
+	// A faked ios_backup that hangs forever
+	procs := NewFakeRunner()
+	procs.Register("ios_backup", FakeTool{Steps: []FakeStep{{Delay: time.Hour}}})
+
 	transformer := NewBackupTransformer()
-	runner, err := NewBackupRunner(backupDir, mockIosBackup, false, transformer)
+	runner, err := NewBackupRunner(backupDir, "ios_backup", false, transformer)
 	if err != nil {
 		t.Fatalf("Failed to create runner: %v", err)
 	}
-	
-	// Run with a very short timeout by modifying the context
-	// This is a bit tricky since Run() creates its own context
-	// We'll test that the mechanism exists by checking the code path
-	
-	// For now, just verify the runner was created with timeout capability
-	if runner == nil {
-		t.Error("Runner should be created successfully")
+	runner.SetProcessRunner(procs)
+	runner.SetRetryPolicy(RetryPolicy{})
+	runner.runTimeout = 100 * time.Millisecond
+
+	start := time.Now()
+	err = runner.Run()
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Expected a timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Timeout took %s", elapsed)
 	}
 }
 
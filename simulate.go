@@ -0,0 +1,482 @@
+package main
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// simulatorName is the program name that makes the binary behave like ios_backup
+	// e.g. ln -s iosbackup_manager ios_backup_sim, then pass -ios-backup ./ios_backup_sim
+	simulatorName = "ios_backup_sim"
+	// simulatorEnvPrefix prefixes environment variables that set simulator options,
+	// e.g. IOS_BACKUP_SIM_FIXTURES for -fixtures (ios_backup arguments leave no room for them)
+	simulatorEnvPrefix = "IOS_BACKUP_SIM_"
+	// simulatorDefaultUDID is the UDID of the simulated device
+	simulatorDefaultUDID = "00008110-000E785101F2401E"
+	// simulatorAttemptsFile counts runs against a backup directory for -fail-attempts
+	simulatorAttemptsFile = "ios_backup_sim.attempts"
+)
+
+// simulatedFailure is what the simulator prints and exits with to reproduce a failure kind
+type simulatedFailure struct {
+	lines    []string // Written to stderr
+	exitCode int
+	early    bool // Happens while connecting, before any file is received (-fail-after doesn't apply)
+}
+
+// simulatedFailures are the failures -fail can reproduce, keyed by the kind they are classified as
+// Stalled is handled separately: the simulator goes silent until it is killed
+var simulatedFailures = map[BackupErrorKind]simulatedFailure{
+	ErrKindDeviceNotFound:     {[]string{"No device found with udid " + simulatorDefaultUDID + "."}, 255, true},
+	ErrKindNotPaired:          {[]string{"ERROR: Could not connect to lockdownd: Pairing dialog response pending (-19)"}, 255, true},
+	ErrKindPasscodeRequired:   {[]string{"Please enter the passcode on the device to continue."}, 255, true},
+	ErrKindDeviceLocked:       {[]string{"ERROR: Could not connect to lockdownd: Password protected (-17)"}, 255, true},
+	ErrKindPasswordRequired:   {[]string{"ERROR: Can't get password input in non-interactive mode. Either pass password as argument or set BACKUP_PASSWORD."}, 255, true},
+	ErrKindWrongPassword:      {[]string{"ErrorCode 207: Wrong password (MBErrorDomain/207)"}, 207, true},
+	ErrKindProtocolError:      {[]string{"ERROR: Could not start service com.apple.mobilebackup2: SSL error"}, 255, true},
+	ErrKindDiskFull:           {[]string{"ErrorCode 105: Insufficient free disk space on drive to upload files. (MBErrorDomain/105)"}, 105, false},
+	ErrKindDeviceDisconnected: {[]string{"ERROR: Device disconnected during backup"}, 255, false},
+	ErrKindBackupFailed:       {[]string{"Segmentation fault: 11"}, 139, false},
+}
+
+// SimulatorOptions configures a simulated ios_backup run
+type SimulatorOptions struct {
+	Fixtures      string          // Directory laid out as <Domain>/<relativePath>
+	DeviceUDID    string          // UDID of the simulated device
+	UDID          string          // Device requested with -u (empty picks the simulated device)
+	Domains       globList        // --domain filters, matched against "<Domain>-<relativePath>"
+	BackupParent  string          // Directory the backup is written to, as <BackupParent>/<udid>
+	Fail          BackupErrorKind // Failure to reproduce ("" succeeds)
+	FailAfter     int             // Files saved before the failure
+	FailAttempts  int             // Only the first N runs against the backup fail (0 fails every run)
+	FileDelay     time.Duration   // Pause after each saved file
+	FinalizeDelay time.Duration   // Pause before the Snapshot is moved into the backup
+	LongLineBytes int             // Length of an oversized output line printed midway (0 disables)
+	CRLF          bool            // Terminate output lines with \r\n
+}
+
+// simulatorFile is a fixture file as it appears in the simulated backup
+type simulatorFile struct {
+	source       string // Fixture path
+	domain       string
+	relativePath string
+	fileID       string
+}
+
+// key returns the domain value ios_backup reports, e.g. "MediaDomain-Library/SMS/Attachments/IMG_1.HEIC"
+func (f simulatorFile) key() string {
+	return f.domain + "-" + f.relativePath
+}
+
+// simulatorFileID returns the backup file name of a file, the SHA-1 of "<domain>-<relativePath>"
+func simulatorFileID(domain string, relativePath string) string {
+	sum := sha1.Sum([]byte(domain + "-" + relativePath))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadSimulatorFixtures lists the fixture files, sorted by domain and path
+func loadSimulatorFixtures(root string) ([]simulatorFile, error) {
+	var files []simulatorFile
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		domain, relativePath, ok := strings.Cut(filepath.ToSlash(rel), "/")
+		if !ok {
+			return nil // Files directly in the fixture directory have no domain
+		}
+		files = append(files, simulatorFile{
+			source:       path,
+			domain:       domain,
+			relativePath: relativePath,
+			fileID:       simulatorFileID(domain, relativePath),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fixtures: %v", err)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].key() < files[j].key() })
+	return files, nil
+}
+
+// simulatorOutput writes ios_backup style lines
+type simulatorOutput struct {
+	stdout io.Writer
+	stderr io.Writer
+	eol    string
+}
+
+func (o *simulatorOutput) out(format string, args ...interface{}) {
+	fmt.Fprintf(o.stdout, format+o.eol, args...)
+}
+
+func (o *simulatorOutput) err(format string, args ...interface{}) {
+	fmt.Fprintf(o.stderr, format+o.eol, args...)
+}
+
+// progressBar formats an idevicebackup2 progress bar, e.g. "[=====                    ]  20% (1.0 MB/5.0 MB)"
+func progressBar(received int64, total int64) string {
+	percent := 100.0
+	if total > 0 {
+		percent = float64(received) * 100 / float64(total)
+	}
+	const width = 25
+	filled := int(percent * width / 100)
+	return fmt.Sprintf("[%s%s] %3.0f%% (%s/%s)", strings.Repeat("=", filled), strings.Repeat(" ", width-filled),
+		percent, formatBytes(received), formatBytes(total))
+}
+
+// simulateBackup behaves like ios_backup backing up the fixtures and returns its exit code
+func simulateBackup(opts SimulatorOptions, stdout io.Writer, stderr io.Writer) int {
+	out := &simulatorOutput{stdout: stdout, stderr: stderr, eol: "\n"}
+	if opts.CRLF {
+		out.eol = "\r\n"
+	}
+	fail := func(kind BackupErrorKind) int {
+		if kind == ErrKindStalled {
+			time.Sleep(365 * 24 * time.Hour) // Silent until killed
+			return 1
+		}
+		failure := simulatedFailures[kind]
+		for _, line := range failure.lines {
+			out.err("%s", line)
+		}
+		return failure.exitCode
+	}
+
+	udid := opts.DeviceUDID
+	if opts.UDID != "" && opts.UDID != udid {
+		out.err("No device found with udid %s.", opts.UDID)
+		return 255
+	}
+
+	files, err := loadSimulatorFixtures(opts.Fixtures)
+	if err != nil {
+		out.err("ERROR: %v", err)
+		return 1
+	}
+
+	backupDir := filepath.Join(opts.BackupParent, udid)
+	if err := os.MkdirAll(backupDir, 0755); err != nil {
+		out.err("ERROR: Could not create backup directory: %v", err)
+		return 1
+	}
+	failing := false
+	if opts.Fail != "" {
+		attempt := simulatorAttempt(backupDir)
+		failing = opts.FailAttempts == 0 || attempt <= opts.FailAttempts
+	}
+
+	out.out("Backup directory is \"%s\"", opts.BackupParent)
+	if failing && simulatedFailures[opts.Fail].early {
+		return fail(opts.Fail)
+	}
+	out.out("Started \"com.apple.mobilebackup2\" service on port 49152.")
+	out.out("Negotiated Protocol Version 2.1")
+	out.out("Starting backup...")
+	if _, err := os.Stat(filepath.Join(backupDir, "Manifest.db")); err == nil {
+		out.out("Incremental backup mode.")
+	} else {
+		out.out("Full backup mode.")
+	}
+	out.out("Requesting backup from device...")
+	out.out("Receiving files")
+
+	var selected []simulatorFile
+	var total int64
+	for _, file := range files {
+		if !opts.Domains.matches(file.key()) {
+			out.err("FILE_FILTERED: domain=%s", file.key())
+			continue
+		}
+		if info, err := os.Stat(file.source); err == nil {
+			total += info.Size()
+		}
+		selected = append(selected, file)
+	}
+
+	snapshotDir := filepath.Join(backupDir, "Snapshot")
+	var received int64
+	for i, file := range selected {
+		if failing && i == opts.FailAfter {
+			return fail(opts.Fail)
+		}
+		if opts.LongLineBytes > 0 && i == len(selected)/2 {
+			out.out("%s", strings.Repeat("#", opts.LongLineBytes))
+			out.err("DEBUG: %s", strings.Repeat("x", opts.LongLineBytes))
+		}
+
+		target := filepath.Join(snapshotDir, file.fileID[:2], file.fileID)
+		size, err := copySimulatorFile(file.source, target)
+		if err != nil {
+			out.err("ERROR: Could not write %s: %v", target, err)
+			return 1
+		}
+		received += size
+		out.err("FILE_SAVED: path=%s/Snapshot/%s/%s domain=%s", udid, file.fileID[:2], file.fileID, file.key())
+		out.out("%s", progressBar(received, total))
+		if opts.FileDelay > 0 {
+			time.Sleep(opts.FileDelay)
+		}
+	}
+	if failing {
+		return fail(opts.Fail)
+	}
+
+	out.out("Received %d files from device.", len(selected))
+	if opts.FinalizeDelay > 0 {
+		time.Sleep(opts.FinalizeDelay)
+	}
+	if err := finishSimulatedBackup(backupDir, selected); err != nil {
+		out.err("ERROR: %v", err)
+		return 1
+	}
+	out.out("Backup Successful.")
+	return 0
+}
+
+// simulatorAttempt counts a run against a backup directory and returns its number (1-based)
+func simulatorAttempt(backupDir string) int {
+	path := filepath.Join(backupDir, simulatorAttemptsFile)
+	attempt := 1
+	if data, err := os.ReadFile(path); err == nil {
+		fmt.Sscanf(string(data), "%d", &attempt)
+		attempt++
+	}
+	os.WriteFile(path, []byte(fmt.Sprintf("%d\n", attempt)), 0644)
+	return attempt
+}
+
+// copySimulatorFile copies a fixture into the backup and returns its size
+func copySimulatorFile(source string, target string) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return 0, err
+	}
+	in, err := os.Open(source)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	out, err := os.Create(target)
+	if err != nil {
+		return 0, err
+	}
+	size, err := io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return size, err
+}
+
+// finishSimulatedBackup moves the Snapshot contents into the backup and writes Manifest.db, Manifest.plist and Status.plist
+func finishSimulatedBackup(backupDir string, files []simulatorFile) error {
+	snapshotDir := filepath.Join(backupDir, "Snapshot")
+	for _, file := range files {
+		target := filepath.Join(backupDir, file.fileID[:2], file.fileID)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return fmt.Errorf("failed to move Snapshot: %v", err)
+		}
+		if err := os.Rename(filepath.Join(snapshotDir, file.fileID[:2], file.fileID), target); err != nil {
+			return fmt.Errorf("failed to move Snapshot: %v", err)
+		}
+	}
+	// Directories still in use (e.g. by a conversion writing a temp file) are left behind
+	if entries, err := os.ReadDir(snapshotDir); err == nil {
+		for _, entry := range entries {
+			os.Remove(filepath.Join(snapshotDir, entry.Name()))
+		}
+		os.Remove(snapshotDir)
+	}
+
+	if err := writeSimulatedManifest(backupDir, files); err != nil {
+		return err
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	manifestPlist := xmlPlist(`<key>IsEncrypted</key><false/><key>Version</key><string>10.0</string><key>Date</key><date>` + now + `</date>`)
+	statusPlist := xmlPlist(`<key>IsFullBackup</key><false/><key>SnapshotState</key><string>finished</string><key>Date</key><date>` + now + `</date>`)
+	if err := os.WriteFile(filepath.Join(backupDir, "Manifest.plist"), []byte(manifestPlist), 0644); err != nil {
+		return fmt.Errorf("failed to write Manifest.plist: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(backupDir, "Status.plist"), []byte(statusPlist), 0644); err != nil {
+		return fmt.Errorf("failed to write Status.plist: %v", err)
+	}
+	return nil
+}
+
+// xmlPlist wraps dict contents in an XML property list
+func xmlPlist(dict string) string {
+	return `<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+		`<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">` + "\n" +
+		`<plist version="1.0"><dict>` + dict + `</dict></plist>` + "\n"
+}
+
+// writeSimulatedManifest writes a Manifest.db listing the backed up files with their archived MBFile metadata
+func writeSimulatedManifest(backupDir string, files []simulatorFile) error {
+	manifestPath := filepath.Join(backupDir, "Manifest.db")
+	os.Remove(manifestPath)
+	db, err := sql.Open("sqlite3", manifestPath)
+	if err != nil {
+		return fmt.Errorf("failed to create Manifest.db: %v", err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(`CREATE TABLE Files (fileID TEXT PRIMARY KEY, domain TEXT, relativePath TEXT, flags INTEGER, file BLOB);
+		CREATE TABLE Properties (key TEXT PRIMARY KEY, value BLOB)`); err != nil {
+		return fmt.Errorf("failed to create Manifest.db tables: %v", err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to write Manifest.db: %v", err)
+	}
+	for _, file := range files {
+		blob, err := simulatedMBFile(filepath.Join(backupDir, file.fileID[:2], file.fileID), file)
+		if err == nil {
+			_, err = tx.Exec(`INSERT INTO Files (fileID, domain, relativePath, flags, file) VALUES (?, ?, ?, 1, ?)`,
+				file.fileID, file.domain, file.relativePath, blob)
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to write Manifest.db: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to write Manifest.db: %v", err)
+	}
+	return nil
+}
+
+// isSimulatorName reports whether the program was started under the simulator's name
+func isSimulatorName(program string) bool {
+	name := filepath.Base(program)
+	return strings.TrimSuffix(name, filepath.Ext(name)) == simulatorName
+}
+
+// runSimulateCommand implements the "simulate" subcommand (and the ios_backup_sim program) and returns the exit code
+func runSimulateCommand(args []string) int {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	var (
+		fixtures      = fs.String("fixtures", "", "Directory of files to back up, laid out as <Domain>/<relativePath> (required)")
+		deviceUDID    = fs.String("device", simulatorDefaultUDID, "UDID of the simulated device")
+		failKind      = fs.String("fail", "", "Failure to reproduce ("+joinKinds(backupErrorKinds)+")")
+		failAfter     = fs.Int("fail-after", 0, "Files saved before the failure")
+		failAttempts  = fs.Int("fail-attempts", 0, "Only fail the first N runs against the backup directory, to exercise retries (0 fails every run)")
+		fileDelay     = fs.Duration("file-delay", 0, "Pause after each saved file")
+		finalizeDelay = fs.Duration("finalize-delay", 0, "Pause before the Snapshot is moved into the backup directory")
+		longLine      = fs.Int("long-line", 0, "Print an output line of this many bytes midway through the backup (0 disables)")
+		crlf          = fs.Bool("crlf", false, "Terminate output lines with CRLF like ios_backup on Windows")
+		udid          = fs.String("u", "", "ios_backup: UDID of the device to back up")
+		domains       globList
+	)
+	fs.Bool("n", false, "ios_backup: connect over the network (accepted and ignored)")
+	fs.Var(&domains, "domain", "ios_backup: domain filter (repeatable)")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s simulate -fixtures <dir> [options] [-u <udid>] [--domain <filter>...] backup <backup_parent>\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Behaves like ios_backup without a device: writes the fixtures as a Snapshot tree of hashed files,\n")
+		fmt.Fprintf(os.Stderr, "reports them with FILE_SAVED/FILE_FILTERED lines and progress bars, and can reproduce failures.\n\n")
+		fmt.Fprintf(os.Stderr, "To use it as -ios-backup, install the binary under the name %s; options are then read from\n", simulatorName)
+		fmt.Fprintf(os.Stderr, "%s<OPTION> environment variables (e.g. %sFIXTURES, %sFAIL_AFTER).\n\n", simulatorEnvPrefix, simulatorEnvPrefix, simulatorEnvPrefix)
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  ln -s %s %s\n", os.Args[0], simulatorName)
+		fmt.Fprintf(os.Stderr, "  %sFIXTURES=testdata/device %sFAIL=device-disconnected %sFAIL_AFTER=3 %sFAIL_ATTEMPTS=1 \\\n",
+			simulatorEnvPrefix, simulatorEnvPrefix, simulatorEnvPrefix, simulatorEnvPrefix)
+		fmt.Fprintf(os.Stderr, "    %s -ios-backup ./%s -backup-dir /tmp/backups/%s\n", os.Args[0], simulatorName, simulatorDefaultUDID)
+	}
+
+	// Environment variables set defaults, so the options survive being run as -ios-backup
+	// (the single-letter ios_backup options only come from arguments)
+	fs.VisitAll(func(f *flag.Flag) {
+		env := simulatorEnvPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value, ok := os.LookupEnv(env); ok && len(f.Name) > 1 {
+			if err := fs.Set(f.Name, value); err != nil {
+				fmt.Fprintf(os.Stderr, "invalid %s: %v\n", env, err)
+				os.Exit(1)
+			}
+		}
+	})
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if *fixtures == "" || fs.NArg() != 2 || fs.Arg(0) != "backup" {
+		fs.Usage()
+		return 1
+	}
+
+	fail := BackupErrorKind(*failKind)
+	if _, ok := simulatedFailures[fail]; !ok && fail != "" && fail != ErrKindStalled {
+		fmt.Fprintf(os.Stderr, "unknown -fail %q (supported: %s)\n", *failKind, joinKinds(backupErrorKinds))
+		return 1
+	}
+
+	return simulateBackup(SimulatorOptions{
+		Fixtures:      *fixtures,
+		DeviceUDID:    *deviceUDID,
+		UDID:          *udid,
+		Domains:       domains,
+		BackupParent:  fs.Arg(1),
+		Fail:          fail,
+		FailAfter:     *failAfter,
+		FailAttempts:  *failAttempts,
+		FileDelay:     *fileDelay,
+		FinalizeDelay: *finalizeDelay,
+		LongLineBytes: *longLine,
+		CRLF:          *crlf,
+	}, os.Stdout, os.Stderr)
+}
+
+// simulatedMBFile archives a file's metadata the way iOS stores it in Files.file
+func simulatedMBFile(storedPath string, file simulatorFile) ([]byte, error) {
+	stat, err := os.Stat(storedPath)
+	if err != nil {
+		return nil, err
+	}
+	modified := stat.ModTime().Unix()
+	return encodeBinaryPlist(map[string]interface{}{
+		"$version":  int64(100000),
+		"$archiver": "NSKeyedArchiver",
+		"$top":      map[string]interface{}{"root": plistUID(1)},
+		"$objects": []interface{}{
+			"$null",
+			map[string]interface{}{
+				"$class":           plistUID(3),
+				"RelativePath":     plistUID(2),
+				"Size":             stat.Size(),
+				"LastModified":     modified,
+				"LastStatusChange": modified,
+				"Birth":            modified,
+				"Mode":             int64(0100644),
+				"UserID":           int64(501),
+				"GroupID":          int64(501),
+				"InodeNumber":      int64(0),
+				"ProtectionClass":  int64(3),
+				"Flags":            int64(0),
+			},
+			file.relativePath,
+			map[string]interface{}{
+				"$classname": "MBFile",
+				"$classes":   []interface{}{"MBFile", "NSObject"},
+			},
+		},
+	})
+}
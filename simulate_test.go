@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMain lets the test binary stand in for ios_backup when it is started as ios_backup_sim
+func TestMain(m *testing.M) {
+	if isSimulatorName(os.Args[0]) {
+		os.Exit(runSimulateCommand(os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+// writeSimulatorFixtures creates a fixture directory with an SMS attachment and a preferences file
+func writeSimulatorFixtures(t *testing.T) string {
+	t.Helper()
+	fixtures := t.TempDir()
+	attachment := filepath.Join(fixtures, "MediaDomain", "Library", "SMS", "Attachments", "0a", "IMG_0001.PNG")
+	if err := os.MkdirAll(filepath.Dir(attachment), 0755); err != nil {
+		t.Fatalf("Failed to create fixture dir: %v", err)
+	}
+	writeTestPNG(t, attachment, 800, 600, color.RGBA{200, 30, 30, 255})
+
+	prefs := filepath.Join(fixtures, "HomeDomain", "Library", "Preferences", "com.apple.springboard.plist")
+	if err := os.MkdirAll(filepath.Dir(prefs), 0755); err != nil {
+		t.Fatalf("Failed to create fixture dir: %v", err)
+	}
+	if err := os.WriteFile(prefs, []byte("<plist/>"), 0644); err != nil {
+		t.Fatalf("Failed to write fixture: %v", err)
+	}
+	return fixtures
+}
+
+// TestSimulateBackup tests the simulated Snapshot tree, output lines and Manifest.db
+func TestSimulateBackup(t *testing.T) {
+	parent := t.TempDir()
+	var stdout, stderr bytes.Buffer
+	code := simulateBackup(SimulatorOptions{
+		Fixtures:      writeSimulatorFixtures(t),
+		DeviceUDID:    simulatorDefaultUDID,
+		Domains:       testGlobs(t, "*SMS*"),
+		BackupParent:  parent,
+		LongLineBytes: 2000,
+		CRLF:          true,
+	}, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("Simulated backup failed with %d: %s", code, stderr.String())
+	}
+
+	fileID := simulatorFileID("MediaDomain", "Library/SMS/Attachments/0a/IMG_0001.PNG")
+	saved := "FILE_SAVED: path=" + simulatorDefaultUDID + "/Snapshot/" + fileID[:2] + "/" + fileID +
+		" domain=MediaDomain-Library/SMS/Attachments/0a/IMG_0001.PNG\r\n"
+	if !strings.Contains(stderr.String(), saved) {
+		t.Errorf("Missing FILE_SAVED line in %q", stderr.String())
+	}
+	if !strings.Contains(stderr.String(), "FILE_FILTERED: domain=HomeDomain-Library/Preferences/com.apple.springboard.plist\r\n") {
+		t.Errorf("Missing FILE_FILTERED line in %q", stderr.String())
+	}
+	if !strings.Contains(stdout.String(), strings.Repeat("#", 2000)+"\r\n") {
+		t.Error("Missing long line")
+	}
+	if _, ok := NewProgressTracker().Update(progressBar(500, 1000), time.Now()); !ok {
+		t.Errorf("Progress bar %q is not recognised", progressBar(500, 1000))
+	}
+
+	// The Snapshot is moved into the backup and listed in Manifest.db
+	backupDir := filepath.Join(parent, simulatorDefaultUDID)
+	if _, err := os.Stat(filepath.Join(backupDir, fileID[:2], fileID)); err != nil {
+		t.Errorf("Backup file not moved out of the Snapshot: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(backupDir, "Snapshot")); !os.IsNotExist(err) {
+		t.Error("Snapshot directory should be removed")
+	}
+	analyzer, decryptor, err := OpenBackupManifest(backupDir, "")
+	if err != nil || decryptor != nil {
+		t.Fatalf("Failed to open manifest: %v", err)
+	}
+	defer analyzer.Close()
+	files, err := analyzer.ListFiles()
+	if err != nil || len(files) != 1 || files[0].FileID != fileID || files[0].Domain != "MediaDomain" {
+		t.Errorf("Unexpected manifest files: %+v, %v", files, err)
+	}
+}
+
+// TestSimulatedFailuresClassified tests that each simulated failure is classified as the kind it reproduces
+func TestSimulatedFailuresClassified(t *testing.T) {
+	for kind, failure := range simulatedFailures {
+		got := classifyOutputLine(failure.lines[0])
+		if got == "" {
+			got = deviceErrorCodes[failure.exitCode]
+		}
+		if got == "" {
+			got = ErrKindBackupFailed
+		}
+		if got != kind {
+			t.Errorf("Simulated %s failure is classified as %s", kind, got)
+		}
+	}
+}
+
+// TestBackupRunnerAgainstSimulator runs the backup pipeline against the simulator as -ios-backup
+// The simulated device disconnects after the first file on the first run and the retry completes the backup
+func TestBackupRunnerAgainstSimulator(t *testing.T) {
+	simulator := filepath.Join(t.TempDir(), simulatorName)
+	if err := os.Symlink(os.Args[0], simulator); err != nil {
+		t.Skipf("Cannot link the simulator: %v", err)
+	}
+	t.Setenv(simulatorEnvPrefix+"FIXTURES", writeSimulatorFixtures(t))
+	t.Setenv(simulatorEnvPrefix+"FAIL", string(ErrKindDeviceDisconnected))
+	t.Setenv(simulatorEnvPrefix+"FAIL_AFTER", "1")
+	t.Setenv(simulatorEnvPrefix+"FAIL_ATTEMPTS", "1")
+	t.Setenv(simulatorEnvPrefix+"FINALIZE_DELAY", "500ms")
+
+	events := captureEvents(t)
+	backupDir := filepath.Join(t.TempDir(), simulatorDefaultUDID)
+	runner, err := NewBackupRunner(backupDir, simulator, false, NewBackupTransformer())
+	if err != nil {
+		t.Fatalf("Failed to create runner: %v", err)
+	}
+	runner.SetConsoleOutput(&bytes.Buffer{})
+	runner.SetRetryPolicy(RetryPolicy{
+		Retries:   1,
+		Backoff:   10 * time.Millisecond,
+		Retryable: []BackupErrorKind{ErrKindDeviceDisconnected},
+	})
+
+	if err := runner.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	fileID := simulatorFileID("MediaDomain", "Library/SMS/Attachments/0a/IMG_0001.PNG")
+	if !isJPEGFile(t, filepath.Join(backupDir, fileID[:2], fileID)) {
+		t.Error("Expected the attachment to be converted to JPEG")
+	}
+
+	retries := 0
+	for _, event := range decodeEvents(t, events) {
+		if event["type"] == EventBackupRetry && event["error_kind"] == string(ErrKindDeviceDisconnected) {
+			retries++
+		}
+	}
+	if retries != 1 {
+		t.Errorf("Expected one retry after the simulated disconnect, got %d", retries)
+	}
+}
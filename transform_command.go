@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// TransformOptions selects which files of a finished backup are transformed
+type TransformOptions struct {
+	BackupDir      string   // Backup directory containing Manifest.db
+	DomainPatterns globList // Globs matched against the manifest domain (any match selects the file)
+	PathPatterns   globList // Globs matched against the manifest relativePath (any match selects the file)
+	Workers        int
+	Password       string     // Backup password, required for encrypted backups
+	Report         *RunReport // Optional per-file report
+	UpdateManifest bool       // Rewrite the Manifest.db metadata of converted files afterwards
+}
+
+// TransformSummary counts the outcomes of a transform run
+type TransformSummary struct {
+	Matched  int // Files selected by the filters
+	Missing  int // Files listed in the manifest but not present on disk
+	Outcomes map[TransformOutcome]int
+}
+
+// glob is a compiled glob pattern
+type glob struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+// compileGlob compiles a glob pattern into a regular expression
+// Unlike filepath.Match, '*' also matches '/' (same as ios_backup --domain patterns)
+func compileGlob(pattern string) (glob, error) {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return glob{}, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+	return glob{pattern: pattern, re: re}, nil
+}
+
+// globList is a list of compiled glob patterns and a flag.Value that collects repeated pattern flags
+// Patterns are compiled once when they are added, not for every matched string
+type globList []glob
+
+func (g *globList) String() string {
+	patterns := make([]string, len(*g))
+	for i, p := range *g {
+		patterns[i] = p.pattern
+	}
+	return strings.Join(patterns, ",")
+}
+
+func (g *globList) Set(value string) error {
+	compiled, err := compileGlob(value)
+	if err != nil {
+		return err
+	}
+	*g = append(*g, compiled)
+	return nil
+}
+
+// matches reports whether s matches any of the patterns (no patterns matches everything)
+func (g globList) matches(s string) bool {
+	if len(g) == 0 {
+		return true
+	}
+	for _, p := range g {
+		if p.re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// backupFilePath returns the on-disk location of a manifest file in a backup
+// Modern backups store files as <xx>/<fileID>, older ones keep them flat
+func backupFilePath(backupDir string, fileID string) (string, bool) {
+	candidates := []string{filepath.Join(backupDir, fileID)}
+	if len(fileID) > 2 {
+		candidates = append([]string{filepath.Join(backupDir, fileID[:2], fileID)}, candidates...)
+	}
+
+	for _, candidate := range candidates {
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+// TransformBackup runs the media transformations over a finished backup using its Manifest.db
+// The original extension of each hashed file comes from its manifest relativePath
+// Files of encrypted backups are decrypted to a staging directory, transformed, and encrypted again with their own key
+// Cancelling ctx stops queueing files and cancels the conversions in progress
+func TransformBackup(ctx context.Context, transformer *BackupTransformer, opts TransformOptions) (TransformSummary, error) {
+	summary := TransformSummary{Outcomes: make(map[TransformOutcome]int)}
+
+	analyzer, decryptor, err := OpenBackupManifest(opts.BackupDir, opts.Password)
+	if err != nil {
+		return summary, err
+	}
+	defer analyzer.Close()
+
+	var staging string
+	var keeper *Quarantine
+	if decryptor != nil {
+		staging, err = os.MkdirTemp("", "iosbackup-decrypted-*")
+		if err != nil {
+			return summary, fmt.Errorf("failed to create staging directory: %v", err)
+		}
+		defer os.RemoveAll(staging)
+
+		// Journal keys stay relative to the backup layout (<xx>/<fileID>) for staged copies
+		if journal := transformer.journal; journal != nil {
+			transformer.SetJournal(journal.WithRoot(staging))
+			defer transformer.SetJournal(journal)
+		}
+		// Originals are quarantined as stored (encrypted), not as the decrypted copies the converters see
+		if quarantine := transformer.quarantine; quarantine != nil {
+			transformer.SetQuarantine(nil)
+			defer transformer.SetQuarantine(quarantine)
+			keeper = quarantine
+		}
+		infoLog.Printf("Backup is encrypted, transforming decrypted copies")
+	}
+
+	files, err := analyzer.ListFiles()
+	if err != nil {
+		return summary, err
+	}
+
+	var jobs []fileJob
+	for _, info := range files {
+		if !opts.DomainPatterns.matches(info.Domain) || !opts.PathPatterns.matches(info.RelativePath) {
+			continue
+		}
+		summary.Matched++
+
+		filePath, found := backupFilePath(opts.BackupDir, info.FileID)
+		if !found {
+			summary.Missing++
+			continue
+		}
+		jobs = append(jobs, fileJob{filePath: filePath, domain: info.Domain + "-" + info.RelativePath})
+	}
+
+	// Report progress as "(remaining of total)" like the live backup does
+	var mu sync.Mutex
+	remaining := int64(len(jobs))
+	transformer.queueDepth = func() (int64, int64) {
+		mu.Lock()
+		defer mu.Unlock()
+		return remaining, int64(len(jobs))
+	}
+	transformer.incrementTotal = nil
+
+	// Converted files and their plaintext sizes, for the Manifest.db update
+	var converted []string
+	plainSizes := make(map[string]int64)
+
+	scheduler := NewWorkScheduler(opts.Workers, defaultQueueSize, func(job fileJob) {
+		var result TransformResult
+		if decryptor != nil {
+			result = transformEncryptedFile(ctx, transformer, analyzer, decryptor, keeper, opts.BackupDir, staging, job)
+		} else {
+			result = transformFile(ctx, transformer, job.filePath, job)
+		}
+		opts.Report.Record(job.filePath, job.domain, result)
+
+		mu.Lock()
+		remaining--
+		summary.Outcomes[result.Outcome]++
+		if result.Outcome == OutcomeConverted || result.Outcome == OutcomeAlreadyDone {
+			fileID := filepath.Base(job.filePath)
+			converted = append(converted, fileID)
+			if decryptor != nil {
+				plainSizes[fileID] = result.SizeAfter
+			}
+		}
+		mu.Unlock()
+	})
+	for _, job := range jobs {
+		if ctx.Err() != nil {
+			break
+		}
+		scheduler.Submit(job)
+	}
+	scheduler.Close()
+
+	// Files converted before an interruption are recorded too, so the manifest matches the files on disk
+	if opts.UpdateManifest && len(converted) > 0 {
+		if err := updateConvertedManifest(analyzer, decryptor, opts.BackupDir, converted, plainSizes); err != nil {
+			return summary, err
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return summary, fmt.Errorf("transform interrupted: %v", err)
+	}
+	return summary, nil
+}
+
+// transformFile transforms one file in place
+func transformFile(ctx context.Context, transformer *BackupTransformer, filePath string, job fileJob) TransformResult {
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		errorLog.Printf("Error stating file %s: %v", filePath, err)
+		return TransformResult{Outcome: OutcomeFailed, Err: err}
+	}
+	timing := &FileTiming{
+		CreatedTime:     stat.ModTime(),
+		DiscoveredTime:  time.Now(),
+		DiscoveryMethod: "manifest",
+		Domain:          job.domain,
+	}
+	return transformer.ProcessFileByExtension(ctx, filePath, strings.ToLower(filepath.Ext(job.domain)), timing)
+}
+
+// transformEncryptedFile decrypts a backup file to the staging directory, transforms the copy,
+// and replaces the backup file with the converted output encrypted under the file's key
+// With a quarantine the encrypted original is kept there instead of being overwritten
+func transformEncryptedFile(ctx context.Context, transformer *BackupTransformer, analyzer *ManifestAnalyzer, decryptor *BackupDecryptor,
+	quarantine *Quarantine, backupDir string, staging string, job fileJob) TransformResult {
+	fail := func(err error) TransformResult {
+		errorLog.Printf("Error processing encrypted file %s: %v", job.filePath, err)
+		return TransformResult{Outcome: OutcomeFailed, Err: err}
+	}
+
+	blob, err := analyzer.FileBlob(filepath.Base(job.filePath))
+	if err != nil {
+		return fail(err)
+	}
+	key, err := decryptor.FileKey(blob)
+	if err != nil {
+		return fail(err)
+	}
+
+	rel, err := filepath.Rel(backupDir, job.filePath)
+	if err != nil {
+		return fail(err)
+	}
+	plainPath := filepath.Join(staging, rel)
+	if err := os.MkdirAll(filepath.Dir(plainPath), 0700); err != nil {
+		return fail(fmt.Errorf("failed to create staging directory: %v", err))
+	}
+	defer os.Remove(plainPath)
+
+	if err := DecryptFile(key, job.filePath, plainPath); err != nil {
+		return fail(err)
+	}
+
+	result := transformFile(ctx, transformer, plainPath, job)
+	if result.Outcome != OutcomeConverted {
+		return result
+	}
+
+	tempPath := job.filePath + ".encrypting"
+	if err := EncryptFile(key, plainPath, tempPath); err != nil {
+		os.Remove(tempPath)
+		return fail(err)
+	}
+	if err := quarantine.Replace(job.filePath, tempPath); err != nil {
+		os.Remove(tempPath)
+		return fail(fmt.Errorf("failed to replace original file: %v", err))
+	}
+	return result
+}
+
+// runTransformCommand implements the "transform" subcommand and returns the process exit code
+func runTransformCommand(args []string) int {
+	fs := flag.NewFlagSet("transform", flag.ExitOnError)
+	var (
+		backupDir  = fs.String("backup-dir", "", "Finished backup directory containing Manifest.db (required)")
+		workers    = fs.Int("workers", defaultWorkerCount(), "Number of concurrent file transformation workers")
+		useJournal = fs.Bool("journal", true, "Record conversions in a journal next to the backup so reruns skip completed work")
+		provenance = fs.Bool("provenance", true, "Record the original of every converted file in a provenance database next to the backup")
+		updateMeta = fs.Bool("update-manifest", true, "Rewrite the size, digest and modification time of converted files in Manifest.db")
+		quarantine = fs.Bool("quarantine", false, "Move the originals of converted files into a quarantine directory instead of overwriting them (restore with the undo command)")
+		quarantDir = fs.String("quarantine-dir", "", "Quarantine directory, implies -quarantine (default: <backup-dir>.quarantine next to the backup)")
+		dryRun     = fs.Bool("dry-run", false, "Report what would be converted and the projected savings without changing the backup")
+		eventsMode = fs.String("events", "", "Machine-readable event stream: \"json\" writes NDJSON events to stdout and moves human output to stderr")
+		resample   = fs.String("resample", defaultResampleFilter, "Filter for downscaling images: "+strings.Join(resampleFilterNames(), ", "))
+		timeout    = fs.Duration("transform-timeout", defaultTransformTimeout, "Give up on a file whose conversion takes longer than this (0 disables)")
+		domains    globList
+		paths      globList
+		reports    stringListFlag
+		passwords  = passwordFlags(fs)
+	)
+	fs.Var(&domains, "domain", "Only transform files whose manifest domain matches this glob (repeatable)")
+	fs.Var(&paths, "path", "Only transform files whose relative path matches this glob (repeatable)")
+	fs.Var(&reports, "report", "Write a per-file report when done: HTML for .html paths, JSON otherwise (repeatable)")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s transform -backup-dir <backup_directory> [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Transforms media files in a finished backup (e.g. taken with idevicebackup2 or Finder)\n")
+		fmt.Fprintf(os.Stderr, "using Manifest.db to recover each file's original name.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  %s transform -backup-dir /path/to/backup/00008110-000E785101F2401E\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s transform -backup-dir /path/to/backup/00008110-000E785101F2401E -domain 'MediaDomain' -path 'Library/SMS/Attachments/*'\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s transform -backup-dir /path/to/backup/00008110-000E785101F2401E -domain '*whatsapp*' -path '*.jpg'\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s transform -backup-dir /path/to/backup/00008110-000E785101F2401E -password-stdin < password.txt\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s transform -backup-dir /path/to/backup/00008110-000E785101F2401E -report report.json -report report.html\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s transform -backup-dir /path/to/backup/00008110-000E785101F2401E -quarantine\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s transform -backup-dir /path/to/backup/00008110-000E785101F2401E -dry-run -report plan.html\n", os.Args[0])
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if *backupDir == "" {
+		fs.Usage()
+		return 1
+	}
+
+	resampleFilter, err := ParseResampleFilter(*resample)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -resample: %v\n", err)
+		return 1
+	}
+
+	console, err := setupEvents(*eventsMode)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	infoLog = log.New(console, "", 0)
+	errorLog = log.New(os.Stderr, "", 0)
+	log.SetOutput(os.Stderr)
+	log.SetFlags(0)
+
+	password, err := ReadBackupPassword(*passwords, os.Stdin)
+	if err != nil {
+		errorLog.Printf("Failed to read backup password: %v", err)
+		return 1
+	}
+
+	transformer := NewBackupTransformer()
+	transformer.SetFileTimeout(*timeout)
+	transformer.SetResampleFilter(resampleFilter)
+	// A dry run only reads an existing journal and records nothing
+	if *useJournal && (!*dryRun || fileExists(journalPathForBackup(*backupDir))) {
+		journal, err := OpenTransformJournal(journalPathForBackup(*backupDir), *backupDir)
+		if err != nil {
+			errorLog.Printf("Failed to open transformation journal: %v", err)
+			return 1
+		}
+		defer journal.Close()
+		transformer.SetJournal(journal)
+	}
+	if *provenance && !*dryRun {
+		store, err := OpenProvenanceStore(provenancePathForBackup(*backupDir))
+		if err != nil {
+			errorLog.Printf("Failed to open provenance database: %v", err)
+			return 1
+		}
+		defer store.Close()
+		transformer.SetProvenance(store)
+	}
+	if keeper := quarantineForBackup(*quarantine, *quarantDir, *backupDir); keeper != nil && !*dryRun {
+		transformer.SetQuarantine(keeper)
+		infoLog.Printf("Quarantining originals in %s", keeper.dir)
+	}
+
+	transformer.SetDryRun(*dryRun)
+
+	infoLog.Printf("Transforming backup: %s", *backupDir)
+	start := time.Now()
+
+	// Ctrl+C/SIGTERM cancels the conversions in progress; the journal lets a rerun pick up from there
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var report *RunReport
+	if len(reports) > 0 {
+		report = NewRunReport(*backupDir)
+		report.SetDryRun(*dryRun)
+	}
+
+	eventLog.Emit(Event{Type: EventBackupStarted, BackupDir: *backupDir})
+	summary, err := TransformBackup(ctx, transformer, TransformOptions{
+		BackupDir:      *backupDir,
+		DomainPatterns: domains,
+		PathPatterns:   paths,
+		Workers:        *workers,
+		Password:       password,
+		Report:         report,
+		UpdateManifest: *updateMeta && !*dryRun,
+	})
+	writeReports(report, reports, reportStatus(err, ctx.Err() != nil), err)
+
+	success := err == nil
+	processed := int64(summary.Matched - summary.Missing)
+	completed := Event{
+		Type:           EventRunCompleted,
+		BackupDir:      *backupDir,
+		Success:        &success,
+		FilesProcessed: &processed,
+		DurationMs:     millis(time.Since(start)),
+	}
+	if err != nil {
+		completed.Error = err.Error()
+		completed.ErrorKind = string(backupErrorKind(err))
+		completed.Remediation = errorRemediation(err)
+	}
+	eventLog.Emit(completed)
+
+	if err != nil {
+		logFailure("Transform failed", err)
+		return exitCodeForError(err)
+	}
+
+	infoLog.Printf("Transform completed in %v: %d files matched, %d missing on disk, %d converted, %d already done, %d skipped, %d failed",
+		time.Since(start).Round(time.Millisecond), summary.Matched, summary.Missing,
+		summary.Outcomes[OutcomeConverted], summary.Outcomes[OutcomeAlreadyDone],
+		summary.Outcomes[OutcomeSkipped], summary.Outcomes[OutcomeFailed])
+	if *dryRun {
+		logDryRunSummary(transformer.DryRunTotals())
+	}
+	return 0
+}
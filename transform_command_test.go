@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testManifestFile describes a file to put in a test backup
+type testManifestFile struct {
+	fileID       string
+	domain       string
+	relativePath string
+	flags        int
+}
+
+// createTestManifest writes a minimal Manifest.db with the given Files rows
+func createTestManifest(t *testing.T, backupDir string, files []testManifestFile) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(backupDir, "Manifest.db"))
+	if err != nil {
+		t.Fatalf("Failed to create manifest: %v", err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(`CREATE TABLE Files (fileID TEXT PRIMARY KEY, domain TEXT, relativePath TEXT, flags INTEGER, file BLOB)`); err != nil {
+		t.Fatalf("Failed to create Files table: %v", err)
+	}
+	for _, f := range files {
+		if _, err := db.Exec(`INSERT INTO Files (fileID, domain, relativePath, flags) VALUES (?, ?, ?, ?)`,
+			f.fileID, f.domain, f.relativePath, f.flags); err != nil {
+			t.Fatalf("Failed to insert manifest row: %v", err)
+		}
+	}
+}
+
+// TestTransformBackupFromManifest tests that a finished backup is transformed using Manifest.db
+func TestTransformBackupFromManifest(t *testing.T) {
+	backupDir := filepath.Join(t.TempDir(), "00008110-000E785101F2401E")
+	files := []testManifestFile{
+		{"aa00000000000000000000000000000000000001", "MediaDomain", "Library/SMS/Attachments/01/IMG_0001.PNG", 1},
+		{"bb00000000000000000000000000000000000002", "CameraRollDomain", "Media/DCIM/100APPLE/IMG_0002.PNG", 1},
+		{"cc00000000000000000000000000000000000003", "MediaDomain", "Library/SMS/Attachments/02/IMG_0003.png", 1},
+		{"dd00000000000000000000000000000000000004", "MediaDomain", "Library/SMS/Attachments/03", 2},
+	}
+	for _, f := range files[:2] {
+		path := filepath.Join(backupDir, f.fileID[:2], f.fileID)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		writeTestPNG(t, path, 30, 30, color.RGBA{10, 20, 30, 255})
+	}
+	createTestManifest(t, backupDir, files)
+
+	summary, err := TransformBackup(context.Background(), NewBackupTransformer(), TransformOptions{
+		BackupDir:      backupDir,
+		DomainPatterns: testGlobs(t, "MediaDomain"),
+		PathPatterns:   testGlobs(t, "Library/SMS/*"),
+		Workers:        2,
+	})
+	if err != nil {
+		t.Fatalf("TransformBackup failed: %v", err)
+	}
+
+	if summary.Matched != 2 || summary.Missing != 1 {
+		t.Errorf("Expected 2 matched and 1 missing, got %+v", summary)
+	}
+	if summary.Outcomes[OutcomeConverted] != 1 {
+		t.Errorf("Expected 1 converted file, got %+v", summary.Outcomes)
+	}
+
+	if !isJPEGFile(t, filepath.Join(backupDir, "aa", files[0].fileID)) {
+		t.Error("Matching file should have been converted")
+	}
+	if isJPEGFile(t, filepath.Join(backupDir, "bb", files[1].fileID)) {
+		t.Error("File outside the domain filter should not have been converted")
+	}
+}
+
+// TestTransformBackupMissingManifest tests that a directory without Manifest.db is an error
+func TestTransformBackupMissingManifest(t *testing.T) {
+	if _, err := TransformBackup(context.Background(), NewBackupTransformer(), TransformOptions{BackupDir: t.TempDir(), Workers: 1}); err == nil {
+		t.Error("Expected error for missing Manifest.db")
+	}
+}
+
+// TestGlobMatch tests domain and path glob matching
+func TestGlobMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{"*SMS*", "MediaDomain-Library/SMS/Attachments/a.jpg", true},
+		{"Library/SMS/*", "Library/SMS/Attachments/01/a.jpg", true},
+		{"*.jpg", "Library/SMS/a.JPG", false},
+		{"AppDomain-?et.whatsapp.WhatsApp", "AppDomain-net.whatsapp.WhatsApp", true},
+		{"MediaDomain", "MediaDomain-x", false},
+		{"a+b(c)", "a+b(c)", true},
+	}
+	for _, c := range cases {
+		if got := testGlobs(t, c.pattern).matches(c.s); got != c.want {
+			t.Errorf("glob %q matching %q = %v, want %v", c.pattern, c.s, got, c.want)
+		}
+	}
+
+	// Repeated flags collect patterns; any of them selects, none selects everything
+	var patterns globList
+	if !patterns.matches("anything") {
+		t.Error("An empty pattern list should match everything")
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Var(&patterns, "domain", "")
+	if err := fs.Parse([]string{"-domain", "MediaDomain", "-domain", "*whatsapp*"}); err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if patterns.String() != "MediaDomain,*whatsapp*" || !patterns.matches("AppDomain-net.whatsapp.WhatsApp") || patterns.matches("HomeDomain") {
+		t.Errorf("Unexpected pattern list %q", patterns.String())
+	}
+}
+
+// testGlobs compiles glob patterns for test options
+func testGlobs(t *testing.T, patterns ...string) globList {
+	t.Helper()
+	var globs globList
+	for _, pattern := range patterns {
+		if err := globs.Set(pattern); err != nil {
+			t.Fatalf("Failed to compile %q: %v", pattern, err)
+		}
+	}
+	return globs
+}
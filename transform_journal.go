@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TransformJournal is an on-disk record of per-file conversion outcomes
+// A rerun consults it to skip files an interrupted run already converted
+type TransformJournal struct {
+	db   *sql.DB
+	root string // Paths are stored relative to this directory
+}
+
+// JournalEntry is the journal record for a single file
+type JournalEntry struct {
+	Path        string
+	OriginalExt string
+	SourceHash  string // SHA-256 of the file before conversion
+	OutputHash  string // SHA-256 of the file after conversion (converted files only)
+	Outcome     TransformOutcome
+	Error       string
+	UpdatedAt   time.Time
+}
+
+const journalSchema = `CREATE TABLE IF NOT EXISTS transforms (
+	path         TEXT PRIMARY KEY,
+	original_ext TEXT NOT NULL,
+	source_hash  TEXT NOT NULL,
+	output_hash  TEXT NOT NULL DEFAULT '',
+	outcome      TEXT NOT NULL,
+	error        TEXT NOT NULL DEFAULT '',
+	updated_at   TEXT NOT NULL
+)`
+
+// journalPathForBackup returns the journal location next to a backup directory
+// e.g. /backups/00008110-000E785101F2401E -> /backups/00008110-000E785101F2401E.journal.db
+func journalPathForBackup(backupDir string) string {
+	backupDir = filepath.Clean(backupDir)
+	return filepath.Join(filepath.Dir(backupDir), filepath.Base(backupDir)+".journal.db")
+}
+
+// OpenTransformJournal opens or creates a journal database
+// root is the backup directory that journal paths are relative to
+func OpenTransformJournal(journalPath string, root string) (*TransformJournal, error) {
+	db, err := sql.Open("sqlite3", journalPath+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal database: %v", err)
+	}
+
+	// Workers record outcomes concurrently; a single connection serializes writes
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(journalSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize journal database: %v", err)
+	}
+
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		absRoot = root
+	}
+
+	return &TransformJournal{db: db, root: absRoot}, nil
+}
+
+// key returns the journal key for a file path
+func (j *TransformJournal) key(filePath string) string {
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return filePath
+	}
+	rel, err := filepath.Rel(j.root, absPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return filepath.ToSlash(absPath)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// Lookup returns the journal entry for a file, or nil if there is none
+func (j *TransformJournal) Lookup(filePath string) (*JournalEntry, error) {
+	row := j.db.QueryRow(`SELECT path, original_ext, source_hash, output_hash, outcome, error, updated_at
+		FROM transforms WHERE path = ?`, j.key(filePath))
+
+	var entry JournalEntry
+	var outcome, updatedAt string
+	err := row.Scan(&entry.Path, &entry.OriginalExt, &entry.SourceHash, &entry.OutputHash, &outcome, &entry.Error, &updatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to query journal: %v", err)
+	}
+	entry.Outcome = TransformOutcome(outcome)
+	entry.UpdatedAt, _ = time.Parse(time.RFC3339Nano, updatedAt)
+
+	return &entry, nil
+}
+
+// Record stores the entry for a file, replacing any earlier entry
+func (j *TransformJournal) Record(entry JournalEntry) error {
+	if entry.UpdatedAt.IsZero() {
+		entry.UpdatedAt = time.Now()
+	}
+
+	_, err := j.db.Exec(`INSERT OR REPLACE INTO transforms
+		(path, original_ext, source_hash, output_hash, outcome, error, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		j.key(entry.Path), entry.OriginalExt, entry.SourceHash, entry.OutputHash,
+		string(entry.Outcome), entry.Error, entry.UpdatedAt.UTC().Format(time.RFC3339Nano))
+	if err != nil {
+		return fmt.Errorf("failed to write journal entry: %v", err)
+	}
+	return nil
+}
+
+// WithRoot returns a view of the journal whose paths are relative to another directory
+// Used when files are transformed from staged copies (e.g. decrypted files) so keys still match the backup layout
+// The view shares the database and must not be closed
+func (j *TransformJournal) WithRoot(root string) *TransformJournal {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		absRoot = root
+	}
+	return &TransformJournal{db: j.db, root: absRoot}
+}
+
+// Close closes the journal database
+func (j *TransformJournal) Close() error {
+	return j.db.Close()
+}
+
+// hashFile returns the hex SHA-256 of a file's contents
+func hashFile(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestPNG writes a solid-color PNG of the given size
+func writeTestPNG(t *testing.T, path string, width, height int, c color.Color) {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Failed to create PNG: %v", err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+}
+
+// TestJournalSkipsCompletedWork tests that a converted file is not converted again
+func TestJournalSkipsCompletedWork(t *testing.T) {
+	tempDir := t.TempDir()
+	backupDir := filepath.Join(tempDir, "00008110-000E785101F2401E")
+	if err := os.MkdirAll(filepath.Join(backupDir, "ab"), 0755); err != nil {
+		t.Fatalf("Failed to create backup dir: %v", err)
+	}
+
+	journal, err := OpenTransformJournal(journalPathForBackup(backupDir), backupDir)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	defer journal.Close()
+
+	if filepath.Dir(journalPathForBackup(backupDir)) != tempDir {
+		t.Errorf("Journal should be stored next to the backup, got %s", journalPathForBackup(backupDir))
+	}
+
+	transformer := NewBackupTransformer()
+	transformer.SetJournal(journal)
+
+	pngPath := filepath.Join(backupDir, "ab", "abcdef")
+	writeTestPNG(t, pngPath, 50, 50, color.RGBA{255, 0, 0, 255})
+
+	result := transformer.ProcessFileByExtension(context.Background(), pngPath, ".png", nil)
+	if result.Outcome != OutcomeConverted {
+		t.Fatalf("Expected first run to convert, got %s (%v)", result.Outcome, result.Err)
+	}
+
+	entry, err := journal.Lookup(pngPath)
+	if err != nil || entry == nil {
+		t.Fatalf("Expected journal entry, got %v (err %v)", entry, err)
+	}
+	if entry.Path != "ab/abcdef" {
+		t.Errorf("Expected path relative to backup dir, got %s", entry.Path)
+	}
+	if entry.OriginalExt != ".png" || entry.SourceHash == "" || entry.OutputHash == "" || entry.SourceHash == entry.OutputHash {
+		t.Errorf("Unexpected journal entry: %+v", entry)
+	}
+
+	// Rerun: the file on disk is the converted JPEG, so it must be skipped
+	result = transformer.ProcessFileByExtension(context.Background(), pngPath, ".png", nil)
+	if result.Outcome != OutcomeAlreadyDone {
+		t.Errorf("Expected rerun to skip converted file, got %s (%v)", result.Outcome, result.Err)
+	}
+
+	// A new original at the same path (e.g. re-downloaded by ios_backup) is converted again
+	writeTestPNG(t, pngPath, 60, 60, color.RGBA{0, 255, 0, 255})
+	result = transformer.ProcessFileByExtension(context.Background(), pngPath, ".png", nil)
+	if result.Outcome != OutcomeConverted {
+		t.Errorf("Expected new original to be converted, got %s (%v)", result.Outcome, result.Err)
+	}
+}
+
+// TestJournalRecordsFailures tests that failed conversions are recorded but retried
+func TestJournalRecordsFailures(t *testing.T) {
+	tempDir := t.TempDir()
+	journal, err := OpenTransformJournal(filepath.Join(tempDir, "journal.db"), tempDir)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	defer journal.Close()
+
+	transformer := NewBackupTransformer()
+	transformer.SetJournal(journal)
+
+	badPng := filepath.Join(tempDir, "bad.png")
+	if err := os.WriteFile(badPng, []byte("not a png"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		result := transformer.ProcessFileByExtension(context.Background(), badPng, ".png", nil)
+		if result.Outcome != OutcomeFailed || result.Err == nil {
+			t.Errorf("Run %d: expected failure, got %s (%v)", i, result.Outcome, result.Err)
+		}
+	}
+
+	entry, err := journal.Lookup(badPng)
+	if err != nil || entry == nil {
+		t.Fatalf("Expected journal entry, got %v (err %v)", entry, err)
+	}
+	if entry.Outcome != OutcomeFailed || entry.Error == "" {
+		t.Errorf("Expected failed entry with error, got %+v", entry)
+	}
+
+	// Files that are not media are not journaled
+	txt := filepath.Join(tempDir, "notes.txt")
+	if err := os.WriteFile(txt, []byte("hello"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	transformer.ProcessFileByExtension(context.Background(), txt, ".txt", nil)
+	if entry, _ := journal.Lookup(txt); entry != nil {
+		t.Errorf("Non-media file should not be journaled, got %+v", entry)
+	}
+}
+
+// TestJournalSurvivesKillAfterReplace tests that a run killed right after the output replaced the original
+// leaves a journal entry and provenance record, so the rerun neither converts the output again nor loses the original
+func TestJournalSurvivesKillAfterReplace(t *testing.T) {
+	dir := t.TempDir()
+	backupDir := filepath.Join(dir, "backup")
+	journal, err := OpenTransformJournal(journalPathForBackup(backupDir), backupDir)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	defer journal.Close()
+	store, err := OpenProvenanceStore(provenancePathForBackup(backupDir))
+	if err != nil {
+		t.Fatalf("Failed to open provenance store: %v", err)
+	}
+	defer store.Close()
+
+	transformer := NewBackupTransformer()
+	transformer.SetJournal(journal)
+	transformer.SetProvenance(store)
+
+	fileID := "1276b26ae2d4f2d5ce874643b94e60aefa863441"
+	path := filepath.Join(backupDir, fileID[:2], fileID)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	writeTestPNG(t, path, 50, 50, color.RGBA{255, 0, 0, 255})
+	originalHash, err := hashFile(path)
+	if err != nil {
+		t.Fatalf("Failed to hash original: %v", err)
+	}
+
+	// The converter replaces the original, then the run is killed before the converter returns
+	ctx, cancel := context.WithCancel(context.Background())
+	killed := func(ctx context.Context, filePath string) error {
+		output := filePath + ".out"
+		writeTestPNG(t, output, 20, 20, color.RGBA{0, 0, 255, 255})
+		if err := transformer.replaceOriginal(filePath, output); err != nil {
+			return err
+		}
+		cancel()
+		return ctx.Err()
+	}
+	result := transformer.processWithConverter(ctx, path, ".png", "MediaDomain-Library/IMG_0001.PNG", "png->jpeg", killed)
+	if result.Outcome != OutcomeFailed {
+		t.Fatalf("Expected the killed conversion to fail, got %s", result.Outcome)
+	}
+
+	result = transformer.ProcessFileByExtension(context.Background(), path, ".png", nil)
+	if result.Outcome != OutcomeAlreadyDone {
+		t.Errorf("Expected rerun to find the file converted, got %s (%v)", result.Outcome, result.Err)
+	}
+	rec, err := store.Lookup(fileID)
+	if err != nil || rec == nil {
+		t.Fatalf("Expected a provenance record, got %v, %v", rec, err)
+	}
+	if rec.OriginalHash != originalHash || rec.RelativePath != "Library/IMG_0001.PNG" || rec.OutputWidth != 20 {
+		t.Errorf("Unexpected provenance record: %+v", rec)
+	}
+}
+
+// TestJournalRecordsTimeouts tests that a conversion that runs out of -transform-timeout is journaled as failed,
+// while one cut short by shutdown is left unrecorded for the next run
+func TestJournalRecordsTimeouts(t *testing.T) {
+	tempDir := t.TempDir()
+	journal, err := OpenTransformJournal(filepath.Join(tempDir, "journal.db"), tempDir)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	defer journal.Close()
+
+	procs := NewFakeRunner()
+	procs.Register("heic-converter", FakeTool{Steps: []FakeStep{{Delay: 30 * time.Second}}})
+	transformer := NewBackupTransformer()
+	transformer.SetJournal(journal)
+	transformer.SetProcessRunner(procs)
+
+	timedOut := filepath.Join(tempDir, "slow.heic")
+	writeTestHEIC(t, timedOut)
+	transformer.SetFileTimeout(100 * time.Millisecond)
+	result := transformer.ProcessFileByExtension(context.Background(), timedOut, ".heic", nil)
+	if result.Outcome != OutcomeFailed || result.Err == nil {
+		t.Fatalf("Expected the timed out conversion to fail, got %s (%v)", result.Outcome, result.Err)
+	}
+	entry, err := journal.Lookup(timedOut)
+	if err != nil || entry == nil {
+		t.Fatalf("Expected a journal entry for the timed out file, got %v (err %v)", entry, err)
+	}
+	if entry.Outcome != OutcomeFailed || !strings.Contains(entry.Error, "timed out") {
+		t.Errorf("Expected a failed entry naming the timeout, got %+v", entry)
+	}
+
+	cancelled := filepath.Join(tempDir, "cancelled.heic")
+	writeTestHEIC(t, cancelled)
+	transformer.SetFileTimeout(time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	result = transformer.ProcessFileByExtension(ctx, cancelled, ".heic", nil)
+	if result.Outcome != OutcomeFailed {
+		t.Fatalf("Expected the cancelled conversion to fail, got %s (%v)", result.Outcome, result.Err)
+	}
+	if entry, _ := journal.Lookup(cancelled); entry != nil {
+		t.Errorf("A conversion cut short by shutdown should not be journaled, got %+v", entry)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// UndoOptions selects which quarantined originals are restored into a backup
+type UndoOptions struct {
+	BackupDir      string   // Backup directory the originals came from
+	QuarantineDir  string   // Quarantine directory (default: <backup>.quarantine)
+	DomainPatterns globList // Globs matched against the manifest domain (any match selects the file)
+	PathPatterns   globList // Globs matched against the manifest relativePath (any match selects the file)
+	Password       string   // Backup password, required for encrypted backups
+	UpdateManifest bool     // Rewrite the Manifest.db metadata of restored files afterwards
+}
+
+// UndoSummary counts the outcomes of an undo run
+type UndoSummary struct {
+	Quarantined int // Originals found in quarantine
+	Restored    int
+	Failed      int
+}
+
+// UndoQuarantine moves quarantined originals back into a backup, replacing the converted files
+// Filters need Manifest.db to recover each file's domain and path; without filters every original is restored
+// Provenance records of restored files are removed since the files are no longer converted
+func UndoQuarantine(opts UndoOptions) (UndoSummary, error) {
+	var summary UndoSummary
+
+	dir := opts.QuarantineDir
+	if dir == "" {
+		dir = quarantinePathForBackup(opts.BackupDir)
+	}
+	quarantine := NewQuarantine(dir, opts.BackupDir)
+	files, err := quarantine.Files()
+	if err != nil {
+		return summary, err
+	}
+	summary.Quarantined = len(files)
+	if len(files) == 0 {
+		infoLog.Printf("No quarantined originals in %s", quarantine.dir)
+		return summary, nil
+	}
+
+	filtered := len(opts.DomainPatterns) > 0 || len(opts.PathPatterns) > 0
+	var analyzer *ManifestAnalyzer
+	var decryptor *BackupDecryptor
+	if fileExists(filepath.Join(opts.BackupDir, "Manifest.db")) && (filtered || opts.UpdateManifest) {
+		analyzer, decryptor, err = OpenBackupManifest(opts.BackupDir, opts.Password)
+		if err != nil {
+			return summary, err
+		}
+		defer analyzer.Close()
+	} else if filtered {
+		return summary, fmt.Errorf("failed to select quarantined files: %s has no Manifest.db", opts.BackupDir)
+	}
+
+	var provenance *ProvenanceStore
+	if provenancePath := provenancePathForBackup(opts.BackupDir); fileExists(provenancePath) {
+		provenance, err = OpenProvenanceStore(provenancePath)
+		if err != nil {
+			return summary, err
+		}
+		defer provenance.Close()
+	}
+
+	// Restored files and, for encrypted backups, their plaintext sizes from the provenance records
+	var restored []string
+	plainSizes := make(map[string]int64)
+	for _, rel := range files {
+		fileID := filepath.Base(rel)
+		if filtered {
+			info, err := analyzer.GetFileInfo(fileID)
+			if err != nil {
+				return summary, err
+			}
+			if info == nil || !opts.DomainPatterns.matches(info.Domain) || !opts.PathPatterns.matches(info.RelativePath) {
+				continue
+			}
+		}
+
+		var original *ProvenanceRecord
+		if provenance != nil {
+			if original, err = provenance.Lookup(fileID); err != nil {
+				errorLog.Printf("Error reading provenance for %s: %v", fileID, err)
+			}
+		}
+
+		target, err := quarantine.Restore(rel)
+		if err != nil {
+			errorLog.Printf("Error restoring %s: %v", rel, err)
+			summary.Failed++
+			continue
+		}
+		infoLog.Printf("Restored original: %s", target)
+		summary.Restored++
+
+		if provenance != nil {
+			if err := provenance.Delete(fileID); err != nil {
+				errorLog.Printf("Error removing provenance for %s: %v", fileID, err)
+			}
+		}
+		if decryptor == nil {
+			restored = append(restored, fileID)
+		} else if original != nil {
+			restored = append(restored, fileID)
+			plainSizes[fileID] = original.OriginalSize
+		} else {
+			errorLog.Printf("Warning: original size of %s is unknown, leaving its Manifest.db entry", fileID)
+		}
+	}
+
+	if opts.UpdateManifest && analyzer != nil && len(restored) > 0 {
+		if err := updateConvertedManifest(analyzer, decryptor, opts.BackupDir, restored, plainSizes); err != nil {
+			return summary, err
+		}
+	}
+	if summary.Failed > 0 {
+		return summary, fmt.Errorf("failed to restore %d of %d quarantined originals", summary.Failed, summary.Failed+summary.Restored)
+	}
+	return summary, nil
+}
+
+// runUndoCommand implements the "undo" subcommand and returns the process exit code
+func runUndoCommand(args []string) int {
+	fs := flag.NewFlagSet("undo", flag.ExitOnError)
+	var (
+		backupDir  = fs.String("backup-dir", "", "Backup directory whose converted files are restored (required)")
+		quarantDir = fs.String("quarantine-dir", "", "Quarantine directory the originals were moved to (default: <backup-dir>.quarantine next to the backup)")
+		updateMeta = fs.Bool("update-manifest", true, "Rewrite the size, digest and modification time of restored files in Manifest.db")
+		domains    globList
+		paths      globList
+		passwords  = passwordFlags(fs)
+	)
+	fs.Var(&domains, "domain", "Only restore files whose manifest domain matches this glob (repeatable)")
+	fs.Var(&paths, "path", "Only restore files whose relative path matches this glob (repeatable)")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s undo -backup-dir <backup_directory> [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Restores the originals of converted files from the quarantine kept by -quarantine,\n")
+		fmt.Fprintf(os.Stderr, "for the whole backup or the files selected with -domain and -path.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  %s undo -backup-dir /path/to/backup/00008110-000E785101F2401E\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s undo -backup-dir /path/to/backup/00008110-000E785101F2401E -domain 'MediaDomain' -path 'Library/SMS/Attachments/*'\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s undo -backup-dir /path/to/backup/00008110-000E785101F2401E -password-stdin < password.txt\n", os.Args[0])
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if *backupDir == "" {
+		fs.Usage()
+		return 1
+	}
+
+	infoLog = log.New(os.Stdout, "", 0)
+	errorLog = log.New(os.Stderr, "", 0)
+	log.SetOutput(os.Stderr)
+	log.SetFlags(0)
+
+	password, err := ReadBackupPassword(*passwords, os.Stdin)
+	if err != nil {
+		errorLog.Printf("Failed to read backup password: %v", err)
+		return 1
+	}
+
+	start := time.Now()
+	summary, err := UndoQuarantine(UndoOptions{
+		BackupDir:      *backupDir,
+		QuarantineDir:  *quarantDir,
+		DomainPatterns: domains,
+		PathPatterns:   paths,
+		Password:       password,
+		UpdateManifest: *updateMeta,
+	})
+	if err != nil {
+		logFailure("Undo failed", err)
+		return exitCodeForError(err)
+	}
+
+	infoLog.Printf("Undo completed in %v: %d of %d quarantined originals restored",
+		time.Since(start).Round(time.Millisecond), summary.Restored, summary.Quarantined)
+	return 0
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultDrainTimeout is how long a shutdown waits for queued files (-shutdown-timeout)
+const defaultDrainTimeout = 30 * time.Second
+
+// Reasons recorded in the unfinished-work report
+const (
+	unfinishedReasonDeadline = "drain-timeout"
+	unfinishedReasonForced   = "forced"
+)
+
+// UnfinishedFile is a saved file whose transformation didn't finish before shutdown
+type UnfinishedFile struct {
+	Path   string `json:"path"`   // Relative to the backup directory
+	Domain string `json:"domain"` // ios_backup domain, which carries the original file name
+	State  string `json:"state"`  // "queued" or "in-progress"
+}
+
+// UnfinishedReport lists the files an interrupted shutdown abandoned
+// The next run of the same backup directory transforms them before anything else
+type UnfinishedReport struct {
+	BackupDir string           `json:"backup_dir"`
+	WrittenAt time.Time        `json:"written_at"`
+	Reason    string           `json:"reason"`
+	Files     []UnfinishedFile `json:"files"`
+}
+
+// unfinishedPathForBackup returns the report location next to a backup directory
+// e.g. /backups/00008110-000E785101F2401E -> /backups/00008110-000E785101F2401E.unfinished.json
+func unfinishedPathForBackup(backupDir string) string {
+	backupDir = filepath.Clean(backupDir)
+	return filepath.Join(filepath.Dir(backupDir), filepath.Base(backupDir)+".unfinished.json")
+}
+
+// writeUnfinishedReport writes the report atomically
+func writeUnfinishedReport(reportPath string, report UnfinishedReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode unfinished-work report: %v", err)
+	}
+	tempPath := reportPath + ".tmp"
+	if err := os.WriteFile(tempPath, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write unfinished-work report: %v", err)
+	}
+	if err := os.Rename(tempPath, reportPath); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to write unfinished-work report: %v", err)
+	}
+	return nil
+}
+
+// readUnfinishedReport reads a report, returning nil if there is none
+func readUnfinishedReport(reportPath string) (*UnfinishedReport, error) {
+	data, err := os.ReadFile(reportPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read unfinished-work report: %v", err)
+	}
+	var report UnfinishedReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, fmt.Errorf("failed to parse unfinished-work report %s: %v", reportPath, err)
+	}
+	return &report, nil
+}
+
+// unfinishedFiles returns the files that are queued or being processed, sorted by path
+func (br *BackupRunner) unfinishedFiles() []UnfinishedFile {
+	br.savedMu.Lock()
+	defer br.savedMu.Unlock()
+
+	var files []UnfinishedFile
+	for filePath, state := range br.savedFiles {
+		if !state.pending {
+			continue
+		}
+		file := UnfinishedFile{Path: filePath, Domain: state.domain, State: "queued"}
+		if state.started {
+			file.State = "in-progress"
+		}
+		if rel, err := filepath.Rel(br.backupDir, filePath); err == nil && !strings.HasPrefix(rel, "..") {
+			file.Path = filepath.ToSlash(rel)
+		}
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files
+}
+
+// abandonWork kills running conversions and records the unfinished files for the next run
+func (br *BackupRunner) abandonWork(reason string) {
+	br.aborted.Store(true)
+	br.cancelWork()
+
+	files := br.unfinishedFiles()
+	errorLog.Printf("Shutdown did not finish (%s): abandoning %d unfinished files", reason, len(files))
+	if len(files) == 0 {
+		return
+	}
+
+	reportPath := unfinishedPathForBackup(br.backupDir)
+	report := UnfinishedReport{
+		BackupDir: br.backupDir,
+		WrittenAt: time.Now().UTC(),
+		Reason:    reason,
+		Files:     files,
+	}
+	if err := writeUnfinishedReport(reportPath, report); err != nil {
+		errorLog.Printf("Error: %v", err)
+		return
+	}
+	infoLog.Printf("Unfinished files written to %s; the next run transforms them first", reportPath)
+}
+
+// resumeUnfinished queues the files a previous run abandoned and removes its report
+func (br *BackupRunner) resumeUnfinished() {
+	reportPath := unfinishedPathForBackup(br.backupDir)
+	report, err := readUnfinishedReport(reportPath)
+	if err != nil {
+		errorLog.Printf("Warning: %v", err)
+		return
+	}
+	if report == nil {
+		return
+	}
+
+	queued := 0
+	for _, file := range report.Files {
+		filePath := filepath.FromSlash(file.Path)
+		if !filepath.IsAbs(filePath) {
+			filePath = filepath.Join(br.backupDir, filePath)
+		}
+		if _, err := os.Stat(filePath); err != nil || !br.claimFile(filePath, file.Domain) {
+			continue
+		}
+		br.submitFile(filePath, file.Domain)
+		queued++
+	}
+	infoLog.Printf("Resuming %d of %d files left unfinished by the previous run", queued, len(report.Files))
+
+	if err := os.Remove(reportPath); err != nil {
+		errorLog.Printf("Warning: failed to remove unfinished-work report: %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startWedgedConversions queues two HEIC files on a single worker whose heic-converter never finishes
+// Returns the runner once the first file is being converted
+func startWedgedConversions(t *testing.T, backupDir string) *BackupRunner {
+	t.Helper()
+	binDir := t.TempDir()
+	converter := filepath.Join(binDir, "heic-converter")
+	if err := os.WriteFile(converter, []byte("#!/bin/bash\nexec sleep 30\n"), 0755); err != nil {
+		t.Fatalf("Failed to create mock heic-converter: %v", err)
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	runner, err := NewBackupRunner(backupDir, "ios_backup", false, NewBackupTransformer())
+	if err != nil {
+		t.Fatalf("Failed to create runner: %v", err)
+	}
+	runner.SetConcurrency(1, 10)
+
+	for _, name := range []string{"aa11", "bb22"} {
+		path := filepath.Join(backupDir, name[:2], name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte("not really heic"), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+		runner.enqueueFile(path, "MediaDomain-Library/SMS/Attachments/IMG_"+name+".HEIC")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		files := runner.unfinishedFiles()
+		if len(files) == 2 && files[0].State == "in-progress" {
+			return runner
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Conversion did not start: %v", files)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestStopAbandonsWedgedConversions tests the drain deadline, the unfinished-work report and its pickup
+func TestStopAbandonsWedgedConversions(t *testing.T) {
+	backupDir := filepath.Join(t.TempDir(), "00008110-000E785101F2401E")
+	runner := startWedgedConversions(t, backupDir)
+	runner.SetDrainTimeout(200 * time.Millisecond)
+
+	start := time.Now()
+	if runner.Stop() {
+		t.Fatal("Stop should report abandoned work")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Stop took %s despite the drain deadline", elapsed)
+	}
+
+	// The wedged heic-converter is killed
+	drained := make(chan struct{})
+	go func() {
+		runner.processingWg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(10 * time.Second):
+		t.Fatal("In-flight conversion was not killed")
+	}
+
+	report, err := readUnfinishedReport(unfinishedPathForBackup(backupDir))
+	if err != nil || report == nil {
+		t.Fatalf("Expected an unfinished-work report, got %v, %v", report, err)
+	}
+	if report.Reason != unfinishedReasonDeadline || len(report.Files) != 2 {
+		t.Fatalf("Unexpected report: %+v", report)
+	}
+	first, second := report.Files[0], report.Files[1]
+	if first.Path != "aa/aa11" || first.State != "in-progress" || first.Domain != "MediaDomain-Library/SMS/Attachments/IMG_aa11.HEIC" {
+		t.Errorf("Unexpected first file: %+v", first)
+	}
+	if second.Path != "bb/bb22" || second.State != "queued" {
+		t.Errorf("Unexpected second file: %+v", second)
+	}
+
+	// The next run picks the files up and removes the report
+	binDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(binDir, "heic-converter"), []byte("#!/bin/bash\nexit 1\n"), 0755); err != nil {
+		t.Fatalf("Failed to create mock heic-converter: %v", err)
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	next, err := NewBackupRunner(backupDir, "ios_backup", false, NewBackupTransformer())
+	if err != nil {
+		t.Fatalf("Failed to create runner: %v", err)
+	}
+	emptyLog := filepath.Join(t.TempDir(), "empty.log")
+	if err := os.WriteFile(emptyLog, nil, 0644); err != nil {
+		t.Fatalf("Failed to write log: %v", err)
+	}
+	if err := next.Replay(emptyLog); err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if next.totalCount != 2 {
+		t.Errorf("Expected both unfinished files to be transformed, got %d", next.totalCount)
+	}
+	if _, err := os.Stat(unfinishedPathForBackup(backupDir)); !os.IsNotExist(err) {
+		t.Error("Unfinished-work report should be removed once picked up")
+	}
+}
+
+// TestForceStop tests that a second signal ends an indefinite drain
+func TestForceStop(t *testing.T) {
+	backupDir := filepath.Join(t.TempDir(), "backup")
+	runner := startWedgedConversions(t, backupDir)
+	runner.SetDrainTimeout(0)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		runner.ForceStop()
+	}()
+	if runner.Stop() {
+		t.Fatal("Stop should report abandoned work")
+	}
+
+	report, err := readUnfinishedReport(unfinishedPathForBackup(backupDir))
+	if err != nil || report == nil || report.Reason != unfinishedReasonForced {
+		t.Errorf("Expected a forced unfinished-work report, got %+v, %v", report, err)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Watchdog defaults for -idle-timeout and -idle-restart
+const (
+	defaultIdleTimeout = 10 * time.Minute
+	defaultIdleRestart = 30 * time.Minute
+)
+
+// Watchdog reactions reported in stall_detected events
+const (
+	watchdogActionCheckDevice = "check-device"
+	watchdogActionTerminate   = "terminate"
+)
+
+// activityMonitor records when ios_backup last printed anything
+// The clock is paused while output is not being read, so backpressure from busy workers isn't taken for a stall
+type activityMonitor struct {
+	mu       sync.Mutex
+	last     time.Time
+	lastLine string
+	paused   int // Readers currently blocked on something other than ios_backup
+}
+
+// touch records output at the given time
+func (m *activityMonitor) touch(line string, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.last = now
+	if line != "" {
+		m.lastLine = line
+	}
+}
+
+// pause stops the idle clock until the matching resume
+func (m *activityMonitor) pause() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.paused++
+}
+
+// resume restarts the idle clock from the given time once no reader is paused
+func (m *activityMonitor) resume(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.paused--
+	if m.paused == 0 {
+		m.last = now
+	}
+}
+
+// idle returns how long ios_backup has been silent and the last line it printed
+// A paused monitor is never idle
+func (m *activityMonitor) idle(now time.Time) (time.Duration, string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.paused > 0 {
+		return 0, m.lastLine
+	}
+	return now.Sub(m.last), m.lastLine
+}
+
+// watchdogInterval returns how often the watchdog checks for inactivity
+func watchdogInterval(idleTimeout time.Duration, idleRestart time.Duration) time.Duration {
+	shortest := idleTimeout
+	if shortest <= 0 || (idleRestart > 0 && idleRestart < shortest) {
+		shortest = idleRestart
+	}
+	interval := shortest / 10
+	if interval > 30*time.Second {
+		interval = 30 * time.Second
+	}
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	return interval
+}
+
+// watch terminates ios_backup when it stops producing output
+// After idleTimeout without output it logs diagnostics and checks whether the device is still connected
+// (terminating if it's gone); after idleRestart it terminates ios_backup so the retry policy can restart it
+func (br *BackupRunner) watch(done <-chan struct{}, terminate func()) {
+	if br.idleTimeout <= 0 && br.idleRestart <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(watchdogInterval(br.idleTimeout, br.idleRestart))
+	defer ticker.Stop()
+
+	checks := 0
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			idle, lastLine := br.activity.idle(now)
+
+			if br.idleRestart > 0 && idle >= br.idleRestart {
+				br.reportStall(idle, lastLine, watchdogActionTerminate)
+				br.setFailure(&BackupError{Kind: ErrKindStalled, Detail: fmt.Sprintf("no output for %s", br.idleRestart)})
+				terminate()
+				return
+			}
+
+			if br.idleTimeout <= 0 || idle < time.Duration(checks+1)*br.idleTimeout {
+				if idle < br.idleTimeout {
+					checks = 0 // Output resumed
+				}
+				continue
+			}
+
+			checks++
+			br.reportStall(idle, lastLine, watchdogActionCheckDevice)
+			connected, err := br.checkDevice()
+			switch {
+			case err != nil:
+				errorLog.Printf("Watchdog: could not check the device: %v", err)
+			case !connected:
+				errorLog.Printf("Watchdog: the device is no longer connected, terminating ios_backup")
+				br.setFailure(&BackupError{Kind: ErrKindDeviceDisconnected, Detail: "not listed by idevice_id"})
+				terminate()
+				return
+			default:
+				infoLog.Printf("Watchdog: the device is still connected, waiting for ios_backup")
+			}
+		}
+	}
+}
+
+// reportStall logs and emits diagnostics about a silent ios_backup
+func (br *BackupRunner) reportStall(idle time.Duration, lastLine string, action string) {
+	br.countMu.Lock()
+	active, queued, total := br.activeCount, br.queuedCount, br.totalCount
+	br.countMu.Unlock()
+
+	errorLog.Printf("Watchdog: no ios_backup output for %s", idle.Round(time.Second))
+	if lastLine != "" {
+		errorLog.Printf("Watchdog: last output: %s", br.redact(lastLine))
+	}
+	errorLog.Printf("Watchdog: progress: %s", br.progress.Snapshot())
+	errorLog.Printf("Watchdog: transformations: %d in progress, %d queued, %d started", active, queued, total)
+
+	eventLog.Emit(Event{
+		Type:      EventStallDetected,
+		BackupDir: br.backupDir,
+		Action:    action,
+		IdleMs:    millis(idle),
+		Message:   br.redact(lastLine),
+	})
+}
+
+// deviceConnected reports whether the device being backed up is still listed by idevice_id
+func (br *BackupRunner) deviceConnected() (bool, error) {
+	tools, err := findDeviceTools()
+	if err != nil {
+		return false, err
+	}
+	connection := connectionUSB
+	if br.network {
+		connection = connectionNetwork
+	}
+	udids, err := listConnectedUDIDs(tools, connection)
+	if err != nil {
+		return false, err
+	}
+	if br.udid == "" {
+		return len(udids) > 0, nil
+	}
+	for _, udid := range udids {
+		if udid == br.udid {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newStallingRunner creates a runner whose ios_backup prints one line and then hangs
+func newStallingRunner(t *testing.T) *BackupRunner {
+	t.Helper()
+	tempDir := t.TempDir()
+	mockIosBackup := filepath.Join(tempDir, "ios_backup_mock")
+	script := "#!/bin/bash\necho '[==                       ]   3% (3.0 MB/100.0 MB)'\nexec sleep 30\n"
+	if err := os.WriteFile(mockIosBackup, []byte(script), 0755); err != nil {
+		t.Fatalf("Failed to create mock ios_backup: %v", err)
+	}
+
+	runner, err := NewBackupRunner(filepath.Join(tempDir, "backup"), mockIosBackup, false, NewBackupTransformer())
+	if err != nil {
+		t.Fatalf("Failed to create runner: %v", err)
+	}
+	runner.SetConsoleOutput(&bytes.Buffer{})
+	runner.SetRetryPolicy(RetryPolicy{})
+	return runner
+}
+
+// TestWatchdogTerminatesStalledBackup tests that a silent ios_backup is terminated as stalled
+func TestWatchdogTerminatesStalledBackup(t *testing.T) {
+	events := captureEvents(t)
+	runner := newStallingRunner(t)
+	runner.SetWatchdog(0, 200*time.Millisecond)
+
+	start := time.Now()
+	err := runner.Run()
+	if kind := backupErrorKind(err); kind != ErrKindStalled {
+		t.Fatalf("Expected %s, got %v", ErrKindStalled, err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Stalled backup took %s to terminate", elapsed)
+	}
+
+	found := false
+	for _, event := range decodeEvents(t, events) {
+		if event["type"] == EventStallDetected {
+			found = true
+			if event["action"] != watchdogActionTerminate || event["message"] == "" {
+				t.Errorf("Unexpected stall event: %v", event)
+			}
+		}
+	}
+	if !found {
+		t.Error("Expected a stall_detected event")
+	}
+}
+
+// TestWatchdogChecksDevice tests the device check after the idle timeout
+func TestWatchdogChecksDevice(t *testing.T) {
+	// Device gone: ios_backup is terminated as disconnected
+	runner := newStallingRunner(t)
+	runner.SetWatchdog(100*time.Millisecond, 0)
+	runner.checkDevice = func() (bool, error) { return false, nil }
+	if err := runner.Run(); backupErrorKind(err) != ErrKindDeviceDisconnected {
+		t.Errorf("Expected %s, got %v", ErrKindDeviceDisconnected, err)
+	}
+
+	// Device still there: keep waiting until the restart threshold, checking once per idle period
+	runner = newStallingRunner(t)
+	runner.SetWatchdog(100*time.Millisecond, 450*time.Millisecond)
+	var checks atomic.Int32
+	runner.checkDevice = func() (bool, error) {
+		checks.Add(1)
+		return true, nil
+	}
+	if err := runner.Run(); backupErrorKind(err) != ErrKindStalled {
+		t.Errorf("Expected %s, got %v", ErrKindStalled, err)
+	}
+	if n := checks.Load(); n < 2 || n > 4 {
+		t.Errorf("Expected one device check per idle period, got %d", n)
+	}
+}
+
+// TestWatchdogIgnoresBackpressure tests that time spent waiting for busy workers doesn't count as a stall
+func TestWatchdogIgnoresBackpressure(t *testing.T) {
+	tempDir := t.TempDir()
+	mockIosBackup := filepath.Join(tempDir, "ios_backup_mock")
+	backupDir := filepath.Join(tempDir, "backup")
+	script := "#!/bin/bash\n"
+	for i := 0; i < 5; i++ {
+		rel := fmt.Sprintf("Snapshot/0%d/0%d", i, i)
+		if err := os.MkdirAll(filepath.Join(backupDir, filepath.Dir(rel)), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(backupDir, rel), []byte("notes"), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+		script += fmt.Sprintf("echo 'FILE_SAVED: path=backup/%s domain=HomeDomain-Library/%d.txt' >&2\n", rel, i)
+	}
+	if err := os.WriteFile(mockIosBackup, []byte(script), 0755); err != nil {
+		t.Fatalf("Failed to create mock ios_backup: %v", err)
+	}
+
+	runner, err := NewBackupRunner(backupDir, mockIosBackup, false, NewBackupTransformer())
+	if err != nil {
+		t.Fatalf("Failed to create runner: %v", err)
+	}
+	runner.SetConsoleOutput(&bytes.Buffer{})
+	runner.SetRetryPolicy(RetryPolicy{})
+	runner.SetWatchdog(100*time.Millisecond, 200*time.Millisecond)
+	var checks atomic.Int32
+	runner.checkDevice = func() (bool, error) {
+		checks.Add(1)
+		return true, nil
+	}
+
+	// One slow worker and no queue: the output reader waits about 600ms in Submit
+	runner.scheduler.Close()
+	runner.scheduler = NewWorkScheduler(1, 0, func(job fileJob) {
+		time.Sleep(150 * time.Millisecond)
+		runner.runJob(job)
+	})
+
+	start := time.Now()
+	if err := runner.Run(); err != nil {
+		t.Errorf("Expected the backup to finish, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 600*time.Millisecond {
+		t.Errorf("Expected the workers to hold up the backup, took %s", elapsed)
+	}
+	if n := checks.Load(); n != 0 {
+		t.Errorf("Expected no device checks, got %d", n)
+	}
+}
+
+// TestWatchdogInterval tests the inactivity check interval
+func TestWatchdogInterval(t *testing.T) {
+	if got := watchdogInterval(10*time.Minute, 30*time.Minute); got != 30*time.Second {
+		t.Errorf("Expected interval capped at 30s, got %s", got)
+	}
+	if got := watchdogInterval(0, time.Second); got != 100*time.Millisecond {
+		t.Errorf("Expected 100ms, got %s", got)
+	}
+	if got := watchdogInterval(time.Millisecond, 0); got != 10*time.Millisecond {
+		t.Errorf("Expected 10ms minimum, got %s", got)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+)
+
+// Worker pool defaults
+const (
+	defaultQueueSize = 256 // Files waiting for a worker before line readers block
+)
+
+// defaultWorkerCount returns the default number of transformation workers
+func defaultWorkerCount() int {
+	return runtime.NumCPU()
+}
+
+// fileJob is a file reported by ios_backup that is waiting to be transformed
+type fileJob struct {
+	filePath string
+	domain   string
+}
+
+// WorkScheduler runs file jobs on a fixed number of workers fed by a bounded queue
+// Submit blocks while the queue is full, which applies backpressure to the caller
+type WorkScheduler struct {
+	jobs      chan fileJob
+	handle    func(fileJob)
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// NewWorkScheduler creates a scheduler and starts its workers
+func NewWorkScheduler(workers int, queueSize int, handle func(fileJob)) *WorkScheduler {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+
+	ws := &WorkScheduler{
+		jobs:   make(chan fileJob, queueSize),
+		handle: handle,
+	}
+
+	for i := 0; i < workers; i++ {
+		ws.wg.Add(1)
+		go ws.worker()
+	}
+
+	return ws
+}
+
+// worker processes jobs until the queue is closed
+func (ws *WorkScheduler) worker() {
+	defer ws.wg.Done()
+	for job := range ws.jobs {
+		ws.run(job)
+	}
+}
+
+// run handles a single job, recovering from panics so the worker keeps running
+func (ws *WorkScheduler) run(job fileJob) {
+	defer func() {
+		if r := recover(); r != nil {
+			errorLog.Printf("PANIC recovered in file processing worker: %v", r)
+		}
+	}()
+	ws.handle(job)
+}
+
+// Submit queues a job, blocking while the queue is full
+func (ws *WorkScheduler) Submit(job fileJob) {
+	ws.jobs <- job
+}
+
+// Pending returns the number of jobs waiting for a worker
+func (ws *WorkScheduler) Pending() int {
+	return len(ws.jobs)
+}
+
+// Close stops accepting jobs and waits for queued jobs to finish
+func (ws *WorkScheduler) Close() {
+	ws.closeOnce.Do(func() {
+		close(ws.jobs)
+	})
+	ws.wg.Wait()
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestWorkSchedulerLimitsConcurrency tests that no more than the configured workers run at once
+func TestWorkSchedulerLimitsConcurrency(t *testing.T) {
+	var running, maxRunning int64
+	scheduler := NewWorkScheduler(3, 10, func(job fileJob) {
+		n := atomic.AddInt64(&running, 1)
+		for {
+			current := atomic.LoadInt64(&maxRunning)
+			if n <= current || atomic.CompareAndSwapInt64(&maxRunning, current, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt64(&running, -1)
+	})
+
+	for i := 0; i < 30; i++ {
+		scheduler.Submit(fileJob{filePath: fmt.Sprintf("file%d", i)})
+	}
+	scheduler.Close()
+
+	if maxRunning > 3 {
+		t.Errorf("Expected at most 3 concurrent jobs, got %d", maxRunning)
+	}
+	if maxRunning == 0 {
+		t.Error("Expected jobs to run")
+	}
+}
+
+// TestWorkSchedulerBackpressure tests that Submit blocks while the queue is full
+func TestWorkSchedulerBackpressure(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	scheduler := NewWorkScheduler(1, 1, func(job fileJob) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+	})
+
+	scheduler.Submit(fileJob{filePath: "first"}) // Picked up by the worker
+	<-started
+	scheduler.Submit(fileJob{filePath: "second"}) // Fills the queue
+
+	submitted := make(chan struct{})
+	go func() {
+		scheduler.Submit(fileJob{filePath: "third"})
+		close(submitted)
+	}()
+
+	select {
+	case <-submitted:
+		t.Fatal("Submit should block while the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-submitted:
+	case <-time.After(time.Second):
+		t.Fatal("Submit should unblock once the worker drains the queue")
+	}
+	scheduler.Close()
+}
+
+// TestWorkSchedulerPanicRecovery tests that a panicking job does not kill its worker
+func TestWorkSchedulerPanicRecovery(t *testing.T) {
+	var handled int64
+	scheduler := NewWorkScheduler(1, 2, func(job fileJob) {
+		if job.filePath == "panic" {
+			panic("boom")
+		}
+		atomic.AddInt64(&handled, 1)
+	})
+
+	scheduler.Submit(fileJob{filePath: "panic"})
+	scheduler.Submit(fileJob{filePath: "ok"})
+	scheduler.Close()
+
+	if handled != 1 {
+		t.Errorf("Expected the job after the panic to run, handled %d", handled)
+	}
+}
+
+// TestRunnerQueueDepthIncludesQueuedFiles tests that queued files are reported through queueDepth
+func TestRunnerQueueDepthIncludesQueuedFiles(t *testing.T) {
+	tempDir := t.TempDir()
+	backupDir := filepath.Join(tempDir, "backup")
+	if err := os.MkdirAll(backupDir, 0755); err != nil {
+		t.Fatalf("Failed to create backup dir: %v", err)
+	}
+
+	transformer := NewBackupTransformer()
+	runner, err := NewBackupRunner(backupDir, "ios_backup", false, transformer)
+	if err != nil {
+		t.Fatalf("Failed to create runner: %v", err)
+	}
+
+	var once sync.Once
+	release := make(chan struct{})
+	runner.scheduler.Close()
+	runner.scheduler = NewWorkScheduler(1, 10, func(job fileJob) {
+		once.Do(func() { <-release })
+		runner.runJob(job)
+	})
+
+	var lines bytes.Buffer
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("file%d", i)
+		if err := os.WriteFile(filepath.Join(backupDir, name), []byte("data"), 0644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+		fmt.Fprintf(&lines, "FILE_SAVED: path=backup/%s domain=%s.txt\n", name, name)
+	}
+
+	runner.wg.Add(1)
+	if err := runner.processStderr(&lines); err != nil {
+		t.Fatalf("processStderr failed: %v", err)
+	}
+
+	active, _ := transformer.queueDepth()
+	if active != 3 {
+		t.Errorf("Expected 3 outstanding files while the worker is blocked, got %d", active)
+	}
+
+	close(release)
+	runner.processingWg.Wait()
+
+	active, _ = transformer.queueDepth()
+	if active != 0 {
+		t.Errorf("Expected no outstanding files after processing, got %d", active)
+	}
+}